@@ -4,6 +4,7 @@ import (
 	"fmt"
 	"io/ioutil"
 	"os"
+	"syscall"
 )
 
 // checkDirEmpty - check if "dir" exists and is an empty directory.
@@ -20,7 +21,26 @@ func checkDirEmpty(dir string) error {
 	if len(entries) == 0 {
 		return nil
 	}
-	return fmt.Errorf("directory %s not empty", dir)
+	return &dirNotEmptyError{dir}
+}
+
+// dirNotEmptyError is returned by checkDirEmpty if the directory exists but
+// is not empty
+type dirNotEmptyError struct {
+	dir string
+}
+
+func (e *dirNotEmptyError) Error() string {
+	return fmt.Sprintf("directory %s not empty", e.dir)
+}
+
+// isStaleMount returns true if "err" says that the FUSE daemon behind the path
+// is gone ("Transport endpoint is not connected").
+func isStaleMount(err error) bool {
+	if pe, ok := err.(*os.PathError); ok {
+		return pe.Err == syscall.ENOTCONN
+	}
+	return false
 }
 
 // checkDir - check if "dir" exists and is a directory
@@ -0,0 +1,93 @@
+// Package cipherdir gives Go programs read access to a gocryptfs CIPHERDIR
+// without mounting it. It translates plaintext paths to the paths on disk and
+// decrypts individual files.
+//
+// Example:
+//
+//	d, err := cipherdir.Open("/home/me/cipher", "", password)
+//	...
+//	cPath, err := d.EncryptPath("docs/letter.txt")
+//	...
+//	f, err := d.OpenFile(cPath)
+//	...
+//	io.Copy(os.Stdout, f)
+package cipherdir
+
+import (
+	"errors"
+	"path/filepath"
+
+	"github.com/rfjakob/gocryptfs/internal/configfile"
+	"github.com/rfjakob/gocryptfs/internal/contentenc"
+	"github.com/rfjakob/gocryptfs/internal/cryptocore"
+	"github.com/rfjakob/gocryptfs/internal/nametransform"
+)
+
+// CipherDir is an unlocked CIPHERDIR. It is safe for concurrent use.
+type CipherDir struct {
+	// dir is the absolute path of the CIPHERDIR
+	dir            string
+	plaintextNames bool
+	contentEnc     *contentenc.ContentEnc
+	nameTransform  *nametransform.NameTransform
+}
+
+// Open decrypts the master key of the CIPHERDIR "dir" using "password".
+// "confPath" is the path of the config file, the empty string means
+// "dir/gocryptfs.conf". Reverse mode config files are not supported.
+func Open(dir string, confPath string, password string) (*CipherDir, error) {
+	if password == "" {
+		return nil, errors.New("empty password")
+	}
+	dir, err := filepath.Abs(dir)
+	if err != nil {
+		return nil, err
+	}
+	if confPath == "" {
+		confPath = filepath.Join(dir, configfile.ConfDefaultName)
+	}
+	masterkey, confFile, err := configfile.LoadConfFile(confPath, password)
+	if err != nil {
+		return nil, err
+	}
+	defer cryptocore.Wipe(masterkey)
+	backend := cryptocore.BackendGoGCM
+	if confFile.IsFeatureFlagSet(configfile.FlagAESSIV) {
+		backend = cryptocore.BackendAESSIV
+	}
+	cc := cryptocore.New(masterkey, backend, contentenc.DefaultIVBits,
+		confFile.IsFeatureFlagSet(configfile.FlagHKDF), false)
+	return &CipherDir{
+		dir:            dir,
+		plaintextNames: confFile.IsFeatureFlagSet(configfile.FlagPlaintextNames),
+		contentEnc:     contentenc.New(cc, contentenc.DefaultBS, false),
+		nameTransform: nametransform.New(cc.EMECipher,
+			confFile.IsFeatureFlagSet(configfile.FlagLongNames),
+			confFile.IsFeatureFlagSet(configfile.FlagRaw64)),
+	}, nil
+}
+
+// OpenFile is a shortcut for opening the CIPHERDIR that contains the config
+// file "confPath" and decrypting the file "cipherPath" in it.
+func OpenFile(confPath string, password string, cipherPath string) (*File, error) {
+	d, err := Open(filepath.Dir(confPath), confPath, password)
+	if err != nil {
+		return nil, err
+	}
+	return d.OpenFile(cipherPath)
+}
+
+// EncryptPath translates the plaintext path "plainPath" (relative to the
+// root of the filesystem) to the absolute path of the file on disk. The
+// directories on the way must exist, the last component need not.
+func (d *CipherDir) EncryptPath(plainPath string) (string, error) {
+	plainPath = filepath.Clean("/" + plainPath)[1:]
+	if d.plaintextNames {
+		return filepath.Join(d.dir, plainPath), nil
+	}
+	cPath, err := d.nameTransform.EncryptPathDirIV(plainPath, d.dir)
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(d.dir, cPath), nil
+}
@@ -0,0 +1,141 @@
+package cipherdir
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/hanwen/go-fuse/fuse"
+
+	"github.com/rfjakob/gocryptfs/internal/configfile"
+	"github.com/rfjakob/gocryptfs/internal/cryptocore"
+	"github.com/rfjakob/gocryptfs/internal/fusefrontend"
+	"github.com/rfjakob/gocryptfs/internal/nametransform"
+)
+
+// newTestDir creates a CIPHERDIR with the password "test" and writes
+// "content" to "dir/file" through fusefrontend
+func newTestDir(t *testing.T, content []byte) string {
+	dir, err := ioutil.TempDir("", "gocryptfs_cipherdir")
+	if err != nil {
+		t.Fatal(err)
+	}
+	conf := filepath.Join(dir, configfile.ConfDefaultName)
+	err = configfile.CreateConfFile(&configfile.CreateArgs{Filename: conf, Password: "test", LogN: 10, Creator: "test"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = nametransform.WriteDirIV(nil, dir); err != nil {
+		t.Fatal(err)
+	}
+	masterkey, _, err := configfile.LoadConfFile(conf, "test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	fs := fusefrontend.NewFS(masterkey, fusefrontend.Args{
+		Cipherdir:     dir,
+		CryptoBackend: cryptocore.BackendGoGCM,
+		LongNames:     true,
+		Raw64:         true,
+		HKDF:          true,
+	})
+	ctx := &fuse.Context{}
+	if status := fs.Mkdir("dir", 0700, ctx); !status.Ok() {
+		t.Fatal(status)
+	}
+	f, status := fs.Create("dir/file", uint32(os.O_WRONLY), 0600, ctx)
+	if !status.Ok() {
+		t.Fatal(status)
+	}
+	if _, status = f.Write(content, 0); !status.Ok() {
+		t.Fatal(status)
+	}
+	f.Release()
+	return dir
+}
+
+func TestOpenFile(t *testing.T) {
+	content := make([]byte, 3*4096+100)
+	rand.Read(content)
+	dir := newTestDir(t, content)
+	defer os.RemoveAll(dir)
+
+	if _, err := Open(dir, "", "wrong"); err == nil {
+		t.Error("wrong password was accepted")
+	}
+	d, err := Open(dir, "", "test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	cPath, err := d.EncryptPath("/dir/file")
+	if err != nil {
+		t.Fatal(err)
+	}
+	f, err := OpenFile(filepath.Join(dir, configfile.ConfDefaultName), "test", cPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	if f.Size() != int64(len(content)) {
+		t.Errorf("wrong size %d", f.Size())
+	}
+	have, err := ioutil.ReadAll(f)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(have, content) {
+		t.Error("wrong content")
+	}
+	// Unaligned read across block boundaries
+	buf := make([]byte, 5000)
+	n, err := f.ReadAt(buf, 4000)
+	if err != nil || n != len(buf) || !bytes.Equal(buf, content[4000:9000]) {
+		t.Errorf("ReadAt: n=%d err=%v", n, err)
+	}
+	// Short read at the end
+	n, err = f.ReadAt(buf, int64(len(content)-10))
+	if err != io.EOF || n != 10 || !bytes.Equal(buf[:n], content[len(content)-10:]) {
+		t.Errorf("ReadAt at the end: n=%d err=%v", n, err)
+	}
+	if pos, err := f.Seek(-100, os.SEEK_END); err != nil || pos != int64(len(content)-100) {
+		t.Errorf("Seek: pos=%d err=%v", pos, err)
+	}
+	have, err = ioutil.ReadAll(f)
+	if err != nil || !bytes.Equal(have, content[len(content)-100:]) {
+		t.Errorf("read after Seek: len=%d err=%v", len(have), err)
+	}
+}
+
+// A file that fails authentication must give an error instead of garbage
+func TestOpenFileCorrupt(t *testing.T) {
+	dir := newTestDir(t, []byte("hello world"))
+	defer os.RemoveAll(dir)
+	d, err := Open(dir, "", "test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	cPath, err := d.EncryptPath("dir/file")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ciphertext, err := ioutil.ReadFile(cPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ciphertext[len(ciphertext)-1]++
+	if err = ioutil.WriteFile(cPath, ciphertext, 0600); err != nil {
+		t.Fatal(err)
+	}
+	f, err := d.OpenFile(cPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	if _, err = ioutil.ReadAll(f); err == nil {
+		t.Error("corruption was not detected")
+	}
+}
@@ -0,0 +1,161 @@
+package cipherdir
+
+import (
+	"errors"
+	"io"
+	"os"
+
+	"github.com/rfjakob/gocryptfs/internal/contentenc"
+)
+
+// maxReadBlocks limits the memory used by a single ReadAt call
+const maxReadBlocks = 32
+
+// File is an encrypted file opened for reading. It decrypts on the fly and
+// implements io.Reader, io.ReaderAt, io.Seeker and io.Closer.
+type File struct {
+	fd         *os.File
+	contentEnc *contentenc.ContentEnc
+	// fileID from the file header, nil for an empty file
+	fileID []byte
+	// size is the plaintext size
+	size int64
+	// offset is the plaintext position for Read and Seek
+	offset int64
+}
+
+// OpenFile opens the encrypted file "cipherPath", for example a path returned
+// by EncryptPath.
+func (d *CipherDir) OpenFile(cipherPath string) (*File, error) {
+	fd, err := os.Open(cipherPath)
+	if err != nil {
+		return nil, err
+	}
+	f, err := d.newFile(fd)
+	if err != nil {
+		fd.Close()
+		return nil, err
+	}
+	return f, nil
+}
+
+// newFile reads the file header of "fd"
+func (d *CipherDir) newFile(fd *os.File) (*File, error) {
+	fi, err := fd.Stat()
+	if err != nil {
+		return nil, err
+	}
+	if !fi.Mode().IsRegular() {
+		return nil, &os.PathError{Op: "open", Path: fd.Name(), Err: errors.New("not a regular file")}
+	}
+	f := &File{
+		fd:         fd,
+		contentEnc: d.contentEnc,
+		size:       int64(d.contentEnc.CipherSizeToPlainSize(uint64(fi.Size()))),
+	}
+	if fi.Size() == 0 {
+		return f, nil
+	}
+	buf := make([]byte, contentenc.HeaderLen)
+	_, err = fd.ReadAt(buf, 0)
+	if err == io.EOF {
+		err = io.ErrUnexpectedEOF
+	}
+	if err != nil {
+		return nil, err
+	}
+	h, err := contentenc.ParseHeader(buf)
+	if err != nil {
+		return nil, &os.PathError{Op: "open", Path: fd.Name(), Err: err}
+	}
+	f.fileID = h.ID
+	return f, nil
+}
+
+// Size returns the plaintext size of the file
+func (f *File) Size() int64 {
+	return f.size
+}
+
+// ReadAt implements io.ReaderAt. A block that fails authentication gives an
+// error.
+func (f *File) ReadAt(p []byte, off int64) (n int, err error) {
+	if off < 0 {
+		return 0, errors.New("negative offset")
+	}
+	for n < len(p) {
+		if off >= f.size {
+			return n, io.EOF
+		}
+		m, err := f.readBlocks(p[n:], off)
+		n += m
+		off += int64(m)
+		if err != nil {
+			return n, err
+		}
+	}
+	return n, nil
+}
+
+// readBlocks reads into "p" from plaintext offset "off", at most
+// maxReadBlocks blocks
+func (f *File) readBlocks(p []byte, off int64) (int, error) {
+	ce := f.contentEnc
+	length := uint64(len(p))
+	if max := maxReadBlocks * ce.PlainBS(); length > max {
+		length = max
+	}
+	if rest := uint64(f.size - off); length > rest {
+		length = rest
+	}
+	blocks := ce.ExplodePlainRange(uint64(off), length)
+	cOff, cLen := blocks[0].JointCiphertextRange(blocks)
+	ciphertext := make([]byte, cLen)
+	m, err := f.fd.ReadAt(ciphertext, int64(cOff))
+	if err != nil && err != io.EOF {
+		return 0, err
+	}
+	plaintext, err := ce.DecryptBlocks(ciphertext[:m], blocks[0].BlockNo, f.fileID)
+	if err != nil {
+		return 0, &os.PathError{Op: "read", Path: f.fd.Name(), Err: err}
+	}
+	skip := blocks[0].Skip
+	if uint64(len(plaintext)) < skip+length {
+		// The file was truncated after we opened it
+		return 0, io.ErrUnexpectedEOF
+	}
+	return copy(p, plaintext[skip:skip+length]), nil
+}
+
+// Read implements io.Reader
+func (f *File) Read(p []byte) (int, error) {
+	n, err := f.ReadAt(p, f.offset)
+	f.offset += int64(n)
+	if err == io.EOF && n > 0 {
+		err = nil
+	}
+	return n, err
+}
+
+// Seek implements io.Seeker
+func (f *File) Seek(offset int64, whence int) (int64, error) {
+	switch whence {
+	case os.SEEK_SET:
+	case os.SEEK_CUR:
+		offset += f.offset
+	case os.SEEK_END:
+		offset += f.size
+	default:
+		return 0, errors.New("invalid whence")
+	}
+	if offset < 0 {
+		return 0, errors.New("negative position")
+	}
+	f.offset = offset
+	return offset, nil
+}
+
+// Close closes the underlying file
+func (f *File) Close() error {
+	return f.fd.Close()
+}
@@ -3,14 +3,18 @@ package main
 import (
 	"flag"
 	"fmt"
+	"io/ioutil"
 	"net"
 	"os"
 	"strconv"
 	"strings"
+	"time"
 
 	"github.com/hanwen/go-fuse/fuse"
 	"github.com/rfjakob/gocryptfs/internal/configfile"
 	"github.com/rfjakob/gocryptfs/internal/exitcodes"
+	"github.com/rfjakob/gocryptfs/internal/fusefrontend_reverse"
+	"github.com/rfjakob/gocryptfs/internal/nametransform/dirivcache"
 	"github.com/rfjakob/gocryptfs/internal/prefer_openssl"
 	"github.com/rfjakob/gocryptfs/internal/stupidgcm"
 	"github.com/rfjakob/gocryptfs/internal/tlog"
@@ -28,13 +32,100 @@ type argContainer struct {
 	// Configuration file name override
 	config             string
 	notifypid, scryptn int
+	// Allow -init on a directory that already contains a filesystem, "-force_init"
+	force_init bool
+	// Password hashing algorithm for -init, "-kdf"
+	kdf string
+	// Refuse group- or world-accessible config files, "-strictperms"
+	strictperms bool
+	// Load config files with unknown feature flags, "-acceptunknownflags"
+	acceptunknownflags bool
+	// Feature flags to change in the config file, "-setflag", "-unsetflag"
+	setflag, unsetflag string
+	// Directory for the temporary files of atomic writes, "-tmpdir"
+	tmpdir string
+	// Read the password from this file descriptor, "-passfd"
+	passfd int
+	// Unlock with a keyfile instead of a password, "-keyfile"
+	keyfile string
+	// Require a password in addition to the keyfile, "-keyfile-password"
+	keyfile_password bool
+	// Keyfiles for changing the keyfile with -passwd, "-old-keyfile", "-new-keyfile"
+	old_keyfile, new_keyfile string
+	// Read the master key from this file, "-masterkey-file"
+	masterkey_file string
+	// Refuse to mount on a different master key fingerprint, "-expect-fingerprint"
+	expect_fingerprint string
+	// Actions that do not mount: "-detect", "-fsck", "-check-password",
+	// "-unmount", "-scrypt-bench"
+	detect         bool
+	fsck           bool
+	check_password bool
+	unmount        bool
+	scrypt_bench   bool
+	// With -fsck: fail on directories without gocryptfs.seal, "-require-seal"
+	require_seal bool
+	// Print version information as JSON, "-json"
+	json bool
+	// Decrypt a subtree without mounting, "-export-subtree"
+	export_subtree string
+	// Translate a single path and exit, "-encrypt-name", "-decrypt-name"
+	encrypt_name, decrypt_name string
+	// Let the kernel check file permissions, "-default_permissions"
+	default_permissions bool
+	// Fsync the parent directory after metadata changes, "-strict-sync"
+	strict_sync bool
+	// Read back and verify every write, "-verify-after-write"
+	verify_after_write bool
+	// Store all-zero blocks as holes, "-sparse"
+	sparse bool
+	// Match file names case-insensitively, "-caseinsensitive"
+	caseinsensitive bool
+	// Panic instead of returning EIO on corruption, "-panic-on-corruption"
+	panic_on_corruption bool
+	// Retries and cache size for gocryptfs.diriv, "-diriv-retries", "-diriv-cache-size"
+	diriv_retries, diriv_cache_size int
+	// Write log messages to this file, "-logfile"
+	logfile string
+	// Write log messages as JSON, "-logjson"
+	logjson bool
+	// Print JSON status lines on mount and unmount, "-status-json"
+	status_json bool
+	// Reverse mode: log progress periodically, "-progress"
+	progress bool
+	// Reverse mode: check the reverse and forward round trip, "-reverse-test"
+	reverse_test bool
+	// Reverse mode: add gocryptfs.seal files, "-reverse-seal"
+	reverse_seal bool
+	// Reverse mode: state file for the list of changed files, "-reverse-index"
+	reverse_index string
+	// Reverse mode: file with patterns of paths to hide, "-reverse-exclude-from"
+	reverse_exclude_from string
+	// Reverse mode: how to handle bind mounts, "-reverse-bind-mounts"
+	reverse_bind_mounts string
+	// Unmount after this much time without activity, "-idle"
+	idle time.Duration
+	// Kernel cache timeouts, "-attr-timeout", "-entry-timeout", "-negative-timeout"
+	attr_timeout, entry_timeout, negative_timeout time.Duration
+	// Size of the decrypted block cache in bytes, "-blockcache"
+	blockcache uint64
+	// Read-ahead window in bytes, "-readahead"
+	readahead uint64
 	// Helper variables that are NOT cli options all start with an underscore
 	// _configCustom is true when the user sets a custom config file name.
 	_configCustom bool
 	// _ctlsockFd stores the control socket file descriptor (ctlsock stores the path)
 	_ctlsockFd net.Listener
+	// _logfile is the opened "-logfile"
+	_logfile *tlog.LogFile
 	// _forceOwner is, if non-nil, a parsed, validated Owner (as opposed to the string above)
 	_forceOwner *fuse.Owner
+	// _excludePatterns are the patterns read from "-reverse-exclude-from"
+	_excludePatterns []string
+	// _hiddenMounts are the bind mounts that "-reverse-bind-mounts" hides
+	_hiddenMounts []string
+	// _passfd is the opened "-passfd", or nil
+	_passfd *os.File
 }
 
 var flagSet *flag.FlagSet
@@ -110,6 +201,7 @@ func parseCliOpts() (args argContainer) {
 	flagSet.BoolVar(&args.fg, "f", false, "")
 	flagSet.BoolVar(&args.fg, "fg", false, "Stay in the foreground")
 	flagSet.BoolVar(&args.version, "version", false, "Print version and exit")
+	flagSet.BoolVar(&args.json, "json", false, "Print version information as JSON (with -version)")
 	flagSet.BoolVar(&args.plaintextnames, "plaintextnames", false, "Do not encrypt file names")
 	flagSet.BoolVar(&args.quiet, "q", false, "")
 	flagSet.BoolVar(&args.quiet, "quiet", false, "Quiet - silence informational messages")
@@ -118,6 +210,8 @@ func parseCliOpts() (args argContainer) {
 	flagSet.BoolVar(&args.longnames, "longnames", true, "Store names longer than 176 bytes in extra files")
 	flagSet.BoolVar(&args.allow_other, "allow_other", false, "Allow other users to access the filesystem. "+
 		"Only works if user_allow_other is set in /etc/fuse.conf.")
+	flagSet.BoolVar(&args.default_permissions, "default_permissions", false, "Let the kernel check file permissions. "+
+		"Implied by -allow_other.")
 	flagSet.BoolVar(&args.ro, "ro", false, "Mount the filesystem read-only")
 	flagSet.BoolVar(&args.reverse, "reverse", false, "Reverse mode")
 	flagSet.BoolVar(&args.aessiv, "aessiv", false, "AES-SIV encryption")
@@ -125,27 +219,83 @@ func parseCliOpts() (args argContainer) {
 	flagSet.BoolVar(&args.raw64, "raw64", true, "Use unpadded base64 for file names")
 	flagSet.BoolVar(&args.noprealloc, "noprealloc", false, "Disable preallocation before writing")
 	flagSet.BoolVar(&args.speed, "speed", false, "Run crypto speed test")
+	flagSet.BoolVar(&args.scrypt_bench, "scrypt-bench", false, "Measure scrypt on this machine and recommend a -scryptn value")
 	flagSet.BoolVar(&args.hkdf, "hkdf", true, "Use HKDF as an additional key derivation step")
 	flagSet.BoolVar(&args.serialize_reads, "serialize_reads", false, "Try to serialize read operations")
 	flagSet.BoolVar(&args.forcedecode, "forcedecode", false, "Force decode of files even if integrity check fails."+
 		" Requires gocryptfs to be compiled with openssl support and implies -openssl true")
 	flagSet.BoolVar(&args.hh, "hh", false, "Show this long help text")
 	flagSet.BoolVar(&args.info, "info", false, "Display information about CIPHERDIR")
+	flagSet.BoolVar(&args.fsck, "fsck", false, "Check the integrity of CIPHERDIR without mounting")
+	flagSet.BoolVar(&args.require_seal, "require-seal", false, "With -fsck: fail if a directory has no gocryptfs.seal file")
+	flagSet.BoolVar(&args.check_password, "check-password", false, "Check the password of CIPHERDIR without mounting")
+	flagSet.BoolVar(&args.unmount, "unmount", false, "Unmount the gocryptfs filesystem at MOUNTPOINT")
+	flagSet.BoolVar(&args.detect, "detect", false, "Guess the format of CIPHERDIR without the config file (best-effort)")
+	flagSet.BoolVar(&args.force_init, "force_init", false, "Allow -init on a directory that already contains a gocryptfs filesystem")
 	flagSet.BoolVar(&args.sharedstorage, "sharedstorage", false, "Make concurrent access to a shared CIPHERDIR safer")
 	flagSet.BoolVar(&args.devrandom, "devrandom", false, "Use /dev/random for generating master key")
+	flagSet.BoolVar(&args.reverse_test, "reverse-test", false, "Check that SOURCEDIR survives a reverse and forward mount round trip")
+	flagSet.BoolVar(&args.progress, "progress", false, "Reverse mode: periodically log the number of files and bytes read")
+	flagSet.BoolVar(&args.reverse_seal, "reverse-seal", false, "Reverse mode: add a gocryptfs.seal file with HMACs to every directory. "+
+		"Reading a seal encrypts the whole subtree, a backup that reads all seals costs O(depth x tree size)")
+	flagSet.StringVar(&args.reverse_index, "reverse-index", "", "Reverse mode: print the files that changed since the "+
+		"last run, using the index in this directory, and update the index")
+	flagSet.BoolVar(&args.strict_sync, "strict-sync", false, "Fsync the parent directory after creating, deleting or renaming files")
+	flagSet.BoolVar(&args.verify_after_write, "verify-after-write", false, "Read back and verify every write (slow)")
+	flagSet.BoolVar(&args.sparse, "sparse", false, "Store all-zero blocks as holes in the ciphertext files")
+	flagSet.BoolVar(&args.caseinsensitive, "caseinsensitive", false, "Match file names case-insensitively if there "+
+		"is no exact match (slower)")
+	flagSet.BoolVar(&args.panic_on_corruption, "panic-on-corruption", false, "Panic instead of returning an I/O error "+
+		"when encrypted data fails the integrity check")
+	flagSet.BoolVar(&args.keyfile_password, "keyfile-password", false, "Require a password in addition to the keyfile")
 	flagSet.StringVar(&args.masterkey, "masterkey", "", "Mount with explicit master key")
+	flagSet.StringVar(&args.masterkey_file, "masterkey-file", "", "Mount with the explicit master key read from this file")
 	flagSet.StringVar(&args.cpuprofile, "cpuprofile", "", "Write cpu profile to specified file")
 	flagSet.StringVar(&args.memprofile, "memprofile", "", "Write memory profile to specified file")
 	flagSet.StringVar(&args.config, "config", "", "Use specified config file instead of CIPHERDIR/gocryptfs.conf")
 	flagSet.StringVar(&args.extpass, "extpass", "", "Use external program for the password prompt")
 	flagSet.StringVar(&args.passfile, "passfile", "", "Read password from file")
+	flagSet.StringVar(&args.keyfile, "keyfile", "", "Unlock using the contents of the specified file instead of a password")
+	flagSet.StringVar(&args.old_keyfile, "old-keyfile", "", "-passwd: the keyfile that unlocks the filesystem now")
+	flagSet.StringVar(&args.new_keyfile, "new-keyfile", "", "-passwd: the keyfile that should unlock the filesystem from now on")
 	flagSet.StringVar(&args.ko, "ko", "", "Pass additional options directly to the kernel, comma-separated list")
 	flagSet.StringVar(&args.ctlsock, "ctlsock", "", "Create control socket at specified path")
 	flagSet.StringVar(&args.fsname, "fsname", "", "Override the filesystem name")
 	flagSet.StringVar(&args.force_owner, "force_owner", "", "uid:gid pair to coerce ownership")
 	flagSet.StringVar(&args.trace, "trace", "", "Write execution trace to file")
+	flagSet.StringVar(&args.expect_fingerprint, "expect-fingerprint", "", "Refuse to mount if the master key fingerprint does not match")
+	flagSet.StringVar(&args.export_subtree, "export-subtree", "", "Decrypt the specified directory or file to DEST without mounting")
+	flagSet.StringVar(&args.encrypt_name, "encrypt-name", "", "Print the ciphertext path of the specified plaintext path and exit")
+	flagSet.StringVar(&args.decrypt_name, "decrypt-name", "", "Print the plaintext path of the specified ciphertext path and exit")
+	flagSet.StringVar(&args.logfile, "logfile", "", "Write log messages to this file instead of stdout/stderr or syslog")
+	flagSet.BoolVar(&args.logjson, "logjson", false, "Write log messages as JSON objects, one per line")
+	flagSet.BoolVar(&args.status_json, "status-json", false, "With -f: print a JSON line to stdout when the filesystem is mounted and unmounted")
+	flagSet.StringVar(&args.reverse_exclude_from, "reverse-exclude-from", "", "Reverse mode: hide the paths matching the patterns in this file")
+	flagSet.StringVar(&args.reverse_bind_mounts, "reverse-bind-mounts", fusefrontend_reverse.BindMountsFollow,
+		"Reverse mode: what to do with bind mounts below CIPHERDIR. Possible values: follow, skip, dedup")
+	flagSet.StringVar(&args.setflag, "setflag", "", "Enable a feature flag in the config file")
+	flagSet.StringVar(&args.unsetflag, "unsetflag", "", "Disable a feature flag in the config file")
+	flagSet.StringVar(&args.kdf, "kdf", configfile.KDFScrypt, "Password hashing algorithm for -init: scrypt or argon2id")
+	flagSet.BoolVar(&args.strictperms, "strictperms", false, "Refuse to use a config file that is accessible by group or others")
+	flagSet.BoolVar(&args.acceptunknownflags, "acceptunknownflags", false, "Load config files with unknown feature flags. DANGEROUS")
+	flagSet.StringVar(&args.tmpdir, "tmpdir", "", "Create the temporary files for atomic writes of the config file and the -reverse-index state in this directory")
+	flagSet.DurationVar(&args.idle, "idle", 0, "Unmount automatically after the filesystem has not been "+
+		"used for the specified duration, for example 10m")
+	// The defaults are compatible with libfuse, making benchmarking easier
+	flagSet.DurationVar(&args.attr_timeout, "attr-timeout", time.Second, "How long the kernel may cache file attributes")
+	flagSet.DurationVar(&args.entry_timeout, "entry-timeout", time.Second, "How long the kernel may cache file name lookups")
+	flagSet.DurationVar(&args.negative_timeout, "negative-timeout", time.Second, "How long the kernel may cache failed file name lookups")
+	flagSet.Uint64Var(&args.blockcache, "blockcache", 0, "Cache up to this many bytes of decrypted "+
+		"blocks to speed up repeated reads of the same data")
+	flagSet.Uint64Var(&args.readahead, "readahead", 0, "Decrypt this many bytes in advance when a file "+
+		"is read sequentially")
+	flagSet.IntVar(&args.passfd, "passfd", -1, "Read password from the specified file descriptor")
 	flagSet.IntVar(&args.notifypid, "notifypid", 0, "Send USR1 to the specified process after "+
 		"successful mount - used internally for daemonization")
+	flagSet.IntVar(&args.diriv_retries, "diriv-retries", 3, "Retry reading gocryptfs.diriv this often after "+
+		"transient errors like ESTALE on network filesystems")
+	flagSet.IntVar(&args.diriv_cache_size, "diriv-cache-size", dirivcache.DefaultMaxEntries, "Number of "+
+		"directory IVs to keep in memory")
 	flagSet.IntVar(&args.scryptn, "scryptn", configfile.ScryptDefaultLogN, "scrypt cost parameter logN. Possible values: 10-28. "+
 		"A lower value speeds up mounting and reduces its memory needs, but makes the password susceptible to brute-force attacks")
 	// Ignored otions
@@ -175,6 +325,11 @@ func parseCliOpts() (args argContainer) {
 			tlog.Fatal.Printf("Invalid \"-openssl\" setting: %v", err)
 			os.Exit(exitcodes.Usage)
 		}
+		// Fail now instead of after the password prompt
+		if args.openssl && stupidgcm.BuiltWithoutOpenssl {
+			tlog.Fatal.Printf("-openssl=%s was requested, but gocryptfs was compiled without openssl support", opensslAuto)
+			os.Exit(exitcodes.OpenSSL)
+		}
 	}
 	// "-forcedecode" only works with openssl. Check compilation and command line parameters
 	if args.forcedecode == true {
@@ -206,10 +361,160 @@ func parseCliOpts() (args argContainer) {
 	if args.passfile != "" {
 		args.extpass = "/bin/cat -- " + args.passfile
 	}
-	if args.extpass != "" && args.masterkey != "" {
+	if args.masterkey != "" && args.masterkey_file != "" {
+		tlog.Fatal.Printf("The options -masterkey and -masterkey-file cannot be used at the same time")
+		os.Exit(exitcodes.Usage)
+	}
+	explicitKey := args.masterkey != "" || args.masterkey_file != ""
+	if args.check_password && explicitKey {
+		tlog.Fatal.Printf("The option -check-password cannot be combined with -masterkey")
+		os.Exit(exitcodes.Usage)
+	}
+	if args.setflag != "" && args.unsetflag != "" {
+		tlog.Fatal.Printf("The options -setflag and -unsetflag cannot be used at the same time")
+		os.Exit(exitcodes.Usage)
+	}
+	if (args.setflag != "" || args.unsetflag != "") && explicitKey {
+		tlog.Fatal.Printf("The options -setflag and -unsetflag need the password, they cannot be combined with -masterkey")
+		os.Exit(exitcodes.Usage)
+	}
+	if args.extpass != "" && explicitKey {
 		tlog.Fatal.Printf("The options -extpass and -masterkey cannot be used at the same time")
 		os.Exit(exitcodes.Usage)
 	}
+	if args.passfd != -1 {
+		if args.passfd < 0 {
+			tlog.Fatal.Printf("Invalid -passfd %d", args.passfd)
+			os.Exit(exitcodes.Usage)
+		}
+		if args.extpass != "" || explicitKey {
+			tlog.Fatal.Printf("The option -passfd cannot be combined with -extpass, -passfile or -masterkey")
+			os.Exit(exitcodes.Usage)
+		}
+		if args.keyfile != "" && !args.keyfile_password {
+			tlog.Fatal.Printf("-keyfile without -keyfile-password does not use a password. Drop -passfd or add -keyfile-password")
+			os.Exit(exitcodes.Usage)
+		}
+		args._passfd = os.NewFile(uintptr(args.passfd), "passfd")
+	}
+	if args.json && !args.version {
+		tlog.Fatal.Printf("The -json option only works together with -version")
+		os.Exit(exitcodes.Usage)
+	}
+	if args.progress && !args.reverse {
+		tlog.Fatal.Printf("The -progress option only works in reverse mode")
+		os.Exit(exitcodes.Usage)
+	}
+	if args.idle != 0 && args.reverse {
+		tlog.Fatal.Printf("The -idle option does not work in reverse mode")
+		os.Exit(exitcodes.Usage)
+	}
+	if args.caseinsensitive && args.reverse {
+		tlog.Fatal.Printf("The -caseinsensitive option does not work in reverse mode")
+		os.Exit(exitcodes.Usage)
+	}
+	for _, t := range []struct {
+		name string
+		d    *time.Duration
+	}{
+		{"attr-timeout", &args.attr_timeout},
+		{"entry-timeout", &args.entry_timeout},
+		{"negative-timeout", &args.negative_timeout},
+	} {
+		if *t.d < 0 {
+			tlog.Fatal.Printf("Invalid -%s %v", t.name, *t.d)
+			os.Exit(exitcodes.Usage)
+		}
+		// "-sharedstorage" disables caching so changes to the backing shared
+		// storage show up immediately. Explicit values still win.
+		if args.sharedstorage && !isFlagPassed(t.name) {
+			*t.d = 0
+		}
+	}
+	if args.diriv_retries < 0 {
+		tlog.Fatal.Printf("Invalid -diriv-retries %d", args.diriv_retries)
+		os.Exit(exitcodes.Usage)
+	}
+	if args.diriv_cache_size < 1 {
+		tlog.Fatal.Printf("Invalid -diriv-cache-size %d", args.diriv_cache_size)
+		os.Exit(exitcodes.Usage)
+	}
+	if args.blockcache != 0 && (args.reverse || args.sharedstorage) {
+		tlog.Fatal.Printf("The -blockcache option does not work in reverse mode or with -sharedstorage")
+		os.Exit(exitcodes.Usage)
+	}
+	if args.readahead != 0 && (args.reverse || args.sharedstorage || args.serialize_reads) {
+		tlog.Fatal.Printf("The -readahead option does not work in reverse mode, with -sharedstorage or with -serialize_reads")
+		os.Exit(exitcodes.Usage)
+	}
+	if args.sparse && args.reverse {
+		tlog.Fatal.Printf("The -sparse option does not work in reverse mode")
+		os.Exit(exitcodes.Usage)
+	}
+	if args.panic_on_corruption && (args.reverse || args.forcedecode) {
+		tlog.Fatal.Printf("The -panic-on-corruption option does not work in reverse mode or with -forcedecode")
+		os.Exit(exitcodes.Usage)
+	}
+	switch args.reverse_bind_mounts {
+	case fusefrontend_reverse.BindMountsFollow:
+	case fusefrontend_reverse.BindMountsSkip, fusefrontend_reverse.BindMountsDedup:
+		if !args.reverse {
+			tlog.Fatal.Printf("The -reverse-bind-mounts option only works in reverse mode")
+			os.Exit(exitcodes.Usage)
+		}
+	default:
+		tlog.Fatal.Printf("Invalid -reverse-bind-mounts %q. Possible values: %s, %s, %s", args.reverse_bind_mounts,
+			fusefrontend_reverse.BindMountsFollow, fusefrontend_reverse.BindMountsSkip, fusefrontend_reverse.BindMountsDedup)
+		os.Exit(exitcodes.Usage)
+	}
+	if args.reverse_seal && !args.reverse {
+		tlog.Fatal.Printf("The -reverse-seal option only works in reverse mode")
+		os.Exit(exitcodes.Usage)
+	}
+	if args.require_seal && !args.fsck {
+		tlog.Fatal.Printf("The -require-seal option only works together with -fsck")
+		os.Exit(exitcodes.Usage)
+	}
+	// In the background, stdout is redirected after mounting and the
+	// "unmounted" event would be lost
+	if args.status_json && !args.fg {
+		tlog.Fatal.Printf("The -status-json option only works together with -f")
+		os.Exit(exitcodes.Usage)
+	}
+	if args.reverse_index != "" && !args.reverse {
+		tlog.Fatal.Printf("The -reverse-index option only works in reverse mode")
+		os.Exit(exitcodes.Usage)
+	}
+	if args.reverse_exclude_from != "" && !args.reverse {
+		tlog.Fatal.Printf("The -reverse-exclude-from option only works in reverse mode")
+		os.Exit(exitcodes.Usage)
+	}
+	if args.kdf != configfile.KDFScrypt && args.kdf != configfile.KDFArgon2id {
+		tlog.Fatal.Printf("Invalid -kdf %q. Possible values: %s, %s", args.kdf, configfile.KDFScrypt, configfile.KDFArgon2id)
+		os.Exit(exitcodes.Usage)
+	}
+	if args.old_keyfile != "" || args.new_keyfile != "" {
+		if !args.passwd {
+			tlog.Fatal.Printf("The options -old-keyfile and -new-keyfile only work together with -passwd")
+			os.Exit(exitcodes.Usage)
+		}
+		if args.keyfile != "" {
+			tlog.Fatal.Printf("The options -old-keyfile and -new-keyfile replace -keyfile, they cannot be combined with it")
+			os.Exit(exitcodes.Usage)
+		}
+	}
+	if args.keyfile_password && args.keyfile == "" && args.old_keyfile == "" && args.new_keyfile == "" {
+		tlog.Fatal.Printf("The -keyfile-password option requires -keyfile")
+		os.Exit(exitcodes.Usage)
+	}
+	if args.keyfile != "" && !args.keyfile_password && args.extpass != "" {
+		tlog.Fatal.Printf("-keyfile without -keyfile-password does not use a password. Drop -extpass/-passfile or add -keyfile-password")
+		os.Exit(exitcodes.Usage)
+	}
+	if (args.keyfile != "" || args.old_keyfile != "") && explicitKey {
+		tlog.Fatal.Printf("The options -keyfile and -masterkey cannot be used at the same time")
+		os.Exit(exitcodes.Usage)
+	}
 	return args
 }
 
@@ -220,3 +525,33 @@ func prettyArgs() string {
 	pa = pa[1 : len(pa)-1]
 	return pa
 }
+
+// readExcludeFile reads gitignore-style patterns from "filename", one per
+// line, like rsync's "--exclude-from". Blank lines and lines starting with
+// "#" are ignored.
+func readExcludeFile(filename string) ([]string, error) {
+	content, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return nil, err
+	}
+	var patterns []string
+	for _, line := range strings.Split(string(content), "\n") {
+		line = strings.TrimRight(line, " \r")
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		patterns = append(patterns, line)
+	}
+	return patterns, nil
+}
+
+// isFlagPassed returns true if the flag "name" was set on the command line
+func isFlagPassed(name string) bool {
+	passed := false
+	flagSet.Visit(func(f *flag.Flag) {
+		if f.Name == name {
+			passed = true
+		}
+	})
+	return passed
+}
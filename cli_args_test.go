@@ -1,8 +1,11 @@
 package main
 
 import (
+	"io/ioutil"
+	"os"
 	"reflect"
 	"testing"
+	"time"
 )
 
 type testcase struct {
@@ -69,3 +72,63 @@ func TestPrefixOArgs(t *testing.T) {
 		}
 	}
 }
+
+// TestReadExcludeFile checks that comments and blank lines are skipped
+func TestReadExcludeFile(t *testing.T) {
+	f, err := ioutil.TempFile("", "gocryptfs_exclude")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(f.Name())
+	f.WriteString("# comment\n\n*.o\r\n/foo/bar  \n  \n!keep.o\n")
+	f.Close()
+	patterns, err := readExcludeFile(f.Name())
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []string{"*.o", "/foo/bar", "!keep.o"}
+	if !reflect.DeepEqual(patterns, want) {
+		t.Errorf("want %q, got %q", want, patterns)
+	}
+}
+
+// parseTimeouts parses "extra" like a mount command line and returns the cache
+// timeouts
+func parseTimeouts(extra ...string) (attr, entry, negative time.Duration) {
+	oldArgs := os.Args
+	defer func() { os.Args = oldArgs }()
+	os.Args = append(append([]string{"gocryptfs"}, extra...), "CIPHERDIR", "MOUNTPOINT")
+	args := parseCliOpts()
+	return args.attr_timeout, args.entry_timeout, args.negative_timeout
+}
+
+func TestCacheTimeouts(t *testing.T) {
+	attr, entry, negative := parseTimeouts()
+	if attr != time.Second || entry != time.Second || negative != time.Second {
+		t.Errorf("wrong defaults: %v %v %v", attr, entry, negative)
+	}
+	attr, entry, negative = parseTimeouts("-attr-timeout", "1m", "-entry-timeout", "0", "-negative-timeout", "500ms")
+	if attr != time.Minute || entry != 0 || negative != 500*time.Millisecond {
+		t.Errorf("values not used: %v %v %v", attr, entry, negative)
+	}
+	// -sharedstorage disables caching, except where explicitly requested
+	attr, entry, negative = parseTimeouts("-sharedstorage", "-entry-timeout", "2s")
+	if attr != 0 || entry != 2*time.Second || negative != 0 {
+		t.Errorf("wrong -sharedstorage timeouts: %v %v %v", attr, entry, negative)
+	}
+}
+
+// TestReverseTestOpts checks that the mounts of "-reverse-test" get the
+// options we got, also when an option value looks like a filtered flag
+func TestReverseTestOpts(t *testing.T) {
+	oldArgs := os.Args
+	defer func() { os.Args = oldArgs }()
+	os.Args = []string{"gocryptfs", "-reverse-test", "-passfile", "f", "-fsname", "reverse",
+		"-q", "-fg", "SOURCEDIR"}
+	parseCliOpts()
+	have := reverseTestOpts()
+	want := []string{"-fsname=reverse", "-passfile=f", "-q=true"}
+	if !reflect.DeepEqual(have, want) {
+		t.Errorf("want %q, have %q", want, have)
+	}
+}
@@ -26,7 +26,7 @@ func exitOnUsr1() {
 // forkChild - execute ourselves once again, this time with the "-fg" flag, and
 // wait for SIGUSR1 or child exit.
 // This is a workaround for the missing true fork function in Go.
-func forkChild() int {
+func forkChild(args *argContainer) int {
 	name := os.Args[0]
 	newArgs := []string{"-fg", fmt.Sprintf("-notifypid=%d", os.Getpid())}
 	newArgs = append(newArgs, os.Args[1:]...)
@@ -34,6 +34,12 @@ func forkChild() int {
 	c.Stdout = os.Stdout
 	c.Stderr = os.Stderr
 	c.Stdin = os.Stdin
+	// The child reads the password from "-passfd", so it must get the same fd
+	// number. ExtraFiles[i] becomes fd 3+i, nil entries are closed.
+	if args.passfd > 2 {
+		c.ExtraFiles = make([]*os.File, args.passfd-2)
+		c.ExtraFiles[args.passfd-3] = args._passfd
+	}
 	exitOnUsr1()
 	err := c.Start()
 	if err != nil {
@@ -75,25 +81,35 @@ func redirectStdFds() {
 	// The logger now reads on "pr". We can close it.
 	pr.Close()
 	// Redirect stout and stderr to "pw".
-	err = syscallcompat.Dup3(int(pw.Fd()), 1, 0)
+	dupStdFds(int(pw.Fd()))
+	// Our stout and stderr point to "pw". We can close the extra copy.
+	pw.Close()
+}
+
+// redirectStdFdsToFile redirects stderr and stdout to "f"; stdin to /dev/null
+func redirectStdFdsToFile(f *os.File) {
+	dupStdFds(int(f.Fd()))
+}
+
+// dupStdFds points stdout and stderr to "fd" and stdin to /dev/null
+func dupStdFds(fd int) {
+	err := syscallcompat.Dup3(fd, 1, 0)
 	if err != nil {
-		tlog.Warn.Printf("redirectStdFds: stdout dup error: %v\n", err)
+		tlog.Warn.Printf("dupStdFds: stdout dup error: %v\n", err)
 	}
-	syscallcompat.Dup3(int(pw.Fd()), 2, 0)
+	err = syscallcompat.Dup3(fd, 2, 0)
 	if err != nil {
-		tlog.Warn.Printf("redirectStdFds: stderr dup error: %v\n", err)
+		tlog.Warn.Printf("dupStdFds: stderr dup error: %v\n", err)
 	}
-	// Our stout and stderr point to "pw". We can close the extra copy.
-	pw.Close()
 	// Redirect stdin to /dev/null
 	nullFd, err := os.Open("/dev/null")
 	if err != nil {
-		tlog.Warn.Printf("redirectStdFds: could not open /dev/null: %v\n", err)
+		tlog.Warn.Printf("dupStdFds: could not open /dev/null: %v\n", err)
 		return
 	}
 	err = syscallcompat.Dup3(int(nullFd.Fd()), 0, 0)
 	if err != nil {
-		tlog.Warn.Printf("redirectStdFds: stdin dup error: %v\n", err)
+		tlog.Warn.Printf("dupStdFds: stdin dup error: %v\n", err)
 	}
 	nullFd.Close()
 }
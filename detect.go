@@ -0,0 +1,139 @@
+package main
+
+import (
+	"encoding/base64"
+	"encoding/binary"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/rfjakob/gocryptfs/internal/contentenc"
+	"github.com/rfjakob/gocryptfs/internal/exitcodes"
+	"github.com/rfjakob/gocryptfs/internal/nametransform"
+	"github.com/rfjakob/gocryptfs/internal/tlog"
+)
+
+// detectStats collects what detect() has seen in CIPHERDIR
+type detectStats struct {
+	// Entries (except gocryptfs.* files) whose names look like
+	// EME-encrypted names, with and without base64 padding
+	namesRaw64, namesPadded int
+	// Entries whose names do not look encrypted at all
+	namesPlain int
+	// Long name files
+	longNames int
+	// Regular files with a valid header, and how many of them have a size
+	// that is consistent with 128-bit or 96-bit GCM IVs
+	files, iv128, iv96 int
+	// Regular files that are too short or have a bad header
+	badFiles int
+}
+
+// detect inspects CIPHERDIR "dir" without the config file or the password and
+// prints the feature flags it probably uses. Everything is best-effort.
+// This is called when you pass the "-detect" option.
+func detect(dir string) {
+	var s detectStats
+	err := filepath.Walk(dir, func(path string, fi os.FileInfo, err error) error {
+		if err != nil {
+			tlog.Warn.Printf("detect: %v", err)
+			return nil
+		}
+		if path == dir {
+			return nil
+		}
+		detectName(&s, fi.Name())
+		if fi.Mode().IsRegular() && !strings.HasPrefix(fi.Name(), "gocryptfs.") &&
+			!strings.HasPrefix(fi.Name(), ".gocryptfs.") {
+			detectFile(&s, path, fi.Size())
+		}
+		return nil
+	})
+	if err != nil {
+		tlog.Fatal.Printf("detect: %v", err)
+		os.Exit(exitcodes.CipherDir)
+	}
+	var flags []string
+	_, err = os.Stat(filepath.Join(dir, nametransform.DirIVFilename))
+	dirIV := err == nil
+	if dirIV {
+		flags = append(flags, "DirIV")
+	}
+	if s.namesRaw64+s.namesPadded > 0 && s.namesPlain == 0 {
+		flags = append(flags, "EMENames")
+		if s.namesPadded == 0 {
+			flags = append(flags, "Raw64")
+		}
+	} else if s.namesPlain > 0 && !dirIV {
+		flags = append(flags, "PlaintextNames")
+	}
+	if s.longNames > 0 {
+		flags = append(flags, "LongNames")
+	}
+	if s.iv128 > 0 && s.iv96 == 0 {
+		// AES-SIV has the same per-block overhead as GCM with 128-bit IVs
+		flags = append(flags, "GCMIV128|AESSIV")
+	}
+	fmt.Printf("Note: this is a best-effort guess based on the file names and sizes.\n")
+	fmt.Printf("FeatureFlags (likely): %s\n", strings.Join(flags, " "))
+	fmt.Printf("Names: %d encrypted (%d unpadded), %d not encrypted, %d long names\n",
+		s.namesRaw64+s.namesPadded, s.namesRaw64, s.namesPlain, s.longNames)
+	fmt.Printf("Files: %d with valid header (%d consistent with 128-bit IVs, %d with 96-bit IVs), %d invalid\n",
+		s.files, s.iv128, s.iv96, s.badFiles)
+	os.Exit(0)
+}
+
+// detectName classifies the file name "name"
+func detectName(s *detectStats, name string) {
+	if nametransform.IsLongContent(name) {
+		s.longNames++
+		return
+	}
+	if strings.HasPrefix(name, "gocryptfs.") || strings.HasPrefix(name, ".gocryptfs.") {
+		return
+	}
+	// EME operates on 16-byte blocks
+	if b, err := base64.RawURLEncoding.DecodeString(name); err == nil && len(b) > 0 && len(b)%16 == 0 {
+		s.namesRaw64++
+	} else if b, err := base64.URLEncoding.DecodeString(name); err == nil && len(b) > 0 && len(b)%16 == 0 {
+		s.namesPadded++
+	} else {
+		s.namesPlain++
+	}
+}
+
+// detectFile checks the header of the regular file "path" and whether its
+// size is consistent with 128-bit or 96-bit IVs.
+func detectFile(s *detectStats, path string, size int64) {
+	if size == 0 {
+		// Empty files have no header
+		return
+	}
+	f, err := os.Open(path)
+	if err != nil {
+		return
+	}
+	defer f.Close()
+	hdr := make([]byte, contentenc.HeaderLen)
+	_, err = f.Read(hdr)
+	if err != nil || size < contentenc.HeaderLen ||
+		binary.BigEndian.Uint16(hdr) != contentenc.CurrentVersion {
+		s.badFiles++
+		return
+	}
+	s.files++
+	// A ciphertext block is the plaintext plus IV plus 16 bytes GCM tag.
+	// A partial last block still carries the full overhead.
+	consistent := func(ivLen int64) bool {
+		overhead := ivLen + 16
+		rem := (size - contentenc.HeaderLen) % (contentenc.DefaultBS + overhead)
+		return rem == 0 || rem > overhead
+	}
+	if consistent(16) {
+		s.iv128++
+	}
+	if consistent(12) {
+		s.iv96++
+	}
+}
@@ -0,0 +1,127 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"syscall"
+	"time"
+
+	"github.com/hanwen/go-fuse/fuse"
+
+	"github.com/rfjakob/gocryptfs/internal/cryptocore"
+	"github.com/rfjakob/gocryptfs/internal/exitcodes"
+	"github.com/rfjakob/gocryptfs/internal/fusefrontend"
+	"github.com/rfjakob/gocryptfs/internal/readpassword"
+	"github.com/rfjakob/gocryptfs/internal/tlog"
+)
+
+// exportSubtree decrypts the plaintext path "args.export_subtree" of
+// CIPHERDIR into the new directory "dest", without mounting.
+// Does not return.
+func exportSubtree(args *argContainer, dest string) {
+	if args.reverse {
+		tlog.Fatal.Printf("-export-subtree does not work in reverse mode")
+		os.Exit(exitcodes.Usage)
+	}
+	if _, err := os.Lstat(dest); err == nil {
+		tlog.Fatal.Printf("Export destination %q already exists", dest)
+		os.Exit(exitcodes.Usage)
+	}
+	masterkey, confFile, err := loadConfig(args)
+	if err != nil {
+		exitcodes.Exit(err)
+	}
+	readpassword.CheckTrailingGarbage()
+	fs := fusefrontend.NewFS(masterkey, makeFrontendArgs(args, confFile))
+	cryptocore.Wipe(masterkey)
+	ctx := &fuse.Context{Owner: fuse.Owner{Uid: uint32(os.Getuid()), Gid: uint32(os.Getgid())}}
+	src := filepath.Clean("/" + args.export_subtree)[1:]
+	err = exportPath(fs, ctx, src, dest)
+	if err != nil {
+		tlog.Fatal.Printf("Export failed: %v", err)
+		os.Exit(exitcodes.Other)
+	}
+	tlog.Info.Printf(tlog.ColorGreen+"Exported %q to %q"+tlog.ColorReset, "/"+src, dest)
+	os.Exit(0)
+}
+
+// exportPath decrypts the plaintext path "path" to "dest". Directories are
+// handled recursively. Modes and timestamps are preserved.
+func exportPath(fs *fusefrontend.FS, ctx *fuse.Context, path string, dest string) error {
+	a, status := fs.GetAttr(path, ctx)
+	if !status.Ok() {
+		return &os.PathError{Op: "stat", Path: "/" + path, Err: syscall.Errno(status)}
+	}
+	switch {
+	case a.IsDir():
+		// Create the directory with restrictive permissions while we fill it,
+		// the real mode is set below.
+		if err := os.Mkdir(dest, 0700); err != nil {
+			return err
+		}
+		entries, status := fs.OpenDir(path, ctx)
+		if !status.Ok() {
+			return &os.PathError{Op: "readdir", Path: "/" + path, Err: syscall.Errno(status)}
+		}
+		for _, e := range entries {
+			err := exportPath(fs, ctx, filepath.Join(path, e.Name), filepath.Join(dest, e.Name))
+			if err != nil {
+				return err
+			}
+		}
+	case a.IsRegular():
+		if err := exportFile(fs, ctx, path, dest); err != nil {
+			return err
+		}
+	case a.IsSymlink():
+		target, status := fs.Readlink(path, ctx)
+		if !status.Ok() {
+			return &os.PathError{Op: "readlink", Path: "/" + path, Err: syscall.Errno(status)}
+		}
+		// Symlinks have no mode and we do not bother with their timestamps
+		return os.Symlink(target, dest)
+	default:
+		tlog.Warn.Printf("Skipping special file %q", "/"+path)
+		return nil
+	}
+	if err := syscall.Chmod(dest, a.Mode&07777); err != nil {
+		return err
+	}
+	atime := time.Unix(int64(a.Atime), int64(a.Atimensec))
+	mtime := time.Unix(int64(a.Mtime), int64(a.Mtimensec))
+	return os.Chtimes(dest, atime, mtime)
+}
+
+// exportFile decrypts the contents of the regular file "path" to "dest".
+func exportFile(fs *fusefrontend.FS, ctx *fuse.Context, path string, dest string) error {
+	f, status := fs.Open(path, syscall.O_RDONLY, ctx)
+	if !status.Ok() {
+		return &os.PathError{Op: "open", Path: "/" + path, Err: syscall.Errno(status)}
+	}
+	defer f.Release()
+	out, err := os.OpenFile(dest, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	if err != nil {
+		return err
+	}
+	buf := make([]byte, 128*1024)
+	var off int64
+	for {
+		res, status := f.Read(buf, off)
+		if !status.Ok() {
+			out.Close()
+			return &os.PathError{Op: "read", Path: "/" + path, Err: syscall.Errno(status)}
+		}
+		data, _ := res.Bytes(buf)
+		res.Done()
+		if len(data) == 0 {
+			break
+		}
+		_, err = out.Write(data)
+		if err != nil {
+			out.Close()
+			return err
+		}
+		off += int64(len(data))
+	}
+	return out.Close()
+}
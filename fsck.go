@@ -0,0 +1,258 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	"github.com/rfjakob/gocryptfs/internal/contentenc"
+	"github.com/rfjakob/gocryptfs/internal/cryptocore"
+	"github.com/rfjakob/gocryptfs/internal/exitcodes"
+	"github.com/rfjakob/gocryptfs/internal/fusefrontend"
+	"github.com/rfjakob/gocryptfs/internal/nametransform"
+	"github.com/rfjakob/gocryptfs/internal/readpassword"
+	"github.com/rfjakob/gocryptfs/internal/seal"
+	"github.com/rfjakob/gocryptfs/internal/tlog"
+)
+
+type fsckObj struct {
+	args          *argContainer
+	contentEnc    *contentenc.ContentEnc
+	nameTransform *nametransform.NameTransform
+	// plaintextNames is set if the filesystem has no name encryption and no
+	// DirIVs
+	plaintextNames bool
+	// problems is the number of problems found
+	problems int
+	// files and dirs are the number of checked files and directories
+	files, dirs int
+	// sealKey is the HMAC key for gocryptfs.seal files
+	sealKey []byte
+	// sealed is set if the root directory has a gocryptfs.seal file
+	// ("-reverse-seal") or if "-require-seal" was passed. Every directory
+	// must have one then.
+	sealed bool
+}
+
+// report prints a problem with "cPath" (relative ciphertext path) and counts
+// it.
+func (ck *fsckObj) report(cPath string, format string, a ...interface{}) {
+	ck.problems++
+	fmt.Printf("fsck: %q: %s\n", "/"+cPath, fmt.Sprintf(format, a...))
+}
+
+// fsck checks the integrity of CIPHERDIR without mounting and without modifying
+// anything: every block of every file must pass authentication, every
+// directory must have a valid gocryptfs.diriv and every file name must
+// decrypt.
+// This is called when you pass the "-fsck" option.
+// Does not return.
+func fsck(args *argContainer) {
+	if args.reverse {
+		tlog.Fatal.Printf("-fsck does not work in reverse mode")
+		os.Exit(exitcodes.Usage)
+	}
+	masterkey, confFile, err := loadConfig(args)
+	if err != nil {
+		exitcodes.Exit(err)
+	}
+	readpassword.CheckTrailingGarbage()
+	fa := makeFrontendArgs(args, confFile)
+	cc := cryptocore.New(masterkey, fa.CryptoBackend, contentenc.DefaultIVBits, fa.HKDF, false)
+	cryptocore.Wipe(masterkey)
+	ck := fsckObj{
+		args:           args,
+		contentEnc:     contentenc.New(cc, contentenc.DefaultBS, false),
+		nameTransform:  nametransform.New(cc.EMECipher, fa.LongNames, fa.Raw64),
+		plaintextNames: fa.PlaintextNames,
+		sealKey:        cc.SealKey,
+	}
+	if args.require_seal {
+		ck.sealed = true
+	} else if _, err = os.Lstat(filepath.Join(args.cipherdir, seal.Filename)); err == nil {
+		ck.sealed = true
+		tlog.Info.Printf("fsck: found %s, checking the seal of every directory", seal.Filename)
+	}
+	// We report all problems ourselves, silence the warnings of the
+	// decryption functions
+	tlog.Warn.Enabled = false
+	ck.dir("")
+	tlog.Warn.Enabled = true
+	if ck.problems > 0 {
+		tlog.Fatal.Printf("fsck: checked %d directories and %d files, found %d problem(s)",
+			ck.dirs, ck.files, ck.problems)
+		os.Exit(exitcodes.FsckErrors)
+	}
+	tlog.Info.Printf(tlog.ColorGreen+"fsck: checked %d directories and %d files, no problems found"+
+		tlog.ColorReset, ck.dirs, ck.files)
+	os.Exit(0)
+}
+
+// dir checks the directory "cPath" (relative ciphertext path) and everything
+// below it.
+func (ck *fsckObj) dir(cPath string) {
+	ck.dirs++
+	absPath := filepath.Join(ck.args.cipherdir, cPath)
+	entries, err := ioutil.ReadDir(absPath)
+	if err != nil {
+		ck.report(cPath, "readdir failed: %v", err)
+		return
+	}
+	if ck.sealed {
+		ck.checkSeal(cPath)
+	}
+	var iv []byte
+	if !ck.plaintextNames {
+		err = nametransform.RetryDirIV(func() (err error) {
+			iv, err = nametransform.ReadDirIV(absPath)
+			return err
+		})
+		// Without the IV we cannot decrypt the names, but the contents can
+		// still be checked
+		if _, ok := err.(*nametransform.DirIVMissingError); ok {
+			ck.report(cPath, "%s is missing, the names in this directory cannot be decrypted",
+				nametransform.DirIVFilename)
+		} else if err != nil {
+			ck.report(cPath, "invalid %s: %v", nametransform.DirIVFilename, err)
+		}
+	}
+	for _, e := range entries {
+		name := e.Name()
+		child := filepath.Join(cPath, name)
+		if name == seal.Filename {
+			// Without the seal of the root directory, the other seals are
+			// not checked. They only show up when it has been deleted.
+			if !ck.sealed {
+				ck.report(cPath, "has a %s, but the root directory has none", seal.Filename)
+			}
+			continue
+		}
+		if fusefrontend.IsReservedName(cPath, name, ck.plaintextNames) {
+			// The config file, gocryptfs.diriv and the long name files. The
+			// long names are checked together with the content file.
+			if name == fusefrontend.DirCommentFilename && iv != nil {
+				ck.dirComment(child, iv)
+			}
+			continue
+		}
+		if !ck.plaintextNames && iv != nil {
+			ck.name(child, iv)
+		}
+		switch {
+		case e.IsDir():
+			ck.dir(child)
+		case e.Mode().IsRegular():
+			ck.file(child)
+		case e.Mode()&os.ModeSymlink != 0:
+			ck.symlink(child)
+		}
+	}
+}
+
+// checkSeal checks the directory "cPath" against its gocryptfs.seal file.
+func (ck *fsckObj) checkSeal(cPath string) {
+	problems, err := seal.CheckDir(ck.sealKey, ck.args.cipherdir, cPath)
+	if os.IsNotExist(err) {
+		ck.report(cPath, "%s is missing", seal.Filename)
+		return
+	} else if err != nil {
+		ck.report(cPath, "could not read %s: %v", seal.Filename, err)
+		return
+	}
+	for _, p := range problems {
+		ck.report(p.Path, "seal check failed: %s", p.Msg)
+	}
+}
+
+// name checks that the last path element of "cPath" decrypts using "iv".
+func (ck *fsckObj) name(cPath string, iv []byte) {
+	cName := filepath.Base(cPath)
+	if nametransform.IsLongContent(cName) {
+		var err error
+		cName, err = nametransform.ReadLongName(filepath.Join(ck.args.cipherdir, cPath))
+		if err != nil {
+			ck.report(cPath, "could not read long name: %v", err)
+			return
+		}
+		if ck.nameTransform.HashLongName(cName) != filepath.Base(cPath) {
+			ck.report(cPath, "long name does not match its hash")
+			return
+		}
+	}
+	if _, err := ck.nameTransform.DecryptName(cName, iv); err != nil {
+		ck.report(cPath, "could not decrypt name: %v", err)
+	}
+}
+
+// file checks the header and all blocks of the regular file "cPath".
+func (ck *fsckObj) file(cPath string) {
+	ck.files++
+	f, err := os.Open(filepath.Join(ck.args.cipherdir, cPath))
+	if err != nil {
+		ck.report(cPath, "open failed: %v", err)
+		return
+	}
+	defer f.Close()
+	// Empty files have no header
+	buf := make([]byte, contentenc.HeaderLen)
+	n, err := io.ReadFull(f, buf)
+	if n == 0 && err == io.EOF {
+		return
+	} else if err != nil {
+		ck.report(cPath, "could not read file header: %v", err)
+		return
+	}
+	header, err := contentenc.ParseHeader(buf)
+	if err != nil {
+		ck.report(cPath, "invalid file header: %v", err)
+		return
+	}
+	buf = make([]byte, ck.contentEnc.CipherBS())
+	for blockNo := uint64(0); ; blockNo++ {
+		n, err = io.ReadFull(f, buf)
+		if n == 0 && err == io.EOF {
+			return
+		} else if err != nil && err != io.ErrUnexpectedEOF {
+			ck.report(cPath, "block %d: read failed: %v", blockNo, err)
+			return
+		}
+		_, err = ck.contentEnc.DecryptBlock(buf[:n], blockNo, header.ID)
+		if err != nil {
+			ck.report(cPath, "block %d: %v", blockNo, err)
+		}
+	}
+}
+
+// symlink checks that the target of the symlink "cPath" decrypts.
+func (ck *fsckObj) symlink(cPath string) {
+	ck.files++
+	if ck.plaintextNames {
+		return
+	}
+	cTarget, err := os.Readlink(filepath.Join(ck.args.cipherdir, cPath))
+	if err != nil {
+		ck.report(cPath, "readlink failed: %v", err)
+		return
+	}
+	cBinTarget, err := ck.nameTransform.B64.DecodeString(cTarget)
+	if err == nil {
+		_, err = ck.contentEnc.DecryptBlock(cBinTarget, 0, nil)
+	}
+	if err != nil {
+		ck.report(cPath, "could not decrypt symlink target: %v", err)
+	}
+}
+
+// dirComment checks that the directory comment "cPath" decrypts using the
+// DirIV of its directory.
+func (ck *fsckObj) dirComment(cPath string, iv []byte) {
+	ciphertext, err := ioutil.ReadFile(filepath.Join(ck.args.cipherdir, cPath))
+	if err == nil {
+		_, err = ck.contentEnc.DecryptBlock(ciphertext, 0, iv)
+	}
+	if err != nil {
+		ck.report(cPath, "could not decrypt directory comment: %v", err)
+	}
+}
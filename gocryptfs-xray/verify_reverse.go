@@ -0,0 +1,117 @@
+package main
+
+import (
+	"bytes"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	"github.com/rfjakob/gocryptfs/internal/configfile"
+	"github.com/rfjakob/gocryptfs/internal/contentenc"
+	"github.com/rfjakob/gocryptfs/internal/cryptocore"
+	"github.com/rfjakob/gocryptfs/internal/exitcodes"
+	"github.com/rfjakob/gocryptfs/internal/pathiv"
+	"github.com/rfjakob/gocryptfs/internal/readpassword"
+	"github.com/rfjakob/gocryptfs/internal/tlog"
+)
+
+// verifyReverseMain handles "-verify-reverse PLAINFILE". "cipherFn" is the
+// ciphertext file as produced by reverse mode, "root" the root directory of
+// the encrypted view (or of a copy of it).
+func verifyReverseMain(plainFn string, cipherFn string, root string, masterkeyHex string, hkdf bool) {
+	if root == "" {
+		errExit(fmt.Errorf("-verify-reverse needs -root"))
+	}
+	cRelPath, err := filepath.Rel(root, cipherFn)
+	if err != nil {
+		errExit(err)
+	}
+	var masterkey []byte
+	if masterkeyHex != "" {
+		masterkey, err = hex.DecodeString(masterkeyHex)
+		if err != nil || len(masterkey) != cryptocore.KeyLen {
+			errExit(fmt.Errorf("-masterkey must be %d hex-encoded bytes", cryptocore.KeyLen))
+		}
+	} else {
+		// Reverse mode presents ".gocryptfs.reverse.conf" as "gocryptfs.conf"
+		confFn := filepath.Join(root, configfile.ConfDefaultName)
+		tlog.Info.Enabled = false
+		pw := readpassword.Once("")
+		var cf *configfile.ConfFile
+		masterkey, cf, err = configfile.LoadConfFile(confFn, pw)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			exitcodes.Exit(err)
+		}
+		hkdf = cf.IsFeatureFlagSet(configfile.FlagHKDF)
+	}
+	err = verifyReverse(masterkey, hkdf, cRelPath, plainFn, cipherFn)
+	cryptocore.Wipe(masterkey)
+	if err != nil {
+		fmt.Printf("MISMATCH: %v\n", err)
+		os.Exit(1)
+	}
+	fmt.Printf("OK: %s is the correct reverse mode encryption of %s\n", cipherFn, plainFn)
+}
+
+// verifyReverse derives what reverse mode should produce for the plaintext
+// file "plainFn" at the relative ciphertext path "cRelPath" and compares it
+// with the file "cipherFn". It uses the derivation functions directly and
+// not the reverse mode code, so it can catch bugs there.
+//
+// Note: for hard links, reverse mode uses the path that is accessed first,
+// so verifying a hard-linked file may report a mismatch.
+func verifyReverse(masterkey []byte, hkdf bool, cRelPath string, plainFn string, cipherFn string) error {
+	cc := cryptocore.New(masterkey, cryptocore.BackendAESSIV, contentenc.DefaultIVBits, hkdf, false)
+	ce := contentenc.New(cc, contentenc.DefaultBS, false)
+	plain, err := os.Open(plainFn)
+	if err != nil {
+		return err
+	}
+	defer plain.Close()
+	cipher, err := os.Open(cipherFn)
+	if err != nil {
+		return err
+	}
+	defer cipher.Close()
+	ivs := pathiv.DeriveFile(cRelPath)
+	// Empty files have no header
+	pBlock := make([]byte, contentenc.DefaultBS)
+	n, err := io.ReadFull(plain, pBlock)
+	if n == 0 {
+		rest, _ := ioutil.ReadAll(cipher)
+		if len(rest) != 0 {
+			return fmt.Errorf("plaintext is empty but ciphertext has %d bytes", len(rest))
+		}
+		return nil
+	}
+	header := contentenc.FileHeader{Version: contentenc.CurrentVersion, ID: ivs.ID}
+	cBuf := make([]byte, contentenc.HeaderLen)
+	if _, err2 := io.ReadFull(cipher, cBuf); err2 != nil || !bytes.Equal(cBuf, header.Pack()) {
+		return fmt.Errorf("file header differs")
+	}
+	for blockNo := uint64(0); n > 0; blockNo++ {
+		want := ce.EncryptBlockNonce(pBlock[:n], blockNo, ivs.ID, pathiv.BlockIV(ivs.Block0IV, blockNo))
+		cBuf = make([]byte, len(want))
+		m, _ := io.ReadFull(cipher, cBuf)
+		if m != len(want) || !bytes.Equal(cBuf, want) {
+			return fmt.Errorf("block %d (ciphertext offset %d) differs", blockNo,
+				uint64(contentenc.HeaderLen)+blockNo*ce.CipherBS())
+		}
+		if err == io.ErrUnexpectedEOF {
+			break
+		}
+		n, err = io.ReadFull(plain, pBlock)
+	}
+	if err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
+		return err
+	}
+	// The ciphertext must not be longer than expected
+	if m, _ := cipher.Read(make([]byte, 1)); m != 0 {
+		return fmt.Errorf("ciphertext is longer than expected")
+	}
+	return nil
+}
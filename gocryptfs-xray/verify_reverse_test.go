@@ -0,0 +1,150 @@
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/hanwen/go-fuse/fuse"
+
+	"github.com/rfjakob/gocryptfs/internal/configfile"
+	"github.com/rfjakob/gocryptfs/internal/cryptocore"
+	"github.com/rfjakob/gocryptfs/internal/fusefrontend"
+	"github.com/rfjakob/gocryptfs/internal/fusefrontend_reverse"
+	"github.com/rfjakob/gocryptfs/internal/nametransform"
+)
+
+// reverseEncrypt encrypts "plainFn" (which must be in "src") through
+// fusefrontend_reverse and writes the ciphertext to "cipherFn". Returns the
+// encrypted name.
+func reverseEncrypt(t *testing.T, key []byte, src string, cipherFn string) string {
+	rfs := fusefrontend_reverse.NewFS(key, fusefrontend.Args{
+		Cipherdir:     src,
+		CryptoBackend: cryptocore.BackendAESSIV,
+		HKDF:          true,
+		LongNames:     true,
+		Raw64:         true,
+	})
+	ctx := &fuse.Context{}
+	entries, status := rfs.OpenDir("", ctx)
+	if !status.Ok() {
+		t.Fatal(status)
+	}
+	var cName string
+	for _, e := range entries {
+		if e.Name != nametransform.DirIVFilename && e.Name != configfile.ConfDefaultName {
+			cName = e.Name
+		}
+	}
+	if cName == "" {
+		t.Fatal("encrypted file not found")
+	}
+	f, status := rfs.Open(cName, uint32(os.O_RDONLY), ctx)
+	if !status.Ok() {
+		t.Fatal(status)
+	}
+	defer f.Release()
+	var ciphertext []byte
+	buf := make([]byte, 4096)
+	for {
+		res, status := f.Read(buf, int64(len(ciphertext)))
+		if !status.Ok() {
+			t.Fatal(status)
+		}
+		if res == nil {
+			// EOF
+			break
+		}
+		data, status := res.Bytes(buf)
+		res.Done()
+		if !status.Ok() {
+			t.Fatal(status)
+		}
+		if len(data) == 0 {
+			break
+		}
+		ciphertext = append(ciphertext, data...)
+	}
+	if err := ioutil.WriteFile(cipherFn, ciphertext, 0600); err != nil {
+		t.Fatal(err)
+	}
+	return cName
+}
+
+func TestVerifyReverse(t *testing.T) {
+	tmp, err := ioutil.TempDir("", "xray_verify_reverse")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmp)
+	src := filepath.Join(tmp, "src")
+	if err = os.Mkdir(src, 0700); err != nil {
+		t.Fatal(err)
+	}
+	key := bytes.Repeat([]byte{0x12}, cryptocore.KeyLen)
+	// 3.5 blocks, so the last block is partial
+	plain := make([]byte, 3*4096+2048)
+	for i := range plain {
+		plain[i] = byte(i * 7)
+	}
+	plainFn := filepath.Join(src, "foo")
+	if err = ioutil.WriteFile(plainFn, plain, 0600); err != nil {
+		t.Fatal(err)
+	}
+	cipherFn := filepath.Join(tmp, "ciphertext")
+	cName := reverseEncrypt(t, key, src, cipherFn)
+	if err = verifyReverse(key, true, cName, plainFn, cipherFn); err != nil {
+		t.Fatal(err)
+	}
+	// A different path means different IVs
+	if err = verifyReverse(key, true, "x/"+cName, plainFn, cipherFn); err == nil {
+		t.Error("wrong path was not detected")
+	}
+	// Flip one bit in the third block
+	ciphertext, err := ioutil.ReadFile(cipherFn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ciphertext[len(ciphertext)-3000] ^= 1
+	if err = ioutil.WriteFile(cipherFn, ciphertext, 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err = verifyReverse(key, true, cName, plainFn, cipherFn); err == nil {
+		t.Error("flipped bit was not detected")
+	}
+	// Truncated ciphertext
+	if err = os.Truncate(cipherFn, int64(len(ciphertext)-1)); err != nil {
+		t.Fatal(err)
+	}
+	if err = verifyReverse(key, true, cName, plainFn, cipherFn); err == nil {
+		t.Error("truncated ciphertext was not detected")
+	}
+}
+
+// Empty files are empty in the encrypted view too
+func TestVerifyReverseEmpty(t *testing.T) {
+	tmp, err := ioutil.TempDir("", "xray_verify_reverse")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmp)
+	plainFn := filepath.Join(tmp, "empty")
+	cipherFn := filepath.Join(tmp, "ciphertext")
+	for _, fn := range []string{plainFn, cipherFn} {
+		if err = ioutil.WriteFile(fn, nil, 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+	key := make([]byte, cryptocore.KeyLen)
+	if err = verifyReverse(key, true, "foo", plainFn, cipherFn); err != nil {
+		t.Error(err)
+	}
+	if err = ioutil.WriteFile(cipherFn, []byte{0}, 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err = verifyReverse(key, true, "foo", plainFn, cipherFn); err == nil {
+		t.Error("non-empty ciphertext was not detected")
+	}
+}
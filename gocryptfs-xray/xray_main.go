@@ -33,6 +33,13 @@ func prettyPrintHeader(h *contentenc.FileHeader) {
 
 func main() {
 	dumpmasterkey := flag.Bool("dumpmasterkey", false, "Decrypt and dump the master key")
+	verifyreverse := flag.String("verify-reverse", "", "Check that FILE is the correct reverse mode\n"+
+		"encryption of this plaintext file")
+	root := flag.String("root", "", "Root of the reverse mode encrypted view that FILE is in,\n"+
+		"used by -verify-reverse")
+	masterkey := flag.String("masterkey", "", "Use this master key (hex) for -verify-reverse instead of\n"+
+		"asking for the password")
+	hkdf := flag.Bool("hkdf", true, "Use HKDF key derivation, used with -masterkey")
 	flag.Parse()
 	if flag.NArg() != 1 {
 		fmt.Fprintf(os.Stderr, "Usage: %s [OPTIONS] FILE\n"+
@@ -42,7 +49,8 @@ func main() {
 		fmt.Fprintf(os.Stderr, "\n"+
 			"Examples:\n"+
 			"  gocryptfs-xray myfs/mCXnISiv7nEmyc0glGuhTQ\n"+
-			"  gocryptfs-xray -dumpmasterkey myfs/gocryptfs.conf\n")
+			"  gocryptfs-xray -dumpmasterkey myfs/gocryptfs.conf\n"+
+			"  gocryptfs-xray -verify-reverse plain/foo -root cipher cipher/mCXnISiv7nEmyc0glGuhTQ\n")
 		os.Exit(1)
 	}
 	fn := flag.Arg(0)
@@ -53,6 +61,8 @@ func main() {
 	defer fd.Close()
 	if *dumpmasterkey {
 		dumpMasterKey(fn)
+	} else if *verifyreverse != "" {
+		verifyReverseMain(*verifyreverse, fn, *root, *masterkey, *hkdf)
 	} else {
 		inspectCiphertext(fd)
 	}
@@ -7,7 +7,7 @@ import (
 )
 
 const tUsage = "" +
-	"Usage: " + tlog.ProgramName + " -init|-passwd|-info [OPTIONS] CIPHERDIR\n" +
+	"Usage: " + tlog.ProgramName + " -init|-passwd|-info|-fsck [OPTIONS] CIPHERDIR\n" +
 	"  or   " + tlog.ProgramName + " [OPTIONS] CIPHERDIR MOUNTPOINT\n"
 
 // helpShort is what gets displayed when passed "-h" or on syntax error.
@@ -19,10 +19,12 @@ func helpShort() {
 Common Options (use -hh to show all):
   -aessiv            Use AES-SIV encryption (with -init)
   -allow_other       Allow other users to access the mount
+  -check-password    Check the password without mounting
   -config            Custom path to config file
   -ctlsock           Create control socket at location
   -extpass           Call external program to prompt for the password
   -fg                Stay in the foreground
+  -fsck              Check the integrity of CIPHERDIR without mounting
   -fusedebug         Debug FUSE calls
   -h, -help          This short help text
   -hh                Long help text with all options
@@ -31,6 +33,7 @@ Common Options (use -hh to show all):
   -masterkey         Mount with explicit master key instead of password
   -nonempty          Allow mounting over non-empty directory
   -nosyslog          Do not redirect log messages to syslog
+  -passfd            Read password from file descriptor
   -passfile          Read password from file
   -passwd            Change password
   -plaintextnames    Do not encrypt file names (with -init)
@@ -38,6 +41,7 @@ Common Options (use -hh to show all):
   -reverse           Enable reverse mode
   -ro                Mount read-only
   -speed             Run crypto speed test
+  -unmount           Unmount MOUNTPOINT
   -version           Print version information
   --                 Stop option parsing
 `)
@@ -9,14 +9,16 @@ import (
 
 	"github.com/rfjakob/gocryptfs/internal/configfile"
 	"github.com/rfjakob/gocryptfs/internal/contentenc"
+	"github.com/rfjakob/gocryptfs/internal/cryptocore"
 	"github.com/rfjakob/gocryptfs/internal/exitcodes"
 	"github.com/rfjakob/gocryptfs/internal/tlog"
 )
 
 // info pretty-prints the contents of the config file at "filename" for human
-// consumption, stripping out sensitive data.
+// consumption, stripping out sensitive data. "gcm" is the GCM backend selected
+// by "-openssl", used unless the filesystem uses AES-SIV.
 // This is called when you pass the "-info" option.
-func info(filename string) {
+func info(filename string, gcm cryptocore.AEADTypeEnum) {
 	// Read from disk
 	js, err := ioutil.ReadFile(filename)
 	if err != nil {
@@ -34,12 +36,23 @@ func info(filename string) {
 		tlog.Fatal.Printf("Unsupported on-disk format %d", cf.Version)
 		os.Exit(exitcodes.LoadConf)
 	}
-	// Pretty-print
+	// Pretty-print. One "Key: value" per line so the output can be grepped.
 	fmt.Printf("Creator:      %s\n", cf.Creator)
+	fmt.Printf("Version:      %d\n", cf.Version)
 	fmt.Printf("FeatureFlags: %s\n", strings.Join(cf.FeatureFlags, " "))
 	fmt.Printf("EncryptedKey: %dB\n", len(cf.EncryptedKey))
 	s := cf.ScryptObject
-	fmt.Printf("ScryptObject: Salt=%dB N=%d R=%d P=%d KeyLen=%d\n",
-		len(s.Salt), s.N, s.R, s.P, s.KeyLen)
+	if a := cf.Argon2idObject; a != nil {
+		fmt.Printf("Argon2idObject: Salt=%dB Time=%d Memory=%dKiB Parallelism=%d KeyLen=%d\n",
+			len(a.Salt), a.Time, a.Memory, a.Parallelism, a.KeyLen)
+	} else {
+		fmt.Printf("ScryptObject: Salt=%dB N=%d LogN=%d R=%d P=%d KeyLen=%d\n",
+			len(s.Salt), s.N, s.LogN(), s.R, s.P, s.KeyLen)
+	}
+	backend := gcm
+	if cf.IsFeatureFlagSet(configfile.FlagAESSIV) {
+		backend = cryptocore.BackendAESSIV
+	}
+	fmt.Printf("Backend:      %s\n", cryptocore.BackendDescription(backend))
 	os.Exit(0)
 }
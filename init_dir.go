@@ -7,6 +7,7 @@ import (
 
 	"github.com/rfjakob/gocryptfs/internal/configfile"
 	"github.com/rfjakob/gocryptfs/internal/exitcodes"
+	"github.com/rfjakob/gocryptfs/internal/fusefrontend_reverse"
 	"github.com/rfjakob/gocryptfs/internal/nametransform"
 	"github.com/rfjakob/gocryptfs/internal/readpassword"
 	"github.com/rfjakob/gocryptfs/internal/tlog"
@@ -19,6 +20,14 @@ import (
 // not to be empty.
 func initDir(args *argContainer) {
 	var err error
+	// Initializing a new filesystem inside an existing one leads to confusing
+	// double encryption
+	if name := existingVolumeFile(args.cipherdir); name != "" && !args.force_init {
+		tlog.Fatal.Printf("Directory %q already contains a gocryptfs filesystem (found %q). "+
+			"Pass -force_init if you really want to create another one inside it.",
+			args.cipherdir, name)
+		os.Exit(exitcodes.Init)
+	}
 	if args.reverse {
 		_, err = os.Stat(args.config)
 		if err == nil {
@@ -33,13 +42,27 @@ func initDir(args *argContainer) {
 		}
 	}
 	// Choose password for config file
-	if args.extpass == "" {
+	if args.extpass == "" && args._passfd == nil && (args.keyfile == "" || args.keyfile_password) {
 		tlog.Info.Printf("Choose a password for protecting your files.")
 	}
-	password := readpassword.Twice(args.extpass)
+	password := readPasswordTwice(args)
 	readpassword.CheckTrailingGarbage()
 	creator := tlog.ProgramName + " " + GitVersion
-	err = configfile.CreateConfFile(args.config, password, args.plaintextnames, args.scryptn, creator, args.aessiv, args.devrandom)
+	createArgs := &configfile.CreateArgs{
+		Filename:       args.config,
+		Password:       password,
+		PlaintextNames: args.plaintextnames,
+		LogN:           args.scryptn,
+		Creator:        creator,
+		AESSIV:         args.aessiv,
+		Devrandom:      args.devrandom,
+		KDF:            args.kdf,
+		Keyfile:        args.keyfile != "",
+	}
+	if args.reverse {
+		createArgs.ReverseFormat = fusefrontend_reverse.CurrentReverseFormat
+	}
+	err = configfile.CreateConfFile(createArgs)
 	if err != nil {
 		tlog.Fatal.Println(err)
 		os.Exit(exitcodes.WriteConf)
@@ -75,3 +98,15 @@ func initDir(args *argContainer) {
 		tlog.ProgramName, mountArgs, friendlyPath)
 	os.Exit(0)
 }
+
+// existingVolumeFile returns the name of the first gocryptfs config or diriv
+// file found in "dir", or "" if there is none.
+func existingVolumeFile(dir string) string {
+	for _, name := range []string{configfile.ConfDefaultName, configfile.ConfReverseName,
+		nametransform.DirIVFilename} {
+		if _, err := os.Lstat(filepath.Join(dir, name)); err == nil {
+			return name
+		}
+	}
+	return ""
+}
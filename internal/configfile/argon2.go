@@ -0,0 +1,93 @@
+package configfile
+
+import (
+	"os"
+
+	"golang.org/x/crypto/argon2"
+
+	"github.com/rfjakob/gocryptfs/internal/cryptocore"
+	"github.com/rfjakob/gocryptfs/internal/exitcodes"
+	"github.com/rfjakob/gocryptfs/internal/tlog"
+)
+
+const (
+	// KDFScrypt is the name of the scrypt key derivation function. Config
+	// files without a "KDF" field use scrypt.
+	KDFScrypt = "scrypt"
+	// KDFArgon2id is the name of the Argon2id key derivation function.
+	KDFArgon2id = "argon2id"
+
+	// Argon2idDefaultTime, Argon2idDefaultMemory and
+	// Argon2idDefaultParallelism: three passes over 64MiB of memory using four
+	// threads. Like scrypt logN=16, this takes a few seconds on slow machines.
+	Argon2idDefaultTime        = 3
+	Argon2idDefaultMemory      = 64 * 1024
+	Argon2idDefaultParallelism = 4
+	// We reject all lower values that we might get through modified config
+	// files.
+	argon2idMinTime    = 1
+	argon2idMinMemory  = 8 * 1024
+	argon2idMinSaltLen = 32
+)
+
+// Argon2idKDF is an instance of the Argon2id key deriviation function.
+type Argon2idKDF struct {
+	// Salt is the random salt that is passed to Argon2id
+	Salt []byte
+	// Time is the number of passes over the memory
+	Time uint32
+	// Memory is the memory usage in KiB
+	Memory uint32
+	// Parallelism is the number of threads
+	Parallelism uint8
+	// KeyLen is the output data length
+	KeyLen uint32
+}
+
+// NewArgon2idKDF returns a new instance of Argon2idKDF with the default
+// parameters.
+func NewArgon2idKDF() Argon2idKDF {
+	return Argon2idKDF{
+		Salt:        cryptocore.RandBytes(cryptocore.KeyLen),
+		Time:        Argon2idDefaultTime,
+		Memory:      Argon2idDefaultMemory,
+		Parallelism: Argon2idDefaultParallelism,
+		KeyLen:      cryptocore.KeyLen,
+	}
+}
+
+// DeriveKey returns a new key from a supplied password.
+func (a *Argon2idKDF) DeriveKey(pw string) []byte {
+	a.validateParams()
+	pwBytes := []byte(pw)
+	k := argon2.IDKey(pwBytes, a.Salt, a.Time, a.Memory, a.Parallelism, a.KeyLen)
+	cryptocore.Wipe(pwBytes)
+	return k
+}
+
+// validateParams checks that all parameters are at or above hardcoded limits.
+// If not, it exists with an error message.
+// This makes sure we do not get weak parameters passed through a
+// rougue gocryptfs.conf.
+func (a *Argon2idKDF) validateParams() {
+	if a.Time < argon2idMinTime {
+		tlog.Fatal.Printf("Fatal: argon2id parameter Time below minimum: value=%d, min=%d", a.Time, argon2idMinTime)
+		os.Exit(exitcodes.ScryptParams)
+	}
+	if a.Memory < argon2idMinMemory {
+		tlog.Fatal.Printf("Fatal: argon2id parameter Memory below minimum: value=%d, min=%d", a.Memory, argon2idMinMemory)
+		os.Exit(exitcodes.ScryptParams)
+	}
+	if a.Parallelism < 1 {
+		tlog.Fatal.Printf("Fatal: argon2id parameter Parallelism below minimum: value=%d, min=1", a.Parallelism)
+		os.Exit(exitcodes.ScryptParams)
+	}
+	if len(a.Salt) < argon2idMinSaltLen {
+		tlog.Fatal.Printf("Fatal: argon2id salt length below minimum: value=%d, min=%d", len(a.Salt), argon2idMinSaltLen)
+		os.Exit(exitcodes.ScryptParams)
+	}
+	if a.KeyLen < cryptocore.KeyLen {
+		tlog.Fatal.Printf("Fatal: argon2id parameter KeyLen below minimum: value=%d, min=%d", a.KeyLen, cryptocore.KeyLen)
+		os.Exit(exitcodes.ScryptParams)
+	}
+}
@@ -8,6 +8,9 @@ import (
 	"io"
 	"io/ioutil"
 	"log"
+	"path/filepath"
+	"strings"
+	"syscall"
 
 	"github.com/rfjakob/gocryptfs/internal/contentenc"
 	"github.com/rfjakob/gocryptfs/internal/cryptocore"
@@ -25,8 +28,21 @@ const (
 	// the config file gets stored next to the plain-text files. Make it hidden
 	// (start with dot) to not annoy the user.
 	ConfReverseName = ".gocryptfs.reverse.conf"
+	// ConfBackupSuffix is appended to the config file name to get the name of
+	// the copy WriteFile keeps of the previous version.
+	ConfBackupSuffix = ".bak"
 )
 
+// TmpDir is where atomic writes (WriteFile and the reverse mode index) create
+// the temporary file that is then renamed over the target. Empty means the
+// directory of the target. See TmpFileDir.
+var TmpDir string
+
+// AcceptUnknownFlags makes LoadConfFile accept config files with feature flags
+// that this version does not know ("-acceptunknownflags"). IsFeatureFlagSet
+// treats them as not set.
+var AcceptUnknownFlags bool
+
 // ConfFile is the content of a config file.
 type ConfFile struct {
 	// Creator is the gocryptfs version string.
@@ -38,6 +54,13 @@ type ConfFile struct {
 	EncryptedKey []byte
 	// ScryptObject stores parameters for scrypt hashing (key derivation)
 	ScryptObject ScryptKDF
+	// KDF is the name of the password hashing algorithm, KDFScrypt or
+	// KDFArgon2id. Empty means scrypt, which is what config files created
+	// before Argon2id support was added use.
+	KDF string `json:",omitempty"`
+	// Argon2idObject stores parameters for Argon2id hashing. Only set if KDF
+	// is KDFArgon2id.
+	Argon2idObject *Argon2idKDF `json:",omitempty"`
 	// Version is the On-Disk-Format version this filesystem uses
 	Version uint16
 	// FeatureFlags is a list of feature flags this filesystem has enabled.
@@ -45,6 +68,12 @@ type ConfFile struct {
 	// mounting. This mechanism is analogous to the ext4 feature flags that are
 	// stored in the superblock.
 	FeatureFlags []string
+	// ReverseFormat pins the way reverse mode derives the ciphertext, see
+	// fusefrontend_reverse.ReverseFormatV1. Only set for reverse mode.
+	// Zero means the config file was created before this field existed,
+	// which is equivalent to format 1. Older gocryptfs versions ignore the
+	// field, which is fine as they all use format 1.
+	ReverseFormat uint16 `json:",omitempty"`
 	// Filename is the name of the config file. Not exported to JSON.
 	filename string
 }
@@ -64,19 +93,46 @@ func randBytesDevRandom(n int) []byte {
 	return b
 }
 
+// CreateArgs exists because the argument list of CreateConfFile got too long.
+type CreateArgs struct {
+	// Path of the config file to write
+	Filename string
+	// Password that encrypts the master key. Already mixed with the keyfile
+	// if Keyfile is set.
+	Password string
+	// Do not encrypt file names, "-plaintextnames"
+	PlaintextNames bool
+	// scrypt cost parameter logN, "-scryptn"
+	LogN int
+	// Program name and version that created the config file
+	Creator string
+	// Use AES-SIV instead of AES-GCM, "-aessiv"
+	AESSIV bool
+	// Read the master key from /dev/random, "-devrandom"
+	Devrandom bool
+	// Password hashing algorithm, KDFScrypt (or empty) or KDFArgon2id, "-kdf"
+	KDF string
+	// Stored as ReverseFormat. Zero for forward mode.
+	ReverseFormat uint16
+	// Sets FlagKeyfile, "-keyfile"
+	Keyfile bool
+}
+
 // CreateConfFile - create a new config with a random key encrypted with
-// "password" and write it to "filename".
-// Uses scrypt with cost parameter logN.
-func CreateConfFile(filename string, password string, plaintextNames bool, logN int, creator string, aessiv bool, devrandom bool) error {
+// "args.Password" and write it to "args.Filename".
+// Uses scrypt with cost parameter args.LogN, or Argon2id with default
+// parameters if args.KDF is KDFArgon2id.
+func CreateConfFile(args *CreateArgs) error {
 	var cf ConfFile
-	cf.filename = filename
-	cf.Creator = creator
+	cf.filename = args.Filename
+	cf.Creator = args.Creator
 	cf.Version = contentenc.CurrentVersion
+	cf.ReverseFormat = args.ReverseFormat
 
 	// Set feature flags
 	cf.FeatureFlags = append(cf.FeatureFlags, knownFlags[FlagGCMIV128])
 	cf.FeatureFlags = append(cf.FeatureFlags, knownFlags[FlagHKDF])
-	if plaintextNames {
+	if args.PlaintextNames {
 		cf.FeatureFlags = append(cf.FeatureFlags, knownFlags[FlagPlaintextNames])
 	} else {
 		cf.FeatureFlags = append(cf.FeatureFlags, knownFlags[FlagDirIV])
@@ -84,22 +140,36 @@ func CreateConfFile(filename string, password string, plaintextNames bool, logN
 		cf.FeatureFlags = append(cf.FeatureFlags, knownFlags[FlagLongNames])
 		cf.FeatureFlags = append(cf.FeatureFlags, knownFlags[FlagRaw64])
 	}
-	if aessiv {
+	if args.AESSIV {
 		cf.FeatureFlags = append(cf.FeatureFlags, knownFlags[FlagAESSIV])
 	}
+	if args.Keyfile {
+		cf.FeatureFlags = append(cf.FeatureFlags, knownFlags[FlagKeyfile])
+	}
+	switch args.KDF {
+	case "", KDFScrypt:
+	case KDFArgon2id:
+		// Older gocryptfs versions do not know the "KDF" field. The feature flag
+		// makes them refuse the config file with a clear error message.
+		cf.KDF = KDFArgon2id
+		cf.FeatureFlags = append(cf.FeatureFlags, knownFlags[FlagArgon2id])
+	default:
+		return fmt.Errorf("Unknown KDF %q", args.KDF)
+	}
 
 	// Generate new random master key
 	var key []byte
-	if devrandom {
+	if args.Devrandom {
 		key = randBytesDevRandom(cryptocore.KeyLen)
 	} else {
 		key = cryptocore.RandBytes(cryptocore.KeyLen)
 	}
 
 	// Encrypt it using the password
-	// This sets ScryptObject and EncryptedKey
+	// This sets ScryptObject or Argon2idObject and EncryptedKey
 	// Note: this looks at the FeatureFlags, so call it AFTER setting them.
-	cf.EncryptKey(key, password, logN)
+	cf.EncryptKey(key, args.Password, args.LogN)
+	cryptocore.Wipe(key)
 
 	// Write file to disk
 	return cf.WriteFile()
@@ -133,11 +203,21 @@ func LoadConfFile(filename string, password string) ([]byte, *ConfFile, error) {
 		return nil, nil, fmt.Errorf("Unsupported on-disk format %d", cf.Version)
 	}
 
-	// Check that all set feature flags are known
+	// Check that all set feature flags are known. Ignoring one may mean that
+	// we misinterpret the data on disk.
+	var unknownFlags []string
 	for _, flag := range cf.FeatureFlags {
 		if !cf.isFeatureFlagKnown(flag) {
-			return nil, nil, fmt.Errorf("Unsupported feature flag %q", flag)
+			unknownFlags = append(unknownFlags, flag)
+		}
+	}
+	if len(unknownFlags) > 0 {
+		msg := fmt.Sprintf("The filesystem uses features unknown to this version of gocryptfs: %s",
+			strings.Join(unknownFlags, ", "))
+		if !AcceptUnknownFlags {
+			return nil, nil, exitcodes.NewErr(msg+". Please upgrade gocryptfs.", exitcodes.LoadConf)
 		}
+		tlog.Warn.Printf("%s. Ignoring them because of -acceptunknownflags, files may be misinterpreted.", msg)
 	}
 
 	// Check that all required feature flags are set
@@ -168,6 +248,9 @@ func LoadConfFile(filename string, password string) ([]byte, *ConfFile, error) {
 
 		return nil, nil, fmt.Errorf("Deprecated filesystem")
 	}
+	if cf.IsFeatureFlagSet(FlagArgon2id) != (cf.KDF == KDFArgon2id) {
+		return nil, nil, fmt.Errorf("KDF %q does not match the feature flags", cf.KDF)
+	}
 	if password == "" {
 		// We have validated the config file, but without a password we cannot
 		// decrypt the master key. Return only the parsed config.
@@ -175,11 +258,15 @@ func LoadConfFile(filename string, password string) ([]byte, *ConfFile, error) {
 	}
 
 	// Generate derived key from password
-	scryptHash := cf.ScryptObject.DeriveKey(password)
+	pwHash, err := cf.derivePasswordKey(password)
+	if err != nil {
+		return nil, nil, err
+	}
 
 	// Unlock master key using password-based key
 	useHKDF := cf.IsFeatureFlagSet(FlagHKDF)
-	ce := getKeyEncrypter(scryptHash, useHKDF)
+	ce := getKeyEncrypter(pwHash, useHKDF)
+	cryptocore.Wipe(pwHash)
 
 	tlog.Warn.Enabled = false // Silence DecryptBlock() error messages on incorrect password
 	key, err := ce.DecryptBlock(cf.EncryptedKey, 0, nil)
@@ -192,53 +279,148 @@ func LoadConfFile(filename string, password string) ([]byte, *ConfFile, error) {
 	return key, &cf, err
 }
 
-// EncryptKey - encrypt "key" using an scrypt hash generated from "password"
+// derivePasswordKey hashes "password" using the KDF stored in the config file.
+func (cf *ConfFile) derivePasswordKey(password string) ([]byte, error) {
+	switch cf.KDF {
+	case "", KDFScrypt:
+		return cf.ScryptObject.DeriveKey(password), nil
+	case KDFArgon2id:
+		if cf.Argon2idObject == nil {
+			return nil, fmt.Errorf("KDF is %q, but Argon2idObject is missing", cf.KDF)
+		}
+		return cf.Argon2idObject.DeriveKey(password), nil
+	default:
+		return nil, fmt.Errorf("Unsupported KDF %q", cf.KDF)
+	}
+}
+
+// EncryptKey - encrypt "key" using a hash generated from "password"
 // and store it in cf.EncryptedKey.
-// Uses scrypt with cost parameter logN and stores the scrypt parameters in
-// cf.ScryptObject.
+// Keeps the KDF of the config file. For scrypt, uses cost parameter logN and
+// stores the scrypt parameters in cf.ScryptObject. For Argon2id, the existing
+// parameters in cf.Argon2idObject (or the defaults) are used with a new salt.
+// The parameters of the other KDF are cleared, so no stale salt is left
+// behind when the KDF has been changed.
 func (cf *ConfFile) EncryptKey(key []byte, password string, logN int) {
 	// Generate derived key from password
-	cf.ScryptObject = NewScryptKDF(logN)
-	scryptHash := cf.ScryptObject.DeriveKey(password)
+	if cf.KDF == KDFArgon2id {
+		a := NewArgon2idKDF()
+		if old := cf.Argon2idObject; old != nil {
+			a.Time, a.Memory, a.Parallelism = old.Time, old.Memory, old.Parallelism
+		}
+		cf.Argon2idObject = &a
+		cf.ScryptObject = ScryptKDF{}
+	} else {
+		cf.ScryptObject = NewScryptKDF(logN)
+		cf.Argon2idObject = nil
+	}
+	pwHash, err := cf.derivePasswordKey(password)
+	if err != nil {
+		log.Panic(err)
+	}
 
 	// Lock master key using password-based key
 	useHKDF := cf.IsFeatureFlagSet(FlagHKDF)
-	ce := getKeyEncrypter(scryptHash, useHKDF)
+	ce := getKeyEncrypter(pwHash, useHKDF)
+	cryptocore.Wipe(pwHash)
 	cf.EncryptedKey = ce.EncryptBlock(key, 0, nil)
 }
 
 // WriteFile - write out config in JSON format to file "filename.tmp"
 // then rename over "filename".
 // This way a password change atomically replaces the file.
+// The previous config file, if any, is kept as "filename.bak" because it
+// holds the only copy of the encrypted master key.
 func (cf *ConfFile) WriteFile() error {
-	tmp := cf.filename + ".tmp"
-	// 0400 permissions: gocryptfs.conf should be kept secret and never be written to.
-	fd, err := os.OpenFile(tmp, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0400)
-	if err != nil {
-		return err
-	}
 	js, err := json.MarshalIndent(cf, "", "\t")
 	if err != nil {
 		return err
 	}
 	// For convenience for the user, add a newline at the end.
 	js = append(js, '\n')
-	_, err = fd.Write(js)
+	old, err := ioutil.ReadFile(cf.filename)
+	if err == nil {
+		err = writeFileAtomic(cf.filename+ConfBackupSuffix, old)
+		if err != nil {
+			return fmt.Errorf("could not create backup of %q: %v", cf.filename, err)
+		}
+	} else if !os.IsNotExist(err) {
+		return err
+	}
+	return writeFileAtomic(cf.filename, js)
+}
+
+// writeFileAtomic writes "data" to a temporary file, fsyncs it and renames it
+// over "filename". The directory is fsynced as well so the rename survives a
+// power loss.
+func writeFileAtomic(filename string, data []byte) (err error) {
+	tmp := filepath.Join(TmpFileDir(filename), filepath.Base(filename)+".tmp")
+	// 0400 permissions: gocryptfs.conf should be kept secret and never be written to.
+	fd, err := os.OpenFile(tmp, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0400)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if err != nil {
+			os.Remove(tmp)
+		}
+	}()
+	_, err = fd.Write(data)
 	if err != nil {
+		fd.Close()
 		return err
 	}
 	err = fd.Sync()
 	if err != nil {
+		fd.Close()
 		return err
 	}
 	err = fd.Close()
 	if err != nil {
 		return err
 	}
-	err = os.Rename(tmp, cf.filename)
+	err = os.Rename(tmp, filename)
+	if err != nil {
+		return err
+	}
+	dir, err := os.Open(filepath.Dir(filename))
+	if err != nil {
+		return err
+	}
+	err = dir.Sync()
+	dir.Close()
 	return err
 }
 
+// TmpFileDir returns the directory where an atomic write creates the temporary
+// file for "filename": TmpDir if it is set and on the same filesystem as
+// "filename", the directory of "filename" otherwise.
+func TmpFileDir(filename string) string {
+	dir := filepath.Dir(filename)
+	if TmpDir == "" {
+		return dir
+	}
+	if !sameFilesystem(TmpDir, dir) {
+		tlog.Warn.Printf("Temp dir %q is not on the same filesystem as %q, rename would not be atomic. Using %q instead.",
+			TmpDir, filename, dir)
+		return dir
+	}
+	return TmpDir
+}
+
+// sameFilesystem returns true if "a" and "b" are on the same filesystem, which
+// means that rename(2) between them is atomic.
+func sameFilesystem(a string, b string) bool {
+	var stA, stB syscall.Stat_t
+	if err := syscall.Stat(a, &stA); err != nil {
+		return false
+	}
+	if err := syscall.Stat(b, &stB); err != nil {
+		return false
+	}
+	return stA.Dev == stB.Dev
+}
+
 // getKeyEncrypter is a helper function that returns the right ContentEnc
 // instance for the "useHKDF" setting.
 func getKeyEncrypter(scryptHash []byte, useHKDF bool) *contentenc.ContentEnc {
@@ -1,10 +1,15 @@
 package configfile
 
 import (
+	"bytes"
 	"fmt"
+	"io/ioutil"
+	"os"
+	"strings"
 	"testing"
 	"time"
 
+	"github.com/rfjakob/gocryptfs/internal/exitcodes"
 	"github.com/rfjakob/gocryptfs/internal/tlog"
 )
 
@@ -57,10 +62,25 @@ func TestLoadV2StrangeFeature(t *testing.T) {
 	} else if testing.Verbose() {
 		fmt.Println(err)
 	}
+	if _, ok := err.(exitcodes.Err); !ok {
+		t.Errorf("want an exitcodes.Err, got %#v", err)
+	}
+	if err != nil && !strings.Contains(err.Error(), "StrangeFeatureFlag") {
+		t.Errorf("flag name missing in error %q", err)
+	}
+	AcceptUnknownFlags = true
+	defer func() { AcceptUnknownFlags = false }()
+	_, c, err := LoadConfFile("config_test/StrangeFeature.conf", "test")
+	if err != nil {
+		t.Fatalf("-acceptunknownflags: %v", err)
+	}
+	if !c.IsFeatureFlagSet(FlagLongNames) {
+		t.Error("known flags must still work")
+	}
 }
 
 func TestCreateConfDefault(t *testing.T) {
-	err := CreateConfFile("config_test/tmp.conf", "test", false, 10, "test", false, false)
+	err := CreateConfFile(&CreateArgs{Filename: "config_test/tmp.conf", Password: "test", LogN: 10, Creator: "test"})
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -81,14 +101,14 @@ func TestCreateConfDefault(t *testing.T) {
 }
 
 func TestCreateConfDevRandom(t *testing.T) {
-	err := CreateConfFile("config_test/tmp.conf", "test", false, 10, "test", false, true)
+	err := CreateConfFile(&CreateArgs{Filename: "config_test/tmp.conf", Password: "test", LogN: 10, Creator: "test", Devrandom: true})
 	if err != nil {
 		t.Fatal(err)
 	}
 }
 
 func TestCreateConfPlaintextnames(t *testing.T) {
-	err := CreateConfFile("config_test/tmp.conf", "test", true, 10, "test", false, false)
+	err := CreateConfFile(&CreateArgs{Filename: "config_test/tmp.conf", Password: "test", PlaintextNames: true, LogN: 10, Creator: "test"})
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -109,7 +129,7 @@ func TestCreateConfPlaintextnames(t *testing.T) {
 
 // Reverse mode uses AESSIV
 func TestCreateConfFileAESSIV(t *testing.T) {
-	err := CreateConfFile("config_test/tmp.conf", "test", false, 10, "test", true, false)
+	err := CreateConfFile(&CreateArgs{Filename: "config_test/tmp.conf", Password: "test", LogN: 10, Creator: "test", AESSIV: true})
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -122,6 +142,74 @@ func TestCreateConfFileAESSIV(t *testing.T) {
 	}
 }
 
+func TestCreateConfFileKeyfile(t *testing.T) {
+	err := CreateConfFile(&CreateArgs{Filename: "config_test/tmp.conf", Password: "test", LogN: 10, Creator: "test", Keyfile: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The flag must be readable without the password
+	_, c, err := LoadConfFile("config_test/tmp.conf", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !c.IsFeatureFlagSet(FlagKeyfile) {
+		t.Error("Keyfile flag should be set but is not")
+	}
+}
+
+func TestCreateConfArgon2id(t *testing.T) {
+	err := CreateConfFile(&CreateArgs{Filename: "config_test/tmp.conf", Password: "test", LogN: 10, Creator: "test", KDF: KDFArgon2id})
+	if err != nil {
+		t.Fatal(err)
+	}
+	key, c, err := LoadConfFile("config_test/tmp.conf", "test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !c.IsFeatureFlagSet(FlagArgon2id) {
+		t.Error("Argon2id flag should be set but is not")
+	}
+	if c.KDF != KDFArgon2id || c.Argon2idObject == nil {
+		t.Fatalf("wrong KDF %q or missing Argon2idObject", c.KDF)
+	}
+	if c.Argon2idObject.Memory != Argon2idDefaultMemory {
+		t.Errorf("wrong Memory %d", c.Argon2idObject.Memory)
+	}
+	_, _, err = LoadConfFile("config_test/tmp.conf", "wrongpassword")
+	if err == nil {
+		t.Error("wrong password was accepted")
+	}
+	// Changing the password (what "-passwd" does) must keep the KDF and its
+	// parameters
+	c.Argon2idObject.Memory = 2 * Argon2idDefaultMemory
+	oldSalt := c.Argon2idObject.Salt
+	c.EncryptKey(key, "test2", c.ScryptObject.LogN())
+	if c.KDF != KDFArgon2id || c.Argon2idObject.Memory != 2*Argon2idDefaultMemory {
+		t.Errorf("KDF was not preserved: %q %#v", c.KDF, c.Argon2idObject)
+	}
+	if bytes.Equal(oldSalt, c.Argon2idObject.Salt) {
+		t.Error("salt was not renewed")
+	}
+	err = c.WriteFile()
+	if err != nil {
+		t.Fatal(err)
+	}
+	key2, _, err := LoadConfFile("config_test/tmp.conf", "test2")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(key, key2) {
+		t.Error("master key changed")
+	}
+}
+
+func TestCreateConfUnknownKDF(t *testing.T) {
+	err := CreateConfFile(&CreateArgs{Filename: "config_test/tmp.conf", Password: "test", LogN: 10, Creator: "test", KDF: "md5"})
+	if err == nil {
+		t.Error("unknown KDF was accepted")
+	}
+}
+
 func TestIsFeatureFlagKnown(t *testing.T) {
 	// Test a few hardcoded values
 	testKnownFlags := []string{"DirIV", "PlaintextNames", "EMENames", "GCMIV128", "LongNames", "AESSIV"}
@@ -143,3 +231,125 @@ func TestIsFeatureFlagKnown(t *testing.T) {
 		t.Errorf("flag %q should be NOT known", f)
 	}
 }
+
+func TestSetFeatureFlag(t *testing.T) {
+	flag, ok := FeatureFlagByName("LongNames")
+	if !ok || flag != FlagLongNames {
+		t.Fatalf("FeatureFlagByName returned %v, %v", flag, ok)
+	}
+	if _, ok = FeatureFlagByName("StrangeFeatureFlag"); ok {
+		t.Error("unknown flag was found")
+	}
+	cf := ConfFile{FeatureFlags: []string{"GCMIV128", "LongNames", "HKDF"}}
+	cf.SetFeatureFlag(FlagLongNames, false)
+	cf.SetFeatureFlag(FlagRaw64, true)
+	cf.SetFeatureFlag(FlagRaw64, true)
+	if have := strings.Join(cf.FeatureFlags, ","); have != "GCMIV128,HKDF,Raw64" {
+		t.Errorf("wrong flags %q", have)
+	}
+}
+
+// TestWriteFileTmpDir checks that WriteFile works with a custom TmpDir and
+// does not leave the temporary file behind.
+func TestWriteFileTmpDir(t *testing.T) {
+	dir, err := ioutil.TempDir("config_test", "tmpdir")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	TmpDir = dir
+	defer func() { TmpDir = "" }()
+	err = CreateConfFile(&CreateArgs{Filename: "config_test/tmp.conf", Password: "test", LogN: 10, Creator: "test"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, _, err = LoadConfFile("config_test/tmp.conf", "test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	entries, err := ioutil.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 0 {
+		t.Errorf("temp dir should be empty, has %d entries", len(entries))
+	}
+}
+
+// TestTmpFileDir checks that TmpFileDir only returns TmpDir if it is on the
+// same filesystem as the target
+func TestTmpFileDir(t *testing.T) {
+	dir, err := ioutil.TempDir("config_test", "tmpdir")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	defer func() { TmpDir = "" }()
+	for _, tc := range []struct {
+		tmpDir string
+		want   string
+	}{
+		{"", "config_test"},
+		{dir, dir},
+		// Different filesystem, rename would not be atomic
+		{"/proc", "config_test"},
+	} {
+		TmpDir = tc.tmpDir
+		if got := TmpFileDir("config_test/tmp.conf"); got != tc.want {
+			t.Errorf("TmpDir=%q: want %q, got %q", tc.tmpDir, tc.want, got)
+		}
+	}
+}
+
+// TestWriteFileBackup checks that WriteFile keeps the previous config file
+// as ".bak" and leaves no temporary files behind.
+func TestWriteFileBackup(t *testing.T) {
+	dir, err := ioutil.TempDir("config_test", "backup")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	fn := dir + "/gocryptfs.conf"
+	err = CreateConfFile(&CreateArgs{Filename: fn, Password: "test", LogN: 10, Creator: "test"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Nothing to back up on the first write
+	if _, err = os.Stat(fn + ConfBackupSuffix); !os.IsNotExist(err) {
+		t.Errorf("unexpected backup file: %v", err)
+	}
+	key, cf, err := LoadConfFile(fn, "test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 2; i++ {
+		prev, err := ioutil.ReadFile(fn)
+		if err != nil {
+			t.Fatal(err)
+		}
+		cf.EncryptKey(key, fmt.Sprintf("new%d", i), 10)
+		if err = cf.WriteFile(); err != nil {
+			t.Fatal(err)
+		}
+		bak, err := ioutil.ReadFile(fn + ConfBackupSuffix)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(bak, prev) {
+			t.Errorf("round %d: backup does not match the previous config", i)
+		}
+	}
+	if _, _, err = LoadConfFile(fn, "new1"); err != nil {
+		t.Error(err)
+	}
+	if _, _, err = LoadConfFile(fn+ConfBackupSuffix, "new0"); err != nil {
+		t.Error(err)
+	}
+	entries, err := ioutil.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 2 {
+		t.Errorf("want config and backup, have %d entries", len(entries))
+	}
+}
@@ -22,9 +22,16 @@ const (
 	// FlagHKDF enables HKDF-derived keys for use with GCM, EME and SIV
 	// instead of directly using the master key (GCM and EME) or the SHA-512
 	// hashed master key (SIV).
-	// Note that this flag does not change the password hashing algorithm
-	// which always is scrypt.
+	// Note that this flag does not change the password hashing algorithm,
+	// see FlagArgon2id for that.
 	FlagHKDF
+	// FlagArgon2id indicates that the master key is encrypted using an
+	// Argon2id hash of the password instead of scrypt.
+	FlagArgon2id
+	// FlagKeyfile indicates that the master key can only be unlocked with
+	// the keyfile ("-keyfile"), which is mixed into the password before
+	// hashing.
+	FlagKeyfile
 )
 
 // knownFlags stores the known feature flags and their string representation
@@ -37,6 +44,8 @@ var knownFlags = map[flagIota]string{
 	FlagAESSIV:         "AESSIV",
 	FlagRaw64:          "Raw64",
 	FlagHKDF:           "HKDF",
+	FlagArgon2id:       "Argon2id",
+	FlagKeyfile:        "Keyfile",
 }
 
 // Filesystems that do not have these feature flags set are deprecated.
@@ -72,3 +81,35 @@ func (cf *ConfFile) IsFeatureFlagSet(flagWant flagIota) bool {
 	}
 	return false
 }
+
+// FeatureFlagByName returns the feature flag called "name", for example
+// "HKDF". The second return value is false if there is no such flag.
+func FeatureFlagByName(name string) (flagIota, bool) {
+	for flag, flagName := range knownFlags {
+		if flagName == name {
+			return flag, true
+		}
+	}
+	return 0, false
+}
+
+// SetFeatureFlag enables ("on" = true) or disables the feature flag "flag".
+// This only edits the list. The caller must make sure that the filesystem
+// can still be read with the new flags.
+func (cf *ConfFile) SetFeatureFlag(flag flagIota, on bool) {
+	if cf.IsFeatureFlagSet(flag) == on {
+		return
+	}
+	flagString := knownFlags[flag]
+	if on {
+		cf.FeatureFlags = append(cf.FeatureFlags, flagString)
+		return
+	}
+	var flags []string
+	for _, f := range cf.FeatureFlags {
+		if f != flagString {
+			flags = append(flags, f)
+		}
+	}
+	cf.FeatureFlags = flags
+}
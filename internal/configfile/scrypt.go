@@ -64,7 +64,9 @@ func NewScryptKDF(logN int) ScryptKDF {
 func (s *ScryptKDF) DeriveKey(pw string) []byte {
 	s.validateParams()
 
-	k, err := scrypt.Key([]byte(pw), s.Salt, s.N, s.R, s.P, s.KeyLen)
+	pwBytes := []byte(pw)
+	k, err := scrypt.Key(pwBytes, s.Salt, s.N, s.R, s.P, s.KeyLen)
+	cryptocore.Wipe(pwBytes)
 	if err != nil {
 		log.Panicf("DeriveKey failed: %v", err)
 	}
@@ -0,0 +1,122 @@
+package contentenc
+
+import (
+	"container/list"
+	"sync"
+)
+
+type blockCacheKey struct {
+	// fileID is the file ID from the file header, converted to a string so
+	// it can be used as a map key
+	fileID  string
+	blockNo uint64
+}
+
+type blockCacheEntry struct {
+	key blockCacheKey
+	// plaintext of the block. Never modified after it has been stored.
+	plaintext []byte
+}
+
+// blockCache is an LRU cache of decrypted blocks, bounded by the total size
+// of the cached plaintext.
+type blockCache struct {
+	// data in the cache, indexed by file ID and block number, so that
+	// invalidateFile does not have to scan the whole cache. The values are
+	// elements of "lru".
+	data map[string]map[uint64]*list.Element
+	// lru holds *blockCacheEntry values, most recently used first
+	lru *list.List
+	// maxBytes is the capacity, curBytes the current size
+	maxBytes, curBytes uint64
+	// hits and misses count the lookups, for tests and benchmarks
+	hits, misses uint64
+
+	sync.Mutex
+}
+
+func newBlockCache(maxBytes uint64) *blockCache {
+	return &blockCache{
+		data:     make(map[string]map[uint64]*list.Element),
+		lru:      list.New(),
+		maxBytes: maxBytes,
+	}
+}
+
+// get returns the cached plaintext of block "blockNo" of file "fileID", or nil.
+// The caller must not modify the returned slice.
+func (c *blockCache) get(fileID []byte, blockNo uint64) []byte {
+	c.Lock()
+	defer c.Unlock()
+	e := c.data[string(fileID)][blockNo]
+	if e == nil {
+		c.misses++
+		return nil
+	}
+	c.hits++
+	c.lru.MoveToFront(e)
+	return e.Value.(*blockCacheEntry).plaintext
+}
+
+// put stores a copy of "plaintext" as block "blockNo" of file "fileID".
+// If "unchanged" is not nil, the block is only stored if it returns true.
+func (c *blockCache) put(fileID []byte, blockNo uint64, plaintext []byte, unchanged func() bool) {
+	if uint64(len(plaintext)) > c.maxBytes {
+		return
+	}
+	key := blockCacheKey{string(fileID), blockNo}
+	c.Lock()
+	defer c.Unlock()
+	if unchanged != nil && !unchanged() {
+		// A writer may have invalidated the block after the ciphertext
+		// was read
+		return
+	}
+	if e := c.data[key.fileID][blockNo]; e != nil {
+		c.remove(e)
+	}
+	for c.curBytes+uint64(len(plaintext)) > c.maxBytes {
+		c.remove(c.lru.Back())
+	}
+	blocks := c.data[key.fileID]
+	if blocks == nil {
+		blocks = make(map[uint64]*list.Element)
+		c.data[key.fileID] = blocks
+	}
+	entry := &blockCacheEntry{key, append([]byte{}, plaintext...)}
+	blocks[blockNo] = c.lru.PushFront(entry)
+	c.curBytes += uint64(len(plaintext))
+}
+
+// remove drops the list element "e" from the cache. Must be called with the
+// lock held.
+func (c *blockCache) remove(e *list.Element) {
+	entry := e.Value.(*blockCacheEntry)
+	blocks := c.data[entry.key.fileID]
+	delete(blocks, entry.key.blockNo)
+	if len(blocks) == 0 {
+		delete(c.data, entry.key.fileID)
+	}
+	c.lru.Remove(e)
+	c.curBytes -= uint64(len(entry.plaintext))
+}
+
+// invalidate drops "count" blocks of file "fileID", starting at "firstBlockNo".
+func (c *blockCache) invalidate(fileID []byte, firstBlockNo uint64, count int) {
+	c.Lock()
+	defer c.Unlock()
+	for i := 0; i < count; i++ {
+		if e := c.data[string(fileID)][firstBlockNo+uint64(i)]; e != nil {
+			c.remove(e)
+		}
+	}
+}
+
+// invalidateFile drops all blocks of file "fileID".
+func (c *blockCache) invalidateFile(fileID []byte) {
+	c.Lock()
+	defer c.Unlock()
+	for _, e := range c.data[string(fileID)] {
+		c.remove(e)
+	}
+}
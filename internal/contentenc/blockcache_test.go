@@ -0,0 +1,138 @@
+package contentenc
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/rfjakob/gocryptfs/internal/cryptocore"
+)
+
+func newTestContentEnc(cacheBytes uint64) *ContentEnc {
+	key := make([]byte, cryptocore.KeyLen)
+	cc := cryptocore.New(key, cryptocore.BackendGoGCM, DefaultIVBits, true, false)
+	ce := New(cc, DefaultBS, false)
+	ce.SetBlockCache(cacheBytes)
+	return ce
+}
+
+// testBlocks returns "n" plaintext blocks filled with "b"
+func testBlocks(n int, b byte) [][]byte {
+	blocks := make([][]byte, n)
+	for i := range blocks {
+		blocks[i] = bytes.Repeat([]byte{b}, DefaultBS)
+	}
+	return blocks
+}
+
+// Writing a block through EncryptBlocks must invalidate the cached plaintext
+func TestBlockCacheWriteInvalidates(t *testing.T) {
+	ce := newTestContentEnc(1024 * 1024)
+	fileID := RandomHeader().ID
+	cOld := append([]byte{}, ce.EncryptBlocks(testBlocks(2, 'a'), 0, fileID)...)
+	for i := 0; i < 2; i++ {
+		p, err := ce.DecryptBlocks(cOld, 0, fileID)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(p, bytes.Join(testBlocks(2, 'a'), nil)) {
+			t.Fatalf("round %d: wrong plaintext", i)
+		}
+	}
+	if ce.blockCache.hits != 2 || ce.blockCache.misses != 2 {
+		t.Errorf("want 2 hits and 2 misses, got %d and %d", ce.blockCache.hits, ce.blockCache.misses)
+	}
+	// Overwrite block 1
+	cNew := ce.EncryptBlocks(testBlocks(1, 'b'), 1, fileID)
+	p, err := ce.DecryptBlocks(append(cOld[:ce.CipherBS()], cNew...), 0, fileID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(p[DefaultBS:], testBlocks(1, 'b')[0]) {
+		t.Error("stale block returned after write")
+	}
+	if !bytes.Equal(p[:DefaultBS], testBlocks(1, 'a')[0]) {
+		t.Error("block 0 was corrupted")
+	}
+	// Other files must not be affected
+	if ce.blockCache.get(RandomHeader().ID, 0) != nil {
+		t.Error("cache hit for a different file ID")
+	}
+	ce.InvalidateFile(fileID)
+	if ce.blockCache.lru.Len() != 0 || len(ce.blockCache.data) != 0 || ce.blockCache.curBytes != 0 {
+		t.Errorf("InvalidateFile left %d entries, %d bytes", ce.blockCache.lru.Len(), ce.blockCache.curBytes)
+	}
+}
+
+// InvalidateFile must only drop the blocks of the given file
+func TestBlockCacheInvalidateFile(t *testing.T) {
+	ce := newTestContentEnc(1024 * 1024)
+	id1 := RandomHeader().ID
+	id2 := RandomHeader().ID
+	for _, id := range [][]byte{id1, id2} {
+		if _, err := ce.DecryptBlocks(ce.EncryptBlocks(testBlocks(3, 'x'), 0, id), 0, id); err != nil {
+			t.Fatal(err)
+		}
+	}
+	c := ce.blockCache
+	ce.InvalidateFile(id1)
+	if c.get(id1, 0) != nil {
+		t.Error("block of the invalidated file is still cached")
+	}
+	if c.lru.Len() != 3 || c.curBytes != 3*DefaultBS {
+		t.Errorf("want 3 entries, have %d entries with %d bytes", c.lru.Len(), c.curBytes)
+	}
+	for i := uint64(0); i < 3; i++ {
+		if c.get(id2, i) == nil {
+			t.Errorf("block %d of the other file was dropped", i)
+		}
+	}
+}
+
+// The cache must not grow beyond its byte limit
+func TestBlockCacheEviction(t *testing.T) {
+	ce := newTestContentEnc(3 * DefaultBS)
+	fileID := RandomHeader().ID
+	ciphertext := ce.EncryptBlocks(testBlocks(10, 'x'), 0, fileID)
+	_, err := ce.DecryptBlocks(ciphertext, 0, fileID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c := ce.blockCache
+	if c.lru.Len() != 3 || len(c.data[string(fileID)]) != 3 || c.curBytes != 3*DefaultBS {
+		t.Errorf("want 3 entries, have %d entries with %d bytes", c.lru.Len(), c.curBytes)
+	}
+	// The most recently used blocks are kept
+	if c.get(fileID, 9) == nil || c.get(fileID, 0) != nil {
+		t.Error("wrong blocks were evicted")
+	}
+}
+
+// benchmarkRepeatedRead reads the same 16 blocks again and again and reports
+// how many blocks had to be decrypted.
+func benchmarkRepeatedRead(b *testing.B, cacheBytes uint64) {
+	ce := newTestContentEnc(cacheBytes)
+	fileID := RandomHeader().ID
+	ciphertext := append([]byte{}, ce.EncryptBlocks(testBlocks(16, 'x'), 0, fileID)...)
+	b.SetBytes(int64(len(ciphertext)))
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		p, err := ce.DecryptBlocks(ciphertext, 0, fileID)
+		if err != nil {
+			b.Fatal(err)
+		}
+		ce.PReqPool.Put(p)
+	}
+	decrypts := b.N * 16
+	if ce.blockCache != nil {
+		decrypts = int(ce.blockCache.misses)
+	}
+	b.Logf("N=%d: %d block decrypts", b.N, decrypts)
+}
+
+func BenchmarkRepeatedReadNoCache(b *testing.B) {
+	benchmarkRepeatedRead(b, 0)
+}
+
+func BenchmarkRepeatedReadBlockCache(b *testing.B) {
+	benchmarkRepeatedRead(b, 1024*1024)
+}
@@ -67,6 +67,8 @@ type ContentEnc struct {
 	CReqPool bPool
 	// Plaintext request data pool. Slice have size fuse.MAX_KERNEL_WRITE.
 	PReqPool bPool
+	// Cache of decrypted blocks, "-blockcache". nil if disabled.
+	blockCache *blockCache
 }
 
 // New returns an initialized ContentEnc instance.
@@ -105,30 +107,99 @@ func (be *ContentEnc) CipherBS() uint64 {
 	return be.cipherBS
 }
 
-// DecryptBlocks decrypts a number of blocks
+// SetBlockCache enables a cache of up to "maxBytes" of decrypted blocks for
+// DecryptBlocks. Zero disables the cache.
+// The cache is keyed by file ID and block number. The caller must call
+// InvalidateFile when the blocks of a file change in any other way than
+// through EncryptBlocks, for example when the file is truncated.
+func (be *ContentEnc) SetBlockCache(maxBytes uint64) {
+	if maxBytes == 0 {
+		be.blockCache = nil
+		return
+	}
+	be.blockCache = newBlockCache(maxBytes)
+}
+
+// InvalidateFile drops the cached blocks of file "fileID".
+func (be *ContentEnc) InvalidateFile(fileID []byte) {
+	if be.blockCache != nil && fileID != nil {
+		be.blockCache.invalidateFile(fileID)
+	}
+}
+
+// DecryptBlocks decrypts a number of blocks. Large requests are decrypted in
+// parallel, see parallelBlocks.
+//
+// On error, the returned plaintext contains the blocks before the corrupt one.
 func (be *ContentEnc) DecryptBlocks(ciphertext []byte, firstBlockNo uint64, fileID []byte) ([]byte, error) {
+	return be.DecryptBlocksIfUnchanged(ciphertext, firstBlockNo, fileID, nil)
+}
+
+// DecryptBlocksIfUnchanged is DecryptBlocks for callers that read the
+// ciphertext without excluding concurrent writers. The decrypted blocks are
+// only stored in the block cache if "unchanged" returns true. It is called
+// with the cache locked, so a writer that invalidates the blocks afterwards
+// is guaranteed to remove them again. nil means always.
+func (be *ContentEnc) DecryptBlocksIfUnchanged(ciphertext []byte, firstBlockNo uint64, fileID []byte, unchanged func() bool) ([]byte, error) {
 	cBuf := bytes.NewBuffer(ciphertext)
+	var cBlocks [][]byte
+	for cBuf.Len() > 0 {
+		cBlocks = append(cBlocks, cBuf.Next(int(be.cipherBS)))
+	}
+	pBlocks := make([][]byte, len(cBlocks))
+	errs := make([]error, len(cBlocks))
+	parallelBlocks(len(cBlocks), func(low, high int) {
+		for i := low; i < high; i++ {
+			pBlocks[i], errs[i] = be.decryptBlockCached(cBlocks[i], firstBlockNo+uint64(i), fileID, unchanged)
+		}
+	})
+	// Reassemble in order
 	var err error
+	// forced is set if forcedecode let a corrupt block through
+	var forced bool
 	pBuf := bytes.NewBuffer(be.PReqPool.Get()[:0])
-	blockNo := firstBlockNo
-	for cBuf.Len() > 0 {
-		cBlock := cBuf.Next(int(be.cipherBS))
-		var pBlock []byte
-		pBlock, err = be.DecryptBlock(cBlock, blockNo, fileID)
+	for i, pBlock := range pBlocks {
 		if err != nil {
-			if be.forceDecode && err == stupidgcm.ErrAuth {
-				tlog.Warn.Printf("DecryptBlocks: authentication failure in block #%d, overridden by forcedecode", firstBlockNo)
+			// Stopped at a corrupt block, only return the memory
+			if pBlock != nil {
+				be.pBlockPool.Put(pBlock)
+			}
+			continue
+		}
+		if errs[i] != nil {
+			if be.forceDecode && errs[i] == stupidgcm.ErrAuth {
+				tlog.Warn.Printf("DecryptBlocks: authentication failure in block #%d, overridden by forcedecode", firstBlockNo+uint64(i))
+				forced = true
 			} else {
-				break
+				err = errs[i]
+				continue
 			}
 		}
 		pBuf.Write(pBlock)
 		be.pBlockPool.Put(pBlock)
-		blockNo++
+	}
+	if err == nil && forced {
+		err = stupidgcm.ErrAuth
 	}
 	return pBuf.Bytes(), err
 }
 
+// decryptBlockCached is DecryptBlock with a block cache lookup. The returned
+// slice comes from pBlockPool (or is nil on a hard error).
+func (be *ContentEnc) decryptBlockCached(ciphertext []byte, blockNo uint64, fileID []byte, unchanged func() bool) ([]byte, error) {
+	if be.blockCache != nil {
+		if cached := be.blockCache.get(fileID, blockNo); cached != nil {
+			pBlock := be.pBlockPool.Get()
+			return pBlock[:copy(pBlock, cached)], nil
+		}
+	}
+	pBlock, err := be.DecryptBlock(ciphertext, blockNo, fileID)
+	if err == nil && be.blockCache != nil {
+		be.blockCache.put(fileID, blockNo, pBlock, unchanged)
+	}
+	return pBlock, err
+}
+
 // concatAD concatenates the block number and the file ID to a byte blob
 // that can be passed to AES-GCM as associated data (AD).
 // Result is: aData = blockNo.bigEndian + fileID.
@@ -196,41 +267,55 @@ func (be *ContentEnc) DecryptBlock(ciphertext []byte, blockNo uint64, fileID []b
 	return plaintext, nil
 }
 
-// At some point, splitting the ciphertext into more groups will not improve
-// performance, as spawning goroutines comes at a cost.
-// 2 seems to work ok for now.
-const encryptMaxSplit = 2
+// parallelMinBlocks is the request size (in blocks) above which
+// EncryptBlocks and DecryptBlocks spread the work over all CPUs. For small
+// requests, spawning goroutines costs more than it saves.
+const parallelMinBlocks = 4
+
+// parallelBlocks splits the blocks 0...n-1 into consecutive groups and calls
+// "fn" for each group [low, high). The groups run in parallel if "n" is larger
+// than parallelMinBlocks and GOMAXPROCS allows it. Returns when all calls
+// have finished.
+func parallelBlocks(n int, fn func(low, high int)) {
+	ncpu := runtime.GOMAXPROCS(0)
+	if n <= parallelMinBlocks || ncpu == 1 {
+		fn(0, n)
+		return
+	}
+	if ncpu > n {
+		ncpu = n
+	}
+	groupSize := n / ncpu
+	var wg sync.WaitGroup
+	for i := 0; i < ncpu; i++ {
+		wg.Add(1)
+		go func(i int) {
+			low := i * groupSize
+			high := (i + 1) * groupSize
+			if i == ncpu-1 {
+				// Last group, pick up any left-over blocks
+				high = n
+			}
+			fn(low, high)
+			wg.Done()
+		}(i)
+	}
+	wg.Wait()
+}
 
 // EncryptBlocks is like EncryptBlock but takes multiple plaintext blocks.
+// Large requests are encrypted in parallel, see parallelBlocks.
 // Returns a byte slice from CReqPool - so don't forget to return it
 // to the pool.
 func (be *ContentEnc) EncryptBlocks(plaintextBlocks [][]byte, firstBlockNo uint64, fileID []byte) []byte {
-	ciphertextBlocks := make([][]byte, len(plaintextBlocks))
-	// For large writes, we parallelize encryption.
-	if len(plaintextBlocks) >= 32 {
-		ncpu := runtime.NumCPU()
-		if ncpu > encryptMaxSplit {
-			ncpu = encryptMaxSplit
-		}
-		groupSize := len(plaintextBlocks) / ncpu
-		var wg sync.WaitGroup
-		for i := 0; i < ncpu; i++ {
-			wg.Add(1)
-			go func(i int) {
-				low := i * groupSize
-				high := (i + 1) * groupSize
-				if i == ncpu-1 {
-					// Last group, pick up any left-over blocks
-					high = len(plaintextBlocks)
-				}
-				be.doEncryptBlocks(plaintextBlocks[low:high], ciphertextBlocks[low:high], firstBlockNo+uint64(low), fileID)
-				wg.Done()
-			}(i)
-		}
-		wg.Wait()
-	} else {
-		be.doEncryptBlocks(plaintextBlocks, ciphertextBlocks, firstBlockNo, fileID)
+	// The blocks are about to be overwritten
+	if be.blockCache != nil {
+		be.blockCache.invalidate(fileID, firstBlockNo, len(plaintextBlocks))
 	}
+	ciphertextBlocks := make([][]byte, len(plaintextBlocks))
+	parallelBlocks(len(plaintextBlocks), func(low, high int) {
+		be.doEncryptBlocks(plaintextBlocks[low:high], ciphertextBlocks[low:high], firstBlockNo+uint64(low), fileID)
+	})
 	// Concatenate ciphertext into a single byte array.
 	tmp := be.CReqPool.Get()
 	out := bytes.NewBuffer(tmp[:0])
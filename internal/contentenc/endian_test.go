@@ -0,0 +1,61 @@
+package contentenc
+
+import (
+	"encoding/hex"
+	"testing"
+
+	"github.com/rfjakob/gocryptfs/internal/cryptocore"
+)
+
+// The on-disk format must not depend on the byte order of the host. All
+// integers are stored big-endian. These golden vectors would break if any of
+// them were written in host byte order on a little-endian machine.
+
+var goldenFileID = []byte{0, 1, 2, 3, 4, 5, 6, 7, 8, 9, 10, 11, 12, 13, 14, 15}
+
+func TestHeaderByteOrder(t *testing.T) {
+	h := FileHeader{Version: CurrentVersion, ID: goldenFileID}
+	want := "0002000102030405060708090a0b0c0d0e0f"
+	if have := hex.EncodeToString(h.Pack()); have != want {
+		t.Errorf("wrong header:\nhave %s\nwant %s", have, want)
+	}
+	// Version 2 read as little-endian would be 0x0200
+	swapped, _ := hex.DecodeString("0200000102030405060708090a0b0c0d0e0f")
+	if _, err := ParseHeader(swapped); err == nil {
+		t.Error("byte-swapped header version was accepted")
+	}
+}
+
+func TestConcatADByteOrder(t *testing.T) {
+	want := "0000000000000102" + hex.EncodeToString(goldenFileID)
+	if have := hex.EncodeToString(concatAD(0x0102, goldenFileID)); have != want {
+		t.Errorf("wrong AD:\nhave %s\nwant %s", have, want)
+	}
+}
+
+// goldenBlock is block #1 containing "hello", encrypted with an all-zero master
+// key, HKDF, AES-GCM, the file ID "goldenFileID" and a nonce of 0x01 bytes
+const goldenBlock = "01010101010101010101010101010101977235e4b64b8703bdbfdd8f38c299cf53baeb5227"
+
+func TestBlockGoldenVector(t *testing.T) {
+	key := make([]byte, cryptocore.KeyLen)
+	cc := cryptocore.New(key, cryptocore.BackendGoGCM, DefaultIVBits, true, false)
+	ce := New(cc, DefaultBS, false)
+	nonce := make([]byte, cc.IVLen)
+	for i := range nonce {
+		nonce[i] = 1
+	}
+	have := hex.EncodeToString(ce.doEncryptBlock([]byte("hello"), 1, goldenFileID, nonce))
+	if have != goldenBlock {
+		t.Errorf("wrong ciphertext:\nhave %s\nwant %s", have, goldenBlock)
+	}
+	ciphertext, _ := hex.DecodeString(goldenBlock)
+	plaintext, err := ce.DecryptBlock(ciphertext, 1, goldenFileID)
+	if err != nil || string(plaintext) != "hello" {
+		t.Errorf("decrypting the golden block failed: %v", err)
+	}
+	// Block number 1 with swapped bytes must not authenticate
+	if _, err = ce.DecryptBlock(ciphertext, 1<<56, goldenFileID); err == nil {
+		t.Error("golden block decrypted with a byte-swapped block number")
+	}
+}
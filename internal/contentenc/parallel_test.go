@@ -0,0 +1,88 @@
+package contentenc
+
+import (
+	"bytes"
+	"fmt"
+	"runtime"
+	"testing"
+)
+
+// forceParallel makes parallelBlocks use several goroutines even on a single
+// CPU machine. Call the returned function to undo.
+func forceParallel() func() {
+	old := runtime.GOMAXPROCS(4)
+	return func() { runtime.GOMAXPROCS(old) }
+}
+
+// parallelBlocks must visit every block exactly once, for every request size
+func TestParallelBlocksCoverage(t *testing.T) {
+	defer forceParallel()()
+	for n := 0; n < 100; n++ {
+		seen := make([]int, n)
+		parallelBlocks(n, func(low, high int) {
+			for i := low; i < high; i++ {
+				seen[i]++
+			}
+		})
+		for i, c := range seen {
+			if c != 1 {
+				t.Fatalf("n=%d: block %d visited %d times", n, i, c)
+			}
+		}
+	}
+}
+
+// Blocks decrypted in parallel must be reassembled in order, and a corrupt
+// block must cut off the plaintext right before it
+func TestDecryptBlocksParallel(t *testing.T) {
+	defer forceParallel()()
+	ce := newTestContentEnc(0)
+	fileID := RandomHeader().ID
+	const n = 37
+	var plaintext [][]byte
+	for i := 0; i < n; i++ {
+		plaintext = append(plaintext, bytes.Repeat([]byte{byte(i)}, DefaultBS))
+	}
+	// Short last block
+	plaintext[n-1] = plaintext[n-1][:100]
+	ciphertext := append([]byte{}, ce.EncryptBlocks(plaintext, 5, fileID)...)
+	p, err := ce.DecryptBlocks(ciphertext, 5, fileID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(p, bytes.Join(plaintext, nil)) {
+		t.Fatal("wrong plaintext")
+	}
+	// Wrong block number must fail authentication
+	if _, err = ce.DecryptBlocks(ciphertext, 6, fileID); err == nil {
+		t.Error("decryption with wrong block number succeeded")
+	}
+	const corrupt = 20
+	ciphertext[corrupt*int(ce.CipherBS())+100]++
+	p, err = ce.DecryptBlocks(ciphertext, 5, fileID)
+	if err == nil {
+		t.Fatal("corruption was not detected")
+	}
+	if len(p) != corrupt*DefaultBS {
+		t.Errorf("want %d bytes of plaintext before the corrupt block, have %d", corrupt*DefaultBS, len(p))
+	}
+}
+
+func BenchmarkDecryptBlocks(b *testing.B) {
+	for _, n := range []int{1, 4, 32} {
+		b.Run(fmt.Sprintf("%d", n), func(b *testing.B) {
+			ce := newTestContentEnc(0)
+			fileID := RandomHeader().ID
+			ciphertext := append([]byte{}, ce.EncryptBlocks(testBlocks(n, 'x'), 0, fileID)...)
+			b.SetBytes(int64(n * DefaultBS))
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				p, err := ce.DecryptBlocks(ciphertext, 0, fileID)
+				if err != nil {
+					b.Fatal(err)
+				}
+				ce.PReqPool.Put(p)
+			}
+		})
+	}
+}
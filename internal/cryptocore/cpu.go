@@ -0,0 +1,51 @@
+package cryptocore
+
+import (
+	"io/ioutil"
+	"regexp"
+	"runtime"
+)
+
+// CPUHasAES tells us if the CPU has AES instructions (AES-NI on x86). Go GCM
+// and AES-SIV are only fast with them. "known" is false if we could not find
+// out, which is the case everywhere except on Linux.
+func CPUHasAES() (has bool, known bool) {
+	if runtime.GOOS != "linux" {
+		return false, false
+	}
+	has, err := fileHasAES("/proc/cpuinfo")
+	if err != nil {
+		return false, false
+	}
+	return has, true
+}
+
+// fileHasAES looks for the "aes" CPU flag in the cpuinfo file "file". It
+// takes an explicit filename so it can be tested with saved cpuinfo files.
+func fileHasAES(file string) (bool, error) {
+	ci, err := ioutil.ReadFile(file)
+	if err != nil {
+		return false, err
+	}
+	return regexp.Match(`(?m)^flags.*\baes\b`, ci)
+}
+
+// AESInstructions returns the result of CPUHasAES as "yes", "no" or
+// "unknown"
+func AESInstructions() string {
+	has, known := CPUHasAES()
+	if !known {
+		return "unknown"
+	}
+	if has {
+		return "yes"
+	}
+	return "no"
+}
+
+// BackendDescription returns a human-readable description of the content
+// encryption backend "b", including whether the CPU has AES instructions,
+// like "Go-GCM, AES instructions: yes".
+func BackendDescription(b AEADTypeEnum) string {
+	return b.String() + ", AES instructions: " + AESInstructions()
+}
@@ -0,0 +1,23 @@
+package cryptocore
+
+import (
+	"testing"
+)
+
+func TestFileHasAES(t *testing.T) {
+	for file, want := range map[string]bool{
+		"../prefer_openssl/cpuinfo.xeon_e312xx.txt":  true,
+		"../prefer_openssl/cpuinfo.pentium_g630.txt": false,
+	} {
+		have, err := fileHasAES(file)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if have != want {
+			t.Errorf("%s: want %v, have %v", file, want, have)
+		}
+	}
+	if BackendOpenSSL.String() != "OpenSSL" || BackendGoGCM.String() != "Go-GCM" || BackendAESSIV.String() != "AES-SIV" {
+		t.Error("wrong backend names")
+	}
+}
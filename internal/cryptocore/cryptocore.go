@@ -33,6 +33,19 @@ const (
 	BackendAESSIV AEADTypeEnum = iota
 )
 
+// String returns the name of the backend as shown to the user
+func (b AEADTypeEnum) String() string {
+	switch b {
+	case BackendOpenSSL:
+		return "OpenSSL"
+	case BackendGoGCM:
+		return "Go-GCM"
+	case BackendAESSIV:
+		return "AES-SIV"
+	}
+	return fmt.Sprintf("AEADTypeEnum(%d)", int(b))
+}
+
 // CryptoCore is the low level crypto implementation.
 type CryptoCore struct {
 	// EME is used for filename encryption.
@@ -44,6 +57,12 @@ type CryptoCore struct {
 	// GCM needs unique IVs (nonces)
 	IVGenerator *nonceGenerator
 	IVLen       int
+	// SealKey is the HMAC key for the reverse mode integrity seal (see
+	// package seal). It is always derived using HKDF.
+	SealKey []byte
+	// IndexKey is the HMAC key that protects the "-reverse-index" state
+	// file. It is always derived using HKDF.
+	IndexKey []byte
 }
 
 // New returns a new CryptoCore object or panics.
@@ -70,6 +89,11 @@ func New(key []byte, aeadType AEADTypeEnum, IVBitLen int, useHKDF bool, forceDec
 			log.Panic(err)
 		}
 		emeCipher = eme.New(emeBlockCipher)
+		// The AES key schedule is a copy. Don't wipe "key" itself, it belongs
+		// to the caller.
+		if useHKDF {
+			Wipe(emeKey)
+		}
 	}
 
 	// Initialize an AEAD cipher for file content encryption.
@@ -100,6 +124,10 @@ func New(key []byte, aeadType AEADTypeEnum, IVBitLen int, useHKDF bool, forceDec
 			if err != nil {
 				log.Panic(err)
 			}
+			// The AES key schedule is a copy
+			if useHKDF {
+				Wipe(gcmKey)
+			}
 		}
 	} else if aeadType == BackendAESSIV {
 		if IVLen != 16 {
@@ -127,5 +155,7 @@ func New(key []byte, aeadType AEADTypeEnum, IVBitLen int, useHKDF bool, forceDec
 		AEADBackend: aeadType,
 		IVGenerator: &nonceGenerator{nonceLen: IVLen},
 		IVLen:       IVLen,
+		SealKey:     hkdfDerive(key, hkdfInfoSeal, KeyLen),
+		IndexKey:    hkdfDerive(key, hkdfInfoIndex, KeyLen),
 	}
 }
@@ -13,6 +13,8 @@ const (
 	hkdfInfoEMENames   = "EME filename encryption"
 	hkdfInfoGCMContent = "AES-GCM file content encryption"
 	hkdfInfoSIVContent = "AES-SIV file content encryption"
+	hkdfInfoSeal       = "HMAC-SHA256 reverse mode seal"
+	hkdfInfoIndex      = "HMAC-SHA256 reverse mode index"
 )
 
 // hkdfDerive derives "outLen" bytes from "masterkey" and "info" using
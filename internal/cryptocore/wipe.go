@@ -0,0 +1,13 @@
+package cryptocore
+
+// Wipe overwrites "b" with zeros. Use it on keys and other secrets once they
+// are no longer needed.
+//
+// This only shortens the time a secret stays in memory: the garbage collector
+// may have moved and copied the data before, and strings cannot be wiped at
+// all.
+func Wipe(b []byte) {
+	for i := range b {
+		b[i] = 0
+	}
+}
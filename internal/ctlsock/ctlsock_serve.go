@@ -9,7 +9,9 @@ import (
 	"io"
 	"net"
 	"os"
+	"strings"
 	"syscall"
+	"time"
 
 	"github.com/rfjakob/gocryptfs/internal/tlog"
 )
@@ -41,16 +43,41 @@ type ResponseStruct struct {
 	WarnText string
 }
 
+// MountInfo describes the mounted filesystem for the line-based "STATUS" and
+// "UNMOUNT" commands
+type MountInfo struct {
+	Cipherdir  string
+	Mountpoint string
+	// Start is the time the filesystem was mounted
+	Start time.Time
+	// Unmount is called for "UNMOUNT". May be nil, which disables the
+	// command.
+	Unmount func() error
+	// Stats returns the counters sent for "STATS". May be nil, which
+	// disables the command.
+	Stats func() map[string]uint64
+}
+
+// StatusStruct is sent by us as response to "STATUS"
+type StatusStruct struct {
+	Cipherdir  string
+	Mountpoint string
+	// Uptime is the time since mount in seconds
+	Uptime int64
+}
+
 type ctlSockHandler struct {
 	fs     Interface
+	info   *MountInfo
 	socket *net.UnixListener
 }
 
 // Serve serves incoming connections on "sock". This call blocks so you
 // probably want to run it in a new goroutine.
-func Serve(sock net.Listener, fs Interface) {
+func Serve(sock net.Listener, fs Interface, info *MountInfo) {
 	handler := ctlSockHandler{
 		fs:     fs,
+		info:   info,
 		socket: sock.(*net.UnixListener),
 	}
 	handler.acceptLoop()
@@ -97,6 +124,11 @@ func (ch *ctlSockHandler) handleConnection(conn *net.UnixConn) {
 			return
 		}
 		buf = buf[:n]
+		if !isJSON(buf) {
+			ch.handleLines(string(buf), conn)
+			buf = buf[:cap(buf)]
+			continue
+		}
 		var in RequestStruct
 		err = json.Unmarshal(buf, &in)
 		if err != nil {
@@ -111,6 +143,84 @@ func (ch *ctlSockHandler) handleConnection(conn *net.UnixConn) {
 	}
 }
 
+// isJSON returns true if "buf" looks like a JSON request, as opposed to
+// line-based commands
+func isJSON(buf []byte) bool {
+	return strings.HasPrefix(strings.TrimSpace(string(buf)), "{")
+}
+
+// handleLines handles line-based commands as an alternative to JSON requests.
+// Every line is answered with one line of JSON:
+//
+//	STATUS               -> StatusStruct
+//	ENCRYPT <plainpath>  -> ResponseStruct
+//	DECRYPT <cipherpath> -> ResponseStruct
+//	UNMOUNT              -> ResponseStruct
+//	STATS                -> object with one counter per key
+func (ch *ctlSockHandler) handleLines(lines string, conn *net.UnixConn) {
+	for _, line := range strings.Split(lines, "\n") {
+		line = strings.TrimRight(line, "\r")
+		if strings.TrimSpace(line) == "" {
+			continue
+		}
+		parts := strings.SplitN(line, " ", 2)
+		arg := ""
+		if len(parts) == 2 {
+			arg = parts[1]
+		}
+		switch strings.ToUpper(parts[0]) {
+		case "STATUS":
+			ch.sendStatus(conn)
+		case "ENCRYPT":
+			ch.handleRequest(&RequestStruct{EncryptPath: arg}, conn)
+		case "DECRYPT":
+			ch.handleRequest(&RequestStruct{DecryptPath: arg}, conn)
+		case "UNMOUNT":
+			if ch.info == nil || ch.info.Unmount == nil {
+				sendResponse(conn, errors.New("UNMOUNT is not supported"), "", "")
+				continue
+			}
+			tlog.Info.Printf("ctlsock: unmounting on request")
+			// The reply may get lost if the process exits before we
+			// have written it. EOF means the unmount has worked.
+			sendResponse(conn, ch.info.Unmount(), "", "")
+		case "STATS":
+			if ch.info == nil || ch.info.Stats == nil {
+				sendResponse(conn, errors.New("STATS is not supported"), "", "")
+				continue
+			}
+			sendJSON(conn, ch.info.Stats())
+		default:
+			sendResponse(conn, fmt.Errorf("Unknown command %q", parts[0]), "", "")
+		}
+	}
+}
+
+// sendStatus sends a StatusStruct as a JSON message
+func (ch *ctlSockHandler) sendStatus(conn *net.UnixConn) {
+	var msg StatusStruct
+	if ch.info != nil {
+		msg.Cipherdir = ch.info.Cipherdir
+		msg.Mountpoint = ch.info.Mountpoint
+		msg.Uptime = int64(time.Since(ch.info.Start) / time.Second)
+	}
+	sendJSON(conn, msg)
+}
+
+// sendJSON sends "msg" as one line of JSON
+func sendJSON(conn *net.UnixConn, msg interface{}) {
+	jsonMsg, err := json.Marshal(msg)
+	if err != nil {
+		tlog.Warn.Printf("ctlsock: Marshal failed: %v", err)
+		return
+	}
+	jsonMsg = append(jsonMsg, '\n')
+	_, err = conn.Write(jsonMsg)
+	if err != nil {
+		tlog.Warn.Printf("ctlsock: Write failed: %v", err)
+	}
+}
+
 // handleRequest handles an already-unmarshaled JSON request
 func (ch *ctlSockHandler) handleRequest(in *RequestStruct, conn *net.UnixConn) {
 	var err error
@@ -0,0 +1,163 @@
+package ctlsock
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// reverser "encrypts" a path by reversing it
+type reverser struct{}
+
+func reverse(s string) string {
+	b := []byte(s)
+	for i, j := 0, len(b)-1; i < j; i, j = i+1, j-1 {
+		b[i], b[j] = b[j], b[i]
+	}
+	return string(b)
+}
+
+func (reverser) EncryptPath(p string) (string, error) {
+	if strings.HasPrefix(p, "missing") {
+		return "", errors.New("missing")
+	}
+	return reverse(p), nil
+}
+
+func (reverser) DecryptPath(p string) (string, error) {
+	return reverse(p), nil
+}
+
+// startServer serves a control socket in a temporary directory and returns
+// its path
+func startServer(t *testing.T, info *MountInfo) (string, func()) {
+	dir, err := ioutil.TempDir("", "ctlsock_test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	path := filepath.Join(dir, "sock")
+	sock, err := net.Listen("unix", path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	go Serve(sock, reverser{}, info)
+	return path, func() {
+		sock.Close()
+		os.RemoveAll(dir)
+	}
+}
+
+func TestLineCommands(t *testing.T) {
+	unmounted := false
+	info := &MountInfo{
+		Cipherdir:  "/cipher",
+		Mountpoint: "/mnt",
+		Start:      time.Now().Add(-time.Minute),
+		Unmount: func() error {
+			unmounted = true
+			return nil
+		},
+		Stats: func() map[string]uint64 {
+			return map[string]uint64{"Read": 3}
+		},
+	}
+	path, cleanup := startServer(t, info)
+	defer cleanup()
+	conn, err := net.Dial("unix", path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	r := bufio.NewReader(conn)
+	query := func(cmd string, out interface{}) {
+		if _, err := conn.Write([]byte(cmd + "\n")); err != nil {
+			t.Fatal(err)
+		}
+		line, err := r.ReadBytes('\n')
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err = json.Unmarshal(line, out); err != nil {
+			t.Fatalf("%s: %v", cmd, err)
+		}
+	}
+	var status StatusStruct
+	query("STATUS", &status)
+	if status.Cipherdir != "/cipher" || status.Mountpoint != "/mnt" || status.Uptime < 59 {
+		t.Errorf("wrong status: %+v", status)
+	}
+	var resp ResponseStruct
+	query("ENCRYPT foo/bar", &resp)
+	if resp.Result != "rab/oof" || resp.ErrNo != 0 {
+		t.Errorf("wrong ENCRYPT response: %+v", resp)
+	}
+	resp = ResponseStruct{}
+	query("DECRYPT rab/oof", &resp)
+	if resp.Result != "foo/bar" || resp.ErrNo != 0 {
+		t.Errorf("wrong DECRYPT response: %+v", resp)
+	}
+	resp = ResponseStruct{}
+	query("ENCRYPT missing", &resp)
+	if resp.Result != "" || resp.ErrNo == 0 {
+		t.Errorf("error not reported: %+v", resp)
+	}
+	resp = ResponseStruct{}
+	query("FOO", &resp)
+	if resp.ErrNo == 0 {
+		t.Errorf("unknown command not reported: %+v", resp)
+	}
+	var stats map[string]uint64
+	query("STATS", &stats)
+	if stats["Read"] != 3 {
+		t.Errorf("wrong STATS response: %v", stats)
+	}
+	resp = ResponseStruct{}
+	query("UNMOUNT", &resp)
+	if resp.ErrNo != 0 || !unmounted {
+		t.Errorf("UNMOUNT failed: %+v", resp)
+	}
+}
+
+// JSON requests keep working, also from concurrent clients
+func TestConcurrentClients(t *testing.T) {
+	path, cleanup := startServer(t, nil)
+	defer cleanup()
+	errs := make(chan error)
+	for i := 0; i < 10; i++ {
+		go func() {
+			conn, err := net.Dial("unix", path)
+			if err != nil {
+				errs <- err
+				return
+			}
+			defer conn.Close()
+			req, _ := json.Marshal(RequestStruct{EncryptPath: "abc"})
+			if _, err = conn.Write(req); err != nil {
+				errs <- err
+				return
+			}
+			var resp ResponseStruct
+			if err = json.NewDecoder(conn).Decode(&resp); err != nil {
+				errs <- err
+				return
+			}
+			if resp.Result != "cba" {
+				errs <- errors.New("wrong result " + resp.Result)
+				return
+			}
+			errs <- nil
+		}()
+	}
+	for i := 0; i < 10; i++ {
+		if err := <-errs; err != nil {
+			t.Error(err)
+		}
+	}
+}
@@ -61,6 +61,17 @@ const (
 	// Profiler - error occoured when trying to write cpu or memory profile or
 	// execution trace
 	Profiler = 25
+	// FingerprintMismatch - the master key fingerprint did not match the one
+	// passed via "-expect-fingerprint"
+	FingerprintMismatch = 26
+	// CipherDirLocked - the CIPHERDIR is already mounted read-write by another
+	// gocryptfs instance
+	CipherDirLocked = 27
+	// ReverseTest - "-reverse-test" found differences between the original
+	// and the decrypted files
+	ReverseTest = 28
+	// FsckErrors - "-fsck" found problems in CIPHERDIR
+	FsckErrors = 29
 )
 
 // Err wraps an error with an associated numeric exit code
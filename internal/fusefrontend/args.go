@@ -39,4 +39,44 @@ type Args struct {
 	SerializeReads bool
 	// Force decode even if integrity check fails (openSSL only)
 	ForceDecode bool
+	// Read back, decrypt and compare every write, "-verify-after-write"
+	VerifyAfterWrite bool
+	// Fsync the backing directory after creating, deleting or renaming an
+	// entry, "-strict-sync"
+	StrictSync bool
+	// Reject all writes with EROFS, "-ro". The kernel also enforces this
+	// because we pass "ro" as a mount option, but we do not rely on it.
+	ReadOnly bool
+	// Gitignore-style patterns of plaintext paths to hide in the encrypted
+	// view (reverse mode only), read from "-reverse-exclude-from"
+	ExcludePatterns []string
+	// Relative plaintext paths to hide in the encrypted view (reverse mode
+	// only), the bind mounts found for "-reverse-bind-mounts"
+	HiddenPaths []string
+	// ReverseFormat is the reverse mode ciphertext format the filesystem is
+	// pinned to, see fusefrontend_reverse.ReverseFormatV1. Zero means format 1.
+	ReverseFormat uint16
+	// Seal adds a gocryptfs.seal file with HMACs of all entries to every
+	// directory of the encrypted view (reverse mode only), "-reverse-seal"
+	Seal bool
+	// Periodically log how many files and bytes have been read (reverse
+	// mode only), "-progress"
+	Progress bool
+	// Number of directory IVs to cache, "-diriv-cache-size". Zero means
+	// dirivcache.DefaultMaxEntries.
+	DirIVCacheSize int
+	// Size in bytes of the cache of decrypted blocks, "-blockcache".
+	// Zero disables the cache.
+	BlockCache uint64
+	// Number of bytes to decrypt in advance when a file handle is read
+	// sequentially, "-readahead". Zero disables read-ahead.
+	ReadAhead uint64
+	// Panic instead of returning EIO when a block fails authentication or a
+	// file header or gocryptfs.diriv is invalid, "-panic-on-corruption"
+	PanicOnCorruption bool
+	// Store all-zero blocks as file holes in the ciphertext, "-sparse"
+	Sparse bool
+	// Match names case-insensitively if there is no exact match,
+	// "-caseinsensitive"
+	CaseInsensitive bool
 }
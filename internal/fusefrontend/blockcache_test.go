@@ -0,0 +1,108 @@
+package fusefrontend
+
+import (
+	"bytes"
+	"os"
+	"sync"
+	"testing"
+
+	"github.com/hanwen/go-fuse/fuse"
+	"github.com/hanwen/go-fuse/fuse/nodefs"
+)
+
+func readAll(t *testing.T, f nodefs.File, size int) []byte {
+	buf := make([]byte, size)
+	res, status := f.Read(buf, 0)
+	if !status.Ok() {
+		t.Fatal(status)
+	}
+	data, _ := res.Bytes(buf)
+	res.Done()
+	return append([]byte{}, data...)
+}
+
+// Blocks that were cut off by a truncate must come back as zeros when the
+// file grows again, not as stale cached data
+func TestBlockCacheTruncate(t *testing.T) {
+	fs, cleanup := newTestFS(t, Args{
+		PlaintextNames: true,
+		BlockCache:     1024 * 1024,
+	})
+	defer cleanup()
+	ctx := &fuse.Context{}
+	f, status := fs.Create("file", uint32(os.O_RDWR), 0600, ctx)
+	if !status.Ok() {
+		t.Fatal(status)
+	}
+	defer f.Release()
+	const size = 3 * 4096
+	data := bytes.Repeat([]byte{'a'}, size)
+	if _, status = f.Write(data, 0); !status.Ok() {
+		t.Fatal(status)
+	}
+	// Fill the cache
+	if !bytes.Equal(readAll(t, f, size), data) {
+		t.Fatal("wrong content")
+	}
+	// Overwrite part of the middle block
+	if _, status = f.Write([]byte("bbb"), 5000); !status.Ok() {
+		t.Fatal(status)
+	}
+	copy(data[5000:], "bbb")
+	if !bytes.Equal(readAll(t, f, size), data) {
+		t.Error("stale data after write")
+	}
+	// Shrink to one block and grow again. The last two blocks are file holes
+	// now.
+	if status = f.Truncate(4096); !status.Ok() {
+		t.Fatal(status)
+	}
+	if status = f.Truncate(size); !status.Ok() {
+		t.Fatal(status)
+	}
+	for i := 4096; i < size; i++ {
+		data[i] = 0
+	}
+	if !bytes.Equal(readAll(t, f, size), data) {
+		t.Error("stale data after truncate")
+	}
+}
+
+// A read that races with a write must not put the old content into the
+// block cache after the write has invalidated it
+func TestBlockCacheConcurrentWrite(t *testing.T) {
+	fs, cleanup := newTestFS(t, Args{PlaintextNames: true, BlockCache: 1024 * 1024})
+	defer cleanup()
+	// Large reads take long to decrypt, which widens the race window
+	const size = fuse.MAX_KERNEL_WRITE
+	f := createFile(t, fs, "file", make([]byte, size))
+	defer f.Release()
+	for i := 1; i <= 300; i++ {
+		stop := make(chan struct{})
+		var wg sync.WaitGroup
+		for r := 0; r < 4; r++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				buf := make([]byte, size)
+				for {
+					select {
+					case <-stop:
+						return
+					default:
+					}
+					f.Read(buf, 0)
+				}
+			}()
+		}
+		want := bytes.Repeat([]byte{byte(i)}, size)
+		if _, status := f.Write(want, 0); !status.Ok() {
+			t.Fatal(status)
+		}
+		close(stop)
+		wg.Wait()
+		if !bytes.Equal(readAll(t, f, size), want) {
+			t.Fatalf("iteration %d: stale data after write", i)
+		}
+	}
+}
@@ -0,0 +1,64 @@
+package fusefrontend
+
+import (
+	"io/ioutil"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/hanwen/go-fuse/fuse"
+)
+
+// In case-insensitive mode, a rename that only changes the case must change
+// the name instead of resolving the destination to the source
+func TestCaseInsensitiveRename(t *testing.T) {
+	fs, cleanup := newTestFS(t, Args{
+		LongNames:       true,
+		Raw64:           true,
+		HKDF:            true,
+		CaseInsensitive: true,
+	})
+	defer cleanup()
+	ctx := &fuse.Context{}
+	if status := fs.Mkdir("dir", 0700, ctx); !status.Ok() {
+		t.Fatal(status)
+	}
+	long := strings.Repeat("l", 200)
+	for _, name := range []string{"dir/foo", "dir/" + long} {
+		f, status := fs.Create(name, uint32(os.O_WRONLY), 0600, ctx)
+		if !status.Ok() {
+			t.Fatal(status)
+		}
+		f.Release()
+	}
+	// The parent directory is still matched case-insensitively
+	renames := [][2]string{{"dir/foo", "DIR/Foo"}, {"dir/" + long, "dir/" + strings.ToUpper(long)}}
+	for _, r := range renames {
+		if status := fs.Rename(r[0], r[1], ctx); !status.Ok() {
+			t.Fatalf("rename %q: %v", r[1], status)
+		}
+	}
+	entries, status := fs.OpenDir("dir", ctx)
+	if !status.Ok() {
+		t.Fatal(status)
+	}
+	names := make(map[string]bool)
+	for _, e := range entries {
+		names[e.Name] = true
+	}
+	if len(entries) != 2 || !names["Foo"] || !names[strings.ToUpper(long)] {
+		t.Errorf("wrong entries after rename: %v", entries)
+	}
+	// The old .name file of the long name must be gone
+	cDir, err := fs.getBackingPath("dir")
+	if err != nil {
+		t.Fatal(err)
+	}
+	cEntries, err := ioutil.ReadDir(cDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(cEntries) != 4 {
+		t.Errorf("want diriv, two files and one .name in %q, have %d entries", cDir, len(cEntries))
+	}
+}
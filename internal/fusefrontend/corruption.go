@@ -0,0 +1,25 @@
+package fusefrontend
+
+import (
+	"fmt"
+	"runtime"
+
+	"github.com/rfjakob/gocryptfs/internal/tlog"
+)
+
+// reportCorruption logs a data integrity failure: a block that failed
+// authentication, an invalid file header or an invalid gocryptfs.diriv.
+// With "-panic-on-corruption", it also logs the stacks of all goroutines and
+// panics, which takes down the whole process instead of letting the caller
+// return EIO.
+func (fs *FS) reportCorruption(format string, v ...interface{}) {
+	msg := fmt.Sprintf(format, v...)
+	if !fs.args.PanicOnCorruption {
+		tlog.Warn.Printf("%s", msg)
+		return
+	}
+	buf := make([]byte, 1024*1024)
+	n := runtime.Stack(buf, true)
+	tlog.Fatal.Printf("-panic-on-corruption: %s\n%s", msg, buf[:n])
+	panic("-panic-on-corruption: " + msg)
+}
@@ -0,0 +1,73 @@
+package fusefrontend
+
+import (
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/hanwen/go-fuse/fuse"
+
+	"github.com/rfjakob/gocryptfs/internal/contentenc"
+	"github.com/rfjakob/gocryptfs/internal/cryptocore"
+	"github.com/rfjakob/gocryptfs/internal/tlog"
+)
+
+// readCorrupt creates a file, flips a bit in its first block on disk and reads
+// it back through a new FS.
+func readCorrupt(t *testing.T, panicOnCorruption bool) fuse.Status {
+	fs, cleanup := newTestFS(t, Args{
+		PlaintextNames:    true,
+		PanicOnCorruption: panicOnCorruption,
+	})
+	defer cleanup()
+	dir := fs.args.Cipherdir
+	ctx := &fuse.Context{}
+	f, status := fs.Create("file", uint32(os.O_RDWR), 0600, ctx)
+	if !status.Ok() {
+		t.Fatal(status)
+	}
+	if _, status = f.Write([]byte("hello world"), 0); !status.Ok() {
+		t.Fatal(status)
+	}
+	f.Release()
+	cFile, err := os.OpenFile(dir+"/file", os.O_RDWR, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = cFile.WriteAt([]byte{0xff}, contentenc.HeaderLen+20)
+	cFile.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	fs = NewFS(make([]byte, cryptocore.KeyLen), fs.args)
+	f, status = fs.Open("file", uint32(os.O_RDONLY), ctx)
+	if !status.Ok() {
+		t.Fatal(status)
+	}
+	defer f.Release()
+	_, status = f.Read(make([]byte, 100), 0)
+	return status
+}
+
+func TestCorruptionEIO(t *testing.T) {
+	if status := readCorrupt(t, false); status != fuse.EIO {
+		t.Errorf("want EIO, got %v", status)
+	}
+}
+
+func TestPanicOnCorruption(t *testing.T) {
+	// Do not spam the test output with the goroutine dump
+	tlog.Fatal.Enabled = false
+	defer func() {
+		tlog.Fatal.Enabled = true
+		r := recover()
+		if r == nil {
+			t.Fatal("corrupt block did not cause a panic")
+		}
+		if msg, ok := r.(string); !ok || !strings.Contains(msg, "corrupt block") {
+			t.Errorf("unexpected panic: %v", r)
+		}
+	}()
+	status := readCorrupt(t, true)
+	t.Errorf("Read returned %v instead of panicking", status)
+}
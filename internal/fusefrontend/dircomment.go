@@ -0,0 +1,114 @@
+package fusefrontend
+
+// Per-directory comments that are exposed as a virtual extended attribute
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"syscall"
+
+	"github.com/hanwen/go-fuse/fuse"
+
+	"github.com/rfjakob/gocryptfs/internal/nametransform"
+)
+
+const (
+	// dirCommentXAttr is the name of the virtual extended attribute that
+	// holds the comment of a directory
+	dirCommentXAttr = "user.gocryptfs.comment"
+	// DirCommentFilename is the file in each ciphertext directory that stores
+	// the encrypted comment. It is hidden from directory listings like
+	// gocryptfs.diriv.
+	DirCommentFilename = "gocryptfs.comment"
+)
+
+// dirCommentPath returns the absolute ciphertext path of the directory
+// "relPath" and its DirIV. The comment is encrypted with the DirIV as the
+// file ID, which binds it to the directory.
+// Fails with ENOTSUP for non-directories and in plaintextnames mode, where
+// there are no DirIVs.
+func (fs *FS) dirCommentPath(relPath string) (cDir string, iv []byte, code fuse.Status) {
+	if fs.args.PlaintextNames {
+		return "", nil, fuse.Status(syscall.ENOTSUP)
+	}
+	cDir, err := fs.getBackingPath(relPath)
+	if err != nil {
+		return "", nil, fuse.ToStatus(err)
+	}
+	var st syscall.Stat_t
+	err = syscall.Lstat(cDir, &st)
+	if err != nil {
+		return "", nil, fuse.ToStatus(err)
+	}
+	if st.Mode&syscall.S_IFMT != syscall.S_IFDIR {
+		return "", nil, fuse.Status(syscall.ENOTSUP)
+	}
+	err = nametransform.RetryDirIV(func() (err error) {
+		fs.dirIVLock.RLock()
+		defer fs.dirIVLock.RUnlock()
+		iv, err = nametransform.ReadDirIV(cDir)
+		return err
+	})
+	if err != nil {
+		return "", nil, fuse.ToStatus(fs.checkDirIVMissing(err))
+	}
+	return cDir, iv, fuse.OK
+}
+
+// getDirComment decrypts the comment of directory "relPath".
+// Returns ENOATTR if there is none.
+func (fs *FS) getDirComment(relPath string) ([]byte, fuse.Status) {
+	cDir, iv, status := fs.dirCommentPath(relPath)
+	if !status.Ok() {
+		return nil, status
+	}
+	ciphertext, err := ioutil.ReadFile(filepath.Join(cDir, DirCommentFilename))
+	if os.IsNotExist(err) {
+		return nil, fuse.ENOATTR
+	} else if err != nil {
+		return nil, fuse.ToStatus(err)
+	}
+	plaintext, err := fs.contentEnc.DecryptBlock(ciphertext, 0, iv)
+	if err != nil {
+		fs.reportCorruption("getDirComment %q: %v", cDir, err)
+		return nil, fuse.EIO
+	}
+	// DecryptBlock returns a buffer from a pool
+	return append([]byte{}, plaintext...), fuse.OK
+}
+
+// setDirComment encrypts and stores the comment of directory "relPath".
+// The comment must fit into one block.
+func (fs *FS) setDirComment(relPath string, comment []byte) fuse.Status {
+	if uint64(len(comment)) > fs.contentEnc.PlainBS() {
+		return fuse.Status(syscall.E2BIG)
+	}
+	cDir, iv, status := fs.dirCommentPath(relPath)
+	if !status.Ok() {
+		return status
+	}
+	ciphertext := fs.contentEnc.EncryptBlock(comment, 0, iv)
+	return fuse.ToStatus(ioutil.WriteFile(filepath.Join(cDir, DirCommentFilename), ciphertext, 0600))
+}
+
+// removeDirComment deletes the comment of directory "relPath".
+// Returns ENOATTR if there is none.
+func (fs *FS) removeDirComment(relPath string) fuse.Status {
+	cDir, _, status := fs.dirCommentPath(relPath)
+	if !status.Ok() {
+		return status
+	}
+	err := syscall.Unlink(filepath.Join(cDir, DirCommentFilename))
+	if err == syscall.ENOENT {
+		return fuse.ENOATTR
+	}
+	return fuse.ToStatus(err)
+}
+
+// haveDirComment returns true if "cDir" (absolute ciphertext path) has a
+// comment
+func haveDirComment(cDir string) bool {
+	_, err := os.Lstat(filepath.Join(cDir, DirCommentFilename))
+	return err == nil
+}
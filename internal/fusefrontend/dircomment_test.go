@@ -0,0 +1,125 @@
+package fusefrontend
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"syscall"
+	"testing"
+
+	"github.com/hanwen/go-fuse/fuse"
+
+	"github.com/rfjakob/gocryptfs/internal/cryptocore"
+	"github.com/rfjakob/gocryptfs/internal/nametransform"
+	"github.com/rfjakob/gocryptfs/internal/tlog"
+)
+
+func TestDirComment(t *testing.T) {
+	fs, cleanup := newTestFS(t, Args{
+		LongNames: true,
+		Raw64:     true,
+	})
+	defer cleanup()
+	ctx := &fuse.Context{}
+	if status := fs.Mkdir("d", 0700, ctx); !status.Ok() {
+		t.Fatal(status)
+	}
+	if _, status := fs.GetXAttr("d", dirCommentXAttr, ctx); status != fuse.ENOATTR {
+		t.Errorf("want ENOATTR, got %v", status)
+	}
+	if status := fs.SetXAttr("d", dirCommentXAttr, []byte("foo"), 0, ctx); !status.Ok() {
+		t.Fatal(status)
+	}
+	// A new instance must be able to read it back
+	fs = NewFS(make([]byte, cryptocore.KeyLen), fs.args)
+	comment, status := fs.GetXAttr("d", dirCommentXAttr, ctx)
+	if !status.Ok() || string(comment) != "foo" {
+		t.Errorf("got %q, %v", comment, status)
+	}
+	attrs, _ := fs.ListXAttr("d", ctx)
+	if len(attrs) != 1 || attrs[0] != dirCommentXAttr {
+		t.Errorf("ListXAttr: %v", attrs)
+	}
+	entries, _ := fs.OpenDir("d", ctx)
+	if len(entries) != 0 {
+		t.Errorf("comment file is visible: %v", entries)
+	}
+	// The comment is bound to the directory
+	cD, _ := fs.getBackingPath("d")
+	if status = fs.Mkdir("e", 0700, ctx); !status.Ok() {
+		t.Fatal(status)
+	}
+	cE, _ := fs.getBackingPath("e")
+	ciphertext, _ := ioutil.ReadFile(filepath.Join(cD, DirCommentFilename))
+	ioutil.WriteFile(filepath.Join(cE, DirCommentFilename), ciphertext, 0600)
+	if _, status = fs.GetXAttr("e", dirCommentXAttr, ctx); status != fuse.EIO {
+		t.Errorf("want EIO for a comment from another dir, got %v", status)
+	}
+	// Files have no comments
+	f, status := fs.Create("d/file", uint32(os.O_WRONLY), 0600, ctx)
+	if !status.Ok() {
+		t.Fatal(status)
+	}
+	f.Release()
+	if status = fs.SetXAttr("d/file", dirCommentXAttr, []byte("x"), 0, ctx); status.Ok() {
+		t.Error("setting a comment on a file should fail")
+	}
+	if status = fs.Unlink("d/file", ctx); !status.Ok() {
+		t.Fatal(status)
+	}
+	if status = fs.Rmdir("d", ctx); !status.Ok() {
+		t.Errorf("Rmdir with comment: %v", status)
+	}
+	if status = fs.RemoveXAttr("e", dirCommentXAttr, ctx); !status.Ok() {
+		t.Error(status)
+	}
+	if status = fs.RemoveXAttr("e", dirCommentXAttr, ctx); status != fuse.ENOATTR {
+		t.Errorf("want ENOATTR, got %v", status)
+	}
+}
+
+// Rmdir must not delete the comment of a directory it does not remove
+func TestRmdirKeepsDirComment(t *testing.T) {
+	fs, cleanup := newTestFS(t, Args{
+		LongNames: true,
+		Raw64:     true,
+	})
+	defer cleanup()
+	ctx := &fuse.Context{}
+	if status := fs.Mkdir("d", 0700, ctx); !status.Ok() {
+		t.Fatal(status)
+	}
+	if status := fs.SetXAttr("d", dirCommentXAttr, []byte("foo"), 0, ctx); !status.Ok() {
+		t.Fatal(status)
+	}
+	// The comment plus one more entry, in place of gocryptfs.diriv
+	cD, _ := fs.getBackingPath("d")
+	if err := os.Rename(filepath.Join(cD, nametransform.DirIVFilename), filepath.Join(cD, "x")); err != nil {
+		t.Fatal(err)
+	}
+	tlog.Warn.Enabled = false
+	defer func() { tlog.Warn.Enabled = true }()
+	if status := fs.Rmdir("d", ctx); status != fuse.Status(syscall.ENOTEMPTY) {
+		t.Errorf("want ENOTEMPTY, got %v", status)
+	}
+	if !haveDirComment(cD) {
+		t.Error("Rmdir deleted the comment of a directory it did not remove")
+	}
+	// With gocryptfs.diriv back in place, the comment goes away with the
+	// directory and nothing is left behind in the parent
+	if err := os.Rename(filepath.Join(cD, "x"), filepath.Join(cD, nametransform.DirIVFilename)); err != nil {
+		t.Fatal(err)
+	}
+	if status := fs.Rmdir("d", ctx); !status.Ok() {
+		t.Fatal(status)
+	}
+	entries, err := ioutil.ReadDir(fs.args.Cipherdir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, e := range entries {
+		if e.Name() != nametransform.DirIVFilename {
+			t.Errorf("leftover file %q", e.Name())
+		}
+	}
+}
@@ -0,0 +1,224 @@
+package fusefrontend
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"syscall"
+	"testing"
+
+	"github.com/hanwen/go-fuse/fuse"
+
+	"github.com/rfjakob/gocryptfs/internal/cryptocore"
+	"github.com/rfjakob/gocryptfs/internal/nametransform"
+	"github.com/rfjakob/gocryptfs/internal/tlog"
+)
+
+// A deleted gocryptfs.diriv must give EIO for everything in the directory,
+// not ENOENT or ENOSYS
+func TestDirIVMissing(t *testing.T) {
+	fs, cleanup := newTestFS(t, Args{
+		LongNames: true,
+		Raw64:     true,
+		HKDF:      true,
+	})
+	defer cleanup()
+	ctx := &fuse.Context{}
+	if status := fs.Mkdir("dir", 0700, ctx); !status.Ok() {
+		t.Fatal(status)
+	}
+	f, status := fs.Create("dir/file", uint32(os.O_WRONLY), 0600, ctx)
+	if !status.Ok() {
+		t.Fatal(status)
+	}
+	f.Release()
+	cDir, err := fs.getBackingPath("dir")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = os.Remove(filepath.Join(cDir, nametransform.DirIVFilename)); err != nil {
+		t.Fatal(err)
+	}
+	// Start over with an empty DirIV cache
+	fs = NewFS(make([]byte, cryptocore.KeyLen), fs.args)
+	tlog.Warn.Enabled = false
+	defer func() { tlog.Warn.Enabled = true }()
+	if _, status = fs.GetAttr("dir/file", ctx); status != fuse.EIO {
+		t.Errorf("GetAttr: want EIO, got %v", status)
+	}
+	if _, status = fs.OpenDir("dir", ctx); status != fuse.EIO {
+		t.Errorf("OpenDir: want EIO, got %v", status)
+	}
+	// The directory itself is still accessible
+	if _, status = fs.GetAttr("dir", ctx); !status.Ok() {
+		t.Errorf("GetAttr on the directory: %v", status)
+	}
+}
+
+// Moving a populated directory to a different parent, over an empty
+// directory, must keep all children readable, even with the old paths in the
+// DirIV cache, and a new directory at the old path must not see cached data
+// of the moved one
+func TestRenameDirAcrossParents(t *testing.T) {
+	fs, cleanup := newTestFS(t, Args{
+		LongNames: true,
+		Raw64:     true,
+		HKDF:      true,
+	})
+	defer cleanup()
+	ctx := &fuse.Context{}
+	for _, d := range []string{"p1", "p2", "p1/d", "p1/d/sub"} {
+		if status := fs.Mkdir(d, 0700, ctx); !status.Ok() {
+			t.Fatal(status)
+		}
+	}
+	files := map[string]string{"d/a": "content a", "d/sub/b": "content b"}
+	for name, content := range files {
+		f, status := fs.Create("p1/"+name, uint32(os.O_RDWR), 0600, ctx)
+		if !status.Ok() {
+			t.Fatal(status)
+		}
+		if _, status = f.Write([]byte(content), 0); !status.Ok() {
+			t.Fatal(status)
+		}
+		f.Release()
+	}
+	// check reads all files below "parent", which also fills the DirIV cache
+	check := func(parent string) {
+		for name, content := range files {
+			f, status := fs.Open(parent+"/"+name, uint32(os.O_RDONLY), ctx)
+			if !status.Ok() {
+				t.Fatalf("%s/%s: %v", parent, name, status)
+			}
+			if have := string(readAll(t, f, 100)); have != content {
+				t.Errorf("%s/%s: want %q, have %q", parent, name, content, have)
+			}
+			f.Release()
+		}
+		entries, status := fs.OpenDir(parent+"/d/sub", ctx)
+		if !status.Ok() || len(entries) != 1 || entries[0].Name != "b" {
+			t.Errorf("OpenDir %s/d/sub: %v %v", parent, entries, status)
+		}
+	}
+	check("p1")
+	// Replace an empty directory whose DirIV is in the cache
+	if status := fs.Mkdir("p2/d", 0700, ctx); !status.Ok() {
+		t.Fatal(status)
+	}
+	if _, status := fs.OpenDir("p2/d", ctx); !status.Ok() {
+		t.Fatal(status)
+	}
+	if status := fs.Rename("p1/d", "p2/d", ctx); !status.Ok() {
+		t.Fatal(status)
+	}
+	check("p2")
+	// The name of the moved directory must be encrypted with the diriv of
+	// the new parent
+	cPath, err := fs.getBackingPath("p2/d")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = os.Stat(cPath); err != nil {
+		t.Error(err)
+	}
+	if _, status := fs.GetAttr("p1/d/sub/b", ctx); status != fuse.ENOENT {
+		t.Errorf("old path: want ENOENT, got %v", status)
+	}
+	// A new directory in the old place has its own diriv
+	for _, d := range []string{"p1/d", "p1/d/sub"} {
+		if status := fs.Mkdir(d, 0700, ctx); !status.Ok() {
+			t.Fatal(status)
+		}
+	}
+	if entries, status := fs.OpenDir("p1/d/sub", ctx); !status.Ok() || len(entries) != 0 {
+		t.Errorf("new directory: %v %v", entries, status)
+	}
+	check("p2")
+}
+
+// Rmdir must remove a directory that only holds its gocryptfs.diriv without
+// leaving the diriv behind, and must give ENOTEMPTY for anything else
+func TestRmdirDirIV(t *testing.T) {
+	fs, cleanup := newTestFS(t, Args{
+		LongNames: true,
+		Raw64:     true,
+		HKDF:      true,
+	})
+	defer cleanup()
+	dir := fs.args.Cipherdir
+	ctx := &fuse.Context{}
+	for _, d := range []string{"empty", "full", "noiv"} {
+		if status := fs.Mkdir(d, 0700, ctx); !status.Ok() {
+			t.Fatal(status)
+		}
+	}
+	if status := fs.Rmdir("empty", ctx); !status.Ok() {
+		t.Errorf("Rmdir of a directory with only gocryptfs.diriv: %v", status)
+	}
+	// Only the diriv of the root directory may be left
+	entries, err := ioutil.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, e := range entries {
+		if e.Name() == nametransform.DirIVFilename || e.IsDir() {
+			continue
+		}
+		t.Errorf("Rmdir left %q behind", e.Name())
+	}
+	f, status := fs.Create("full/file", uint32(os.O_WRONLY), 0600, ctx)
+	if !status.Ok() {
+		t.Fatal(status)
+	}
+	f.Release()
+	if status = fs.Rmdir("full", ctx); status != fuse.Status(syscall.ENOTEMPTY) {
+		t.Errorf("Rmdir of a non-empty directory: want ENOTEMPTY, got %v", status)
+	}
+	if _, status = fs.GetAttr("full/file", ctx); !status.Ok() {
+		t.Errorf("file in the directory is no longer accessible: %v", status)
+	}
+	// A directory without diriv that holds one file is not empty either
+	f, status = fs.Create("noiv/file", uint32(os.O_WRONLY), 0600, ctx)
+	if !status.Ok() {
+		t.Fatal(status)
+	}
+	f.Release()
+	cDir, err := fs.getBackingPath("noiv")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = os.Remove(filepath.Join(cDir, nametransform.DirIVFilename)); err != nil {
+		t.Fatal(err)
+	}
+	if status = fs.Rmdir("noiv", ctx); status != fuse.Status(syscall.ENOTEMPTY) {
+		t.Errorf("Rmdir of a directory without diriv: want ENOTEMPTY, got %v", status)
+	}
+}
+
+// Mkdir must only drop the cache entries of the new path, not the whole
+// DirIV cache
+func TestMkdirKeepsDirIVCache(t *testing.T) {
+	fs, cleanup := newTestFS(t, Args{
+		LongNames: true,
+		Raw64:     true,
+		HKDF:      true,
+	})
+	defer cleanup()
+	ctx := &fuse.Context{}
+	if status := fs.Mkdir("a", 0700, ctx); !status.Ok() {
+		t.Fatal(status)
+	}
+	// Resolving "a/x" puts "a" into the cache
+	if _, err := fs.getBackingPath("a/x"); err != nil {
+		t.Fatal(err)
+	}
+	if iv, _ := fs.nameTransform.DirIVCache.Lookup("a"); iv == nil {
+		t.Fatal("\"a\" is not cached")
+	}
+	if status := fs.Mkdir("b", 0700, ctx); !status.Ok() {
+		t.Fatal(status)
+	}
+	if iv, _ := fs.nameTransform.DirIVCache.Lookup("a"); iv == nil {
+		t.Error("Mkdir dropped the cache entry of \"a\"")
+	}
+}
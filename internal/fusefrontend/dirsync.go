@@ -0,0 +1,37 @@
+package fusefrontend
+
+import (
+	"os"
+
+	"github.com/hanwen/go-fuse/fuse"
+
+	"github.com/rfjakob/gocryptfs/internal/tlog"
+)
+
+// fsyncDir is called to fsync a backing directory. It is a variable so the
+// tests can record the calls.
+var fsyncDir = func(d *os.File) error {
+	return d.Sync()
+}
+
+// syncDir fsyncs the backing directory "cDir" (absolute path) if
+// "-strict-sync" is active and "*code" is OK. Without this, a crash can lose
+// a newly created, deleted or renamed directory entry even if the file
+// contents have been synced. Meant to be called via defer with a pointer to
+// the named return value.
+func (fs *FS) syncDir(code *fuse.Status, cDir string) {
+	if !fs.args.StrictSync || !code.Ok() {
+		return
+	}
+	d, err := os.Open(cDir)
+	if err != nil {
+		tlog.Warn.Printf("syncDir: %v", err)
+		return
+	}
+	defer d.Close()
+	err = fsyncDir(d)
+	if err != nil {
+		tlog.Warn.Printf("syncDir %q: %v", cDir, err)
+		*code = fuse.ToStatus(err)
+	}
+}
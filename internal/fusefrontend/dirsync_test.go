@@ -0,0 +1,109 @@
+package fusefrontend
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"syscall"
+	"testing"
+
+	"github.com/hanwen/go-fuse/fuse"
+)
+
+// TestStrictSync records the directory fsyncs. The fsync is the point where a
+// crash stops being able to lose the directory entry: with "-strict-sync",
+// every namespace change must be followed by an fsync of the backing parent
+// directory, without it there must be none.
+func TestStrictSync(t *testing.T) {
+	var synced []string
+	orig := fsyncDir
+	fsyncDir = func(d *os.File) error {
+		synced = append(synced, d.Name())
+		return nil
+	}
+	defer func() { fsyncDir = orig }()
+
+	for _, strict := range []bool{false, true} {
+		fs, cleanup := newTestFS(t, Args{
+			PlaintextNames: true,
+			StrictSync:     strict,
+		})
+		defer cleanup()
+		dir := fs.args.Cipherdir
+		ctx := &fuse.Context{}
+		ops := []struct {
+			name string
+			op   func() fuse.Status
+			// Backing directories that must be synced
+			dirs []string
+		}{
+			{"Mkdir", func() fuse.Status { return fs.Mkdir("sub", 0700, ctx) }, []string{dir}},
+			{"Create", func() fuse.Status {
+				f, status := fs.Create("sub/file", uint32(os.O_RDWR), 0600, ctx)
+				if status.Ok() {
+					f.Release()
+				}
+				return status
+			}, []string{filepath.Join(dir, "sub")}},
+			{"Rename", func() fuse.Status { return fs.Rename("sub/file", "file", ctx) },
+				[]string{filepath.Join(dir, "sub"), dir}},
+			{"Unlink", func() fuse.Status { return fs.Unlink("file", ctx) }, []string{dir}},
+			{"Rmdir", func() fuse.Status { return fs.Rmdir("sub", ctx) }, []string{dir}},
+		}
+		for _, o := range ops {
+			synced = nil
+			if status := o.op(); !status.Ok() {
+				t.Fatalf("%s: %v", o.name, status)
+			}
+			if !strict {
+				if len(synced) != 0 {
+					t.Errorf("%s: unexpected fsync without -strict-sync: %v", o.name, synced)
+				}
+				continue
+			}
+			for _, want := range o.dirs {
+				found := false
+				for _, s := range synced {
+					if s == want {
+						found = true
+					}
+				}
+				if !found {
+					t.Errorf("%s: %q was not fsync'ed, got %v", o.name, want, synced)
+				}
+			}
+		}
+	}
+}
+
+// countFds returns the number of open file descriptors of this process
+func countFds(t *testing.T) int {
+	fds, err := ioutil.ReadDir("/proc/self/fd")
+	if err != nil {
+		t.Skip(err)
+	}
+	return len(fds)
+}
+
+// When the directory fsync fails, Create returns an error and must not leak
+// the file descriptor of the new file
+func TestStrictSyncCreateFails(t *testing.T) {
+	orig := fsyncDir
+	fsyncDir = func(d *os.File) error {
+		return syscall.EIO
+	}
+	defer func() { fsyncDir = orig }()
+	fs, cleanup := newTestFS(t, Args{
+		PlaintextNames: true,
+		StrictSync:     true,
+	})
+	defer cleanup()
+	before := countFds(t)
+	f, status := fs.Create("file", uint32(os.O_RDWR), 0600, &fuse.Context{})
+	if status != fuse.EIO || f != nil {
+		t.Fatalf("want EIO and no file, got %v, %v", status, f)
+	}
+	if after := countFds(t); after != before {
+		t.Errorf("file descriptor leak: %d open before, %d after", before, after)
+	}
+}
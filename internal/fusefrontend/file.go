@@ -8,6 +8,7 @@ import (
 	"log"
 	"os"
 	"sync"
+	"sync/atomic"
 	"syscall"
 	"time"
 
@@ -50,16 +51,22 @@ type file struct {
 	// The opCount is used to judge whether "lastWrittenOffset" is still
 	// guaranteed to be correct.
 	lastOpCount uint64
+	// The file was opened with O_APPEND. The backing file never is, see
+	// mangleOpenFlags.
+	appendMode bool
 	// Parent filesystem
 	fs *FS
+	// Read-ahead state, nil if "-readahead" is not set
+	readAhead *readAhead
 	// We embed a nodefs.NewDefaultFile() that returns ENOSYS for every operation we
 	// have not implemented. This prevents build breakage when the go-fuse library
 	// adds new methods to the nodefs.File interface.
 	nodefs.File
 }
 
-// NewFile returns a new go-fuse File instance.
-func NewFile(fd *os.File, fs *FS) (nodefs.File, fuse.Status) {
+// NewFile returns a new go-fuse File instance. "flags" are the open flags
+// the kernel passed to Open or Create.
+func NewFile(fd *os.File, fs *FS, flags uint32) (nodefs.File, fuse.Status) {
 	var st syscall.Stat_t
 	err := syscall.Fstat(int(fd.Fd()), &st)
 	if err != nil {
@@ -69,15 +76,20 @@ func NewFile(fd *os.File, fs *FS) (nodefs.File, fuse.Status) {
 	qi := openfiletable.QInoFromStat(&st)
 	e := openfiletable.Register(qi)
 
-	return &file{
+	f := &file{
 		fd:             fd,
 		contentEnc:     fs.contentEnc,
 		qIno:           qi,
 		fileTableEntry: e,
 		loopbackFile:   nodefs.NewLoopbackFile(fd),
+		appendMode:     flags&syscall.O_APPEND != 0,
 		fs:             fs,
 		File:           nodefs.NewDefaultFile(),
-	}, fuse.OK
+	}
+	if fs.args.ReadAhead > 0 {
+		f.readAhead = &readAhead{}
+	}
+	return f, fuse.OK
 }
 
 // intFd - return the backing file descriptor as an integer. Used for debug
@@ -105,6 +117,7 @@ func (f *file) readFileID() ([]byte, error) {
 	buf = buf[:contentenc.HeaderLen]
 	h, err := contentenc.ParseHeader(buf)
 	if err != nil {
+		f.fs.reportCorruption("ino%d: readFileID: %v", f.qIno.Ino, err)
 		return nil, err
 	}
 	return h.ID, nil
@@ -142,6 +155,15 @@ func (f *file) createHeader() (fileID []byte, err error) {
 // Called by Read() for normal reading,
 // by Write() and Truncate() for Read-Modify-Write
 func (f *file) doRead(dst []byte, off uint64, length uint64) ([]byte, fuse.Status) {
+	return f.doReadSpeculative(dst, off, length, false)
+}
+
+// doReadSpeculative is doRead for reads that nobody has asked for yet, like
+// the read-ahead, if "speculative" is set. A block that fails to decrypt
+// gives EIO without a corruption report and without "-forcedecode": the data
+// may have been torn by a concurrent write. A real read of the same range
+// reports it.
+func (f *file) doReadSpeculative(dst []byte, off uint64, length uint64, speculative bool) ([]byte, fuse.Status) {
 	// Make sure we have the file ID.
 	f.fileTableEntry.HeaderLock.RLock()
 	if f.fileTableEntry.ID == nil {
@@ -175,6 +197,10 @@ func (f *file) doRead(dst []byte, off uint64, length uint64) ([]byte, fuse.Statu
 
 	ciphertext := f.fs.contentEnc.CReqPool.Get()
 	ciphertext = ciphertext[:int(alignedLength)]
+	// Read does not take the ContentLock. Remember its generation so that
+	// ciphertext that is overwritten while we decrypt it does not end up in
+	// the block cache.
+	gen := f.fileTableEntry.ContentLock.Generation()
 	n, err := f.fd.ReadAt(ciphertext, int64(alignedOffset))
 	// We don't care if the file ID changes after we have read the data. Drop the lock.
 	f.fileTableEntry.HeaderLock.RUnlock()
@@ -194,9 +220,16 @@ func (f *file) doRead(dst []byte, off uint64, length uint64) ([]byte, fuse.Statu
 	tlog.Debug.Printf("ReadAt offset=%d bytes (%d blocks), want=%d, got=%d", alignedOffset, firstBlockNo, alignedLength, n)
 
 	// Decrypt it
-	plaintext, err := f.contentEnc.DecryptBlocks(ciphertext, firstBlockNo, fileID)
+	plaintext, err := f.contentEnc.DecryptBlocksIfUnchanged(ciphertext, firstBlockNo, fileID, func() bool {
+		return gen%2 == 0 && f.fileTableEntry.ContentLock.Generation() == gen
+	})
 	f.fs.contentEnc.CReqPool.Put(ciphertext)
 	if err != nil {
+		if speculative {
+			tlog.Debug.Printf("ino%d: doReadSpeculative off=%d len=%d: %v", f.qIno.Ino, off, length, err)
+			f.fs.contentEnc.PReqPool.Put(plaintext)
+			return nil, fuse.EIO
+		}
 		if f.fs.args.ForceDecode && err == stupidgcm.ErrAuth {
 			// We do not have the information which block was corrupt here anymore,
 			// but DecryptBlocks() has already logged it anyway.
@@ -204,7 +237,7 @@ func (f *file) doRead(dst []byte, off uint64, length uint64) ([]byte, fuse.Statu
 				f.qIno.Ino, off, length)
 		} else {
 			curruptBlockNo := firstBlockNo + f.contentEnc.PlainOffToBlockNo(uint64(len(plaintext)))
-			tlog.Warn.Printf("ino%d: doRead: corrupt block #%d: %v", f.qIno.Ino, curruptBlockNo, err)
+			f.fs.reportCorruption("ino%d: doRead: corrupt block #%d: %v", f.qIno.Ino, curruptBlockNo, err)
 			return nil, fuse.EIO
 		}
 	}
@@ -228,6 +261,7 @@ func (f *file) doRead(dst []byte, off uint64, length uint64) ([]byte, fuse.Statu
 
 // Read - FUSE call
 func (f *file) Read(buf []byte, off int64) (resultData fuse.ReadResult, code fuse.Status) {
+	f.fs.touch()
 	f.fdLock.RLock()
 	defer f.fdLock.RUnlock()
 
@@ -237,11 +271,22 @@ func (f *file) Read(buf []byte, off int64) (resultData fuse.ReadResult, code fus
 		serialize_reads.Wait(off, len(buf))
 	}
 
-	out, status := f.doRead(buf[:0], uint64(off), uint64(len(buf)))
+	var out []byte
+	status := fuse.OK
+	fromBuffer := false
+	if f.readAhead != nil {
+		out, fromBuffer = f.readAheadGet(buf[:0], uint64(off), uint64(len(buf)))
+	}
+	if !fromBuffer {
+		out, status = f.doRead(buf[:0], uint64(off), uint64(len(buf)))
+	}
 
 	if f.fs.args.SerializeReads {
 		serialize_reads.Done()
 	}
+	if f.readAhead != nil && status.Ok() {
+		f.readAheadStart()
+	}
 
 	if status == fuse.EIO {
 		tlog.Warn.Printf("ino%d: Read: returning EIO, offset=%d, length=%d", f.qIno.Ino, len(buf), off)
@@ -251,6 +296,8 @@ func (f *file) Read(buf []byte, off int64) (resultData fuse.ReadResult, code fus
 	}
 
 	tlog.Debug.Printf("ino%d: Read: status %v, returning %d bytes", f.qIno.Ino, status, len(out))
+	atomic.AddUint64(&f.fs.stats.read, 1)
+	atomic.AddUint64(&f.fs.stats.readBytes, uint64(len(out)))
 	return fuse.ReadResultData(out), status
 }
 
@@ -323,15 +370,63 @@ func (f *file) doWrite(data []byte, off int64) (uint32, fuse.Status) {
 	}
 	// Write
 	_, err = f.fd.WriteAt(ciphertext, cOff)
+	cLen := len(ciphertext)
 	// Return memory to CReqPool
 	f.fs.contentEnc.CReqPool.Put(ciphertext)
 	if err != nil {
 		tlog.Warn.Printf("doWrite: Write failed: %s", err.Error())
 		return 0, fuse.ToStatus(err)
 	}
+	if f.fs.args.Sparse {
+		f.punchZeroBlocks(toEncrypt, blocks[0].BlockNo)
+	}
+	if f.fs.args.VerifyAfterWrite {
+		status := f.verifyWrite(cOff, cLen, blocks[0].BlockNo, bytes.Join(toEncrypt, nil))
+		if status != fuse.OK {
+			return 0, status
+		}
+	}
 	return uint32(len(data)), fuse.OK
 }
 
+// verifyWrite flushes the file to stable storage, drops it from the page
+// cache, reads back "cLen" bytes of ciphertext at offset "cOff", and checks
+// that they decrypt to "plaintext". Used for "-verify-after-write".
+func (f *file) verifyWrite(cOff int64, cLen int, firstBlockNo uint64, plaintext []byte) fuse.Status {
+	err := f.fd.Sync()
+	if err != nil {
+		tlog.Warn.Printf("ino%d: verifyWrite: Sync failed: %v", f.qIno.Ino, err)
+		return fuse.ToStatus(err)
+	}
+	// Without this, the read below would just return the pages we have
+	// written from memory
+	err = syscallcompat.DropCache(int(f.fd.Fd()), cOff, int64(cLen))
+	if err != nil {
+		tlog.Warn.Printf("ino%d: verifyWrite: DropCache failed: %v", f.qIno.Ino, err)
+		return fuse.ToStatus(err)
+	}
+	buf := make([]byte, cLen)
+	n, err := f.fd.ReadAt(buf, cOff)
+	if err != nil && err != io.EOF {
+		tlog.Warn.Printf("ino%d: verifyWrite: Read failed: %v", f.qIno.Ino, err)
+		return fuse.ToStatus(err)
+	}
+	readBack, err := f.contentEnc.DecryptBlocks(buf[:n], firstBlockNo, f.fileTableEntry.ID)
+	if err != nil {
+		tlog.Warn.Printf("ino%d: verifyWrite: block #%d: read-back failed to decrypt: %v",
+			f.qIno.Ino, firstBlockNo, err)
+		return fuse.EIO
+	}
+	equal := bytes.Equal(readBack, plaintext)
+	f.contentEnc.PReqPool.Put(readBack)
+	if !equal {
+		tlog.Warn.Printf("ino%d: verifyWrite: block #%d: read-back does not match written data",
+			f.qIno.Ino, firstBlockNo)
+		return fuse.EIO
+	}
+	return fuse.OK
+}
+
 // isConsecutiveWrite returns true if the current write
 // directly (in time and space) follows the last write.
 // This is an optimisation for streaming writes on NFS where a
@@ -346,6 +441,10 @@ func (f *file) isConsecutiveWrite(off int64) bool {
 //
 // If the write creates a hole, pads the file to the next block boundary.
 func (f *file) Write(data []byte, off int64) (uint32, fuse.Status) {
+	f.fs.touch()
+	if f.fs.args.ReadOnly {
+		return 0, fuse.EROFS
+	}
 	f.fdLock.RLock()
 	defer f.fdLock.RUnlock()
 	if f.released {
@@ -358,10 +457,21 @@ func (f *file) Write(data []byte, off int64) (uint32, fuse.Status) {
 	f.fileTableEntry.ContentLock.Lock()
 	defer f.fileTableEntry.ContentLock.Unlock()
 	tlog.Debug.Printf("ino%d: FUSE Write: offset=%d length=%d", f.qIno.Ino, off, len(data))
-	// If the write creates a file hole, we have to zero-pad the last block.
-	// But if the write directly follows an earlier write, it cannot create a
-	// hole, and we can save one Stat() call.
-	if !f.isConsecutiveWrite(off) {
+	if f.appendMode {
+		// The kernel computes the offset from its cached file size, which is
+		// outdated if another file handle has appended in the meantime. Write
+		// to the actual end of the file instead. Holding the ContentLock makes
+		// this atomic.
+		fi, err := f.fd.Stat()
+		if err != nil {
+			tlog.Warn.Printf("ino%d: Write: Fstat failed: %v", f.qIno.Ino, err)
+			return 0, fuse.ToStatus(err)
+		}
+		off = int64(f.contentEnc.CipherSizeToPlainSize(uint64(fi.Size())))
+	} else if !f.isConsecutiveWrite(off) {
+		// If the write creates a file hole, we have to zero-pad the last block.
+		// But if the write directly follows an earlier write, it cannot create a
+		// hole, and we can save one Stat() call.
 		status := f.writePadHole(off)
 		if !status.Ok() {
 			return 0, status
@@ -371,6 +481,8 @@ func (f *file) Write(data []byte, off int64) (uint32, fuse.Status) {
 	if status.Ok() {
 		f.lastOpCount = openfiletable.WriteOpCount()
 		f.lastWrittenOffset = off + int64(len(data)) - 1
+		atomic.AddUint64(&f.fs.stats.write, 1)
+		atomic.AddUint64(&f.fs.stats.writeBytes, uint64(n))
 	}
 	return n, status
 }
@@ -384,10 +496,18 @@ func (f *file) Release() {
 	f.fd.Close()
 	f.released = true
 	f.fdLock.Unlock()
+	f.invalidateBlockCache()
 
 	openfiletable.Unregister(f.qIno)
 }
 
+// invalidateBlockCache drops the cached decrypted blocks of the file.
+func (f *file) invalidateBlockCache() {
+	f.fileTableEntry.HeaderLock.RLock()
+	f.contentEnc.InvalidateFile(f.fileTableEntry.ID)
+	f.fileTableEntry.HeaderLock.RUnlock()
+}
+
 // Flush - FUSE call
 func (f *file) Flush() fuse.Status {
 	f.fdLock.RLock()
@@ -405,14 +525,27 @@ func (f *file) Flush() fuse.Status {
 	return fuse.ToStatus(err)
 }
 
+// fsyncFdatasync is FUSE_FSYNC_FDATASYNC from the kernel headers. The
+// kernel sets it in the fsync flags when the application called fdatasync(2).
+const fsyncFdatasync = 1
+
+// Fsync - FUSE call. Flushes the ciphertext file to disk. With the datasync
+// flag, metadata that is not needed to read the data back (like the mtime)
+// may stay unsynced.
 func (f *file) Fsync(flags int) (code fuse.Status) {
 	f.fdLock.RLock()
 	defer f.fdLock.RUnlock()
 
+	if flags&fsyncFdatasync != 0 {
+		return fuse.ToStatus(syscallcompat.Fdatasync(int(f.fd.Fd())))
+	}
 	return fuse.ToStatus(syscall.Fsync(int(f.fd.Fd())))
 }
 
 func (f *file) Chmod(mode uint32) fuse.Status {
+	if f.fs.args.ReadOnly {
+		return fuse.EROFS
+	}
 	f.fdLock.RLock()
 	defer f.fdLock.RUnlock()
 
@@ -423,10 +556,13 @@ func (f *file) Chmod(mode uint32) fuse.Status {
 }
 
 func (f *file) Chown(uid uint32, gid uint32) fuse.Status {
+	if f.fs.args.ReadOnly {
+		return fuse.EROFS
+	}
 	f.fdLock.RLock()
 	defer f.fdLock.RUnlock()
 
-	return fuse.ToStatus(f.fd.Chown(int(uid), int(gid)))
+	return fuse.ToStatus(f.fd.Chown(chownID(uid), chownID(gid)))
 }
 
 func (f *file) GetAttr(a *fuse.Attr) fuse.Status {
@@ -449,6 +585,9 @@ func (f *file) GetAttr(a *fuse.Attr) fuse.Status {
 }
 
 func (f *file) Utimens(a *time.Time, m *time.Time) fuse.Status {
+	if f.fs.args.ReadOnly {
+		return fuse.EROFS
+	}
 	f.fdLock.RLock()
 	defer f.fdLock.RUnlock()
 	return f.loopbackFile.Utimens(a, m)
@@ -0,0 +1,72 @@
+package fusefrontend
+
+import (
+	"bytes"
+	"os"
+	"syscall"
+	"testing"
+
+	"github.com/hanwen/go-fuse/fuse"
+)
+
+// Allocate must reserve ciphertext space for an unaligned plaintext range,
+// keep the size with FALLOC_FL_KEEP_SIZE and grow it otherwise
+func TestAllocate(t *testing.T) {
+	fs, cleanup := newTestFS(t, Args{
+		PlaintextNames: true,
+	})
+	defer cleanup()
+	dir := fs.args.Cipherdir
+	ctx := &fuse.Context{}
+	f, status := fs.Create("file", uint32(os.O_RDWR), 0600, ctx)
+	if !status.Ok() {
+		t.Fatal(status)
+	}
+	defer f.Release()
+	if _, status = f.Write([]byte("x"), 0); !status.Ok() {
+		t.Fatal(status)
+	}
+	cPath := dir + "/file"
+	var st syscall.Stat_t
+	if err := syscall.Stat(cPath, &st); err != nil {
+		t.Fatal(err)
+	}
+	blocksBefore := st.Blocks
+	// Unaligned range spanning three blocks
+	status = f.Allocate(5000, 10000, FALLOC_FL_KEEP_SIZE)
+	if status == fuse.Status(syscall.EOPNOTSUPP) {
+		t.Skip("backing filesystem does not support fallocate")
+	} else if !status.Ok() {
+		t.Fatal(status)
+	}
+	var a fuse.Attr
+	if status = f.GetAttr(&a); !status.Ok() {
+		t.Fatal(status)
+	}
+	if a.Size != 1 {
+		t.Errorf("FALLOC_FL_KEEP_SIZE changed the size to %d", a.Size)
+	}
+	if err := syscall.Stat(cPath, &st); err != nil {
+		t.Fatal(err)
+	}
+	// 10000 bytes of plaintext need at least 10000 bytes of ciphertext,
+	// st_blocks counts 512-byte units
+	if (st.Blocks-blocksBefore)*512 < 10000 {
+		t.Errorf("space was not allocated: %d -> %d blocks", blocksBefore, st.Blocks)
+	}
+	// Default mode grows the file, the new part reads as zeros
+	if status = f.Allocate(5000, 10000, FALLOC_DEFAULT); !status.Ok() {
+		t.Fatal(status)
+	}
+	if status = f.GetAttr(&a); !status.Ok() {
+		t.Fatal(status)
+	}
+	if a.Size != 15000 {
+		t.Errorf("wrong size %d, want 15000", a.Size)
+	}
+	want := make([]byte, 15000)
+	want[0] = 'x'
+	if !bytes.Equal(readAll(t, f, 15000), want) {
+		t.Error("wrong content after allocate")
+	}
+}
@@ -37,6 +37,9 @@ var allocateWarnOnce sync.Once
 //
 // Other modes (hole punching, zeroing) are not supported.
 func (f *file) Allocate(off uint64, sz uint64, mode uint32) fuse.Status {
+	if f.fs.args.ReadOnly {
+		return fuse.EROFS
+	}
 	if mode != FALLOC_DEFAULT && mode != FALLOC_FL_KEEP_SIZE {
 		f := func() {
 			tlog.Warn.Print("fallocate: only mode 0 (default) and 1 (keep size) are supported")
@@ -93,6 +96,9 @@ func (f *file) Allocate(off uint64, sz uint64, mode uint32) fuse.Status {
 
 // Truncate - FUSE call
 func (f *file) Truncate(newSize uint64) fuse.Status {
+	if f.fs.args.ReadOnly {
+		return fuse.EROFS
+	}
 	f.fdLock.RLock()
 	defer f.fdLock.RUnlock()
 	if f.released {
@@ -102,6 +108,9 @@ func (f *file) Truncate(newSize uint64) fuse.Status {
 	}
 	f.fileTableEntry.ContentLock.Lock()
 	defer f.fileTableEntry.ContentLock.Unlock()
+	// Blocks beyond the new end of file are gone and may come back as file
+	// holes
+	f.invalidateBlockCache()
 	var err error
 	// Common case first: Truncate to zero
 	if newSize == 0 {
@@ -146,7 +155,7 @@ func (f *file) Truncate(newSize uint64) fuse.Status {
 		var status fuse.Status
 		data, status = f.doRead(nil, plainOff, lastBlockLen)
 		if status != fuse.OK {
-			tlog.Warn.Printf("Truncate: shrink doRead returned error: %v", err)
+			tlog.Warn.Printf("Truncate: shrink doRead returned error: %v", status)
 			return status
 		}
 	}
@@ -200,7 +209,10 @@ func (f *file) truncateGrowFile(oldPlainSz uint64, newPlainSz uint64) fuse.Statu
 	//
 	// Make sure the old last block is padded to the block boundary. This call
 	// is a no-op if it is already block-aligned.
-	f.zeroPad(oldPlainSz)
+	if status := f.zeroPad(oldPlainSz); !status.Ok() {
+		tlog.Warn.Printf("Truncate: grow zeroPad returned error: %v", status)
+		return status
+	}
 	// The new size is block-aligned. In this case we can do everything ourselves
 	// and avoid the call to doWrite.
 	if newPlainSz%f.contentEnc.PlainBS() == 0 {
@@ -0,0 +1,73 @@
+package fusefrontend
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"runtime"
+	"sync"
+	"syscall"
+	"testing"
+
+	"github.com/hanwen/go-fuse/fuse"
+)
+
+// Concurrent appenders must not overwrite each other, even if they all pass
+// the same outdated offset like the kernel may do
+func TestAppendConcurrent(t *testing.T) {
+	defer runtime.GOMAXPROCS(runtime.GOMAXPROCS(4))
+	fs, cleanup := newTestFS(t, Args{
+		PlaintextNames: true,
+	})
+	defer cleanup()
+	ctx := &fuse.Context{}
+	f, status := fs.Create("file", uint32(os.O_WRONLY), 0600, ctx)
+	if !status.Ok() {
+		t.Fatal(status)
+	}
+	f.Release()
+	const writers = 4
+	const records = 50
+	var wg sync.WaitGroup
+	for i := 0; i < writers; i++ {
+		f, status := fs.Open("file", uint32(os.O_WRONLY|syscall.O_APPEND), ctx)
+		if !status.Ok() {
+			t.Fatal(status)
+		}
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			defer f.Release()
+			for j := 0; j < records; j++ {
+				// Records are 100 bytes, so they straddle the block
+				// boundaries and need read-modify-write of the last block
+				rec := []byte(fmt.Sprintf("%-99s\n", fmt.Sprintf("writer %d record %d", i, j)))
+				if _, status := f.Write(rec, 0); !status.Ok() {
+					t.Error(status)
+					return
+				}
+			}
+		}(i)
+	}
+	wg.Wait()
+	f, status = fs.Open("file", uint32(os.O_RDONLY), ctx)
+	if !status.Ok() {
+		t.Fatal(status)
+	}
+	defer f.Release()
+	content := readAll(t, f, writers*records*100+1)
+	if len(content) != writers*records*100 {
+		t.Fatalf("want %d bytes, have %d", writers*records*100, len(content))
+	}
+	seen := make(map[string]bool)
+	for _, line := range bytes.Split(content[:len(content)-1], []byte("\n")) {
+		seen[string(bytes.TrimSpace(line))] = true
+	}
+	for i := 0; i < writers; i++ {
+		for j := 0; j < records; j++ {
+			if rec := fmt.Sprintf("writer %d record %d", i, j); !seen[rec] {
+				t.Errorf("%q is missing", rec)
+			}
+		}
+	}
+}
@@ -0,0 +1,33 @@
+package fusefrontend
+
+import (
+	"os"
+	"testing"
+
+	"github.com/hanwen/go-fuse/fuse"
+)
+
+// Fsync must reach the ciphertext file, with and without the datasync flag
+func TestFsync(t *testing.T) {
+	fs, cleanup := newTestFS(t, Args{
+		PlaintextNames: true,
+	})
+	defer cleanup()
+	f, status := fs.Create("file", uint32(os.O_RDWR), 0600, &fuse.Context{})
+	if !status.Ok() {
+		t.Fatal(status)
+	}
+	if _, status = f.Write([]byte("hello"), 0); !status.Ok() {
+		t.Fatal(status)
+	}
+	for _, flags := range []int{0, fsyncFdatasync} {
+		if status = f.Fsync(flags); !status.Ok() {
+			t.Errorf("flags=%d: %v", flags, status)
+		}
+	}
+	// The ciphertext fd is closed now, so the call must fail
+	f.Release()
+	if status = f.Fsync(fsyncFdatasync); status.Ok() {
+		t.Error("Fsync after Release succeeded")
+	}
+}
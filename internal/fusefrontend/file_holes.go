@@ -3,11 +3,21 @@ package fusefrontend
 // Helper functions for sparse files (files with holes)
 
 import (
+	"sync"
+
 	"github.com/hanwen/go-fuse/fuse"
 
+	"github.com/rfjakob/gocryptfs/internal/syscallcompat"
 	"github.com/rfjakob/gocryptfs/internal/tlog"
 )
 
+// FALLOC_FL_PUNCH_HOLE deallocates a range of the file. Must be combined with
+// FALLOC_FL_KEEP_SIZE.
+const FALLOC_FL_PUNCH_HOLE = 0x02
+
+// Only warn once
+var punchHoleWarnOnce sync.Once
+
 // Will a write to plaintext offset "targetOff" create a file hole in the
 // ciphertext? If yes, zero-pad the last ciphertext block.
 func (f *file) writePadHole(targetOff int64) fuse.Status {
@@ -53,3 +63,47 @@ func (f *file) zeroPad(plainSize uint64) fuse.Status {
 	_, status := f.doWrite(pad, int64(plainSize))
 	return status
 }
+
+// isAllZero returns true if "b" contains only zero bytes
+func isAllZero(b []byte) bool {
+	for _, v := range b {
+		if v != 0 {
+			return false
+		}
+	}
+	return true
+}
+
+// punchZeroBlocks turns the ciphertext of the all-zero plaintext blocks in
+// "plaintextBlocks", starting at block "firstBlockNo", into file holes.
+// DecryptBlock() returns zeros for a full-sized all-zero ciphertext block, so
+// this does not change the content. Only full blocks qualify, a partial
+// block of zeros would not decrypt. Used for "-sparse".
+//
+// Errors are not fatal: the encrypted zeros are still in place.
+func (f *file) punchZeroBlocks(plaintextBlocks [][]byte, firstBlockNo uint64) {
+	cipherBS := f.contentEnc.CipherBS()
+	// Consecutive zero blocks are punched in one go. "run" is the number of
+	// zero blocks before block "i".
+	run := 0
+	for i := 0; i <= len(plaintextBlocks); i++ {
+		if i < len(plaintextBlocks) && uint64(len(plaintextBlocks[i])) == f.contentEnc.PlainBS() &&
+			isAllZero(plaintextBlocks[i]) {
+			run++
+			continue
+		}
+		if run == 0 {
+			continue
+		}
+		cOff := f.contentEnc.BlockNoToCipherOff(firstBlockNo + uint64(i-run))
+		err := syscallcompat.Fallocate(f.intFd(), FALLOC_FL_PUNCH_HOLE|FALLOC_FL_KEEP_SIZE,
+			int64(cOff), int64(uint64(run)*cipherBS))
+		if err != nil {
+			punchHoleWarnOnce.Do(func() {
+				tlog.Warn.Printf("ino%d: -sparse: punching a hole failed: %v", f.qIno.Ino, err)
+			})
+			return
+		}
+		run = 0
+	}
+}
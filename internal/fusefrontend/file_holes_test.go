@@ -0,0 +1,76 @@
+package fusefrontend
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"syscall"
+	"testing"
+
+	"github.com/hanwen/go-fuse/fuse"
+
+	"github.com/rfjakob/gocryptfs/internal/syscallcompat"
+)
+
+// writeZeroBlocks writes a file that consists of one block of "x", eight
+// blocks of zeros and another block of "x" through a new FS, reads it back
+// and returns the number of allocated 512-byte units of the ciphertext file.
+func writeZeroBlocks(t *testing.T, sparse bool) int64 {
+	fs, cleanup := newTestFS(t, Args{
+		PlaintextNames:   true,
+		Sparse:           sparse,
+		VerifyAfterWrite: true,
+	})
+	defer cleanup()
+	dir := fs.args.Cipherdir
+	ctx := &fuse.Context{}
+	f, status := fs.Create("file", uint32(os.O_RDWR), 0600, ctx)
+	if !status.Ok() {
+		t.Fatal(status)
+	}
+	defer f.Release()
+	const bs = 4096
+	data := make([]byte, 10*bs)
+	copy(data, bytes.Repeat([]byte{'x'}, bs))
+	copy(data[9*bs:], bytes.Repeat([]byte{'x'}, bs))
+	if _, status = f.Write(data, 0); !status.Ok() {
+		t.Fatal(status)
+	}
+	var a fuse.Attr
+	if status = f.GetAttr(&a); !status.Ok() {
+		t.Fatal(status)
+	}
+	if a.Size != uint64(len(data)) {
+		t.Errorf("wrong size %d", a.Size)
+	}
+	if !bytes.Equal(readAll(t, f, len(data)), data) {
+		t.Error("wrong content")
+	}
+	var st syscall.Stat_t
+	if err := syscall.Stat(dir+"/file", &st); err != nil {
+		t.Fatal(err)
+	}
+	return st.Blocks
+}
+
+// With -sparse, all-zero blocks must become holes and still read as zeros
+func TestSparse(t *testing.T) {
+	// Does the backing filesystem support punching holes?
+	probe, err := ioutil.TempFile("", "gocryptfs_sparse")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(probe.Name())
+	probe.Write(make([]byte, 8192))
+	err = syscallcompat.Fallocate(int(probe.Fd()), FALLOC_FL_PUNCH_HOLE|FALLOC_FL_KEEP_SIZE, 0, 4096)
+	probe.Close()
+	if err != nil {
+		t.Skipf("backing filesystem cannot punch holes: %v", err)
+	}
+	dense := writeZeroBlocks(t, false)
+	sparse := writeZeroBlocks(t, true)
+	// The eight zero blocks cover at least six whole 4 KiB filesystem blocks
+	if (dense-sparse)*512 < 6*4096 {
+		t.Errorf("zero blocks were not turned into holes: %d vs %d units", dense, sparse)
+	}
+}
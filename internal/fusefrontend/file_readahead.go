@@ -0,0 +1,146 @@
+package fusefrontend
+
+// Read-ahead for sequential reads, "-readahead"
+
+import (
+	"sync"
+
+	"github.com/hanwen/go-fuse/fuse"
+
+	"github.com/rfjakob/gocryptfs/internal/tlog"
+)
+
+// readAheadMinSeq is the number of consecutive sequential reads after which
+// prefetching starts
+const readAheadMinSeq = 2
+
+// readAhead holds the read-ahead state of a file handle
+type readAhead struct {
+	sync.Mutex
+	// nextOff is where the next read starts if the access is sequential
+	nextOff uint64
+	// seq counts the consecutive sequential reads
+	seq int
+	// buf holds decrypted data starting at plaintext offset bufOff. It is valid
+	// as long as the generation of the file's ContentLock is still gen.
+	bufOff uint64
+	buf    []byte
+	gen    uint64
+	// pending is closed when the running prefetch is done, nil if none runs
+	pending chan struct{}
+	// wg tracks the running prefetch
+	wg sync.WaitGroup
+}
+
+// readAheadGet returns the data for a read of "length" bytes at "off" from the
+// read-ahead buffer, appended to "dst". If a prefetch is running and the
+// access is sequential, it waits for it. ok is false if the caller has to
+// read from disk.
+func (f *file) readAheadGet(dst []byte, off uint64, length uint64) (out []byte, ok bool) {
+	ra := f.readAhead
+	ra.Lock()
+	if off == ra.nextOff {
+		ra.seq++
+	} else {
+		// Random access, prefetching would only waste work
+		ra.seq = 0
+		ra.buf = nil
+	}
+	ra.nextOff = off + length
+	pending := ra.pending
+	if ra.seq < readAheadMinSeq {
+		pending = nil
+	}
+	ra.Unlock()
+	if pending != nil {
+		<-pending
+	}
+	ra.Lock()
+	defer ra.Unlock()
+	if ra.buf == nil || ra.gen != f.fileTableEntry.ContentLock.Generation() {
+		ra.buf = nil
+		return nil, false
+	}
+	if off < ra.bufOff || off+length > ra.bufOff+uint64(len(ra.buf)) {
+		return nil, false
+	}
+	start := off - ra.bufOff
+	return append(dst, ra.buf[start:start+length]...), true
+}
+
+// readAheadStart prefetches the next f.fs.args.ReadAhead bytes in the
+// background if the access is sequential and the buffer runs low.
+func (f *file) readAheadStart() {
+	ra := f.readAhead
+	window := f.fs.args.ReadAhead
+	ra.Lock()
+	defer ra.Unlock()
+	if ra.seq < readAheadMinSeq || ra.pending != nil {
+		return
+	}
+	gen := f.fileTableEntry.ContentLock.Generation()
+	if gen%2 == 1 {
+		// A write is in progress
+		return
+	}
+	// Continue after the buffered data if it is still valid
+	start := ra.nextOff
+	if ra.buf != nil && ra.gen == gen && ra.bufOff <= ra.nextOff && ra.bufOff+uint64(len(ra.buf)) >= ra.nextOff {
+		end := ra.bufOff + uint64(len(ra.buf))
+		if end-ra.nextOff >= window/2 {
+			// Enough data left
+			return
+		}
+		start = end
+	}
+	done := make(chan struct{})
+	ra.pending = done
+	ra.wg.Add(1)
+	go func() {
+		defer ra.wg.Done()
+		defer close(done)
+		var data []byte
+		status := fuse.OK
+		// Keep Release from closing the fd under us
+		f.fdLock.RLock()
+		if f.released {
+			status = fuse.EBADF
+		}
+		// doRead is limited to the size of the request buffer pools
+		for off := start; off < start+window && status.Ok(); off += fuse.MAX_KERNEL_WRITE {
+			n := uint64(fuse.MAX_KERNEL_WRITE)
+			if off+n > start+window {
+				n = start + window - off
+			}
+			l := len(data)
+			data, status = f.doReadSpeculative(data, off, n, true)
+			if uint64(len(data)-l) < n {
+				// End of file
+				break
+			}
+		}
+		f.fdLock.RUnlock()
+		ra.Lock()
+		defer ra.Unlock()
+		ra.pending = nil
+		if !status.Ok() {
+			tlog.Debug.Printf("ino%d: readAhead: doRead returned %v", f.qIno.Ino, status)
+			return
+		}
+		if f.fileTableEntry.ContentLock.Generation() != gen {
+			// The file changed while we were reading
+			return
+		}
+		if ra.buf != nil && ra.gen == gen && ra.bufOff+uint64(len(ra.buf)) == start && ra.nextOff >= ra.bufOff {
+			// Append to the buffer and drop what has already been read
+			skip := ra.nextOff - ra.bufOff
+			if skip > uint64(len(ra.buf)) {
+				skip = uint64(len(ra.buf))
+			}
+			ra.buf = append(ra.buf[skip:], data...)
+			ra.bufOff += skip
+			return
+		}
+		ra.buf, ra.bufOff, ra.gen = data, start, gen
+	}()
+}
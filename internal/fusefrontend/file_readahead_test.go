@@ -0,0 +1,128 @@
+package fusefrontend
+
+import (
+	"bytes"
+	"math/rand"
+	"os"
+	"testing"
+
+	"github.com/hanwen/go-fuse/fuse"
+
+	"github.com/rfjakob/gocryptfs/internal/contentenc"
+	"github.com/rfjakob/gocryptfs/internal/tlog"
+)
+
+// readAt reads "size" bytes at "off" from "f"
+func readAt(t *testing.T, f *file, off int, size int) []byte {
+	buf := make([]byte, size)
+	res, status := f.Read(buf, int64(off))
+	if !status.Ok() {
+		t.Fatal(status)
+	}
+	data, _ := res.Bytes(buf)
+	return append([]byte{}, data...)
+}
+
+// Sequential reads must be served from the read-ahead buffer, random reads
+// must turn it off, and writes through another handle must not return stale
+// data
+func TestReadAhead(t *testing.T) {
+	fs, cleanup := newTestFS(t, Args{
+		PlaintextNames: true,
+		ReadAhead:      300 * 1024,
+	})
+	defer cleanup()
+	content := make([]byte, 1024*1024+1000)
+	rand.Read(content)
+	w := createFile(t, fs, "file", content)
+	defer w.Release()
+	fh, status := fs.Open("file", uint32(os.O_RDONLY), &fuse.Context{})
+	if !status.Ok() {
+		t.Fatal(status)
+	}
+	defer fh.Release()
+	f := fh.(*file)
+	const chunk = 64 * 1024
+	// Read the whole file sequentially
+	for off := 0; off < len(content); off += chunk {
+		end := off + chunk
+		if end > len(content) {
+			end = len(content)
+		}
+		if !bytes.Equal(readAt(t, f, off, chunk), content[off:end]) {
+			t.Fatalf("wrong content at offset %d", off)
+		}
+		if off == 4*chunk {
+			f.readAhead.Lock()
+			active := len(f.readAhead.buf) > 0 || f.readAhead.pending != nil
+			f.readAhead.Unlock()
+			if !active {
+				t.Error("sequential reads did not start read-ahead")
+			}
+		}
+	}
+	// Random access drops the buffer and stops prefetching
+	readAt(t, f, 4096, 100)
+	readAt(t, f, 500000, 100)
+	f.readAhead.wg.Wait()
+	f.readAhead.Lock()
+	if f.readAhead.buf != nil || f.readAhead.seq != 0 {
+		t.Errorf("random access did not reset read-ahead: seq=%d, %d bytes buffered",
+			f.readAhead.seq, len(f.readAhead.buf))
+	}
+	f.readAhead.Unlock()
+	// Fill the buffer again, then overwrite the data behind it
+	for off := 0; off < 4*chunk; off += chunk {
+		readAt(t, f, off, chunk)
+	}
+	f.readAhead.wg.Wait()
+	patch := bytes.Repeat([]byte{'x'}, 1000)
+	if _, status = w.Write(patch, 5*chunk); !status.Ok() {
+		t.Fatal(status)
+	}
+	copy(content[5*chunk:], patch)
+	for off := 4 * chunk; off < 8*chunk; off += chunk {
+		if !bytes.Equal(readAt(t, f, off, chunk), content[off:off+chunk]) {
+			t.Fatalf("stale content at offset %d after write", off)
+		}
+	}
+}
+
+// A corrupt block that is only touched by the prefetch must not be reported,
+// and Release must not close the fd under a running prefetch
+func TestReadAheadSpeculative(t *testing.T) {
+	fs, cleanup := newTestFS(t, Args{
+		PlaintextNames:    true,
+		ReadAhead:         300 * 1024,
+		PanicOnCorruption: true,
+	})
+	defer cleanup()
+	content := make([]byte, 1024*1024)
+	createFile(t, fs, "file", content).Release()
+	// Corrupt block #50, which is inside the first prefetch window
+	cFile, err := os.OpenFile(fs.args.Cipherdir+"/file", os.O_RDWR, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = cFile.WriteAt([]byte{0xff}, int64(contentenc.HeaderLen+50*fs.contentEnc.CipherBS()+20))
+	cFile.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	tlog.Warn.Enabled = false
+	defer func() { tlog.Warn.Enabled = true }()
+	for i := 0; i < 20; i++ {
+		fh, status := fs.Open("file", uint32(os.O_RDONLY), &fuse.Context{})
+		if !status.Ok() {
+			t.Fatal(status)
+		}
+		f := fh.(*file)
+		const chunk = 64 * 1024
+		for off := 0; off < 3*chunk; off += chunk {
+			readAt(t, f, off, chunk)
+		}
+		// Release while the prefetch may still be running
+		fh.Release()
+		f.readAhead.wg.Wait()
+	}
+}
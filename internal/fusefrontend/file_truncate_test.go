@@ -0,0 +1,124 @@
+package fusefrontend
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"syscall"
+	"testing"
+
+	"github.com/hanwen/go-fuse/fuse"
+
+	"github.com/rfjakob/gocryptfs/internal/contentenc"
+)
+
+// Truncating a file to zero must drop the file header, and the next write
+// must create a new one. Reusing the old file ID would also reuse the block
+// nonces of the old content.
+func TestTruncateZeroFreshHeader(t *testing.T) {
+	fs, cleanup := newTestFS(t, Args{
+		PlaintextNames: true,
+	})
+	defer cleanup()
+	dir := fs.args.Cipherdir
+	f, status := fs.Create("file", uint32(os.O_RDWR), 0600, &fuse.Context{})
+	if !status.Ok() {
+		t.Fatal(status)
+	}
+	defer f.Release()
+	cPath := filepath.Join(dir, "file")
+	// headerAndNonce returns the file header and the nonce of block 0
+	headerAndNonce := func() ([]byte, []byte) {
+		c, err := ioutil.ReadFile(cPath)
+		if err != nil {
+			t.Fatal(err)
+		}
+		ivLen := contentenc.DefaultIVBits / 8
+		if len(c) < contentenc.HeaderLen+ivLen {
+			t.Fatalf("ciphertext too short: %d bytes", len(c))
+		}
+		return c[:contentenc.HeaderLen], c[contentenc.HeaderLen : contentenc.HeaderLen+ivLen]
+	}
+	data := []byte("hello world")
+	if _, status = f.Write(data, 0); !status.Ok() {
+		t.Fatal(status)
+	}
+	header1, nonce1 := headerAndNonce()
+
+	if status = f.Truncate(0); !status.Ok() {
+		t.Fatal(status)
+	}
+	fi, err := os.Stat(cPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fi.Size() != 0 {
+		t.Errorf("ciphertext size after truncate to zero: want 0, have %d", fi.Size())
+	}
+
+	if _, status = f.Write(data, 0); !status.Ok() {
+		t.Fatal(status)
+	}
+	header2, nonce2 := headerAndNonce()
+	if bytes.Equal(header1, header2) {
+		t.Error("file header was reused after truncate to zero")
+	}
+	if bytes.Equal(nonce1, nonce2) {
+		t.Error("block nonce was reused after truncate to zero")
+	}
+	if !bytes.Equal(readAll(t, f, 100), data) {
+		t.Error("wrong content after rewrite")
+	}
+}
+
+// Growing and shrinking across block boundaries must keep the content before
+// the new end intact and read back zeros after the old end. Blocks that are
+// skipped entirely when growing must stay file holes.
+func TestTruncateGrowShrink(t *testing.T) {
+	fs, cleanup := newTestFS(t, Args{PlaintextNames: true})
+	defer cleanup()
+	bs := int(contentenc.DefaultBS)
+	want := bytes.Repeat([]byte("0123456789"), bs/2)
+	f := createFile(t, fs, "file", want)
+	defer f.Release()
+	for _, size := range []int{
+		bs + 100,      // shrink into block 1, needs RMW
+		2*bs + 7,      // grow into block 2, pads block 1
+		2*bs + 3000,   // grow within block 2
+		bs,            // shrink to a block boundary
+		10*bs + 1,     // grow past several blocks, creates holes
+		3*bs - 1,      // shrink to one byte short of a boundary
+		3 * bs,        // grow by a single byte
+		5,             // shrink into the first block
+		4*bs + 4095,   // grow from a partial first block
+		4*bs - 2*bs/3, // shrink again
+	} {
+		if status := f.Truncate(uint64(size)); !status.Ok() {
+			t.Fatalf("Truncate(%d): %v", size, status)
+		}
+		if size < len(want) {
+			want = want[:size]
+		} else {
+			want = append(want, make([]byte, size-len(want))...)
+		}
+		have := readAll(t, f, len(want)+bs)
+		if !bytes.Equal(have, want) {
+			t.Fatalf("size %d: wrong content (have %d bytes)", size, len(have))
+		}
+	}
+	// Blocks 1-9 of the 10-block grow were never written
+	if status := f.Truncate(0); !status.Ok() {
+		t.Fatal(status)
+	}
+	if status := f.Truncate(uint64(10*bs + 1)); !status.Ok() {
+		t.Fatal(status)
+	}
+	var st syscall.Stat_t
+	if err := syscall.Stat(filepath.Join(fs.args.Cipherdir, "file"), &st); err != nil {
+		t.Fatal(err)
+	}
+	if st.Blocks*512 >= int64(4*bs) {
+		t.Errorf("grow was not sparse: %d bytes allocated", st.Blocks*512)
+	}
+}
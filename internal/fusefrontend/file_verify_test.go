@@ -0,0 +1,53 @@
+package fusefrontend
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"testing"
+
+	"github.com/hanwen/go-fuse/fuse"
+
+	"github.com/rfjakob/gocryptfs/internal/contentenc"
+	"github.com/rfjakob/gocryptfs/internal/cryptocore"
+	"github.com/rfjakob/gocryptfs/internal/openfiletable"
+)
+
+// TestVerifyWrite writes an encrypted block, then checks that verifyWrite
+// accepts it, and rejects it after the ciphertext has been corrupted behind
+// our back (simulating silent storage corruption).
+func TestVerifyWrite(t *testing.T) {
+	key := make([]byte, cryptocore.KeyLen)
+	cc := cryptocore.New(key, cryptocore.BackendGoGCM, contentenc.DefaultIVBits, true, false)
+	ce := contentenc.New(cc, contentenc.DefaultBS, false)
+	fd, err := ioutil.TempFile("", "gocryptfs_verifywrite")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(fd.Name())
+	defer fd.Close()
+	f := &file{
+		fd:             fd,
+		contentEnc:     ce,
+		fileTableEntry: &openfiletable.Entry{ID: cryptocore.RandBytes(contentenc.DefaultIVBits / 8)},
+	}
+	plaintext := bytes.Repeat([]byte("x"), 100)
+	ciphertext := ce.EncryptBlock(plaintext, 0, f.fileTableEntry.ID)
+	cOff := int64(contentenc.HeaderLen)
+	_, err = fd.WriteAt(ciphertext, cOff)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if status := f.verifyWrite(cOff, len(ciphertext), 0, plaintext); status != fuse.OK {
+		t.Errorf("intact block: want OK, got %v", status)
+	}
+	// Flip one bit in the stored ciphertext
+	ciphertext[len(ciphertext)/2] ^= 1
+	_, err = fd.WriteAt(ciphertext, cOff)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if status := f.verifyWrite(cOff, len(ciphertext), 0, plaintext); status != fuse.EIO {
+		t.Errorf("corrupted block: want EIO, got %v", status)
+	}
+}
@@ -0,0 +1,61 @@
+package fusefrontend
+
+import (
+	"bytes"
+	"os"
+	"testing"
+
+	"github.com/hanwen/go-fuse/fuse"
+)
+
+// Partial-block writes need a read-modify-write cycle. This must work on
+// files that are opened O_WRONLY, also when the file permissions do not allow
+// reading.
+func TestWriteOnlyRMW(t *testing.T) {
+	fs, cleanup := newTestFS(t, Args{PlaintextNames: true})
+	defer cleanup()
+	ctx := &fuse.Context{}
+	content := bytes.Repeat([]byte{'a'}, 2*4096+2000)
+	f := createFile(t, fs, "file", content)
+	f.Release()
+	// Middle of block 1, and across the end of the partial trailing block
+	writes := []struct {
+		off  int
+		data string
+	}{{5000, "bbb"}, {len(content) - 2, "cccc"}}
+	for _, perms := range []uint32{0600, 0200} {
+		if status := fs.Chmod("file", perms, ctx); !status.Ok() {
+			t.Fatal(status)
+		}
+		f, status := fs.Open("file", uint32(os.O_WRONLY), ctx)
+		if !status.Ok() {
+			t.Fatalf("perms %#o: %v", perms, status)
+		}
+		for _, w := range writes {
+			if _, status = f.Write([]byte(w.data), int64(w.off)); !status.Ok() {
+				t.Fatalf("perms %#o: %v", perms, status)
+			}
+		}
+		f.Release()
+		a, status := fs.GetAttr("file", ctx)
+		if !status.Ok() {
+			t.Fatal(status)
+		}
+		if a.Mode&07777 != perms {
+			t.Errorf("permissions changed from %#o to %#o", perms, a.Mode&07777)
+		}
+	}
+	want := append(content[:len(content)-2], "cccc"...)
+	copy(want[5000:], "bbb")
+	if status := fs.Chmod("file", 0600, ctx); !status.Ok() {
+		t.Fatal(status)
+	}
+	f, status := fs.Open("file", uint32(os.O_RDONLY), ctx)
+	if !status.Ok() {
+		t.Fatal(status)
+	}
+	defer f.Release()
+	if have := readAll(t, f, len(want)+100); !bytes.Equal(have, want) {
+		t.Errorf("wrong content: have %d bytes, want %d", len(have), len(want))
+	}
+}
@@ -7,6 +7,7 @@ import (
 	"os"
 	"path/filepath"
 	"sync"
+	"sync/atomic"
 	"syscall"
 	"time"
 
@@ -26,6 +27,10 @@ import (
 
 // FS implements the go-fuse virtual filesystem interface.
 type FS struct {
+	// lastAccess is the time of the last FUSE operation in nanoseconds since
+	// the epoch, see LastAccess(). Accessed atomically, so it must stay
+	// the first field for 64-bit alignment on 32-bit platforms.
+	lastAccess        int64
 	pathfs.FileSystem      // loopbackFileSystem, see go-fuse/fuse/pathfs/loopback.go
 	args              Args // Stores configuration arguments
 	// dirIVLock: Lock()ed if any "gocryptfs.diriv" file is modified
@@ -39,31 +44,45 @@ type FS struct {
 	// This lock is used by openWriteOnlyFile() to block concurrent opens while
 	// it relaxes the permissions on a file.
 	openWriteOnlyLock sync.RWMutex
+	// stats counts operations for the "STATS" control socket command
+	stats *opStats
 }
 
 var _ pathfs.FileSystem = &FS{} // Verify that interface is implemented.
 
+// symlinkTargetMax is the longest symlink target Linux accepts (PATH_MAX
+// minus the terminating null byte).
+const symlinkTargetMax = 4095
+
 // NewFS returns a new encrypted FUSE overlay filesystem.
 func NewFS(masterkey []byte, args Args) *FS {
 	cryptoCore := cryptocore.New(masterkey, args.CryptoBackend, contentenc.DefaultIVBits, args.HKDF, args.ForceDecode)
 	contentEnc := contentenc.New(cryptoCore, contentenc.DefaultBS, args.ForceDecode)
+	contentEnc.SetBlockCache(args.BlockCache)
 	nameTransform := nametransform.New(cryptoCore.EMECipher, args.LongNames, args.Raw64)
+	nameTransform.SetCaseInsensitive(args.CaseInsensitive)
+	if args.DirIVCacheSize > 0 {
+		nameTransform.DirIVCache.SetMaxEntries(args.DirIVCacheSize)
+	}
 
 	if args.SerializeReads {
 		serialize_reads.InitSerializer()
 	}
 
 	return &FS{
+		lastAccess:    time.Now().UnixNano(),
 		FileSystem:    pathfs.NewLoopbackFileSystem(args.Cipherdir),
 		args:          args,
 		nameTransform: nameTransform,
 		contentEnc:    contentEnc,
+		stats:         &opStats{},
 	}
 }
 
 // GetAttr implements pathfs.Filesystem.
 func (fs *FS) GetAttr(name string, context *fuse.Context) (*fuse.Attr, fuse.Status) {
 	tlog.Debug.Printf("FS.GetAttr('%s')", name)
+	atomic.AddUint64(&fs.stats.getAttr, 1)
 	if fs.isFiltered(name) {
 		return nil, fuse.EPERM
 	}
@@ -104,9 +123,14 @@ func (fs *FS) mangleOpenFlags(flags uint32) (newFlags int) {
 
 // Open implements pathfs.Filesystem.
 func (fs *FS) Open(path string, flags uint32, context *fuse.Context) (fuseFile nodefs.File, status fuse.Status) {
+	fs.touch()
+	atomic.AddUint64(&fs.stats.open, 1)
 	if fs.isFiltered(path) {
 		return nil, fuse.EPERM
 	}
+	if fs.args.ReadOnly && flags&syscall.O_ACCMODE != syscall.O_RDONLY {
+		return nil, fuse.EROFS
+	}
 	// Taking this lock makes sure we don't race openWriteOnlyFile()
 	fs.openWriteOnlyLock.RLock()
 	defer fs.openWriteOnlyLock.RUnlock()
@@ -127,18 +151,18 @@ func (fs *FS) Open(path string, flags uint32, context *fuse.Context) (fuseFile n
 			tlog.Warn.Printf("Open %q: too many open files. Current \"ulimit -n\": %d", cPath, lim.Cur)
 		}
 		if sysErr == syscall.EACCES && (int(flags)&os.O_WRONLY > 0) {
-			return fs.openWriteOnlyFile(cPath, newFlags)
+			return fs.openWriteOnlyFile(cPath, newFlags, flags)
 		}
 		return nil, fuse.ToStatus(err)
 	}
-	return NewFile(f, fs)
+	return NewFile(f, fs, flags)
 }
 
 // Due to RMW, we always need read permissions on the backing file. This is a
 // problem if the file permissions do not allow reading (i.e. 0200 permissions).
 // This function works around that problem by chmod'ing the file, obtaining a fd,
 // and chmod'ing it back.
-func (fs *FS) openWriteOnlyFile(cPath string, newFlags int) (fuseFile nodefs.File, status fuse.Status) {
+func (fs *FS) openWriteOnlyFile(cPath string, newFlags int, flags uint32) (fuseFile nodefs.File, status fuse.Status) {
 	woFd, err := os.OpenFile(cPath, os.O_WRONLY, 0)
 	if err != nil {
 		return nil, fuse.ToStatus(err)
@@ -177,11 +201,16 @@ func (fs *FS) openWriteOnlyFile(cPath string, newFlags int) (fuseFile nodefs.Fil
 	if err != nil {
 		return nil, fuse.ToStatus(err)
 	}
-	return NewFile(rwFd, fs)
+	return NewFile(rwFd, fs, flags)
 }
 
 // Create implements pathfs.Filesystem.
 func (fs *FS) Create(path string, flags uint32, mode uint32, context *fuse.Context) (fuseFile nodefs.File, code fuse.Status) {
+	fs.touch()
+	atomic.AddUint64(&fs.stats.create, 1)
+	if fs.args.ReadOnly {
+		return nil, fuse.EROFS
+	}
 	if fs.isFiltered(path) {
 		return nil, fuse.EPERM
 	}
@@ -190,6 +219,15 @@ func (fs *FS) Create(path string, flags uint32, mode uint32, context *fuse.Conte
 	if err != nil {
 		return nil, fuse.ToStatus(err)
 	}
+	// Runs after syncDir. go-fuse drops the file without calling Release if
+	// we return an error, so we have to close it ourselves.
+	defer func() {
+		if !code.Ok() && fuseFile != nil {
+			fuseFile.Release()
+			fuseFile = nil
+		}
+	}()
+	defer fs.syncDir(&code, filepath.Dir(cPath))
 
 	var fd *os.File
 	cName := filepath.Base(cPath)
@@ -231,11 +269,14 @@ func (fs *FS) Create(path string, flags uint32, mode uint32, context *fuse.Conte
 			tlog.Warn.Printf("Create: fd.Chown failed: %v", err)
 		}
 	}
-	return NewFile(fd, fs)
+	return NewFile(fd, fs, flags)
 }
 
 // Chmod implements pathfs.Filesystem.
 func (fs *FS) Chmod(path string, mode uint32, context *fuse.Context) (code fuse.Status) {
+	if fs.args.ReadOnly {
+		return fuse.EROFS
+	}
 	if fs.isFiltered(path) {
 		return fuse.EPERM
 	}
@@ -252,6 +293,9 @@ func (fs *FS) Chmod(path string, mode uint32, context *fuse.Context) (code fuse.
 
 // Chown implements pathfs.Filesystem.
 func (fs *FS) Chown(path string, uid uint32, gid uint32, context *fuse.Context) (code fuse.Status) {
+	if fs.args.ReadOnly {
+		return fuse.EROFS
+	}
 	if fs.isFiltered(path) {
 		return fuse.EPERM
 	}
@@ -260,7 +304,7 @@ func (fs *FS) Chown(path string, uid uint32, gid uint32, context *fuse.Context)
 		return fuse.ToStatus(err)
 	}
 	defer dirfd.Close()
-	code = fuse.ToStatus(syscallcompat.Fchownat(int(dirfd.Fd()), cName, int(uid), int(gid), unix.AT_SYMLINK_NOFOLLOW))
+	code = fuse.ToStatus(syscallcompat.Fchownat(int(dirfd.Fd()), cName, chownID(uid), chownID(gid), unix.AT_SYMLINK_NOFOLLOW))
 	if !code.Ok() {
 		return code
 	}
@@ -270,13 +314,26 @@ func (fs *FS) Chown(path string, uid uint32, gid uint32, context *fuse.Context)
 		// Instead of checking if "cName" is a directory, we just blindly
 		// execute the chown on "cName/gocryptfs.diriv" and ignore errors.
 		dirIVPath := filepath.Join(cName, nametransform.DirIVFilename)
-		syscallcompat.Fchownat(int(dirfd.Fd()), dirIVPath, int(uid), int(gid), unix.AT_SYMLINK_NOFOLLOW)
+		syscallcompat.Fchownat(int(dirfd.Fd()), dirIVPath, chownID(uid), chownID(gid), unix.AT_SYMLINK_NOFOLLOW)
 	}
 	return fuse.OK
 }
 
+// chownID converts a uid or gid from FUSE to what chown(2) expects. go-fuse
+// passes ^uint32(0) for "do not change", which has to become -1. Plain int()
+// would turn it into 4294967295.
+func chownID(id uint32) int {
+	if id == ^uint32(0) {
+		return -1
+	}
+	return int(id)
+}
+
 // Mknod implements pathfs.Filesystem.
 func (fs *FS) Mknod(path string, mode uint32, dev uint32, context *fuse.Context) (code fuse.Status) {
+	if fs.args.ReadOnly {
+		return fuse.EROFS
+	}
 	if fs.isFiltered(path) {
 		return fuse.EPERM
 	}
@@ -285,6 +342,7 @@ func (fs *FS) Mknod(path string, mode uint32, dev uint32, context *fuse.Context)
 		return fuse.ToStatus(err)
 	}
 	defer dirfd.Close()
+	defer fs.syncDir(&code, dirfd.Name())
 	// Create ".name" file to store long file name (except in PlaintextNames mode)
 	if !fs.args.PlaintextNames && nametransform.IsLongContent(cName) {
 		err = fs.nameTransform.WriteLongName(dirfd, cName, path)
@@ -301,6 +359,12 @@ func (fs *FS) Mknod(path string, mode uint32, dev uint32, context *fuse.Context)
 		err = syscallcompat.Mknodat(int(dirfd.Fd()), cName, mode, int(dev))
 	}
 	if err != nil {
+		typ := mode & syscall.S_IFMT
+		if err == syscall.EPERM && (typ == syscall.S_IFCHR || typ == syscall.S_IFBLK) {
+			// FIFOs and sockets work for everybody, device nodes need
+			// CAP_MKNOD in CIPHERDIR's user namespace
+			tlog.Warn.Printf("Mknod: creating a device node in CIPHERDIR requires root privileges")
+		}
 		return fuse.ToStatus(err)
 	}
 	// Set owner
@@ -319,6 +383,9 @@ func (fs *FS) Mknod(path string, mode uint32, dev uint32, context *fuse.Context)
 // While the glibc "truncate" wrapper seems to always use ftruncate, fsstress from
 // xfstests uses this a lot by calling "truncate64" directly.
 func (fs *FS) Truncate(path string, offset uint64, context *fuse.Context) (code fuse.Status) {
+	if fs.args.ReadOnly {
+		return fuse.EROFS
+	}
 	file, code := fs.Open(path, uint32(os.O_RDWR), context)
 	if code != fuse.OK {
 		return code
@@ -330,6 +397,9 @@ func (fs *FS) Truncate(path string, offset uint64, context *fuse.Context) (code
 
 // Utimens implements pathfs.Filesystem.
 func (fs *FS) Utimens(path string, a *time.Time, m *time.Time, context *fuse.Context) (code fuse.Status) {
+	if fs.args.ReadOnly {
+		return fuse.EROFS
+	}
 	if fs.isFiltered(path) {
 		return fuse.EPERM
 	}
@@ -341,6 +411,8 @@ func (fs *FS) Utimens(path string, a *time.Time, m *time.Time, context *fuse.Con
 }
 
 // StatFs implements pathfs.Filesystem.
+// The sizes are converted to what the plaintext view can hold, see
+// removeStatfsOverhead.
 func (fs *FS) StatFs(path string) *fuse.StatfsOut {
 	if fs.isFiltered(path) {
 		return nil
@@ -349,7 +421,50 @@ func (fs *FS) StatFs(path string) *fuse.StatfsOut {
 	if err != nil {
 		return nil
 	}
-	return fs.FileSystem.StatFs(cPath)
+	out := fs.FileSystem.StatFs(cPath)
+	if out != nil {
+		fs.removeStatfsOverhead(out)
+	}
+	return out
+}
+
+// removeStatfsOverhead converts the statfs numbers of CIPHERDIR to the
+// plaintext view. Every ciphertext block carries the block overhead, and every
+// used inode is assumed to be a file that carries a file header.
+// This is an approximation: statfs only knows the totals of the whole
+// underlying filesystem, not of CIPHERDIR. If CIPHERDIR shares the filesystem
+// with other data, the used inodes of that data are counted as file headers
+// as well. Directories and small files are not accounted for exactly either.
+// Counting the inodes in CIPHERDIR would mean walking the whole tree on
+// every statfs call.
+func (fs *FS) removeStatfsOverhead(out *fuse.StatfsOut) {
+	// The block counts are in units of the fragment size (f_frsize), which
+	// is what "df" uses as well
+	unit := uint64(out.Frsize)
+	if unit == 0 {
+		unit = uint64(out.Bsize)
+	}
+	if unit == 0 || out.Bfree > out.Blocks {
+		return
+	}
+	plainBS := fs.contentEnc.PlainBS()
+	cipherBS := fs.contentEnc.CipherBS()
+	// unscale converts a number of ciphertext bytes to plaintext bytes,
+	// without overflowing for large filesystems
+	unscale := func(cipherBytes uint64) uint64 {
+		return cipherBytes/cipherBS*plainBS + cipherBytes%cipherBS*plainBS/cipherBS
+	}
+	usedBytes := unscale((out.Blocks - out.Bfree) * unit)
+	if out.Ffree <= out.Files {
+		headers := (out.Files - out.Ffree) * contentenc.HeaderLen
+		if headers < usedBytes {
+			usedBytes -= headers
+		}
+	}
+	pUsed := (usedBytes + unit - 1) / unit
+	out.Bfree = unscale(out.Bfree*unit) / unit
+	out.Bavail = unscale(out.Bavail*unit) / unit
+	out.Blocks = out.Bfree + pUsed
 }
 
 // Readlink implements pathfs.Filesystem.
@@ -373,7 +488,7 @@ func (fs *FS) Readlink(path string, context *fuse.Context) (out string, status f
 	}
 	target, err := fs.contentEnc.DecryptBlock([]byte(cBinTarget), 0, nil)
 	if err != nil {
-		tlog.Warn.Printf("Readlink: %v", err)
+		fs.reportCorruption("Readlink %q: %v", cPath, err)
 		return "", fuse.EIO
 	}
 	return string(target), fuse.OK
@@ -381,6 +496,9 @@ func (fs *FS) Readlink(path string, context *fuse.Context) (out string, status f
 
 // Unlink implements pathfs.Filesystem.
 func (fs *FS) Unlink(path string, context *fuse.Context) (code fuse.Status) {
+	if fs.args.ReadOnly {
+		return fuse.EROFS
+	}
 	if fs.isFiltered(path) {
 		return fuse.EPERM
 	}
@@ -389,6 +507,7 @@ func (fs *FS) Unlink(path string, context *fuse.Context) (code fuse.Status) {
 		return fuse.ToStatus(err)
 	}
 	defer dirfd.Close()
+	defer fs.syncDir(&code, dirfd.Name())
 	// Delete content
 	err = syscallcompat.Unlinkat(int(dirfd.Fd()), cName, 0)
 	if err != nil {
@@ -406,6 +525,9 @@ func (fs *FS) Unlink(path string, context *fuse.Context) (code fuse.Status) {
 
 // Symlink implements pathfs.Filesystem.
 func (fs *FS) Symlink(target string, linkName string, context *fuse.Context) (code fuse.Status) {
+	if fs.args.ReadOnly {
+		return fuse.EROFS
+	}
 	tlog.Debug.Printf("Symlink(\"%s\", \"%s\")", target, linkName)
 	if fs.isFiltered(linkName) {
 		return fuse.EPERM
@@ -415,11 +537,20 @@ func (fs *FS) Symlink(target string, linkName string, context *fuse.Context) (co
 		return fuse.ToStatus(err)
 	}
 	defer dirfd.Close()
+	defer fs.syncDir(&code, dirfd.Name())
 	var cTarget string = target
 	if !fs.args.PlaintextNames {
 		// Symlinks are encrypted like file contents (GCM) and base64-encoded
 		cBinTarget := fs.contentEnc.EncryptBlock([]byte(target), 0, nil)
 		cTarget = fs.nameTransform.B64.EncodeToString(cBinTarget)
+		// Encryption and base64 make the target about 4/3 longer plus 43
+		// bytes. Fail before creating a ".name" file if the kernel would
+		// reject it.
+		if len(cTarget) > symlinkTargetMax {
+			tlog.Debug.Printf("Symlink: encrypted target is %d bytes long, max is %d",
+				len(cTarget), symlinkTargetMax)
+			return fuse.Status(syscall.ENAMETOOLONG)
+		}
 	}
 	// Create ".name" file to store long file name (except in PlaintextNames mode)
 	if !fs.args.PlaintextNames && nametransform.IsLongContent(cName) {
@@ -452,6 +583,9 @@ func (fs *FS) Symlink(target string, linkName string, context *fuse.Context) (co
 
 // Rename implements pathfs.Filesystem.
 func (fs *FS) Rename(oldPath string, newPath string, context *fuse.Context) (code fuse.Status) {
+	if fs.args.ReadOnly {
+		return fuse.EROFS
+	}
 	if fs.isFiltered(newPath) {
 		return fuse.EPERM
 	}
@@ -463,9 +597,27 @@ func (fs *FS) Rename(oldPath string, newPath string, context *fuse.Context) (cod
 	if err != nil {
 		return fuse.ToStatus(err)
 	}
+	// In case-insensitive mode, "mv foo Foo" resolves the destination to the
+	// source. Rename to the new case instead of doing nothing.
+	if cNewPath == cOldPath && newPath != oldPath {
+		cNewPath, err = fs.getBackingPathKeepCase(newPath)
+		if err != nil {
+			return fuse.ToStatus(err)
+		}
+	}
+	defer fs.syncDir(&code, filepath.Dir(cOldPath))
+	if filepath.Dir(cNewPath) != filepath.Dir(cOldPath) {
+		defer fs.syncDir(&code, filepath.Dir(cNewPath))
+	}
 	// The Rename may cause a directory to take the place of another directory.
-	// That directory may still be in the DirIV cache, clear it.
-	fs.nameTransform.DirIVCache.Clear()
+	// That directory may still be in the DirIV cache, drop it. The old path
+	// becomes invalid as well.
+	fs.nameTransform.DirIVCache.Delete(oldPath)
+	fs.nameTransform.DirIVCache.Delete(newPath)
+	// A concurrent lookup may re-populate the cache with the old path before
+	// the rename has happened. Drop it again once we are done.
+	defer fs.nameTransform.DirIVCache.Delete(oldPath)
+	defer fs.nameTransform.DirIVCache.Delete(newPath)
 	// Easy case.
 	if fs.args.PlaintextNames {
 		return fuse.ToStatus(syscall.Rename(cOldPath, cNewPath))
@@ -540,6 +692,9 @@ func (fs *FS) Rename(oldPath string, newPath string, context *fuse.Context) (cod
 
 // Link implements pathfs.Filesystem.
 func (fs *FS) Link(oldPath string, newPath string, context *fuse.Context) (code fuse.Status) {
+	if fs.args.ReadOnly {
+		return fuse.EROFS
+	}
 	if fs.isFiltered(newPath) {
 		return fuse.EPERM
 	}
@@ -553,6 +708,7 @@ func (fs *FS) Link(oldPath string, newPath string, context *fuse.Context) (code
 		return fuse.ToStatus(err)
 	}
 	defer newDirFd.Close()
+	defer fs.syncDir(&code, newDirFd.Name())
 	// Handle long file name (except in PlaintextNames mode)
 	if !fs.args.PlaintextNames && nametransform.IsLongContent(cNewName) {
 		err = fs.nameTransform.WriteLongName(newDirFd, cNewName, newPath)
@@ -582,23 +738,3 @@ func (fs *FS) Access(path string, mode uint32, context *fuse.Context) (code fuse
 	}
 	return fuse.ToStatus(syscall.Access(cPath, mode))
 }
-
-// GetXAttr implements pathfs.Filesystem.
-func (fs *FS) GetXAttr(name string, attr string, context *fuse.Context) ([]byte, fuse.Status) {
-	return nil, fuse.ENOSYS
-}
-
-// SetXAttr implements pathfs.Filesystem.
-func (fs *FS) SetXAttr(name string, attr string, data []byte, flags int, context *fuse.Context) fuse.Status {
-	return fuse.ENOSYS
-}
-
-// ListXAttr implements pathfs.Filesystem.
-func (fs *FS) ListXAttr(name string, context *fuse.Context) ([]string, fuse.Status) {
-	return nil, fuse.ENOSYS
-}
-
-// RemoveXAttr implements pathfs.Filesystem.
-func (fs *FS) RemoveXAttr(name string, attr string, context *fuse.Context) fuse.Status {
-	return fuse.ENOSYS
-}
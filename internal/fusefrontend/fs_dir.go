@@ -8,13 +8,13 @@ import (
 	"os"
 	"path/filepath"
 	"runtime"
+	"sync/atomic"
 	"syscall"
 
 	"golang.org/x/sys/unix"
 
 	"github.com/hanwen/go-fuse/fuse"
 
-	"github.com/rfjakob/gocryptfs/internal/configfile"
 	"github.com/rfjakob/gocryptfs/internal/cryptocore"
 	"github.com/rfjakob/gocryptfs/internal/nametransform"
 	"github.com/rfjakob/gocryptfs/internal/syscallcompat"
@@ -25,14 +25,15 @@ const dsStoreName = ".DS_Store"
 
 // mkdirWithIv - create a new directory and corresponding diriv file. dirfd
 // should be a handle to the parent directory, cName is the name of the new
-// directory and mode specifies the access permissions to use.
-func (fs *FS) mkdirWithIv(dirfd *os.File, cName string, mode uint32) error {
+// directory, newPath its plaintext path and mode specifies the access
+// permissions to use.
+func (fs *FS) mkdirWithIv(dirfd *os.File, cName string, newPath string, mode uint32) error {
 	// Between the creation of the directory and the creation of gocryptfs.diriv
 	// the directory is inconsistent. Take the lock to prevent other readers
 	// from seeing it.
 	fs.dirIVLock.Lock()
 	// The new directory may take the place of an older one that is still in the cache
-	fs.nameTransform.DirIVCache.Clear()
+	fs.nameTransform.DirIVCache.Delete(newPath)
 	defer fs.dirIVLock.Unlock()
 	err := syscallcompat.Mkdirat(int(dirfd.Fd()), cName, mode)
 	if err != nil {
@@ -51,6 +52,9 @@ func (fs *FS) mkdirWithIv(dirfd *os.File, cName string, mode uint32) error {
 
 // Mkdir implements pathfs.FileSystem
 func (fs *FS) Mkdir(newPath string, mode uint32, context *fuse.Context) (code fuse.Status) {
+	if fs.args.ReadOnly {
+		return fuse.EROFS
+	}
 	if fs.isFiltered(newPath) {
 		return fuse.EPERM
 	}
@@ -59,6 +63,7 @@ func (fs *FS) Mkdir(newPath string, mode uint32, context *fuse.Context) (code fu
 		return fuse.ToStatus(err)
 	}
 	defer dirfd.Close()
+	defer fs.syncDir(&code, dirfd.Name())
 	if fs.args.PlaintextNames {
 		err = syscallcompat.Mkdirat(int(dirfd.Fd()), cName, mode)
 		// Set owner
@@ -72,6 +77,8 @@ func (fs *FS) Mkdir(newPath string, mode uint32, context *fuse.Context) (code fu
 		return fuse.ToStatus(err)
 	}
 
+	// The new directory contains gocryptfs.diriv
+	defer fs.syncDir(&code, filepath.Join(dirfd.Name(), cName))
 	// We need write and execute permissions to create gocryptfs.diriv
 	origMode := mode
 	mode = mode | 0300
@@ -85,13 +92,13 @@ func (fs *FS) Mkdir(newPath string, mode uint32, context *fuse.Context) (code fu
 		}
 
 		// Create directory
-		err = fs.mkdirWithIv(dirfd, cName, mode)
+		err = fs.mkdirWithIv(dirfd, cName, newPath, mode)
 		if err != nil {
 			nametransform.DeleteLongName(dirfd, cName)
 			return fuse.ToStatus(err)
 		}
 	} else {
-		err = fs.mkdirWithIv(dirfd, cName, mode)
+		err = fs.mkdirWithIv(dirfd, cName, newPath, mode)
 		if err != nil {
 			return fuse.ToStatus(err)
 		}
@@ -131,10 +138,14 @@ func haveDsstore(names []string) bool {
 
 // Rmdir implements pathfs.FileSystem
 func (fs *FS) Rmdir(path string, context *fuse.Context) (code fuse.Status) {
+	if fs.args.ReadOnly {
+		return fuse.EROFS
+	}
 	cPath, err := fs.getBackingPath(path)
 	if err != nil {
 		return fuse.ToStatus(err)
 	}
+	defer fs.syncDir(&code, filepath.Dir(cPath))
 	if fs.args.PlaintextNames {
 		err = syscall.Rmdir(cPath)
 		return fuse.ToStatus(err)
@@ -211,9 +222,21 @@ retry:
 		tlog.Warn.Printf("Rmdir: had to delete blocking file %q", ds)
 		goto retry
 	}
+	// The directory comment goes away together with the directory. It is
+	// moved out together with gocryptfs.diriv below.
+	haveComment := false
+	if len(children) == 2 {
+		for i, n := range children {
+			if n == DirCommentFilename {
+				haveComment = true
+				children = append(children[:i], children[i+1:]...)
+				break
+			}
+		}
+	}
 	// If the directory is not empty besides gocryptfs.diriv, do not even
 	// attempt the dance around gocryptfs.diriv.
-	if len(children) > 1 {
+	if len(children) > 1 || children[0] != nametransform.DirIVFilename {
 		return fuse.ToStatus(syscall.ENOTEMPTY)
 	}
 	// Move "gocryptfs.diriv" to the parent dir as "gocryptfs.diriv.rmdir.XYZ"
@@ -230,16 +253,39 @@ retry:
 			nametransform.DirIVFilename, tmpName, err)
 		return fuse.ToStatus(err)
 	}
-	// Actual Rmdir
-	err = syscallcompat.Unlinkat(int(parentDirFd.Fd()), cName, unix.AT_REMOVEDIR)
-	if err != nil {
-		// This can happen if another file in the directory was created in the
-		// meantime, undo the rename
+	// Move "gocryptfs.comment" to the parent dir as "gocryptfs.comment.rmdir.XYZ"
+	tmpComment := fmt.Sprintf("%s.rmdir.%d", DirCommentFilename, cryptocore.RandUint64())
+	// rollback moves the files back into the directory
+	rollback := func(comment bool) {
+		if comment {
+			err2 := syscallcompat.Renameat(int(parentDirFd.Fd()), tmpComment,
+				int(dirfd.Fd()), DirCommentFilename)
+			if err2 != nil {
+				tlog.Warn.Printf("Rmdir: Rename rollback of %s failed: %v", DirCommentFilename, err2)
+			}
+		}
 		err2 := syscallcompat.Renameat(int(parentDirFd.Fd()), tmpName,
 			int(dirfd.Fd()), nametransform.DirIVFilename)
-		if err != nil {
+		if err2 != nil {
 			tlog.Warn.Printf("Rmdir: Rename rollback failed: %v", err2)
 		}
+	}
+	if haveComment {
+		err = syscallcompat.Renameat(int(dirfd.Fd()), DirCommentFilename,
+			int(parentDirFd.Fd()), tmpComment)
+		if err != nil {
+			tlog.Warn.Printf("Rmdir: Renaming %s to %s failed: %v",
+				DirCommentFilename, tmpComment, err)
+			rollback(false)
+			return fuse.ToStatus(err)
+		}
+	}
+	// Actual Rmdir
+	err = syscallcompat.Unlinkat(int(parentDirFd.Fd()), cName, unix.AT_REMOVEDIR)
+	if err != nil {
+		// This can happen if another file in the directory was created in the
+		// meantime, undo the renames
+		rollback(haveComment)
 		return fuse.ToStatus(err)
 	}
 	// Delete "gocryptfs.diriv.rmdir.XYZ"
@@ -247,17 +293,26 @@ retry:
 	if err != nil {
 		tlog.Warn.Printf("Rmdir: Could not clean up %s: %v", tmpName, err)
 	}
+	// Delete "gocryptfs.comment.rmdir.XYZ"
+	if haveComment {
+		err = syscallcompat.Unlinkat(int(parentDirFd.Fd()), tmpComment, 0)
+		if err != nil {
+			tlog.Warn.Printf("Rmdir: Could not clean up %s: %v", tmpComment, err)
+		}
+	}
 	// Delete .name file
 	if nametransform.IsLongContent(cName) {
 		nametransform.DeleteLongName(parentDirFd, cName)
 	}
-	// The now-deleted directory may have been in the DirIV cache. Clear it.
-	fs.nameTransform.DirIVCache.Clear()
+	// The now-deleted directory may have been in the DirIV cache. Drop it.
+	fs.nameTransform.DirIVCache.Delete(path)
 	return fuse.OK
 }
 
 // OpenDir implements pathfs.FileSystem
 func (fs *FS) OpenDir(dirName string, context *fuse.Context) ([]fuse.DirEntry, fuse.Status) {
+	fs.touch()
+	atomic.AddUint64(&fs.stats.openDir, 1)
 	tlog.Debug.Printf("OpenDir(%s)", dirName)
 	cDirName, err := fs.encryptPath(dirName)
 	if err != nil {
@@ -282,10 +337,24 @@ func (fs *FS) OpenDir(dirName string, context *fuse.Context) ([]fuse.DirEntry, f
 		cachedIV, _ = fs.nameTransform.DirIVCache.Lookup(dirName)
 		if cachedIV == nil {
 			// Read the DirIV from disk and store it in the cache
-			fs.dirIVLock.RLock()
-			cachedIV, err = nametransform.ReadDirIV(cDirAbsPath)
+			err = nametransform.RetryDirIV(func() (err error) {
+				fs.dirIVLock.RLock()
+				defer fs.dirIVLock.RUnlock()
+				cachedIV, err = nametransform.ReadDirIV(cDirAbsPath)
+				if err == nil {
+					fs.nameTransform.DirIVCache.Store(dirName, cachedIV, cDirName)
+				}
+				return err
+			})
 			if err != nil {
-				fs.dirIVLock.RUnlock()
+				if err == syscall.EINVAL {
+					// The file exists but has the wrong size or is all-zero
+					fs.reportCorruption("OpenDir %q: invalid %s", cDirName, nametransform.DirIVFilename)
+					return nil, fuse.EIO
+				}
+				if err = fs.checkDirIVMissing(err); err == syscall.EIO {
+					return nil, fuse.EIO
+				}
 				// This can happen during normal operation when the directory has
 				// been deleted concurrently. But it can also mean that the
 				// gocryptfs.diriv is missing due to an error, so log the event
@@ -293,8 +362,6 @@ func (fs *FS) OpenDir(dirName string, context *fuse.Context) ([]fuse.DirEntry, f
 				tlog.Info.Printf("OpenDir: %v", err)
 				return nil, fuse.ToStatus(err)
 			}
-			fs.nameTransform.DirIVCache.Store(dirName, cachedIV, cDirName)
-			fs.dirIVLock.RUnlock()
 		}
 	}
 	// Decrypted directory entries
@@ -303,24 +370,17 @@ func (fs *FS) OpenDir(dirName string, context *fuse.Context) ([]fuse.DirEntry, f
 	// Filter and decrypt filenames
 	for i := range cipherEntries {
 		cName := cipherEntries[i].Name
-		if dirName == "" && cName == configfile.ConfDefaultName {
-			// silently ignore "gocryptfs.conf" in the top level dir
+		if IsReservedName(cDirName, cName, fs.args.PlaintextNames) {
+			// silently ignore "gocryptfs.conf", "gocryptfs.diriv" and the
+			// other internal files
 			continue
 		}
 		if fs.args.PlaintextNames {
 			plain = append(plain, cipherEntries[i])
 			continue
 		}
-		if cName == nametransform.DirIVFilename {
-			// silently ignore "gocryptfs.diriv" everywhere if dirIV is enabled
-			continue
-		}
 		// Handle long file name
-		isLong := nametransform.LongNameNone
-		if fs.args.LongNames {
-			isLong = nametransform.NameType(cName)
-		}
-		if isLong == nametransform.LongNameContent {
+		if fs.args.LongNames && nametransform.IsLongContent(cName) {
 			cNameLong, err := nametransform.ReadLongName(filepath.Join(cDirAbsPath, cName))
 			if err != nil {
 				tlog.Warn.Printf("OpenDir %q: invalid entry %q: Could not read .name: %v",
@@ -329,9 +389,6 @@ func (fs *FS) OpenDir(dirName string, context *fuse.Context) ([]fuse.DirEntry, f
 				continue
 			}
 			cName = cNameLong
-		} else if isLong == nametransform.LongNameFilename {
-			// ignore "gocryptfs.longname.*.name"
-			continue
 		}
 		name, err := fs.nameTransform.DecryptName(cName, cachedIV)
 		if err != nil {
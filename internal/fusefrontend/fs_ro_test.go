@@ -0,0 +1,50 @@
+package fusefrontend
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+
+	"github.com/hanwen/go-fuse/fuse"
+)
+
+// TestReadOnly checks that all modifying operations fail with EROFS when
+// Args.ReadOnly is set, and that nothing is written to the cipherdir.
+func TestReadOnly(t *testing.T) {
+	fs, cleanup := newTestFS(t, Args{
+		PlaintextNames: true,
+		ReadOnly:       true,
+	})
+	defer cleanup()
+	dir := fs.args.Cipherdir
+	ctx := &fuse.Context{}
+	if _, status := fs.Create("file", uint32(os.O_RDWR), 0600, ctx); status != fuse.EROFS {
+		t.Errorf("Create: want EROFS, got %v", status)
+	}
+	if _, status := fs.Open("file", uint32(os.O_WRONLY), ctx); status != fuse.EROFS {
+		t.Errorf("Open O_WRONLY: want EROFS, got %v", status)
+	}
+	ops := map[string]func() fuse.Status{
+		"Mkdir":    func() fuse.Status { return fs.Mkdir("dir", 0700, ctx) },
+		"Rmdir":    func() fuse.Status { return fs.Rmdir("dir", ctx) },
+		"Unlink":   func() fuse.Status { return fs.Unlink("file", ctx) },
+		"Rename":   func() fuse.Status { return fs.Rename("file", "file2", ctx) },
+		"Truncate": func() fuse.Status { return fs.Truncate("file", 0, ctx) },
+		"Chmod":    func() fuse.Status { return fs.Chmod("file", 0600, ctx) },
+		"Chown":    func() fuse.Status { return fs.Chown("file", 0, 0, ctx) },
+		"Symlink":  func() fuse.Status { return fs.Symlink("target", "link", ctx) },
+		"SetXAttr": func() fuse.Status { return fs.SetXAttr("file", "user.foo", nil, 0, ctx) },
+	}
+	for name, op := range ops {
+		if status := op(); status != fuse.EROFS {
+			t.Errorf("%s: want EROFS, got %v", name, status)
+		}
+	}
+	entries, err := ioutil.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 0 {
+		t.Errorf("cipherdir should still be empty, but has %d entries", len(entries))
+	}
+}
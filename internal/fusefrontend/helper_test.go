@@ -0,0 +1,56 @@
+package fusefrontend
+
+// Helpers shared by the tests in this package
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+
+	"github.com/hanwen/go-fuse/fuse"
+	"github.com/hanwen/go-fuse/fuse/nodefs"
+
+	"github.com/rfjakob/gocryptfs/internal/cryptocore"
+	"github.com/rfjakob/gocryptfs/internal/nametransform"
+)
+
+// newTestFS creates an FS with the options "args" on a new CIPHERDIR in a
+// temporary directory. Cipherdir is set by newTestFS, CryptoBackend defaults
+// to Go GCM. Unless PlaintextNames is set, the root directory gets a
+// gocryptfs.diriv. Call the returned function to delete the directory.
+func newTestFS(t testing.TB, args Args) (*FS, func()) {
+	dir, err := ioutil.TempDir("", "gocryptfs_fusefrontend")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !args.PlaintextNames {
+		if err = nametransform.WriteDirIV(nil, dir); err != nil {
+			os.RemoveAll(dir)
+			t.Fatal(err)
+		}
+	}
+	args.Cipherdir = dir
+	if args.CryptoBackend == 0 {
+		args.CryptoBackend = cryptocore.BackendGoGCM
+	}
+	return NewFS(make([]byte, cryptocore.KeyLen), args), func() { os.RemoveAll(dir) }
+}
+
+// createFile creates "path" with "content" and returns the open file
+func createFile(t testing.TB, fs *FS, path string, content []byte) nodefs.File {
+	f, status := fs.Create(path, uint32(os.O_RDWR), 0600, &fuse.Context{})
+	if !status.Ok() {
+		t.Fatal(status)
+	}
+	// Writes are limited to MAX_KERNEL_WRITE like they are with FUSE
+	for off := 0; off < len(content); off += fuse.MAX_KERNEL_WRITE {
+		end := off + fuse.MAX_KERNEL_WRITE
+		if end > len(content) {
+			end = len(content)
+		}
+		if _, status = f.Write(content[off:end], int64(off)); !status.Ok() {
+			t.Fatal(status)
+		}
+	}
+	return f
+}
@@ -0,0 +1,17 @@
+package fusefrontend
+
+import (
+	"sync/atomic"
+	"time"
+)
+
+// touch records that a FUSE operation has just happened, see LastAccess
+func (fs *FS) touch() {
+	atomic.StoreInt64(&fs.lastAccess, time.Now().UnixNano())
+}
+
+// LastAccess returns the time of the last Open, Create, OpenDir, Read or
+// Write. Used for "-idle".
+func (fs *FS) LastAccess() time.Time {
+	return time.Unix(0, atomic.LoadInt64(&fs.lastAccess))
+}
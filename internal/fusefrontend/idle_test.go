@@ -0,0 +1,47 @@
+package fusefrontend
+
+import (
+	"os"
+	"testing"
+	"time"
+
+	"github.com/hanwen/go-fuse/fuse"
+)
+
+// Operations that count as activity must update LastAccess()
+func TestLastAccess(t *testing.T) {
+	fs, cleanup := newTestFS(t, Args{
+		PlaintextNames: true,
+	})
+	defer cleanup()
+	ctx := &fuse.Context{}
+	ops := []struct {
+		name string
+		op   func()
+	}{
+		{"Create", func() {
+			f, _ := fs.Create("file", uint32(os.O_RDWR), 0600, ctx)
+			f.Release()
+		}},
+		{"Open", func() {
+			f, _ := fs.Open("file", uint32(os.O_RDONLY), ctx)
+			f.Release()
+		}},
+		{"OpenDir", func() { fs.OpenDir("", ctx) }},
+	}
+	for _, o := range ops {
+		before := fs.LastAccess()
+		time.Sleep(2 * time.Millisecond)
+		o.op()
+		if !fs.LastAccess().After(before) {
+			t.Errorf("%s did not update LastAccess", o.name)
+		}
+	}
+	// Reading attributes does not count
+	before := fs.LastAccess()
+	time.Sleep(2 * time.Millisecond)
+	fs.GetAttr("file", ctx)
+	if fs.LastAccess() != before {
+		t.Errorf("GetAttr updated LastAccess")
+	}
+}
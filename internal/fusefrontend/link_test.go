@@ -0,0 +1,58 @@
+package fusefrontend
+
+import (
+	"bytes"
+	"os"
+	"testing"
+
+	"github.com/hanwen/go-fuse/fuse"
+)
+
+// A hard link must share the ciphertext inode with the original file, so a
+// write through one path is visible through the other.
+func TestLink(t *testing.T) {
+	fs, cleanup := newTestFS(t, Args{
+		LongNames: true,
+		Raw64:     true,
+		HKDF:      true,
+	})
+	defer cleanup()
+	ctx := &fuse.Context{}
+	f1, status := fs.Create("file", uint32(os.O_RDWR), 0600, ctx)
+	if !status.Ok() {
+		t.Fatal(status)
+	}
+	defer f1.Release()
+	if _, status = f1.Write([]byte("hello"), 0); !status.Ok() {
+		t.Fatal(status)
+	}
+	if status = fs.Link("file", "link", ctx); !status.Ok() {
+		t.Fatal(status)
+	}
+	a1, status := fs.GetAttr("file", ctx)
+	if !status.Ok() {
+		t.Fatal(status)
+	}
+	a2, status := fs.GetAttr("link", ctx)
+	if !status.Ok() {
+		t.Fatal(status)
+	}
+	if a1.Nlink != 2 || a2.Nlink != 2 {
+		t.Errorf("wrong link count: %d %d", a1.Nlink, a2.Nlink)
+	}
+	if a1.Ino != a2.Ino {
+		t.Errorf("inode numbers differ: %d %d", a1.Ino, a2.Ino)
+	}
+	// Write through the link, read through the original
+	f2, status := fs.Open("link", uint32(os.O_RDWR), ctx)
+	if !status.Ok() {
+		t.Fatal(status)
+	}
+	defer f2.Release()
+	if _, status = f2.Write([]byte("world"), 5); !status.Ok() {
+		t.Fatal(status)
+	}
+	if got := readAll(t, f1, 10); !bytes.Equal(got, []byte("helloworld")) {
+		t.Errorf("wrong content through the original path: %q", got)
+	}
+}
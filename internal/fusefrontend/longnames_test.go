@@ -0,0 +1,94 @@
+package fusefrontend
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/hanwen/go-fuse/fuse"
+
+	"github.com/rfjakob/gocryptfs/internal/nametransform"
+)
+
+// checkLongName checks that the long name "name" in directory "dir" resolves,
+// shows up in the directory listing and has a matching ".name" file.
+func checkLongName(t *testing.T, fs *FS, dir string, name string) {
+	ctx := &fuse.Context{}
+	if _, status := fs.GetAttr(dir+"/"+name, ctx); !status.Ok() {
+		t.Fatalf("GetAttr %q: %v", dir, status)
+	}
+	entries, status := fs.OpenDir(dir, ctx)
+	if !status.Ok() {
+		t.Fatal(status)
+	}
+	if len(entries) != 1 || entries[0].Name != name {
+		t.Errorf("OpenDir %q: wrong entries %v", dir, entries)
+	}
+	cPath, err := fs.getBackingPath(dir + "/" + name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !nametransform.IsLongContent(filepath.Base(cPath)) {
+		t.Fatalf("%q is not a long name", cPath)
+	}
+	cName, err := nametransform.ReadLongName(cPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fs.nameTransform.HashLongName(cName) != filepath.Base(cPath) {
+		t.Errorf("hash of the .name file content does not match %q", cPath)
+	}
+	iv, err := nametransform.ReadDirIV(filepath.Dir(cPath))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if pName, err := fs.nameTransform.DecryptName(cName, iv); err != nil || pName != name {
+		t.Errorf("the .name file does not decrypt with the diriv of its directory: %v", err)
+	}
+	// The old sidecar files must not be left behind
+	cEntries, err := ioutil.ReadDir(filepath.Dir(cPath))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(cEntries) != 3 {
+		t.Errorf("want diriv, file and .name in %q, have %d entries", filepath.Dir(cPath), len(cEntries))
+	}
+}
+
+// Long names must keep resolving when the parent directory is renamed (the
+// diriv moves along) and when the file is moved into a directory with a
+// different diriv
+func TestLongNameRename(t *testing.T) {
+	fs, cleanup := newTestFS(t, Args{
+		LongNames: true,
+		Raw64:     true,
+		HKDF:      true,
+	})
+	defer cleanup()
+	ctx := &fuse.Context{}
+	long := strings.Repeat("l", 200)
+	for _, d := range []string{"a", "c"} {
+		if status := fs.Mkdir(d, 0700, ctx); !status.Ok() {
+			t.Fatal(status)
+		}
+	}
+	f, status := fs.Create("a/"+long, uint32(os.O_WRONLY), 0600, ctx)
+	if !status.Ok() {
+		t.Fatal(status)
+	}
+	f.Release()
+	checkLongName(t, fs, "a", long)
+	if status = fs.Rename("a", "b", ctx); !status.Ok() {
+		t.Fatal(status)
+	}
+	checkLongName(t, fs, "b", long)
+	if status = fs.Rename("b/"+long, "c/"+long, ctx); !status.Ok() {
+		t.Fatal(status)
+	}
+	checkLongName(t, fs, "c", long)
+	if _, status = fs.GetAttr("b/"+long, ctx); status != fuse.ENOENT {
+		t.Errorf("old path: want ENOENT, got %v", status)
+	}
+}
@@ -0,0 +1,57 @@
+package fusefrontend
+
+import (
+	"os"
+	"strings"
+	"syscall"
+	"testing"
+
+	"github.com/hanwen/go-fuse/fuse"
+)
+
+// Mknod must create FIFOs, sockets and (as root) device nodes under their
+// encrypted names, and GetAttr must report type and device number back
+func TestMknod(t *testing.T) {
+	fs, cleanup := newTestFS(t, Args{
+		LongNames: true,
+		Raw64:     true,
+		HKDF:      true,
+	})
+	defer cleanup()
+	dir := fs.args.Cipherdir
+	ctx := &fuse.Context{}
+	// /dev/null is 1:3
+	devNull := uint32(1<<8 | 3)
+	testcases := []struct {
+		name string
+		mode uint32
+		dev  uint32
+	}{
+		{"fifo", syscall.S_IFIFO | 0600, 0},
+		{"socket", syscall.S_IFSOCK | 0600, 0},
+		{strings.Repeat("f", 200), syscall.S_IFIFO | 0600, 0},
+		{"chardev", syscall.S_IFCHR | 0600, devNull},
+	}
+	for _, tc := range testcases {
+		status := fs.Mknod(tc.name, tc.mode, tc.dev, ctx)
+		if tc.mode&syscall.S_IFMT == syscall.S_IFCHR && status == fuse.EPERM {
+			// Not root or no CAP_MKNOD
+			t.Logf("%s: %v", tc.name, status)
+			continue
+		}
+		if !status.Ok() {
+			t.Fatalf("%s: %v", tc.name, status)
+		}
+		a, status := fs.GetAttr(tc.name, ctx)
+		if !status.Ok() {
+			t.Fatalf("%s: GetAttr: %v", tc.name, status)
+		}
+		if a.Mode&syscall.S_IFMT != tc.mode&syscall.S_IFMT || a.Rdev != tc.dev {
+			t.Errorf("%s: wrong mode %o or rdev %d", tc.name, a.Mode, a.Rdev)
+		}
+		// The backing node has an encrypted name
+		if _, err := os.Lstat(dir + "/" + tc.name); !os.IsNotExist(err) {
+			t.Errorf("%s: plaintext name visible in CIPHERDIR", tc.name)
+		}
+	}
+}
@@ -5,8 +5,10 @@ package fusefrontend
 import (
 	"os"
 	"path/filepath"
+	"syscall"
 
 	"github.com/rfjakob/gocryptfs/internal/configfile"
+	"github.com/rfjakob/gocryptfs/internal/nametransform"
 	"github.com/rfjakob/gocryptfs/internal/tlog"
 )
 
@@ -40,6 +42,26 @@ func (fs *FS) getBackingPath(relPath string) (string, error) {
 	return cAbsPath, nil
 }
 
+// getBackingPathKeepCase is like getBackingPath, but does not match the last
+// path component case-insensitively, see
+// nametransform.EncryptPathDirIVKeepCase.
+func (fs *FS) getBackingPathKeepCase(relPath string) (string, error) {
+	if fs.args.PlaintextNames {
+		return filepath.Join(fs.args.Cipherdir, relPath), nil
+	}
+	var cPath string
+	err := nametransform.RetryDirIV(func() (err error) {
+		fs.dirIVLock.RLock()
+		defer fs.dirIVLock.RUnlock()
+		cPath, err = fs.nameTransform.EncryptPathDirIVKeepCase(relPath, fs.args.Cipherdir)
+		return err
+	})
+	if err != nil {
+		return "", fs.checkDirIVMissing(err)
+	}
+	return filepath.Join(fs.args.Cipherdir, cPath), nil
+}
+
 // openBackingPath - get the absolute encrypted path of the backing file
 // and open the corresponding directory
 func (fs *FS) openBackingPath(relPath string) (*os.File, string, error) {
@@ -59,9 +81,26 @@ func (fs *FS) encryptPath(plainPath string) (string, error) {
 	if fs.args.PlaintextNames {
 		return plainPath, nil
 	}
-	fs.dirIVLock.RLock()
-	cPath, err := fs.nameTransform.EncryptPathDirIV(plainPath, fs.args.Cipherdir)
+	// Retry outside of the lock so that a flaky network filesystem does not
+	// block Rmdir and Rename
+	var cPath string
+	err := nametransform.RetryDirIV(func() (err error) {
+		fs.dirIVLock.RLock()
+		defer fs.dirIVLock.RUnlock()
+		cPath, err = fs.nameTransform.EncryptPathDirIV(plainPath, fs.args.Cipherdir)
+		return err
+	})
 	tlog.Debug.Printf("encryptPath '%s' -> '%s' (err: %v)", plainPath, cPath, err)
-	fs.dirIVLock.RUnlock()
-	return cPath, err
+	return cPath, fs.checkDirIVMissing(err)
+}
+
+// checkDirIVMissing turns a nametransform.DirIVMissingError into EIO, after
+// reporting it loudly. go-fuse would convert it to ENOSYS otherwise. All
+// other errors are returned unchanged.
+func (fs *FS) checkDirIVMissing(err error) error {
+	if _, ok := err.(*nametransform.DirIVMissingError); ok {
+		fs.reportCorruption("%v", err)
+		return syscall.EIO
+	}
+	return err
 }
@@ -0,0 +1,39 @@
+package fusefrontend
+
+// Internal files in CIPHERDIR that are never shown in the plaintext view
+
+import (
+	"github.com/rfjakob/gocryptfs/internal/configfile"
+	"github.com/rfjakob/gocryptfs/internal/nametransform"
+	"github.com/rfjakob/gocryptfs/internal/seal"
+)
+
+// reservedRootNames are reserved in the top-level directory only, also
+// with plaintextnames
+var reservedRootNames = map[string]bool{
+	configfile.ConfDefaultName:                               true,
+	configfile.ConfDefaultName + configfile.ConfBackupSuffix: true,
+}
+
+// reservedNames are reserved in every directory when names are encrypted.
+// With plaintextnames, they are ordinary user files.
+var reservedNames = map[string]bool{
+	nametransform.DirIVFilename: true,
+	DirCommentFilename:          true,
+	seal.Filename:               true,
+}
+
+// IsReservedName returns true if "cName" in the ciphertext directory "cDir"
+// (relative to CIPHERDIR, "" is the top-level directory) is an internal file
+// of gocryptfs and not the backing file of a plaintext entry. The long name
+// files "gocryptfs.longname.*.name" are reserved, their content files are
+// not.
+func IsReservedName(cDir string, cName string, plaintextNames bool) bool {
+	if cDir == "" && reservedRootNames[cName] {
+		return true
+	}
+	if plaintextNames {
+		return false
+	}
+	return reservedNames[cName] || nametransform.NameType(cName) == nametransform.LongNameFilename
+}
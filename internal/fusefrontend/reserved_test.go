@@ -0,0 +1,32 @@
+package fusefrontend
+
+import (
+	"testing"
+)
+
+func TestIsReservedName(t *testing.T) {
+	long := "gocryptfs.longname.URrM8kgxTKYMgCk4hKk7RO9Lcfr30XQof4L_5bD9Iro="
+	testCases := []struct {
+		cDir           string
+		cName          string
+		plaintextNames bool
+		want           bool
+	}{
+		{"", "gocryptfs.conf", false, true},
+		{"", "gocryptfs.conf.bak", true, true},
+		{"dir", "gocryptfs.conf", false, false},
+		{"dir", "gocryptfs.diriv", false, true},
+		{"dir", "gocryptfs.diriv", true, false},
+		{"", "gocryptfs.comment", false, true},
+		{"dir", "gocryptfs.seal", false, true},
+		{"dir", long + ".name", false, true},
+		{"dir", long, false, false},
+		{"dir", "i1bpTaVLZq7sRNA9mL_2Ig==", false, false},
+	}
+	for _, tc := range testCases {
+		if have := IsReservedName(tc.cDir, tc.cName, tc.plaintextNames); have != tc.want {
+			t.Errorf("%q in %q, plaintextNames=%v: want %v, have %v",
+				tc.cName, tc.cDir, tc.plaintextNames, tc.want, have)
+		}
+	}
+}
@@ -0,0 +1,62 @@
+package fusefrontend
+
+import (
+	"syscall"
+	"testing"
+
+	"github.com/hanwen/go-fuse/fuse"
+
+	"github.com/rfjakob/gocryptfs/internal/cryptocore"
+)
+
+// TestStatfsOverhead checks the conversion with fixed numbers
+func TestStatfsOverhead(t *testing.T) {
+	fs := NewFS(make([]byte, cryptocore.KeyLen), Args{Cipherdir: "/", CryptoBackend: cryptocore.BackendGoGCM})
+	out := fuse.StatfsOut{
+		Bsize:  4096,
+		Frsize: 4096,
+		Blocks: 1000,
+		Bfree:  400,
+		Bavail: 300,
+		Files:  100,
+		Ffree:  90,
+	}
+	fs.removeStatfsOverhead(&out)
+	// 600 used blocks of 4096 bytes hold 2457600*4096/4128 = 2438548
+	// plaintext bytes, minus 10 file headers of 18 bytes = 596 blocks.
+	// Free: 400*4096*4096/4128/4096 = 396, available: 297.
+	if out.Bfree != 396 || out.Bavail != 297 || out.Blocks != 396+596 {
+		t.Errorf("wrong result: Blocks=%d Bfree=%d Bavail=%d", out.Blocks, out.Bfree, out.Bavail)
+	}
+	if out.Files != 100 || out.Ffree != 90 {
+		t.Errorf("inode counts should not change: Files=%d Ffree=%d", out.Files, out.Ffree)
+	}
+}
+
+// TestStatfs compares the plaintext view against CIPHERDIR
+func TestStatfs(t *testing.T) {
+	fs, cleanup := newTestFS(t, Args{})
+	defer cleanup()
+	dir := fs.args.Cipherdir
+	var s syscall.Statfs_t
+	if err := syscall.Statfs(dir, &s); err != nil {
+		t.Fatal(err)
+	}
+	out := fs.StatFs("")
+	if out == nil {
+		t.Fatal("StatFs failed")
+	}
+	if s.Blocks == 0 {
+		t.Skip("CIPHERDIR reports zero blocks")
+	}
+	// Free space shrinks by the block overhead ratio (4096/4128), give or take
+	// rounding and concurrent activity on the filesystem
+	ratio := 4096.0 / 4128.0
+	want := float64(s.Bavail) * ratio
+	if float64(out.Bavail) < want*0.99 || float64(out.Bavail) > want*1.01+1 {
+		t.Errorf("Bavail=%d, want about %.0f", out.Bavail, want)
+	}
+	if out.Blocks > s.Blocks || out.Blocks == 0 {
+		t.Errorf("Blocks=%d, CIPHERDIR has %d", out.Blocks, s.Blocks)
+	}
+}
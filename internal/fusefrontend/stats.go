@@ -0,0 +1,35 @@
+package fusefrontend
+
+// Operation counters for the "STATS" control socket command
+
+import (
+	"sync/atomic"
+)
+
+// opStats counts FUSE operations since mount. All fields are accessed
+// atomically. It is allocated separately so the fields are 64-bit aligned
+// on 32-bit platforms.
+type opStats struct {
+	getAttr, openDir, open, create, read, write uint64
+	// readBytes and writeBytes are the plaintext bytes returned by Read and
+	// accepted by Write
+	readBytes, writeBytes uint64
+}
+
+// Stats returns the operation counters and the hits and misses of the DirIV
+// cache since mount.
+func (fs *FS) Stats() map[string]uint64 {
+	hits, misses := fs.nameTransform.DirIVCache.Stats()
+	return map[string]uint64{
+		"GetAttr":          atomic.LoadUint64(&fs.stats.getAttr),
+		"OpenDir":          atomic.LoadUint64(&fs.stats.openDir),
+		"Open":             atomic.LoadUint64(&fs.stats.open),
+		"Create":           atomic.LoadUint64(&fs.stats.create),
+		"Read":             atomic.LoadUint64(&fs.stats.read),
+		"Write":            atomic.LoadUint64(&fs.stats.write),
+		"ReadBytes":        atomic.LoadUint64(&fs.stats.readBytes),
+		"WriteBytes":       atomic.LoadUint64(&fs.stats.writeBytes),
+		"DirIVCacheHits":   hits,
+		"DirIVCacheMisses": misses,
+	}
+}
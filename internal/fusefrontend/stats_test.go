@@ -0,0 +1,39 @@
+package fusefrontend
+
+import (
+	"os"
+	"testing"
+
+	"github.com/hanwen/go-fuse/fuse"
+)
+
+func TestStats(t *testing.T) {
+	fs, cleanup := newTestFS(t, Args{})
+	defer cleanup()
+	ctx := &fuse.Context{}
+	if status := fs.Mkdir("dir", 0700, ctx); !status.Ok() {
+		t.Fatal(status)
+	}
+	f, status := fs.Create("dir/file", uint32(os.O_RDWR), 0600, ctx)
+	if !status.Ok() {
+		t.Fatal(status)
+	}
+	if _, status = f.Write([]byte("hello"), 0); !status.Ok() {
+		t.Fatal(status)
+	}
+	readAll(t, f, 100)
+	f.Release()
+	if _, status = fs.GetAttr("dir/file", ctx); !status.Ok() {
+		t.Fatal(status)
+	}
+	s := fs.Stats()
+	for k, want := range map[string]uint64{"Create": 1, "Write": 1, "WriteBytes": 5, "Read": 1, "ReadBytes": 5, "GetAttr": 1} {
+		if s[k] != want {
+			t.Errorf("%s: want %d, have %d", k, want, s[k])
+		}
+	}
+	// Resolving "dir" the second time hits the DirIV cache
+	if s["DirIVCacheHits"] == 0 || s["DirIVCacheMisses"] == 0 {
+		t.Errorf("DirIV cache: hits=%d misses=%d", s["DirIVCacheHits"], s["DirIVCacheMisses"])
+	}
+}
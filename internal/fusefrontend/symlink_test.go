@@ -0,0 +1,59 @@
+package fusefrontend
+
+import (
+	"io/ioutil"
+	"os"
+	"strings"
+	"syscall"
+	"testing"
+
+	"github.com/hanwen/go-fuse/fuse"
+)
+
+// Symlink targets are stored encrypted. Targets that are too long after
+// encryption fail with ENAMETOOLONG and leave nothing behind.
+func TestSymlinkEncrypted(t *testing.T) {
+	fs, cleanup := newTestFS(t, Args{
+		LongNames: true,
+		Raw64:     true,
+		HKDF:      true,
+	})
+	defer cleanup()
+	dir := fs.args.Cipherdir
+	ctx := &fuse.Context{}
+	// The longest target that fits: base64(len + 32) <= 4095
+	targetMax := strings.Repeat("t", 3039)
+	for _, target := range []string{"/etc/passwd", targetMax} {
+		if status := fs.Symlink(target, "link", ctx); !status.Ok() {
+			t.Fatalf("%d bytes: %v", len(target), status)
+		}
+		cPath, err := fs.getBackingPath("link")
+		if err != nil {
+			t.Fatal(err)
+		}
+		cTarget, err := os.Readlink(cPath)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if strings.Contains(cTarget, target) {
+			t.Errorf("plaintext target %q stored in the cipherdir", target)
+		}
+		if have, status := fs.Readlink("link", ctx); !status.Ok() || have != target {
+			t.Errorf("Readlink: %v, %d bytes", status, len(have))
+		}
+		fs.Unlink("link", ctx)
+	}
+	// Too long, also with a long link name that needs a .name file
+	for _, name := range []string{"link", strings.Repeat("n", 200)} {
+		if status := fs.Symlink(targetMax+"t", name, ctx); status != fuse.Status(syscall.ENAMETOOLONG) {
+			t.Errorf("want ENAMETOOLONG, got %v", status)
+		}
+	}
+	entries, err := ioutil.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 1 {
+		t.Errorf("leftover files in the cipherdir: %d entries", len(entries))
+	}
+}
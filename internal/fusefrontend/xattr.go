@@ -0,0 +1,155 @@
+package fusefrontend
+
+// Extended attribute passthrough with encrypted names and values
+
+import (
+	"strings"
+	"syscall"
+
+	"github.com/hanwen/go-fuse/fuse"
+
+	"github.com/rfjakob/gocryptfs/internal/syscallcompat"
+	"github.com/rfjakob/gocryptfs/internal/tlog"
+)
+
+// xattr names are encrypted like file names, but with a fixed IV, so that
+// the same name always maps to the same ciphertext.
+var xattrNameIV = []byte("xattr_name_iv_xx")
+
+// xattrStorePrefix is the prefix of the encrypted xattrs on the backing
+// files. The whole plaintext name, including the namespace, is encrypted,
+// so everything ends up in the "user" namespace that unprivileged users can
+// write.
+const xattrStorePrefix = "user.gocryptfs."
+
+// encryptXattrName encrypts the plaintext xattr name "attr"
+func (fs *FS) encryptXattrName(attr string) string {
+	return xattrStorePrefix + fs.nameTransform.EncryptName(attr, xattrNameIV)
+}
+
+// decryptXattrName decrypts the backing xattr name "cAttr". Fails for names
+// that were not created by encryptXattrName.
+func (fs *FS) decryptXattrName(cAttr string) (string, error) {
+	if !strings.HasPrefix(cAttr, xattrStorePrefix) {
+		return "", syscall.EINVAL
+	}
+	return fs.nameTransform.DecryptName(cAttr[len(xattrStorePrefix):], xattrNameIV)
+}
+
+// disallowedXAttrName returns true for xattrs that only make sense when the
+// kernel interprets them, like POSIX ACLs. Storing them encrypted would
+// silently disable them.
+func disallowedXAttrName(attr string) bool {
+	return strings.HasPrefix(attr, "system.")
+}
+
+// GetXAttr implements pathfs.Filesystem.
+// go-fuse answers the size probe of getxattr(2) (size 0) with the length of
+// the returned value and replies ERANGE if the caller's buffer is too small.
+// We always return the decrypted value, so the size that userspace sees is
+// the plaintext length, not the larger length of the stored ciphertext.
+func (fs *FS) GetXAttr(relPath string, attr string, context *fuse.Context) ([]byte, fuse.Status) {
+	if fs.isFiltered(relPath) {
+		return nil, fuse.EPERM
+	}
+	if attr == dirCommentXAttr {
+		return fs.getDirComment(relPath)
+	}
+	if disallowedXAttrName(attr) {
+		return nil, fuse.Status(syscall.ENOTSUP)
+	}
+	cPath, err := fs.getBackingPath(relPath)
+	if err != nil {
+		return nil, fuse.ToStatus(err)
+	}
+	cData, err := syscallcompat.Lgetxattr(cPath, fs.encryptXattrName(attr))
+	if err != nil {
+		return nil, fuse.ToStatus(err)
+	}
+	// Small values are encrypted with a random nonce like a file block. The
+	// value is not bound to the file, as xattrs are copied around by tools
+	// like "cp -a" without gocryptfs noticing.
+	data, err := fs.contentEnc.DecryptBlock(cData, 0, nil)
+	if err != nil {
+		fs.reportCorruption("GetXAttr %q: %q: %v", cPath, attr, err)
+		return nil, fuse.EIO
+	}
+	// DecryptBlock returns a buffer from a pool
+	return append([]byte{}, data...), fuse.OK
+}
+
+// SetXAttr implements pathfs.Filesystem.
+func (fs *FS) SetXAttr(relPath string, attr string, data []byte, flags int, context *fuse.Context) fuse.Status {
+	if fs.args.ReadOnly {
+		return fuse.EROFS
+	}
+	if fs.isFiltered(relPath) {
+		return fuse.EPERM
+	}
+	if attr == dirCommentXAttr {
+		return fs.setDirComment(relPath, data)
+	}
+	if disallowedXAttrName(attr) {
+		return fuse.Status(syscall.ENOTSUP)
+	}
+	cPath, err := fs.getBackingPath(relPath)
+	if err != nil {
+		return fuse.ToStatus(err)
+	}
+	cData := fs.contentEnc.EncryptBlock(data, 0, nil)
+	// Linux does not allow "user." xattrs on symlinks and returns EPERM
+	return fuse.ToStatus(syscallcompat.Lsetxattr(cPath, fs.encryptXattrName(attr), cData, flags))
+}
+
+// ListXAttr implements pathfs.Filesystem.
+func (fs *FS) ListXAttr(relPath string, context *fuse.Context) ([]string, fuse.Status) {
+	if fs.isFiltered(relPath) {
+		return nil, fuse.EPERM
+	}
+	cPath, err := fs.getBackingPath(relPath)
+	if err != nil {
+		return nil, fuse.ToStatus(err)
+	}
+	cNames, err := syscallcompat.Llistxattr(cPath)
+	if err != nil {
+		return nil, fuse.ToStatus(err)
+	}
+	var names []string
+	for _, cName := range cNames {
+		if !strings.HasPrefix(cName, xattrStorePrefix) {
+			// Not ours (SELinux label of the backing file, for example)
+			continue
+		}
+		name, err := fs.decryptXattrName(cName)
+		if err != nil {
+			tlog.Warn.Printf("ListXAttr %q: invalid xattr %q: %v", cPath, cName, err)
+			continue
+		}
+		names = append(names, name)
+	}
+	if !fs.args.PlaintextNames && haveDirComment(cPath) {
+		names = append(names, dirCommentXAttr)
+	}
+	return names, fuse.OK
+}
+
+// RemoveXAttr implements pathfs.Filesystem.
+func (fs *FS) RemoveXAttr(relPath string, attr string, context *fuse.Context) fuse.Status {
+	if fs.args.ReadOnly {
+		return fuse.EROFS
+	}
+	if fs.isFiltered(relPath) {
+		return fuse.EPERM
+	}
+	if attr == dirCommentXAttr {
+		return fs.removeDirComment(relPath)
+	}
+	if disallowedXAttrName(attr) {
+		return fuse.Status(syscall.ENOTSUP)
+	}
+	cPath, err := fs.getBackingPath(relPath)
+	if err != nil {
+		return fuse.ToStatus(err)
+	}
+	return fuse.ToStatus(syscallcompat.Lremovexattr(cPath, fs.encryptXattrName(attr)))
+}
@@ -0,0 +1,128 @@
+package fusefrontend
+
+import (
+	"bytes"
+	"os"
+	"strings"
+	"syscall"
+	"testing"
+
+	"github.com/hanwen/go-fuse/fuse"
+
+	"github.com/rfjakob/gocryptfs/internal/syscallcompat"
+)
+
+// GetXAttr must return the plaintext, whose length is what the kernel reports
+// to a getxattr size probe
+func TestXAttrLargeValue(t *testing.T) {
+	fs, cleanup := newTestFS(t, Args{
+		PlaintextNames: true,
+	})
+	defer cleanup()
+	ctx := &fuse.Context{}
+	f, status := fs.Create("file", uint32(os.O_WRONLY), 0600, ctx)
+	if !status.Ok() {
+		t.Fatal(status)
+	}
+	f.Release()
+	cPath, _ := fs.getBackingPath("file")
+	if err := syscallcompat.Lsetxattr(cPath, "user.probe", nil, 0); err != nil {
+		t.Skipf("backing filesystem does not support user xattrs: %v", err)
+	}
+	syscallcompat.Lremovexattr(cPath, "user.probe")
+	// Larger than a file block, but small enough for ext4 with 4k blocks
+	val := bytes.Repeat([]byte("0123456789"), 300)
+	if status = fs.SetXAttr("file", "user.large", val, 0, ctx); !status.Ok() {
+		t.Fatal(status)
+	}
+	cVal, err := syscallcompat.Lgetxattr(cPath, fs.encryptXattrName("user.large"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(cVal) <= len(val) {
+		t.Errorf("stored value should be larger than the plaintext: %d <= %d", len(cVal), len(val))
+	}
+	got, status := fs.GetXAttr("file", "user.large", ctx)
+	if !status.Ok() {
+		t.Fatal(status)
+	}
+	if len(got) != len(val) || !bytes.Equal(got, val) {
+		t.Errorf("wrong value: length %d, want %d", len(got), len(val))
+	}
+}
+
+func TestXAttr(t *testing.T) {
+	fs, cleanup := newTestFS(t, Args{
+		LongNames: true,
+		Raw64:     true,
+	})
+	defer cleanup()
+	ctx := &fuse.Context{}
+	f, status := fs.Create("file", uint32(os.O_WRONLY), 0600, ctx)
+	if !status.Ok() {
+		t.Fatal(status)
+	}
+	f.Release()
+	cPath, _ := fs.getBackingPath("file")
+	if err := syscallcompat.Lsetxattr(cPath, "user.probe", nil, 0); err != nil {
+		t.Skipf("backing filesystem does not support user xattrs: %v", err)
+	}
+	syscallcompat.Lremovexattr(cPath, "user.probe")
+
+	values := map[string][]byte{
+		"user.foo":                         []byte("bar"),
+		"user.one":                         {1},
+		"user.empty":                       {},
+		"security.selinux":                 []byte("system_u:object_r:user_home_t:s0"),
+		"user." + strings.Repeat("x", 100): bytes.Repeat([]byte{0xaa}, 1000),
+	}
+	for attr, val := range values {
+		if status = fs.SetXAttr("file", attr, val, 0, ctx); !status.Ok() {
+			t.Fatalf("SetXAttr %q: %v", attr, status)
+		}
+		got, status := fs.GetXAttr("file", attr, ctx)
+		if !status.Ok() || !bytes.Equal(got, val) {
+			t.Errorf("GetXAttr %q: got %q, %v", attr, got, status)
+		}
+	}
+	// Neither names nor values are stored in plaintext
+	cNames, err := syscallcompat.Llistxattr(cPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, cName := range cNames {
+		if strings.Contains(cName, "foo") || strings.Contains(cName, "selinux") {
+			t.Errorf("plaintext name leaked: %q", cName)
+		}
+		cVal, _ := syscallcompat.Lgetxattr(cPath, cName)
+		if bytes.Contains(cVal, []byte("bar")) {
+			t.Errorf("plaintext value leaked: %q", cVal)
+		}
+	}
+	names, status := fs.ListXAttr("file", ctx)
+	if !status.Ok() || len(names) != len(values) {
+		t.Errorf("ListXAttr: %v %v", names, status)
+	}
+	for _, n := range names {
+		if _, ok := values[n]; !ok {
+			t.Errorf("ListXAttr: unexpected name %q", n)
+		}
+	}
+	if status = fs.RemoveXAttr("file", "user.foo", ctx); !status.Ok() {
+		t.Error(status)
+	}
+	if _, status = fs.GetXAttr("file", "user.foo", ctx); status != fuse.ENOATTR {
+		t.Errorf("want ENOATTR after RemoveXAttr, got %v", status)
+	}
+	if status = fs.SetXAttr("file", "system.posix_acl_access", nil, 0, ctx); status != fuse.Status(syscall.ENOTSUP) {
+		t.Errorf("ACLs: want ENOTSUP, got %v", status)
+	}
+	// A tampered value is detected
+	cAttr := fs.encryptXattrName("user.one")
+	cVal, _ := syscallcompat.Lgetxattr(cPath, cAttr)
+	cVal[len(cVal)-1] ^= 1
+	syscallcompat.Lsetxattr(cPath, cAttr, cVal, 0)
+	if _, status = fs.GetXAttr("file", "user.one", ctx); status != fuse.EIO {
+		t.Errorf("tampered value: want EIO, got %v", status)
+	}
+}
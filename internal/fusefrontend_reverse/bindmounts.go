@@ -0,0 +1,102 @@
+package fusefrontend_reverse
+
+// Detection of bind mounts below the plaintext directory, for
+// "-reverse-bind-mounts"
+
+import (
+	"path/filepath"
+	"strings"
+
+	"github.com/rfjakob/gocryptfs/internal/mountinfo"
+)
+
+const (
+	// BindMountsFollow shows bind mounts like any other directory (default)
+	BindMountsFollow = "follow"
+	// BindMountsSkip hides all bind mounts
+	BindMountsSkip = "skip"
+	// BindMountsDedup hides bind mounts whose content is already visible at
+	// another place in the encrypted view
+	BindMountsDedup = "dedup"
+)
+
+// isBelow returns true if "path" is "dir" or inside of it
+func isBelow(path string, dir string) bool {
+	return path == dir || dir == "/" || strings.HasPrefix(path, dir+"/")
+}
+
+// bindMountsToHide returns the bind mounts strictly below "dir" that should be
+// hidden in mode "mode", as paths relative to "dir".
+//
+// A mount counts as a bind mount if it does not mount the root of its
+// filesystem, or if the same filesystem is already mounted elsewhere (earlier
+// in mountinfo).
+func bindMountsToHide(mounts []mountinfo.Entry, dir string, mode string) []string {
+	if mode == BindMountsFollow {
+		return nil
+	}
+	isBind := make([]bool, len(mounts))
+	firstMount := make(map[string]bool)
+	for i, m := range mounts {
+		isBind[i] = m.Root != "/" || firstMount[m.Dev]
+		firstMount[m.Dev] = true
+	}
+	var hide []string
+	// Sources ("dev" + "root") of the bind mounts that stay visible
+	seen := make(map[string]bool)
+	for i, m := range mounts {
+		if !isBind[i] || m.MountPoint == dir || !isBelow(m.MountPoint, dir) {
+			continue
+		}
+		rel := m.MountPoint[len(dir)+1:]
+		if dir == "/" {
+			rel = m.MountPoint[1:]
+		}
+		if mode == BindMountsSkip {
+			hide = append(hide, rel)
+			continue
+		}
+		// BindMountsDedup: hide it if the source directory is visible in the
+		// tree through a normal mount, or if another bind mount of the same
+		// source is already visible
+		source := m.Dev + m.Root
+		if seen[source] {
+			hide = append(hide, rel)
+			continue
+		}
+		dupe := false
+		for j, other := range mounts {
+			if isBind[j] || other.Dev != m.Dev || !isBelow(m.Root, other.Root) {
+				continue
+			}
+			sourcePath := filepath.Join(other.MountPoint, strings.TrimPrefix(m.Root, other.Root))
+			if isBelow(sourcePath, dir) && (isBelow(other.MountPoint, dir) || isBelow(dir, other.MountPoint)) {
+				dupe = true
+				break
+			}
+		}
+		if dupe {
+			hide = append(hide, rel)
+		} else {
+			seen[source] = true
+		}
+	}
+	return hide
+}
+
+// FindBindMounts reads /proc/self/mountinfo and returns the bind mounts below
+// "dir" that "-reverse-bind-mounts=mode" hides, as relative paths.
+func FindBindMounts(dir string, mode string) ([]string, error) {
+	if mode == BindMountsFollow {
+		return nil, nil
+	}
+	dir, err := filepath.EvalSymlinks(dir)
+	if err != nil {
+		return nil, err
+	}
+	mounts, err := mountinfo.Read()
+	if err != nil {
+		return nil, err
+	}
+	return bindMountsToHide(mounts, dir, mode), nil
+}
@@ -0,0 +1,89 @@
+package fusefrontend_reverse
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"syscall"
+	"testing"
+
+	"github.com/rfjakob/gocryptfs/internal/mountinfo"
+)
+
+const testMountinfo = `22 1 8:1 / / rw,relatime - ext4 /dev/sda1 rw
+23 22 0:22 / /proc rw,relatime - proc proc rw
+30 22 8:1 /src/a /src/b rw,relatime - ext4 /dev/sda1 rw
+31 22 8:1 /data /src/c rw,relatime - ext4 /dev/sda1 rw
+32 22 8:1 /data /src/d\040e rw,relatime - ext4 /dev/sda1 rw
+33 22 8:2 / /src/disk rw,relatime - ext4 /dev/sda2 rw
+34 22 8:1 /src /src/loop rw,relatime - ext4 /dev/sda1 rw
+35 22 8:1 / /other rw,relatime - ext4 /dev/sda1 rw
+`
+
+func TestBindMountsToHide(t *testing.T) {
+	mounts, err := mountinfo.Parse(strings.NewReader(testMountinfo))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if mounts[4].MountPoint != "/src/d e" {
+		t.Errorf("escape not decoded: %q", mounts[4].MountPoint)
+	}
+	testCases := []struct {
+		mode string
+		want []string
+	}{
+		{BindMountsFollow, nil},
+		// "disk" is a separate filesystem, not a bind mount
+		{BindMountsSkip, []string{"b", "c", "d e", "loop"}},
+		// "b" and "loop" show directories that are visible anyway, "d e" shows
+		// the same directory as "c"
+		{BindMountsDedup, []string{"b", "d e", "loop"}},
+	}
+	for _, tc := range testCases {
+		have := bindMountsToHide(mounts, "/src", tc.mode)
+		if !reflect.DeepEqual(have, tc.want) {
+			t.Errorf("mode %s: have %q, want %q", tc.mode, have, tc.want)
+		}
+	}
+}
+
+// A real bind mount of a subdirectory onto another subdirectory of the
+// source. Needs root.
+func TestBindMountHidden(t *testing.T) {
+	if os.Getuid() != 0 {
+		t.Skip("needs root")
+	}
+	dir, err := ioutil.TempDir("", "gocryptfs_bindmount")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	dir, _ = filepath.EvalSymlinks(dir)
+	os.Mkdir(dir+"/a", 0700)
+	os.Mkdir(dir+"/b", 0700)
+	if err = ioutil.WriteFile(dir+"/a/file", nil, 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err = syscall.Mount(dir+"/a", dir+"/b", "", syscall.MS_BIND, ""); err != nil {
+		t.Skipf("bind mount failed: %v", err)
+	}
+	defer syscall.Unmount(dir+"/b", 0)
+	for _, mode := range []string{BindMountsSkip, BindMountsDedup} {
+		hidden, err := FindBindMounts(dir, mode)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(hidden, []string{"b"}) {
+			t.Errorf("mode %s: hidden=%q", mode, hidden)
+		}
+		e := newExcluder(nil, hidden, dir)
+		if !e.isExcluded("b/file") || e.isExcluded("a/file") {
+			t.Errorf("mode %s: wrong exclusion", mode)
+		}
+	}
+	if hidden, _ := FindBindMounts(dir, BindMountsFollow); hidden != nil {
+		t.Errorf("follow mode hides %q", hidden)
+	}
+}
@@ -0,0 +1,167 @@
+package fusefrontend_reverse
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+
+	"github.com/rfjakob/gocryptfs/internal/configfile"
+	"github.com/rfjakob/gocryptfs/internal/tlog"
+)
+
+// excludePattern is one compiled gitignore-style pattern
+type excludePattern struct {
+	re *regexp.Regexp
+	// Pattern contains a slash (except a trailing one) and is matched against
+	// the whole relative path instead of the name only
+	anchored bool
+	// Pattern ends with a slash and only matches directories
+	dirOnly bool
+	// Pattern starts with "!" and re-includes what an earlier pattern excluded
+	negate bool
+}
+
+// excluder decides which plaintext paths are hidden in the encrypted view
+type excluder struct {
+	patterns []excludePattern
+	// paths are relative plaintext paths that are hidden together with
+	// everything below them, no matter what the patterns say
+	paths map[string]bool
+	// Plaintext root directory, used to find out if a path is a directory
+	cipherdir string
+}
+
+// newExcluder compiles the gitignore-style "patterns". Supported are "*",
+// "?", "[...]", "**", a leading "/" or a slash in the middle to anchor the
+// pattern to the root, a trailing "/" to only match directories, and a
+// leading "!" to negate the pattern.
+// "paths" are hidden unconditionally, see "-reverse-bind-mounts".
+// Returns nil if there are no patterns and no paths.
+func newExcluder(patterns []string, paths []string, cipherdir string) *excluder {
+	if len(patterns) == 0 && len(paths) == 0 {
+		return nil
+	}
+	e := &excluder{cipherdir: cipherdir, paths: make(map[string]bool)}
+	for _, p := range paths {
+		e.paths[p] = true
+	}
+	for _, p := range patterns {
+		var ep excludePattern
+		if strings.HasPrefix(p, "!") {
+			ep.negate = true
+			p = p[1:]
+		}
+		if strings.HasSuffix(p, "/") {
+			ep.dirOnly = true
+			p = strings.TrimRight(p, "/")
+		}
+		if strings.Contains(p, "/") {
+			ep.anchored = true
+			p = strings.TrimLeft(p, "/")
+		}
+		if p == "" {
+			continue
+		}
+		re, err := regexp.Compile("^" + globToRegexp(p) + "$")
+		if err != nil {
+			// Can only happen with a broken "[...]" class like "[z-a]".
+			// Match the pattern literally.
+			tlog.Warn.Printf("exclude pattern %q: %v, matching it literally", p, err)
+			re = regexp.MustCompile("^" + regexp.QuoteMeta(p) + "$")
+		}
+		ep.re = re
+		e.patterns = append(e.patterns, ep)
+	}
+	return e
+}
+
+// globToRegexp translates the glob "g" to a regular expression. Everything
+// that is not a wildcard is quoted.
+func globToRegexp(g string) string {
+	var b bytes.Buffer
+	for i := 0; i < len(g); i++ {
+		switch c := g[i]; c {
+		case '*':
+			if strings.HasPrefix(g[i:], "**/") {
+				// Zero or more directories
+				b.WriteString("(.*/)?")
+				i += 2
+			} else if strings.HasPrefix(g[i:], "**") {
+				b.WriteString(".*")
+				i++
+			} else {
+				b.WriteString("[^/]*")
+			}
+		case '?':
+			b.WriteString("[^/]")
+		case '[':
+			end := strings.IndexByte(g[i+1:], ']')
+			if end < 0 {
+				b.WriteString(regexp.QuoteMeta(g[i:]))
+				return b.String()
+			}
+			class := g[i+1 : i+1+end]
+			if strings.HasPrefix(class, "!") {
+				class = "^" + class[1:]
+			}
+			b.WriteString("[" + strings.Replace(class, `\`, `\\`, -1) + "]")
+			i += end + 1
+		default:
+			b.WriteString(regexp.QuoteMeta(string(c)))
+		}
+	}
+	return b.String()
+}
+
+// isExcluded returns true if the relative plaintext path "relPath" or one of
+// its parent directories is excluded.
+func (e *excluder) isExcluded(relPath string) bool {
+	if e == nil || relPath == "" {
+		return false
+	}
+	// The config file must stay visible, otherwise the encrypted view cannot
+	// be mounted
+	if relPath == configfile.ConfReverseName {
+		return false
+	}
+	parts := strings.Split(relPath, "/")
+	for i := range parts {
+		if e.paths[strings.Join(parts[:i+1], "/")] {
+			return true
+		}
+		// All but the last component are directories
+		isDir := func() bool { return true }
+		if i == len(parts)-1 {
+			isDir = func() bool {
+				fi, err := os.Lstat(filepath.Join(e.cipherdir, relPath))
+				return err == nil && fi.IsDir()
+			}
+		}
+		if e.match(strings.Join(parts[:i+1], "/"), parts[i], isDir) {
+			return true
+		}
+	}
+	return false
+}
+
+// match evaluates all patterns against one path. The last matching pattern
+// wins, like in .gitignore files.
+func (e *excluder) match(path string, name string, isDir func() bool) bool {
+	excluded := false
+	for _, p := range e.patterns {
+		subject := name
+		if p.anchored {
+			subject = path
+		}
+		if !p.re.MatchString(subject) {
+			continue
+		}
+		if p.dirOnly && !isDir() {
+			continue
+		}
+		excluded = !p.negate
+	}
+	return excluded
+}
@@ -0,0 +1,52 @@
+package fusefrontend_reverse
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+)
+
+func TestExcluder(t *testing.T) {
+	dir, err := ioutil.TempDir("", "gocryptfs_excluder")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	if err = os.MkdirAll(dir+"/a/cache", 0700); err != nil {
+		t.Fatal(err)
+	}
+	if err = ioutil.WriteFile(dir+"/a/cache.txt", nil, 0600); err != nil {
+		t.Fatal(err)
+	}
+	e := newExcluder([]string{"*.o", "!keep.o", "/top", "cache/", "x/**/y", "[ab].tmp", "**/deep"}, nil, dir)
+	testCases := map[string]bool{
+		"":                        false,
+		".gocryptfs.reverse.conf": false,
+		"foo.o":                   true,
+		"sub/dir/foo.o":           true,
+		"sub/keep.o":              false,
+		"foo.c":                   false,
+		"top":                     true,
+		"top/child":               true,
+		"sub/top":                 false,
+		"a/cache":                 true,
+		"a/cache/file":            true,
+		"a/cache.txt":             false,
+		"x/y":                     true,
+		"x/1/2/y":                 true,
+		"a.tmp":                   true,
+		"c.tmp":                   false,
+		"1/2/deep":                true,
+		"deep":                    true,
+	}
+	for path, want := range testCases {
+		if got := e.isExcluded(path); got != want {
+			t.Errorf("%q: want %v, got %v", path, want, got)
+		}
+	}
+	// No patterns: nil excluder, nothing is excluded
+	e = newExcluder(nil, nil, dir)
+	if e.isExcluded("foo.o") {
+		t.Error("nil excluder should not exclude anything")
+	}
+}
@@ -0,0 +1,30 @@
+package fusefrontend_reverse
+
+import (
+	"fmt"
+)
+
+// ReverseFormatV1 is the way reverse mode has derived the file IDs, IVs and
+// encrypted names from the plaintext since gocryptfs v1.2 (see the pathiv
+// package).
+//
+// Backup tools rely on the ciphertext staying the same across gocryptfs
+// upgrades for deduplication and incremental backups. The format a
+// filesystem uses is pinned in its config file. A change to the derivation
+// must get a new format number, and the old formats must stay available for
+// the filesystems that are pinned to them.
+const ReverseFormatV1 = 1
+
+// CurrentReverseFormat is the format "-init -reverse" pins new filesystems to.
+const CurrentReverseFormat uint16 = ReverseFormatV1
+
+// CheckReverseFormat returns an error if the reverse format "format" from the
+// config file is not supported. Zero means the config file predates format
+// pinning and is equivalent to ReverseFormatV1.
+func CheckReverseFormat(format uint16) error {
+	if format > CurrentReverseFormat {
+		return fmt.Errorf("the filesystem uses reverse format %d, but this gocryptfs version only supports up to %d",
+			format, CurrentReverseFormat)
+	}
+	return nil
+}
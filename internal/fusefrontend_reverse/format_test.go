@@ -0,0 +1,87 @@
+package fusefrontend_reverse
+
+import (
+	"encoding/hex"
+	"io/ioutil"
+	"os"
+	"testing"
+
+	"github.com/hanwen/go-fuse/fuse"
+
+	"github.com/rfjakob/gocryptfs/internal/nametransform"
+)
+
+// Ciphertext of a filesystem containing a single file "file" with content
+// "hello world\n", all-zero master key, format 1
+const (
+	goldenV1Name    = "DAn9Q3uhi2OuTFfjA4F7Aw"
+	goldenV1DirIV   = "a8f7bac432ddc1cb3dc74e684d6ae48b"
+	goldenV1Content = "000239fc9ba68bad66b5d8007de7964b1ec4735a7ff0b28eae8641800b0a8509d76445b5119a5002e927d38f214e123678bbed77cab9bf882453bc46458e"
+)
+
+func readVirtual(t *testing.T, rfs *ReverseFS, relPath string) []byte {
+	ctx := &fuse.Context{}
+	a, status := rfs.GetAttr(relPath, ctx)
+	if !status.Ok() {
+		t.Fatalf("GetAttr %q: %v", relPath, status)
+	}
+	f, status := rfs.Open(relPath, uint32(os.O_RDONLY), ctx)
+	if !status.Ok() {
+		t.Fatalf("Open %q: %v", relPath, status)
+	}
+	defer f.Release()
+	buf := make([]byte, a.Size)
+	res, status := f.Read(buf, 0)
+	if !status.Ok() {
+		t.Fatal(status)
+	}
+	data, _ := res.Bytes(buf)
+	return append([]byte{}, data...)
+}
+
+// checkGoldenV1 checks that "rfs" produces the format 1 ciphertext
+func checkGoldenV1(t *testing.T, rfs *ReverseFS) {
+	entries, status := rfs.OpenDir("", &fuse.Context{})
+	if !status.Ok() {
+		t.Fatal(status)
+	}
+	if len(entries) != 2 || entries[1].Name != nametransform.DirIVFilename {
+		t.Fatalf("unexpected entries %v", entries)
+	}
+	name := entries[0].Name
+	if name != goldenV1Name {
+		t.Errorf("name changed: %q", name)
+	}
+	if dirIV := hex.EncodeToString(readVirtual(t, rfs, nametransform.DirIVFilename)); dirIV != goldenV1DirIV {
+		t.Errorf("diriv changed: %s", dirIV)
+	}
+	if content := hex.EncodeToString(readVirtual(t, rfs, name)); content != goldenV1Content {
+		t.Errorf("content changed: %s", content)
+	}
+}
+
+// A filesystem must keep producing the format 1 ciphertext, both when its
+// config file predates pinning and when it is pinned to format 1
+func TestReverseFormatPinned(t *testing.T) {
+	dir, err := ioutil.TempDir("", "gocryptfs_format")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	if err = ioutil.WriteFile(dir+"/file", []byte("hello world\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	// Config files without ReverseFormat predate pinning and use format 1
+	checkGoldenV1(t, newTestFS(dir))
+	rfs := newTestFS(dir)
+	rfs.args.ReverseFormat = ReverseFormatV1
+	checkGoldenV1(t, rfs)
+	for _, f := range []uint16{0, ReverseFormatV1, CurrentReverseFormat} {
+		if err = CheckReverseFormat(f); err != nil {
+			t.Errorf("format %d: %v", f, err)
+		}
+	}
+	if err = CheckReverseFormat(CurrentReverseFormat + 1); err == nil {
+		t.Error("format from the future should be rejected")
+	}
+}
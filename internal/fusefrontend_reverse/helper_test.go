@@ -0,0 +1,21 @@
+package fusefrontend_reverse
+
+// Helpers shared by the tests in this package
+
+import (
+	"github.com/rfjakob/gocryptfs/internal/cryptocore"
+	"github.com/rfjakob/gocryptfs/internal/fusefrontend"
+)
+
+// newTestFS returns a ReverseFS on the plaintext directory "dir", with the
+// options that "-init -reverse" uses
+func newTestFS(dir string) *ReverseFS {
+	args := fusefrontend.Args{
+		Cipherdir:     dir,
+		CryptoBackend: cryptocore.BackendAESSIV,
+		LongNames:     true,
+		Raw64:         true,
+		HKDF:          true,
+	}
+	return NewFS(make([]byte, cryptocore.KeyLen), args)
+}
@@ -0,0 +1,233 @@
+package fusefrontend_reverse
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"syscall"
+
+	"github.com/hanwen/go-fuse/fuse"
+
+	"github.com/rfjakob/gocryptfs/internal/configfile"
+	"github.com/rfjakob/gocryptfs/internal/tlog"
+)
+
+// IndexFilename is the name of the state file in the "-reverse-index"
+// directory
+const IndexFilename = "gocryptfs.reverse-index"
+
+// indexVersion is the format version of the state file. Files with a
+// different version are ignored.
+const indexVersion = 1
+
+// indexEntry is what the index remembers about a file of the encrypted view.
+// If the stat data is unchanged, the file is assumed to be unchanged.
+type indexEntry struct {
+	Ino   uint64
+	Size  uint64
+	Mtime int64
+	Ctime int64
+	// Sum is the hex SHA256 of the encrypted content (or, for symlinks, of the
+	// encrypted target)
+	Sum string
+}
+
+// indexFile is the JSON content of the state file
+type indexFile struct {
+	Version int
+	// MAC is the hex HMAC-SHA256 of the JSON-encoded Entries. It binds the
+	// index to the master key and detects corruption.
+	MAC string
+	// Entries is indexed by the path in the encrypted view. We never store
+	// plaintext names.
+	Entries map[string]indexEntry
+}
+
+// IndexResult is returned by UpdateIndex
+type IndexResult struct {
+	// Changed lists the new and modified files, Deleted the files that
+	// are gone. Both contain paths in the encrypted view, sorted.
+	Changed, Deleted []string
+	// Files is the number of files and symlinks in the encrypted view, Hashed
+	// the number of them that had to be read because the index did not know
+	// them or their stat data changed.
+	Files, Hashed int
+}
+
+// UpdateIndex compares the encrypted view against the index stored in
+// "stateDir", reports the differences and saves the new index.
+//
+// The ciphertext in reverse mode is deterministic, so a file whose inode
+// number, size, mtime and ctime are unchanged does not have to be read again.
+// A missing, corrupt or foreign index is ignored, all files are processed
+// then.
+func (rfs *ReverseFS) UpdateIndex(stateDir string) (*IndexResult, error) {
+	indexPath := filepath.Join(stateDir, IndexFilename)
+	old, err := rfs.loadIndex(indexPath)
+	if err != nil {
+		tlog.Warn.Printf("Ignoring index %q: %v. Processing all files.", indexPath, err)
+		old = nil
+	}
+	if old == nil {
+		old = make(map[string]indexEntry)
+	}
+	res := &IndexResult{}
+	cur := make(map[string]indexEntry)
+	err = rfs.indexDir("", old, cur, res)
+	if err != nil {
+		return nil, err
+	}
+	for cPath := range old {
+		if _, ok := cur[cPath]; !ok {
+			res.Deleted = append(res.Deleted, cPath)
+		}
+	}
+	sort.Strings(res.Changed)
+	sort.Strings(res.Deleted)
+	err = rfs.saveIndex(indexPath, cur)
+	if err != nil {
+		return nil, err
+	}
+	return res, nil
+}
+
+// indexDir adds the files below the encrypted directory "cDir" to "cur",
+// recursively
+func (rfs *ReverseFS) indexDir(cDir string, old map[string]indexEntry, cur map[string]indexEntry, res *IndexResult) error {
+	ctx := &fuse.Context{}
+	entries, status := rfs.OpenDir(cDir, ctx)
+	if !status.Ok() {
+		return &os.PathError{Op: "readdir", Path: "/" + cDir, Err: syscall.Errno(status)}
+	}
+	for _, de := range entries {
+		cPath := filepath.Join(cDir, de.Name)
+		switch de.Mode & syscall.S_IFMT {
+		case syscall.S_IFDIR:
+			err := rfs.indexDir(cPath, old, cur, res)
+			if err != nil {
+				return err
+			}
+			continue
+		case syscall.S_IFREG, syscall.S_IFLNK:
+		default:
+			continue
+		}
+		a, status := rfs.GetAttr(cPath, ctx)
+		if !status.Ok() {
+			return &os.PathError{Op: "stat", Path: "/" + cPath, Err: syscall.Errno(status)}
+		}
+		e := indexEntry{
+			Ino:   a.Ino,
+			Size:  a.Size,
+			Mtime: int64(a.Mtime)*1e9 + int64(a.Mtimensec),
+			Ctime: int64(a.Ctime)*1e9 + int64(a.Ctimensec),
+		}
+		res.Files++
+		prev, known := old[cPath]
+		// Virtual files (gocryptfs.diriv, ...) have no stat data of their
+		// own, and symlinks are cheap. Always hash those.
+		if known && a.IsRegular() && a.Ino < inoBaseMin &&
+			prev.Ino == e.Ino && prev.Size == e.Size && prev.Mtime == e.Mtime && prev.Ctime == e.Ctime {
+			cur[cPath] = prev
+			continue
+		}
+		res.Hashed++
+		h := sha256.New()
+		if a.IsSymlink() {
+			// Also covers targets that are too long for Readlink
+			target, err := rfs.readlinkEncrypted(cPath)
+			status = fuse.ToStatus(err)
+			h.Write([]byte(target))
+		} else {
+			status = rfs.readEncrypted(cPath, h)
+		}
+		if !status.Ok() {
+			return &os.PathError{Op: "read", Path: "/" + cPath, Err: syscall.Errno(status)}
+		}
+		e.Sum = hex.EncodeToString(h.Sum(nil))
+		cur[cPath] = e
+		if !known || prev.Sum != e.Sum {
+			res.Changed = append(res.Changed, cPath)
+		}
+	}
+	return nil
+}
+
+// indexMAC computes the hex MAC of the index entries
+func (rfs *ReverseFS) indexMAC(entries map[string]indexEntry) (string, error) {
+	// encoding/json sorts map keys, so the encoding is deterministic
+	j, err := json.Marshal(entries)
+	if err != nil {
+		return "", err
+	}
+	h := hmac.New(sha256.New, rfs.indexKey)
+	h.Write(j)
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// loadIndex reads the state file "path". Returns nil and no error if it does
+// not exist.
+func (rfs *ReverseFS) loadIndex(path string) (map[string]indexEntry, error) {
+	j, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	var f indexFile
+	err = json.Unmarshal(j, &f)
+	if err != nil {
+		return nil, err
+	}
+	if f.Version != indexVersion {
+		return nil, fmt.Errorf("unsupported version %d", f.Version)
+	}
+	mac, err := rfs.indexMAC(f.Entries)
+	if err != nil {
+		return nil, err
+	}
+	want, _ := hex.DecodeString(f.MAC)
+	have, _ := hex.DecodeString(mac)
+	if !hmac.Equal(want, have) {
+		return nil, errors.New("MAC mismatch, the index is corrupt or belongs to a different filesystem")
+	}
+	return f.Entries, nil
+}
+
+// saveIndex atomically replaces the state file "path". The temporary file
+// is created in configfile.TmpFileDir.
+func (rfs *ReverseFS) saveIndex(path string, entries map[string]indexEntry) error {
+	mac, err := rfs.indexMAC(entries)
+	if err != nil {
+		return err
+	}
+	j, err := json.MarshalIndent(indexFile{Version: indexVersion, MAC: mac, Entries: entries}, "", "\t")
+	if err != nil {
+		return err
+	}
+	tmp, err := ioutil.TempFile(configfile.TmpFileDir(path), IndexFilename+".tmp")
+	if err != nil {
+		return err
+	}
+	_, err = tmp.Write(j)
+	if err == nil {
+		err = tmp.Sync()
+	}
+	if err2 := tmp.Close(); err == nil {
+		err = err2
+	}
+	if err == nil {
+		err = os.Rename(tmp.Name(), path)
+	}
+	if err != nil {
+		os.Remove(tmp.Name())
+	}
+	return err
+}
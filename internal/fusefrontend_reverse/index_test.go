@@ -0,0 +1,161 @@
+package fusefrontend_reverse
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"testing"
+	"time"
+
+	"github.com/rfjakob/gocryptfs/internal/configfile"
+	"github.com/rfjakob/gocryptfs/internal/nametransform"
+)
+
+// decryptPaths translates the encrypted paths "cPaths" back to plaintext and
+// drops the virtual files
+func decryptPaths(t *testing.T, rfs *ReverseFS, cPaths []string) (pPaths []string) {
+	for _, cPath := range cPaths {
+		if filepath.Base(cPath) == nametransform.DirIVFilename {
+			continue
+		}
+		pPath, err := rfs.decryptPath(cPath)
+		if err != nil {
+			t.Fatal(err)
+		}
+		pPaths = append(pPaths, pPath)
+	}
+	sort.Strings(pPaths)
+	return pPaths
+}
+
+// Consecutive passes with the index must report exactly the changed files and
+// only read files whose stat data changed
+func TestUpdateIndex(t *testing.T) {
+	plain, err := ioutil.TempDir("", "gocryptfs_index_plain")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(plain)
+	state, err := ioutil.TempDir("", "gocryptfs_index_state")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(state)
+	if err = os.Mkdir(plain+"/dir", 0700); err != nil {
+		t.Fatal(err)
+	}
+	for _, f := range []string{"a", "b", "dir/c"} {
+		if err = ioutil.WriteFile(filepath.Join(plain, f), []byte("content of "+f), 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err = os.Symlink("a", plain+"/link"); err != nil {
+		t.Fatal(err)
+	}
+	rfs := newTestFS(plain)
+	update := func() *IndexResult {
+		res, err := rfs.UpdateIndex(state)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return res
+	}
+	all := []string{"a", "b", "dir/c", "link"}
+	// First pass: everything is new
+	res := update()
+	if have := decryptPaths(t, rfs, res.Changed); !reflect.DeepEqual(have, all) {
+		t.Errorf("first pass: changed=%v", have)
+	}
+	if res.Hashed != res.Files {
+		t.Errorf("first pass: hashed %d of %d files", res.Hashed, res.Files)
+	}
+	// Second pass: nothing changed, only the virtual files and the symlink
+	// are read again
+	res = update()
+	if len(res.Changed) != 0 || len(res.Deleted) != 0 {
+		t.Errorf("second pass: changed=%v deleted=%v", res.Changed, res.Deleted)
+	}
+	// gocryptfs.diriv of the root and of "dir", plus the symlink
+	if res.Hashed != 3 {
+		t.Errorf("second pass: hashed %d files", res.Hashed)
+	}
+	// Modify "b" keeping its size, only touch "dir/c", delete "a", create "new"
+	if err = ioutil.WriteFile(plain+"/b", []byte("CONTENT OF b"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	future := time.Now().Add(time.Hour)
+	if err = os.Chtimes(plain+"/dir/c", future, future); err != nil {
+		t.Fatal(err)
+	}
+	if err = os.Remove(plain + "/a"); err != nil {
+		t.Fatal(err)
+	}
+	if err = ioutil.WriteFile(plain+"/new", nil, 0600); err != nil {
+		t.Fatal(err)
+	}
+	res = update()
+	if have := decryptPaths(t, rfs, res.Changed); !reflect.DeepEqual(have, []string{"b", "new"}) {
+		t.Errorf("third pass: changed=%v", have)
+	}
+	if len(res.Deleted) != 1 {
+		t.Errorf("third pass: deleted=%v", res.Deleted)
+	}
+	// "b", "dir/c" and "new" have new stat data, plus the 3 files from above
+	if res.Hashed != 3+3 {
+		t.Errorf("third pass: hashed %d files", res.Hashed)
+	}
+	// A corrupt index is ignored and all files are processed again
+	indexPath := filepath.Join(state, IndexFilename)
+	j, err := ioutil.ReadFile(indexPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	j[len(j)/2] ^= 1
+	if err = ioutil.WriteFile(indexPath, j, 0600); err != nil {
+		t.Fatal(err)
+	}
+	res = update()
+	if have := decryptPaths(t, rfs, res.Changed); !reflect.DeepEqual(have, []string{"b", "dir/c", "link", "new"}) {
+		t.Errorf("corrupt index: changed=%v", have)
+	}
+	if res.Hashed != res.Files {
+		t.Errorf("corrupt index: hashed %d of %d files", res.Hashed, res.Files)
+	}
+}
+
+// saveIndex must work with "-tmpdir" and not leave the temporary file behind
+func TestSaveIndexTmpDir(t *testing.T) {
+	plain, err := ioutil.TempDir("", "gocryptfs_index_plain")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(plain)
+	state, err := ioutil.TempDir("", "gocryptfs_index_state")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(state)
+	tmp, err := ioutil.TempDir("", "gocryptfs_index_tmp")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmp)
+	configfile.TmpDir = tmp
+	defer func() { configfile.TmpDir = "" }()
+	rfs := newTestFS(plain)
+	if _, err = rfs.UpdateIndex(state); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = os.Stat(filepath.Join(state, IndexFilename)); err != nil {
+		t.Error(err)
+	}
+	entries, err := ioutil.ReadDir(tmp)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 0 {
+		t.Errorf("temp dir should be empty, has %d entries", len(entries))
+	}
+}
@@ -0,0 +1,113 @@
+package fusefrontend_reverse
+
+import (
+	"io/ioutil"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/hanwen/go-fuse/fuse"
+
+	"github.com/rfjakob/gocryptfs/internal/nametransform"
+)
+
+// findLongName returns the encrypted name of the only subdirectory of the
+// root and the gocryptfs.longname.XYZ entry inside it
+func findLongName(t *testing.T, rfs *ReverseFS) (cDir string, longname string) {
+	ctx := &fuse.Context{}
+	entries, status := rfs.OpenDir("", ctx)
+	if !status.Ok() {
+		t.Fatal(status)
+	}
+	for _, e := range entries {
+		if e.Name != nametransform.DirIVFilename {
+			cDir = e.Name
+		}
+	}
+	entries, status = rfs.OpenDir(cDir, ctx)
+	if !status.Ok() {
+		t.Fatal(status)
+	}
+	for _, e := range entries {
+		if nametransform.NameType(e.Name) == nametransform.LongNameContent {
+			longname = e.Name
+		}
+	}
+	if longname == "" {
+		t.Fatalf("no long name in %v", entries)
+	}
+	return cDir, longname
+}
+
+// checkLongName checks that "cDir/longname" and its .name file resolve, and
+// that the .name file content hashes to "longname"
+func checkLongName(t *testing.T, rfs *ReverseFS, cDir string, longname string) {
+	ctx := &fuse.Context{}
+	if _, status := rfs.GetAttr(cDir+"/"+longname, ctx); !status.Ok() {
+		t.Fatalf("GetAttr %q: %v", longname, status)
+	}
+	dotName := cDir + "/" + longname + nametransform.LongNameSuffix
+	a, status := rfs.GetAttr(dotName, ctx)
+	if !status.Ok() {
+		t.Fatalf("GetAttr %q: %v", dotName, status)
+	}
+	f, status := rfs.Open(dotName, uint32(os.O_RDONLY), ctx)
+	if !status.Ok() {
+		t.Fatal(status)
+	}
+	defer f.Release()
+	buf := make([]byte, a.Size)
+	res, status := f.Read(buf, 0)
+	if !status.Ok() {
+		t.Fatal(status)
+	}
+	cName, _ := res.Bytes(buf)
+	if rfs.nameTransform.HashLongName(string(cName)) != longname {
+		t.Errorf(".name content does not hash to %q", longname)
+	}
+}
+
+// Long names must resolve with the DirIV of the directory they are in, also
+// after the plaintext directory or the file has been renamed
+func TestLongNameRename(t *testing.T) {
+	dir, err := ioutil.TempDir("", "gocryptfs_longname")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	long1 := strings.Repeat("l", 200)
+	long2 := strings.Repeat("m", 200)
+	if err = os.Mkdir(dir+"/a", 0700); err != nil {
+		t.Fatal(err)
+	}
+	if err = ioutil.WriteFile(dir+"/a/"+long1, []byte("hello"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	rfs := newTestFS(dir)
+	cDirA, longA := findLongName(t, rfs)
+	checkLongName(t, rfs, cDirA, longA)
+	// Renaming the directory changes the DirIV and hence the hash
+	if err = os.Rename(dir+"/a", dir+"/b"); err != nil {
+		t.Fatal(err)
+	}
+	cDirB, longB := findLongName(t, rfs)
+	if longA == longB {
+		t.Error("hash did not change with the DirIV")
+	}
+	checkLongName(t, rfs, cDirB, longB)
+	if _, status := rfs.GetAttr(cDirB+"/"+longA, &fuse.Context{}); status != fuse.ENOENT {
+		t.Errorf("old hash in new directory: want ENOENT, got %v", status)
+	}
+	// Renaming the file inside the directory must not leave a stale entry
+	if err = os.Rename(dir+"/b/"+long1, dir+"/b/"+long2); err != nil {
+		t.Fatal(err)
+	}
+	_, longB2 := findLongName(t, rfs)
+	checkLongName(t, rfs, cDirB, longB2)
+	if _, status := rfs.GetAttr(cDirB+"/"+longB, &fuse.Context{}); status != fuse.ENOENT {
+		t.Errorf("old hash after rename: want ENOENT, got %v", status)
+	}
+	if _, status := rfs.GetAttr(cDirB+"/"+longB+nametransform.LongNameSuffix, &fuse.Context{}); status != fuse.ENOENT {
+		t.Errorf("old .name after rename: want ENOENT, got %v", status)
+	}
+}
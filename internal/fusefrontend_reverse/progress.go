@@ -0,0 +1,39 @@
+package fusefrontend_reverse
+
+import (
+	"sync/atomic"
+	"time"
+
+	"github.com/rfjakob/gocryptfs/internal/tlog"
+)
+
+// progressInterval is how often "-progress" logs the counters
+const progressInterval = 10 * time.Second
+
+// progress counts the files that have been opened and the bytes that have been
+// read through the encrypted view. Access the fields only using sync/atomic.
+type progress struct {
+	files uint64
+	bytes uint64
+}
+
+// Progress returns the number of files opened and the number of bytes read
+// through the encrypted view since the filesystem was created.
+func (rfs *ReverseFS) Progress() (files uint64, bytes uint64) {
+	return atomic.LoadUint64(&rfs.progress.files), atomic.LoadUint64(&rfs.progress.bytes)
+}
+
+// logProgress logs the counters every progressInterval if they have changed.
+// Runs forever, start it as a goroutine.
+func (rfs *ReverseFS) logProgress() {
+	var lastFiles, lastBytes uint64
+	for {
+		time.Sleep(progressInterval)
+		files, bytes := rfs.Progress()
+		if files == lastFiles && bytes == lastBytes {
+			continue
+		}
+		tlog.Info.Printf("progress: %d files opened, %d bytes read", files, bytes)
+		lastFiles, lastBytes = files, bytes
+	}
+}
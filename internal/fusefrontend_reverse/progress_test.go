@@ -0,0 +1,49 @@
+package fusefrontend_reverse
+
+import (
+	"io/ioutil"
+	"os"
+	"syscall"
+	"testing"
+)
+
+// TestProgress reads a file through the encrypted view and checks that the
+// counters advance.
+func TestProgress(t *testing.T) {
+	dir, err := ioutil.TempDir("", "gocryptfs_progress")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	err = ioutil.WriteFile(dir+"/file", make([]byte, 10000), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rfs := newTestFS(dir)
+	cPath, err := rfs.EncryptPath("file")
+	if err != nil {
+		t.Fatal(err)
+	}
+	files, bytes := rfs.Progress()
+	if files != 0 || bytes != 0 {
+		t.Errorf("counters should start at zero: files=%d bytes=%d", files, bytes)
+	}
+	f, status := rfs.Open(cPath, syscall.O_RDONLY, nil)
+	if !status.Ok() {
+		t.Fatal(status)
+	}
+	defer f.Release()
+	buf := make([]byte, 4096)
+	res, status := f.Read(buf, 0)
+	if !status.Ok() {
+		t.Fatal(status)
+	}
+	data, _ := res.Bytes(buf)
+	files, bytes = rfs.Progress()
+	if files != 1 {
+		t.Errorf("files: want 1, have %d", files)
+	}
+	if bytes != uint64(len(data)) || bytes == 0 {
+		t.Errorf("bytes: want %d, have %d", len(data), bytes)
+	}
+}
@@ -0,0 +1,53 @@
+package fusefrontend_reverse
+
+import (
+	"io/ioutil"
+	"os"
+	"reflect"
+	"sort"
+	"strings"
+	"testing"
+
+	"github.com/hanwen/go-fuse/fuse"
+)
+
+func readDirNames(t *testing.T, rfs *ReverseFS) []string {
+	entries, status := rfs.OpenDir("", &fuse.Context{})
+	if !status.Ok() {
+		t.Fatal(status)
+	}
+	var names []string
+	for _, e := range entries {
+		names = append(names, e.Name)
+	}
+	return names
+}
+
+// The encrypted directory listing must be sorted and identical across reads
+// and across independent ReverseFS instances
+func TestOpenDirOrder(t *testing.T) {
+	dir, err := ioutil.TempDir("", "gocryptfs_readdir")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	for _, n := range []string{"zzz", "aaa", "mmm", strings.Repeat("l", 200), "b", "yy"} {
+		if err = ioutil.WriteFile(dir+"/"+n, nil, 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+	rfs := newTestFS(dir)
+	names1 := readDirNames(t, rfs)
+	// The virtual gocryptfs.diriv and the .name file of the long name
+	if len(names1) != 8 {
+		t.Errorf("want 8 entries, got %d: %v", len(names1), names1)
+	}
+	if !sort.StringsAreSorted(names1) {
+		t.Errorf("entries are not sorted: %v", names1)
+	}
+	names2 := readDirNames(t, rfs)
+	names3 := readDirNames(t, newTestFS(dir))
+	if !reflect.DeepEqual(names1, names2) || !reflect.DeepEqual(names1, names3) {
+		t.Errorf("order changed:\n%v\n%v\n%v", names1, names2, names3)
+	}
+}
@@ -114,7 +114,10 @@ func (rfs *ReverseFS) newNameFile(relPath string) (nodefs.File, fuse.Status) {
 	if err != nil {
 		return nil, fuse.ToStatus(err)
 	}
-	content := []byte(rfs.nameTransform.EncryptName(pName, dirIV))
 	parentFile := filepath.Join(pDir, pName)
+	if rfs.excluder.isExcluded(parentFile) {
+		return nil, fuse.ENOENT
+	}
+	content := []byte(rfs.nameTransform.EncryptName(pName, dirIV))
 	return rfs.newVirtualFile(content, rfs.args.Cipherdir, parentFile, inoBaseNameFile)
 }
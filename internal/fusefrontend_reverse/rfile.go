@@ -4,6 +4,7 @@ import (
 	"bytes"
 	"io"
 	"os"
+	"sync/atomic"
 	"syscall"
 
 	// In newer Go versions, this has moved to just "sync/syncmap".
@@ -29,6 +30,8 @@ type reverseFile struct {
 	block0IV []byte
 	// Content encryption helper
 	contentEnc *contentenc.ContentEnc
+	// Counters for "-progress"
+	progress *progress
 }
 
 var inodeTable syncmap.Map
@@ -82,6 +85,7 @@ func (rfs *ReverseFS) newFile(relPath string) (*reverseFile, fuse.Status) {
 			}
 		}
 	}
+	atomic.AddUint64(&rfs.progress.files, 1)
 	header := contentenc.FileHeader{
 		Version: contentenc.CurrentVersion,
 		ID:      derivedIVs.ID,
@@ -92,6 +96,7 @@ func (rfs *ReverseFS) newFile(relPath string) (*reverseFile, fuse.Status) {
 		header:     header,
 		block0IV:   derivedIVs.Block0IV,
 		contentEnc: rfs.contentEnc,
+		progress:   &rfs.progress,
 	}, fuse.OK
 }
 
@@ -189,6 +194,7 @@ func (rf *reverseFile) Read(buf []byte, ioff int64) (resultData fuse.ReadResult,
 		}
 		out.Write(fileData)
 	}
+	atomic.AddUint64(&rf.progress.bytes, uint64(out.Len()))
 
 	return fuse.ReadResultData(out.Bytes()), fuse.OK
 }
@@ -4,6 +4,7 @@ import (
 	"fmt"
 	"log"
 	"path/filepath"
+	"sort"
 	"syscall"
 
 	"golang.org/x/sys/unix"
@@ -18,6 +19,7 @@ import (
 	"github.com/rfjakob/gocryptfs/internal/fusefrontend"
 	"github.com/rfjakob/gocryptfs/internal/nametransform"
 	"github.com/rfjakob/gocryptfs/internal/pathiv"
+	"github.com/rfjakob/gocryptfs/internal/seal"
 	"github.com/rfjakob/gocryptfs/internal/syscallcompat"
 	"github.com/rfjakob/gocryptfs/internal/tlog"
 )
@@ -35,6 +37,15 @@ type ReverseFS struct {
 	nameTransform *nametransform.NameTransform
 	// Content encryption helper
 	contentEnc *contentenc.ContentEnc
+	// Files and bytes read, for "-progress"
+	progress progress
+	// Hides paths matching "-reverse-exclude-from". nil if there are no
+	// patterns.
+	excluder *excluder
+	// sealKey is the HMAC key for "-reverse-seal", nil if disabled
+	sealKey []byte
+	// indexKey is the HMAC key for the "-reverse-index" state file
+	indexKey []byte
 }
 
 var _ pathfs.FileSystem = &ReverseFS{}
@@ -46,19 +57,31 @@ func NewFS(masterkey []byte, args fusefrontend.Args) *ReverseFS {
 	if args.CryptoBackend != cryptocore.BackendAESSIV {
 		log.Panic("reverse mode must use AES-SIV, everything else is insecure")
 	}
+	if err := CheckReverseFormat(args.ReverseFormat); err != nil {
+		log.Panic(err)
+	}
 	initLongnameCache()
 	cryptoCore := cryptocore.New(masterkey, args.CryptoBackend, contentenc.DefaultIVBits, args.HKDF, false)
 	contentEnc := contentenc.New(cryptoCore, contentenc.DefaultBS, false)
 	nameTransform := nametransform.New(cryptoCore.EMECipher, args.LongNames, args.Raw64)
 
-	return &ReverseFS{
+	rfs := &ReverseFS{
 		// pathfs.defaultFileSystem returns ENOSYS for all operations
 		FileSystem:    pathfs.NewDefaultFileSystem(),
 		loopbackfs:    pathfs.NewLoopbackFileSystem(args.Cipherdir),
 		args:          args,
 		nameTransform: nameTransform,
 		contentEnc:    contentEnc,
+		excluder:      newExcluder(args.ExcludePatterns, args.HiddenPaths, args.Cipherdir),
+		indexKey:      cryptoCore.IndexKey,
+	}
+	if args.Seal {
+		rfs.sealKey = cryptoCore.SealKey
+	}
+	if args.Progress {
+		go rfs.logProgress()
 	}
+	return rfs
 }
 
 // relDir is identical to filepath.Dir excepts that it returns "" when
@@ -122,7 +145,7 @@ func (rfs *ReverseFS) GetAttr(relPath string, context *fuse.Context) (*fuse.Attr
 		}
 		return &a, fuse.OK
 	}
-	// Handle virtual files (gocryptfs.diriv, *.name)
+	// Handle virtual files (gocryptfs.diriv, gocryptfs.seal, *.name)
 	var f nodefs.File
 	var status fuse.Status
 	virtual := false
@@ -130,6 +153,10 @@ func (rfs *ReverseFS) GetAttr(relPath string, context *fuse.Context) (*fuse.Attr
 		virtual = true
 		f, status = rfs.newDirIVFile(relPath)
 	}
+	if rfs.isSeal(relPath) {
+		virtual = true
+		f, status = rfs.newSealFile(relPath, false)
+	}
 	if rfs.isNameFile(relPath) {
 		virtual = true
 		f, status = rfs.newNameFile(relPath)
@@ -170,14 +197,12 @@ func (rfs *ReverseFS) GetAttr(relPath string, context *fuse.Context) (*fuse.Attr
 	if a.IsRegular() {
 		a.Size = rfs.contentEnc.PlainSizeToCipherSize(a.Size)
 	} else if a.IsSymlink() {
-		var linkTarget string
-		var readlinkStatus fuse.Status
-
-		linkTarget, readlinkStatus = rfs.Readlink(relPath, context)
-		if !readlinkStatus.Ok() {
-			return nil, readlinkStatus
+		// A target that is too long for Readlink must not make the symlink
+		// disappear from directory listings
+		linkTarget, err := rfs.readlinkEncrypted(relPath)
+		if err != nil {
+			return nil, fuse.ToStatus(err)
 		}
-
 		a.Size = uint64(len(linkTarget))
 	}
 	if rfs.args.ForceOwner != nil {
@@ -188,7 +213,7 @@ func (rfs *ReverseFS) GetAttr(relPath string, context *fuse.Context) (*fuse.Attr
 
 // Access - FUSE call
 func (rfs *ReverseFS) Access(relPath string, mode uint32, context *fuse.Context) fuse.Status {
-	if rfs.isTranslatedConfig(relPath) || rfs.isDirIV(relPath) || rfs.isNameFile(relPath) {
+	if rfs.isTranslatedConfig(relPath) || rfs.isDirIV(relPath) || rfs.isNameFile(relPath) || rfs.isSeal(relPath) {
 		// access(2) R_OK flag for checking if the file is readable, always 4 as defined in POSIX.
 		ROK := uint32(0x4)
 		// Virtual files can always be read and never written
@@ -220,6 +245,9 @@ func (rfs *ReverseFS) Open(relPath string, flags uint32, context *fuse.Context)
 	if rfs.isNameFile(relPath) {
 		return rfs.newNameFile(relPath)
 	}
+	if rfs.isSeal(relPath) {
+		return rfs.newSealFile(relPath, true)
+	}
 	return rfs.newFile(relPath)
 }
 
@@ -248,7 +276,18 @@ func (rfs *ReverseFS) openDirPlaintextnames(relPath string, entries []fuse.DirEn
 	return entries, status
 }
 
-// OpenDir - FUSE readdir call
+// dirEntriesByName sorts directory entries by name
+type dirEntriesByName []fuse.DirEntry
+
+func (e dirEntriesByName) Len() int           { return len(e) }
+func (e dirEntriesByName) Less(i, j int) bool { return e[i].Name < e[j].Name }
+func (e dirEntriesByName) Swap(i, j int)      { e[i], e[j] = e[j], e[i] }
+
+// OpenDir - FUSE readdir call.
+// The entries are sorted by their encrypted name, so that the listing does
+// not depend on the order of the plaintext directory and is the same across
+// runs and mounts. Backup and verification tools can then produce
+// reproducible manifests.
 func (rfs *ReverseFS) OpenDir(cipherPath string, context *fuse.Context) ([]fuse.DirEntry, fuse.Status) {
 	relPath, err := rfs.decryptPath(cipherPath)
 	if err != nil {
@@ -264,13 +303,24 @@ func (rfs *ReverseFS) OpenDir(cipherPath string, context *fuse.Context) ([]fuse.
 	if err != nil {
 		return nil, fuse.ToStatus(err)
 	}
+	if rfs.excluder != nil {
+		filtered := entries[:0]
+		for _, e := range entries {
+			if !rfs.excluder.isExcluded(filepath.Join(relPath, e.Name)) {
+				filtered = append(filtered, e)
+			}
+		}
+		entries = filtered
+	}
 	if rfs.args.PlaintextNames {
-		return rfs.openDirPlaintextnames(cipherPath, entries)
+		entries, status := rfs.openDirPlaintextnames(cipherPath, entries)
+		sort.Sort(dirEntriesByName(entries))
+		return entries, status
 	}
 	// Allocate maximum possible number of virtual files.
 	// If all files have long names we need a virtual ".name" file for each,
-	// plus one for gocryptfs.diriv.
-	virtualFiles := make([]fuse.DirEntry, len(entries)+1)
+	// plus one for gocryptfs.diriv and one for gocryptfs.seal.
+	virtualFiles := make([]fuse.DirEntry, len(entries)+2)
 	// Virtual gocryptfs.diriv file
 	virtualFiles[0] = fuse.DirEntry{
 		Mode: virtualFileMode,
@@ -278,6 +328,13 @@ func (rfs *ReverseFS) OpenDir(cipherPath string, context *fuse.Context) ([]fuse.
 	}
 	// Actually used entries
 	nVirtual := 1
+	if rfs.sealKey != nil {
+		virtualFiles[nVirtual] = fuse.DirEntry{
+			Mode: virtualFileMode,
+			Name: seal.Filename,
+		}
+		nVirtual++
+	}
 
 	// Encrypt names
 	dirIV := pathiv.Derive(cipherPath, pathiv.PurposeDirIV)
@@ -301,6 +358,7 @@ func (rfs *ReverseFS) OpenDir(cipherPath string, context *fuse.Context) ([]fuse.
 		entries[i].Name = cName
 	}
 	entries = append(entries, virtualFiles[:nVirtual]...)
+	sort.Sort(dirEntriesByName(entries))
 	return entries, fuse.OK
 }
 
@@ -309,6 +367,8 @@ func (rfs *ReverseFS) OpenDir(cipherPath string, context *fuse.Context) ([]fuse.
 // Securing statfs against symlink races seems to be more trouble than
 // it's worth, so we just ignore the path and always return info about the
 // backing storage root dir.
+// The sizes are converted to what the encrypted view would occupy, see
+// addStatfsOverhead.
 func (rfs *ReverseFS) StatFs(path string) *fuse.StatfsOut {
 	var s syscall.Statfs_t
 	err := syscall.Statfs(rfs.args.Cipherdir, &s)
@@ -317,33 +377,86 @@ func (rfs *ReverseFS) StatFs(path string) *fuse.StatfsOut {
 	}
 	out := &fuse.StatfsOut{}
 	out.FromStatfsT(&s)
+	rfs.addStatfsOverhead(out)
 	return out
 }
 
+// addStatfsOverhead converts the statfs numbers of the plaintext source
+// directory to the encrypted view. Every plaintext block grows by the block
+// overhead, and every used inode is assumed to be a file that carries a
+// file header.
+// This is an estimate: statfs only knows totals, so sparse files, small files
+// and directories are not accounted for exactly.
+func (rfs *ReverseFS) addStatfsOverhead(out *fuse.StatfsOut) {
+	// The block counts are in units of the fragment size (f_frsize), which
+	// is what "df" uses as well
+	unit := uint64(out.Frsize)
+	if unit == 0 {
+		unit = uint64(out.Bsize)
+	}
+	if unit == 0 || out.Bfree > out.Blocks {
+		return
+	}
+	plainBS := rfs.contentEnc.PlainBS()
+	blockOverhead := rfs.contentEnc.BlockOverhead()
+	// scale converts a number of plaintext bytes to ciphertext bytes
+	scale := func(plainBytes uint64) uint64 {
+		return plainBytes + (plainBytes+plainBS-1)/plainBS*blockOverhead
+	}
+	usedBytes := (out.Blocks - out.Bfree) * unit
+	var usedInodes uint64
+	if out.Ffree <= out.Files {
+		usedInodes = out.Files - out.Ffree
+	}
+	cUsedBytes := scale(usedBytes) + usedInodes*contentenc.HeaderLen
+	cUsed := (cUsedBytes + unit - 1) / unit
+	// Free space grows by the same ratio: writing n more plaintext bytes to
+	// the source makes the encrypted view grow by scale(n) bytes.
+	out.Bfree = scale(out.Bfree*unit) / unit
+	out.Bavail = scale(out.Bavail*unit) / unit
+	out.Blocks = out.Bfree + cUsed
+}
+
 // Readlink - FUSE call
 func (rfs *ReverseFS) Readlink(relPath string, context *fuse.Context) (string, fuse.Status) {
-	dirfd, name, err := rfs.openBackingDir(relPath)
+	cTarget, err := rfs.readlinkEncrypted(relPath)
 	if err != nil {
 		return "", fuse.ToStatus(err)
 	}
+	// The kernel will reject a symlink target above 4096 chars and return
+	// and I/O error to the user. Better emit the proper error ourselves.
+	const PATH_MAX = 4096 // not defined on Darwin
+	if len(cTarget) > PATH_MAX {
+		tlog.Debug.Printf("Readlink %q: encrypted target is %d bytes long, max is %d",
+			relPath, len(cTarget), PATH_MAX)
+		return "", fuse.Status(syscall.ENAMETOOLONG)
+	}
+	return cTarget, fuse.OK
+}
+
+// readlinkEncrypted returns the encrypted target of the symlink "relPath".
+// Unlike Readlink, it also returns targets that are too long to be shown in
+// the encrypted view: a plaintext target that is close to PATH_MAX grows
+// beyond it through encryption and base64. GetAttr, the seal files and
+// the index still need them.
+func (rfs *ReverseFS) readlinkEncrypted(relPath string) (string, error) {
+	dirfd, name, err := rfs.openBackingDir(relPath)
+	if err != nil {
+		return "", err
+	}
 	// read the link target using Readlinkat
 	plainTarget, err := syscallcompat.Readlinkat(dirfd, name)
 	syscall.Close(dirfd)
 	if err != nil {
-		return "", fuse.ToStatus(err)
+		return "", err
 	}
 	if rfs.args.PlaintextNames {
-		return plainTarget, fuse.OK
+		return plainTarget, nil
 	}
+	// The nonce is derived from the path, so the encrypted target is
+	// deterministic and stays the same across backup runs.
 	nonce := pathiv.Derive(relPath, pathiv.PurposeSymlinkIV)
 	// Symlinks are encrypted like file contents and base64-encoded
 	cBinTarget := rfs.contentEnc.EncryptBlockNonce([]byte(plainTarget), 0, nil, nonce)
-	cTarget := rfs.nameTransform.B64.EncodeToString(cBinTarget)
-	// The kernel will reject a symlink target above 4096 chars and return
-	// and I/O error to the user. Better emit the proper error ourselves.
-	const PATH_MAX = 4096 // not defined on Darwin
-	if len(cTarget) > PATH_MAX {
-		return "", fuse.Status(syscall.ENAMETOOLONG)
-	}
-	return cTarget, fuse.OK
+	return rfs.nameTransform.B64.EncodeToString(cBinTarget), nil
 }
@@ -62,8 +62,20 @@ func (rfs *ReverseFS) rDecryptName(cName string, dirIV []byte, pDir string) (pNa
 }
 
 // decryptPath decrypts a relative ciphertext path to a relative plaintext
-// path.
+// path. Excluded paths give ENOENT.
 func (rfs *ReverseFS) decryptPath(relPath string) (string, error) {
+	pRelPath, err := rfs.decryptPathNoExclude(relPath)
+	if err != nil {
+		return "", err
+	}
+	if rfs.excluder.isExcluded(pRelPath) {
+		return "", syscall.ENOENT
+	}
+	return pRelPath, nil
+}
+
+// decryptPathNoExclude is like decryptPath but does not check the excludes.
+func (rfs *ReverseFS) decryptPathNoExclude(relPath string) (string, error) {
 	if rfs.args.PlaintextNames || relPath == "" {
 		return relPath, nil
 	}
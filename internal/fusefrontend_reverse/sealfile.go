@@ -0,0 +1,132 @@
+package fusefrontend_reverse
+
+import (
+	"crypto/sha256"
+	"io"
+	"os"
+	"path/filepath"
+	"syscall"
+
+	"github.com/hanwen/go-fuse/fuse"
+	"github.com/hanwen/go-fuse/fuse/nodefs"
+
+	"github.com/rfjakob/gocryptfs/internal/nametransform"
+	"github.com/rfjakob/gocryptfs/internal/seal"
+)
+
+// isSeal determines if the path points to a gocryptfs.seal file
+func (rfs *ReverseFS) isSeal(relPath string) bool {
+	return rfs.sealKey != nil && filepath.Base(relPath) == seal.Filename
+}
+
+// newSealFile creates the virtual gocryptfs.seal file of the directory that
+// contains "cRelPath". Computing the MACs means encrypting every file in the
+// directory. If "withMACs" is false, the MACs are left zero, which is good
+// enough to get the file size.
+func (rfs *ReverseFS) newSealFile(cRelPath string, withMACs bool) (nodefs.File, fuse.Status) {
+	cDir := nametransform.Dir(cRelPath)
+	pDir, err := rfs.decryptPath(cDir)
+	if err != nil {
+		return nil, fuse.ToStatus(err)
+	}
+	content, status := rfs.sealContent(cDir, withMACs)
+	if !status.Ok() {
+		return nil, status
+	}
+	return rfs.newVirtualFile(content, rfs.args.Cipherdir, pDir, inoBaseSeal)
+}
+
+// sealContent returns the content of the gocryptfs.seal file of directory
+// "cDir". With "withMACs", this encrypts everything below "cDir", because
+// the MAC of a subdirectory covers its seal file.
+func (rfs *ReverseFS) sealContent(cDir string, withMACs bool) ([]byte, fuse.Status) {
+	dirEntries, status := rfs.OpenDir(cDir, &fuse.Context{})
+	if !status.Ok() {
+		return nil, status
+	}
+	var entries []seal.Entry
+	for _, de := range dirEntries {
+		if de.Name == seal.Filename {
+			continue
+		}
+		e := seal.Entry{
+			Name: de.Name,
+			Kind: direntKind(de.Mode),
+			MAC:  make([]byte, sha256.Size),
+		}
+		if withMACs {
+			e.MAC, status = rfs.sealMAC(filepath.Join(cDir, de.Name), e.Kind)
+			if !status.Ok() {
+				return nil, status
+			}
+		}
+		entries = append(entries, e)
+	}
+	return seal.Format(rfs.sealKey, cDir, entries), fuse.OK
+}
+
+// direntKind returns the seal.Kind for the mode of a directory entry
+func direntKind(mode uint32) seal.Kind {
+	switch mode & syscall.S_IFMT {
+	case syscall.S_IFDIR:
+		return seal.KindDir
+	case syscall.S_IFLNK:
+		return seal.KindSymlink
+	case syscall.S_IFREG:
+		return seal.KindFile
+	}
+	return seal.KindOther
+}
+
+// sealMAC computes the MAC of the encrypted entry "cPath" as it is shown in
+// the encrypted view
+func (rfs *ReverseFS) sealMAC(cPath string, kind seal.Kind) ([]byte, fuse.Status) {
+	h := seal.NewHash(rfs.sealKey, cPath, kind)
+	switch kind {
+	case seal.KindSymlink:
+		// Also covers targets that are too long for Readlink. fsck then
+		// reports the symlink as missing from the backup, which it is.
+		target, err := rfs.readlinkEncrypted(cPath)
+		if err != nil {
+			return nil, fuse.ToStatus(err)
+		}
+		h.Write([]byte(target))
+	case seal.KindDir:
+		content, status := rfs.sealContent(cPath, true)
+		if !status.Ok() {
+			return nil, status
+		}
+		h.Write(content)
+	case seal.KindFile:
+		if status := rfs.readEncrypted(cPath, h); !status.Ok() {
+			return nil, status
+		}
+	}
+	return h.Sum(nil), fuse.OK
+}
+
+// readEncrypted writes the encrypted content of the file "cPath" to "w"
+func (rfs *ReverseFS) readEncrypted(cPath string, w io.Writer) fuse.Status {
+	f, status := rfs.Open(cPath, uint32(os.O_RDONLY), &fuse.Context{})
+	if !status.Ok() {
+		return status
+	}
+	defer f.Release()
+	buf := make([]byte, fuse.MAX_KERNEL_WRITE)
+	for off := int64(0); ; {
+		res, status := f.Read(buf, off)
+		if !status.Ok() {
+			return status
+		}
+		if res == nil {
+			return fuse.OK
+		}
+		data, _ := res.Bytes(buf)
+		w.Write(data)
+		res.Done()
+		if len(data) == 0 {
+			return fuse.OK
+		}
+		off += int64(len(data))
+	}
+}
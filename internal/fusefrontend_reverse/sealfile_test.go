@@ -0,0 +1,162 @@
+package fusefrontend_reverse
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"testing"
+
+	"github.com/hanwen/go-fuse/fuse"
+
+	"github.com/rfjakob/gocryptfs/internal/seal"
+)
+
+// backup copies the encrypted view of "rfs" below "cDir" to "dst", like a
+// backup program would
+func backup(t *testing.T, rfs *ReverseFS, cDir string, dst string) {
+	ctx := &fuse.Context{}
+	entries, status := rfs.OpenDir(cDir, ctx)
+	if !status.Ok() {
+		t.Fatalf("OpenDir %q: %v", cDir, status)
+	}
+	for _, e := range entries {
+		cPath := filepath.Join(cDir, e.Name)
+		dstPath := filepath.Join(dst, cPath)
+		switch e.Mode & syscall.S_IFMT {
+		case syscall.S_IFDIR:
+			if err := os.Mkdir(dstPath, 0700); err != nil {
+				t.Fatal(err)
+			}
+			backup(t, rfs, cPath, dst)
+		case syscall.S_IFLNK:
+			target, status := rfs.Readlink(cPath, ctx)
+			if !status.Ok() {
+				t.Fatal(status)
+			}
+			if err := os.Symlink(target, dstPath); err != nil {
+				t.Fatal(err)
+			}
+		default:
+			if err := ioutil.WriteFile(dstPath, readVirtual(t, rfs, cPath), 0600); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+}
+
+// checkTree runs seal.CheckDir on every directory below "root" and returns
+// all problems
+func checkTree(t *testing.T, key []byte, root string) (problems []seal.Problem) {
+	filepath.Walk(root, func(path string, fi os.FileInfo, err error) error {
+		if err != nil || !fi.IsDir() {
+			return err
+		}
+		rel, _ := filepath.Rel(root, path)
+		if rel == "." {
+			rel = ""
+		}
+		p, err := seal.CheckDir(key, root, rel)
+		if err != nil {
+			problems = append(problems, seal.Problem{Path: rel, Msg: err.Error()})
+		}
+		problems = append(problems, p...)
+		return nil
+	})
+	return problems
+}
+
+// A backup of the sealed encrypted view must verify, and altering it must be
+// detected
+func TestSealBackup(t *testing.T) {
+	plain, err := ioutil.TempDir("", "gocryptfs_seal_plain")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(plain)
+	if err = os.Mkdir(plain+"/dir", 0700); err != nil {
+		t.Fatal(err)
+	}
+	for _, f := range []string{"a", "dir/b", "dir/" + strings.Repeat("l", 200)} {
+		if err = ioutil.WriteFile(plain+"/"+f, []byte("content of "+f), 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err = os.Symlink("a", plain+"/dir/link"); err != nil {
+		t.Fatal(err)
+	}
+	rfs := newTestFS(plain)
+	rfs.sealKey = make([]byte, 32)
+	restore := func() string {
+		dst, err := ioutil.TempDir("", "gocryptfs_seal_backup")
+		if err != nil {
+			t.Fatal(err)
+		}
+		backup(t, rfs, "", dst)
+		return dst
+	}
+	dst := restore()
+	defer os.RemoveAll(dst)
+	if p := checkTree(t, rfs.sealKey, dst); len(p) != 0 {
+		t.Fatalf("unmodified backup: %v", p)
+	}
+	// The size shown by GetAttr must match the content
+	a, status := rfs.GetAttr(seal.Filename, &fuse.Context{})
+	if !status.Ok() || int(a.Size) != len(readVirtual(t, rfs, seal.Filename)) {
+		t.Errorf("wrong seal file size: %v %v", a, status)
+	}
+	// Flip one byte in every file of the backup, one at a time
+	var files []string
+	filepath.Walk(dst, func(path string, fi os.FileInfo, err error) error {
+		if fi.Mode().IsRegular() && fi.Name() != seal.Filename {
+			files = append(files, path)
+		}
+		return nil
+	})
+	if len(files) < 5 {
+		t.Fatalf("too few files in backup: %v", files)
+	}
+	for _, f := range files {
+		orig, err := ioutil.ReadFile(f)
+		if err != nil {
+			t.Fatal(err)
+		}
+		altered := append([]byte{}, orig...)
+		altered[len(altered)/2] ^= 1
+		ioutil.WriteFile(f, altered, 0600)
+		if p := checkTree(t, rfs.sealKey, dst); len(p) != 1 {
+			t.Errorf("%s: want one problem, got %v", f, p)
+		}
+		ioutil.WriteFile(f, orig, 0600)
+	}
+	// Deleted files are detected as well
+	if err = os.Remove(files[0]); err != nil {
+		t.Fatal(err)
+	}
+	if p := checkTree(t, rfs.sealKey, dst); len(p) != 1 || !strings.Contains(p[0].Msg, "missing") {
+		t.Errorf("deleted file: %v", p)
+	}
+	// Roll back the subdirectory, together with its seal file, to the state
+	// of an older backup. Its own seal is valid, the parent must notice.
+	old := restore()
+	defer os.RemoveAll(old)
+	if err = ioutil.WriteFile(plain+"/dir/b", []byte("new content"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	cur := restore()
+	defer os.RemoveAll(cur)
+	cDir, err := rfs.EncryptPath("dir")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = os.RemoveAll(filepath.Join(cur, cDir)); err != nil {
+		t.Fatal(err)
+	}
+	if err = os.Rename(filepath.Join(old, cDir), filepath.Join(cur, cDir)); err != nil {
+		t.Fatal(err)
+	}
+	if p := checkTree(t, rfs.sealKey, cur); len(p) != 1 || p[0].Path != cDir {
+		t.Errorf("rolled back directory: %v", p)
+	}
+}
@@ -0,0 +1,72 @@
+package fusefrontend_reverse
+
+import (
+	"io/ioutil"
+	"os"
+	"syscall"
+	"testing"
+
+	"github.com/hanwen/go-fuse/fuse"
+
+	"github.com/rfjakob/gocryptfs/internal/contentenc"
+)
+
+// TestStatfsOverhead checks the conversion with fixed numbers
+func TestStatfsOverhead(t *testing.T) {
+	rfs := newTestFS("/")
+	out := fuse.StatfsOut{
+		Bsize:  4096,
+		Frsize: 4096,
+		Blocks: 1000,
+		Bfree:  400,
+		Bavail: 300,
+		Files:  100,
+		Ffree:  90,
+	}
+	rfs.addStatfsOverhead(&out)
+	// 600 used blocks of 4096 bytes become 600 blocks of 4128 bytes, plus
+	// 10 file headers: 600*4128 + 10*18 = 2476980 bytes = 605 blocks.
+	// Free: 400*4128/4096 = 403, available: 300*4128/4096 = 302.
+	if out.Bfree != 403 || out.Bavail != 302 || out.Blocks != 403+605 {
+		t.Errorf("wrong result: Blocks=%d Bfree=%d Bavail=%d", out.Blocks, out.Bfree, out.Bavail)
+	}
+	if out.Files != 100 || out.Ffree != 90 {
+		t.Errorf("inode counts should not change: Files=%d Ffree=%d", out.Files, out.Ffree)
+	}
+}
+
+// TestStatfs compares the encrypted view against the plaintext source
+func TestStatfs(t *testing.T) {
+	dir, err := ioutil.TempDir("", "gocryptfs_statfs")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	rfs := newTestFS(dir)
+	var s syscall.Statfs_t
+	if err = syscall.Statfs(dir, &s); err != nil {
+		t.Fatal(err)
+	}
+	out := rfs.StatFs("")
+	if out == nil {
+		t.Fatal("StatFs failed")
+	}
+	var src fuse.StatfsOut
+	src.FromStatfsT(&s)
+	if src.Blocks == 0 {
+		t.Skip("source filesystem reports zero blocks")
+	}
+	// The size grows by at most the block overhead ratio plus one header per
+	// inode and rounding
+	plainBS := float64(contentenc.DefaultBS)
+	ratio := (plainBS + 32) / plainBS
+	lo := float64(src.Blocks)
+	hi := float64(src.Blocks)*ratio + float64(src.Files*contentenc.HeaderLen)/float64(src.Bsize) + 2
+	if float64(out.Blocks) < lo || float64(out.Blocks) > hi {
+		t.Errorf("Blocks=%d outside of [%.0f, %.0f]", out.Blocks, lo, hi)
+	}
+	// Other processes may allocate space in between, allow 1% difference
+	if float64(out.Bfree) < float64(src.Bfree)*0.99 || float64(out.Bfree) > float64(src.Bfree)*ratio*1.01+1 {
+		t.Errorf("Bfree=%d does not match source Bfree=%d", out.Bfree, src.Bfree)
+	}
+}
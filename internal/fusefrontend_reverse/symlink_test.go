@@ -0,0 +1,79 @@
+package fusefrontend_reverse
+
+import (
+	"io/ioutil"
+	"os"
+	"strings"
+	"syscall"
+	"testing"
+
+	"github.com/hanwen/go-fuse/fuse"
+)
+
+// A symlink whose encrypted target is too long for the encrypted view must
+// still show up in the directory listing with the right size, and only
+// Readlink must fail
+func TestSymlinkTooLong(t *testing.T) {
+	dir, err := ioutil.TempDir("", "gocryptfs_symlink")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	targets := map[string]string{
+		"short": "/usr/share/doc",
+		"long":  strings.Repeat("x", 4000),
+	}
+	for name, target := range targets {
+		if err = os.Symlink(target, dir+"/"+name); err != nil {
+			t.Fatal(err)
+		}
+	}
+	rfs := newTestFS(dir)
+	ctx := &fuse.Context{}
+	entries, status := rfs.OpenDir("", ctx)
+	if !status.Ok() {
+		t.Fatal(status)
+	}
+	found := 0
+	for _, e := range entries {
+		if e.Mode&syscall.S_IFMT != syscall.S_IFLNK {
+			continue
+		}
+		found++
+		name, err := rfs.decryptPath(e.Name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		a, status := rfs.GetAttr(e.Name, ctx)
+		if !status.Ok() {
+			t.Errorf("%s: GetAttr: %v", name, status)
+			continue
+		}
+		cTarget, status := rfs.Readlink(e.Name, ctx)
+		switch name {
+		case "short":
+			if !status.Ok() || a.Size != uint64(len(cTarget)) {
+				t.Errorf("short: Readlink: %v, size %d, target length %d", status, a.Size, len(cTarget))
+			}
+		case "long":
+			if status != fuse.Status(syscall.ENAMETOOLONG) {
+				t.Errorf("long: Readlink: want ENAMETOOLONG, got %v", status)
+			}
+			if a.Size <= 4096 {
+				t.Errorf("long: size %d is too small", a.Size)
+			}
+		}
+	}
+	if found != len(targets) {
+		t.Errorf("found %d symlinks, want %d", found, len(targets))
+	}
+	// The index covers the long symlink as well
+	state, err := ioutil.TempDir("", "gocryptfs_symlink_state")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(state)
+	if _, err = rfs.UpdateIndex(state); err != nil {
+		t.Errorf("UpdateIndex: %v", err)
+	}
+}
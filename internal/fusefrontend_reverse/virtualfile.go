@@ -17,8 +17,8 @@ import (
 )
 
 const (
-	// virtualFileMode is the mode to use for virtual files (gocryptfs.diriv and
-	// *.name). They are always readable, as stated in func Access
+	// virtualFileMode is the mode to use for virtual files (gocryptfs.diriv,
+	// gocryptfs.seal and *.name). They are always readable, as stated in func Access
 	virtualFileMode = syscall.S_IFREG | 0444
 	// inoBaseDirIV is the start of the inode number range that is used
 	// for virtual gocryptfs.diriv files. inoBaseNameFile is the thing for
@@ -29,6 +29,8 @@ const (
 	// INT64_MAX (=UINT64_MAX/2). This avoids signedness issues.
 	inoBaseDirIV    = uint64(1000000000000000000)
 	inoBaseNameFile = uint64(2000000000000000000)
+	// inoBaseSeal is used for virtual gocryptfs.seal files
+	inoBaseSeal = uint64(3000000000000000000)
 	// inoBaseMin marks the start of the inode number space that is
 	// reserved for virtual files. It is the lowest of the inoBaseXXX values
 	// above.
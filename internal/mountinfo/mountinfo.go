@@ -0,0 +1,81 @@
+// Package mountinfo parses /proc/self/mountinfo, see proc(5).
+package mountinfo
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// Entry is one line of /proc/self/mountinfo
+type Entry struct {
+	// Dev is "major:minor" of the mounted filesystem
+	Dev string
+	// Root is the directory of the filesystem that is mounted, "/" for a
+	// normal mount, a subdirectory for most bind mounts
+	Root string
+	// MountPoint is the absolute path where it is mounted
+	MountPoint string
+	// FsType is the filesystem type, for example "ext4" or "fuse.gocryptfs"
+	FsType string
+}
+
+// Read reads and parses /proc/self/mountinfo
+func Read() ([]Entry, error) {
+	f, err := os.Open("/proc/self/mountinfo")
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return Parse(f)
+}
+
+// Parse parses the format of /proc/self/mountinfo
+func Parse(r io.Reader) ([]Entry, error) {
+	var mounts []Entry
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) < 5 {
+			return nil, fmt.Errorf("invalid mountinfo line: %q", scanner.Text())
+		}
+		e := Entry{
+			Dev:        fields[2],
+			Root:       unescape(fields[3]),
+			MountPoint: unescape(fields[4]),
+		}
+		// The optional fields are terminated by a single "-", the
+		// filesystem type follows
+		for i := 6; i < len(fields)-1; i++ {
+			if fields[i] == "-" {
+				e.FsType = unescape(fields[i+1])
+				break
+			}
+		}
+		mounts = append(mounts, e)
+	}
+	return mounts, scanner.Err()
+}
+
+// unescape decodes the octal escapes ("\040" for a space) that the kernel
+// uses for special characters in mountinfo paths
+func unescape(s string) string {
+	if !strings.Contains(s, `\`) {
+		return s
+	}
+	var out []byte
+	for i := 0; i < len(s); i++ {
+		if s[i] == '\\' && i+3 < len(s) {
+			if v, err := strconv.ParseUint(s[i+1:i+4], 8, 8); err == nil {
+				out = append(out, byte(v))
+				i += 3
+				continue
+			}
+		}
+		out = append(out, s[i])
+	}
+	return string(out)
+}
@@ -0,0 +1,32 @@
+package mountinfo
+
+import (
+	"strings"
+	"testing"
+)
+
+const testMountinfo = `22 1 8:1 / / rw,relatime shared:1 - ext4 /dev/sda1 rw
+32 22 8:1 /data /src/d\040e rw,relatime - ext4 /dev/sda1 rw
+40 22 0:45 / /mnt/plain rw,nosuid,nodev,relatime shared:2 master:1 - fuse.gocryptfs /home/joe/cipher rw,user_id=1000
+`
+
+func TestParse(t *testing.T) {
+	mounts, err := Parse(strings.NewReader(testMountinfo))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(mounts) != 3 {
+		t.Fatalf("want 3 entries, have %d", len(mounts))
+	}
+	if mounts[1].MountPoint != "/src/d e" || mounts[1].Root != "/data" {
+		t.Errorf("escape not decoded: %+v", mounts[1])
+	}
+	for i, want := range []string{"ext4", "ext4", "fuse.gocryptfs"} {
+		if mounts[i].FsType != want {
+			t.Errorf("entry %d: want type %q, have %q", i, want, mounts[i].FsType)
+		}
+	}
+	if _, err = Parse(strings.NewReader("garbage\n")); err == nil {
+		t.Error("invalid line accepted")
+	}
+}
@@ -0,0 +1,159 @@
+package nametransform
+
+import (
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"golang.org/x/sys/unix"
+)
+
+const (
+	// foldCacheMaxEntries is the number of directories the fold cache holds
+	// before it is cleared
+	foldCacheMaxEntries = 100
+	// foldCacheRacyWindow: a directory whose mtime is that recent may change
+	// again without a visible mtime change (the timestamp granularity is
+	// two seconds on FAT), so its scan is not cached
+	foldCacheRacyWindow = 2 * time.Second
+)
+
+// foldDir is the scan of a ciphertext directory
+type foldDir struct {
+	// mtime of the directory at scan time. Any entry that is created, deleted
+	// or renamed changes it.
+	mtime time.Time
+	// names maps the case-folded plaintext names to the names on disk
+	names map[string]string
+}
+
+// foldCache caches directory scans for case-insensitive lookups, indexed by
+// the absolute ciphertext directory path. The zero value is ready to use.
+type foldCache struct {
+	data map[string]*foldDir
+	sync.Mutex
+}
+
+// SetCaseInsensitive enables or disables case-insensitive lookups in
+// EncryptPathDirIV, "-caseinsensitive".
+func (be *NameTransform) SetCaseInsensitive(on bool) {
+	be.caseInsensitive = on
+}
+
+// foldName returns the case-folded version of "name"
+func foldName(name string) string {
+	return strings.ToLower(strings.ToUpper(name))
+}
+
+// resolveCase returns the name on disk of the entry "plainName" in the
+// ciphertext directory "cDir", matching case-insensitively if there is no
+// exact match. "cName" is the encrypted (and possibly hashed) "plainName",
+// which is returned if nothing matches. This keeps the original case when
+// a new file is created.
+func (be *NameTransform) resolveCase(cDir string, plainName string, cName string, iv []byte) string {
+	_, err := os.Lstat(filepath.Join(cDir, cName))
+	if !os.IsNotExist(err) {
+		return cName
+	}
+	names := be.scanFold(cDir, iv)
+	if match, ok := names[foldName(plainName)]; ok {
+		return match
+	}
+	return cName
+}
+
+// EncryptPathDirIVKeepCase is like EncryptPathDirIV, but in case-insensitive
+// mode only the parent directories are matched against the existing names.
+// The last component keeps its case. This is needed for the destination of a
+// rename that only changes the case ("mv foo Foo"), which would otherwise
+// resolve to the source.
+func (be *NameTransform) EncryptPathDirIVKeepCase(plainPath string, rootDir string) (string, error) {
+	if !be.caseInsensitive || plainPath == "" {
+		return be.EncryptPathDirIV(plainPath, rootDir)
+	}
+	baseName := filepath.Base(plainPath)
+	if len(baseName) > unix.NAME_MAX {
+		return "", syscall.ENAMETOOLONG
+	}
+	parentDir := Dir(plainPath)
+	cParentDir, err := be.EncryptPathDirIV(parentDir, rootDir)
+	if err != nil {
+		return "", err
+	}
+	iv, _ := be.DirIVCache.Lookup(parentDir)
+	if iv == nil {
+		iv, err = ReadDirIV(filepath.Join(rootDir, cParentDir))
+		if err != nil {
+			return "", err
+		}
+	}
+	return filepath.Join(cParentDir, be.encryptAndHashName(baseName, iv)), nil
+}
+
+// scanFold decrypts the names in the ciphertext directory "cDir" and returns
+// the case-folded names. Uses the cache if the directory has not changed.
+func (be *NameTransform) scanFold(cDir string, iv []byte) map[string]string {
+	fi, err := os.Stat(cDir)
+	if err != nil {
+		return nil
+	}
+	c := &be.foldCache
+	c.Lock()
+	if d := c.data[cDir]; d != nil && d.mtime.Equal(fi.ModTime()) {
+		c.Unlock()
+		return d.names
+	}
+	c.Unlock()
+	f, err := os.Open(cDir)
+	if err != nil {
+		return nil
+	}
+	cNames, err := f.Readdirnames(-1)
+	f.Close()
+	if err != nil {
+		return nil
+	}
+	// Sort so that the result is deterministic if several names only differ
+	// in case
+	sort.Strings(cNames)
+	names := make(map[string]string)
+	for _, cName := range cNames {
+		cFullName := cName
+		switch NameType(cName) {
+		case LongNameFilename:
+			continue
+		case LongNameContent:
+			if !be.longNames {
+				continue
+			}
+			cFullName, err = ReadLongName(filepath.Join(cDir, cName))
+			if err != nil {
+				continue
+			}
+		}
+		// gocryptfs.diriv, gocryptfs.conf and other internal files fail to
+		// decrypt
+		name, err := be.DecryptName(cFullName, iv)
+		if err != nil {
+			continue
+		}
+		k := foldName(name)
+		if _, ok := names[k]; !ok {
+			names[k] = cName
+		}
+	}
+	if time.Since(fi.ModTime()) < foldCacheRacyWindow {
+		return names
+	}
+	c.Lock()
+	if c.data == nil || len(c.data) >= foldCacheMaxEntries {
+		c.data = make(map[string]*foldDir)
+	}
+	c.data[cDir] = &foldDir{mtime: fi.ModTime(), names: names}
+	c.Unlock()
+	return names
+}
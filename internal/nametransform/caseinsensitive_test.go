@@ -0,0 +1,95 @@
+package nametransform
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/rfjakob/gocryptfs/internal/cryptocore"
+)
+
+func TestCaseInsensitive(t *testing.T) {
+	rootDir, err := ioutil.TempDir("", "gocryptfs_caseinsensitive")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(rootDir)
+	if err = WriteDirIV(nil, rootDir); err != nil {
+		t.Fatal(err)
+	}
+	cc := cryptocore.New(make([]byte, cryptocore.KeyLen), cryptocore.BackendGoGCM, 128, true, false)
+	n := New(cc.EMECipher, true, true)
+	n.SetCaseInsensitive(true)
+	// create makes the entry "plainName" in the root directory
+	create := func(plainName string) string {
+		cName, err := n.EncryptPathDirIV(plainName, rootDir)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if IsLongContent(cName) {
+			dirfd, err := os.Open(rootDir)
+			if err != nil {
+				t.Fatal(err)
+			}
+			err = n.WriteLongName(dirfd, cName, plainName)
+			dirfd.Close()
+			if err != nil {
+				t.Fatal(err)
+			}
+		}
+		if err = ioutil.WriteFile(filepath.Join(rootDir, cName), nil, 0600); err != nil {
+			t.Fatal(err)
+		}
+		return cName
+	}
+	lookup := func(plainName string) string {
+		cName, err := n.EncryptPathDirIV(plainName, rootDir)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return cName
+	}
+	iv, err := ReadDirIV(rootDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cHello := create("Hello.txt")
+	long := strings.Repeat("Long", 50)
+	cLong := create(long)
+	if !IsLongContent(cLong) {
+		t.Fatalf("%q is not a long name", cLong)
+	}
+	// Pretend the directory has not been changed for a while, so the scan
+	// can be cached
+	past := time.Now().Add(-time.Hour)
+	if err = os.Chtimes(rootDir, past, past); err != nil {
+		t.Fatal(err)
+	}
+	if c := lookup("HELLO.TXT"); c != cHello {
+		t.Errorf("HELLO.TXT: want %q, have %q", cHello, c)
+	}
+	if c := lookup(strings.ToLower(long)); c != cLong {
+		t.Errorf("long name: want %q, have %q", cLong, c)
+	}
+	// A name without match keeps its case
+	if c := lookup("NEW.txt"); c != n.EncryptName("NEW.txt", iv) {
+		t.Errorf("NEW.txt was resolved to %q", c)
+	}
+	// The cached scan must notice the new file
+	cNew := create("new.TXT")
+	if c := lookup("NEW.txt"); c != cNew {
+		t.Errorf("NEW.txt: want %q, have %q", cNew, c)
+	}
+	// The destination of a case-only rename keeps its case
+	if c, err := n.EncryptPathDirIVKeepCase("HELLO.TXT", rootDir); err != nil || c != n.EncryptName("HELLO.TXT", iv) {
+		t.Errorf("HELLO.TXT was resolved to %q (%v)", c, err)
+	}
+	// Without case-insensitivity, nothing is matched
+	n.SetCaseInsensitive(false)
+	if c := lookup("HELLO.TXT"); c == cHello {
+		t.Error("HELLO.TXT was matched in case-sensitive mode")
+	}
+}
@@ -2,12 +2,14 @@ package nametransform
 
 import (
 	"bytes"
+	"fmt"
 	"io"
 	"log"
 	"os"
 	"path/filepath"
 	"strings"
 	"syscall"
+	"time"
 
 	"golang.org/x/sys/unix"
 
@@ -24,12 +26,95 @@ const (
 	DirIVFilename = "gocryptfs.diriv"
 )
 
+// DirIVMissingError is returned by ReadDirIV and ReadDirIVAt when the
+// directory exists, but its gocryptfs.diriv does not. Unlike a missing
+// directory, which is normal during concurrent deletes, this means that the
+// names in the directory cannot be decrypted anymore.
+type DirIVMissingError struct {
+	// Dir is the ciphertext directory
+	Dir string
+}
+
+func (e *DirIVMissingError) Error() string {
+	return fmt.Sprintf("%s is missing in directory %q, the names in this directory cannot be decrypted",
+		DirIVFilename, e.Dir)
+}
+
+// dirIVRetries is how often RetryDirIV retries after a transient error, see
+// SetDirIVRetries
+var dirIVRetries = 3
+
+// dirIVRetryDelay is the wait before the first retry. It doubles with every
+// further retry.
+var dirIVRetryDelay = 10 * time.Millisecond
+
+// SetDirIVRetries sets how often RetryDirIV retries after a transient error
+// ("-diriv-retries"). Zero disables the retries.
+func SetDirIVRetries(n int) {
+	dirIVRetries = n
+}
+
+// isTransientErr returns true for errors that network filesystems like NFS
+// return temporarily and that may go away when we try again. EIO is not one
+// of them, on a local filesystem it means that the disk is failing.
+func isTransientErr(err error) bool {
+	if pe, ok := err.(*os.PathError); ok {
+		err = pe.Err
+	}
+	return err == syscall.ESTALE || err == syscall.ETIMEDOUT
+}
+
+// RetryDirIV calls "op" again with exponential backoff while it fails with a
+// transient error like ESTALE. "op" should read gocryptfs.diriv files, for
+// example through ReadDirIV or EncryptPathDirIV.
+// A DirIVMissingError is checked again once after a short delay: Rmdir renames
+// gocryptfs.diriv away before it removes the directory, so for a short moment
+// an existing directory without gocryptfs.diriv is normal.
+// The caller must not hold locks across RetryDirIV. "op" has to take them
+// itself so that they are released while we sleep.
+func RetryDirIV(op func() error) error {
+	err := retryTransient(op)
+	if _, ok := err.(*DirIVMissingError); ok {
+		tlog.Debug.Printf("RetryDirIV: %v, checking again in %v", err, dirIVRetryDelay)
+		time.Sleep(dirIVRetryDelay)
+		err = retryTransient(op)
+	}
+	return err
+}
+
+// retryTransient is the transient error retry loop behind RetryDirIV
+func retryTransient(op func() error) error {
+	delay := dirIVRetryDelay
+	for i := 0; ; i++ {
+		err := op()
+		if err == nil || !isTransientErr(err) {
+			return err
+		}
+		if i >= dirIVRetries {
+			if i > 0 {
+				tlog.Warn.Printf("RetryDirIV: giving up after %d retries: %v", i, err)
+			}
+			return err
+		}
+		tlog.Debug.Printf("RetryDirIV: %v, retrying in %v", err, delay)
+		time.Sleep(delay)
+		delay *= 2
+	}
+}
+
 // ReadDirIV - read the "gocryptfs.diriv" file from "dir" (absolute ciphertext path)
 // This function is exported because it allows for an efficient readdir implementation.
+// Errors are not retried, wrap the call in RetryDirIV for that.
 func ReadDirIV(dir string) (iv []byte, err error) {
 	fd, err := os.Open(filepath.Join(dir, DirIVFilename))
 	if err != nil {
 		// Note: getting errors here is normal because of concurrent deletes.
+		// But if the directory is still there, the diriv is lost.
+		if os.IsNotExist(err) {
+			if fi, err2 := os.Lstat(dir); err2 == nil && fi.IsDir() {
+				return nil, &DirIVMissingError{Dir: dir}
+			}
+		}
 		return nil, err
 	}
 	defer fd.Close()
@@ -38,12 +123,34 @@ func ReadDirIV(dir string) (iv []byte, err error) {
 
 // ReadDirIVAt reads "gocryptfs.diriv" from the directory that is opened as "dirfd".
 // Using the dirfd makes it immune to concurrent renames of the directory.
+// The callers hold no locks, so transient errors are retried here.
 func ReadDirIVAt(dirfd *os.File) (iv []byte, err error) {
+	err = RetryDirIV(func() error {
+		iv, err = readDirIVAtOnce(dirfd)
+		return err
+	})
+	return iv, err
+}
+
+// readDirIVAtOnce is the single attempt behind ReadDirIVAt
+func readDirIVAtOnce(dirfd *os.File) (iv []byte, err error) {
 	fdRaw, err := syscallcompat.Openat(int(dirfd.Fd()), DirIVFilename,
 		syscall.O_RDONLY|syscall.O_NOFOLLOW, 0)
+	if err == syscall.ENOENT {
+		// We have the directory open, so it is the diriv that is missing,
+		// unless the directory has been deleted in the meantime
+		var st syscall.Stat_t
+		if err2 := syscall.Fstat(int(dirfd.Fd()), &st); err2 == nil && st.Nlink == 0 {
+			return nil, err
+		}
+		return nil, &DirIVMissingError{Dir: dirfd.Name()}
+	}
 	if err != nil {
-		tlog.Warn.Printf("ReadDirIVAt: opening %q in dir %q failed: %v",
-			DirIVFilename, dirfd.Name(), err)
+		// Transient errors are reported by RetryDirIV when it gives up
+		if !isTransientErr(err) {
+			tlog.Warn.Printf("ReadDirIVAt: opening %q in dir %q failed: %v",
+				DirIVFilename, dirfd.Name(), err)
+		}
 		return nil, err
 	}
 	fd := os.NewFile(uintptr(fdRaw), DirIVFilename)
@@ -122,6 +229,8 @@ func (be *NameTransform) encryptAndHashName(name string, iv []byte) string {
 // EncryptPathDirIV - encrypt relative plaintext path "plainPath" using EME with
 // DirIV. "rootDir" is the backing storage root directory.
 // Components that are longer than 255 bytes are hashed if be.longnames == true.
+// In case-insensitive mode, components that do not exist are matched
+// case-insensitively against the existing names.
 func (be *NameTransform) EncryptPathDirIV(plainPath string, rootDir string) (string, error) {
 	var err error
 	// Empty string means root directory
@@ -139,6 +248,9 @@ func (be *NameTransform) EncryptPathDirIV(plainPath string, rootDir string) (str
 	parentDir := Dir(plainPath)
 	if iv, cParentDir := be.DirIVCache.Lookup(parentDir); iv != nil {
 		cBaseName := be.encryptAndHashName(baseName, iv)
+		if be.caseInsensitive {
+			cBaseName = be.resolveCase(filepath.Join(rootDir, cParentDir), baseName, cBaseName, iv)
+		}
 		return filepath.Join(cParentDir, cBaseName), nil
 	}
 	// We have to walk the directory tree, starting at the root directory.
@@ -152,17 +264,60 @@ func (be *NameTransform) EncryptPathDirIV(plainPath string, rootDir string) (str
 		if iv == nil {
 			iv, err = ReadDirIV(filepath.Join(rootDir, cipherWD))
 			if err != nil {
+				// The kernel already tells us if a component is missing
+				// (ENOENT) or is not a directory (ENOTDIR). Report it for
+				// the directory instead of gocryptfs.diriv, which the
+				// caller never asked for.
+				if pe, ok := err.(*os.PathError); ok {
+					return "", &os.PathError{Op: "lookup", Path: plainWD, Err: pe.Err}
+				}
 				return "", err
 			}
 			be.DirIVCache.Store(plainWD, iv, cipherWD)
 		}
 		cipherName := be.encryptAndHashName(plainName, iv)
+		if be.caseInsensitive {
+			cipherName = be.resolveCase(filepath.Join(rootDir, cipherWD), plainName, cipherName, iv)
+		}
 		cipherWD = filepath.Join(cipherWD, cipherName)
 		plainWD = filepath.Join(plainWD, plainName)
 	}
 	return cipherWD, nil
 }
 
+// DecryptPathDirIV - decrypt relative ciphertext path "cipherPath" using EME
+// with DirIV. "rootDir" is the backing storage root directory.
+// Long name components ("gocryptfs.longname.*") are resolved via their
+// ".name" file.
+func (be *NameTransform) DecryptPathDirIV(cipherPath string, rootDir string) (string, error) {
+	// Empty string means root directory
+	if cipherPath == "" {
+		return cipherPath, nil
+	}
+	cipherWD := ""
+	plainWD := ""
+	for _, cipherName := range strings.Split(cipherPath, "/") {
+		iv, err := ReadDirIV(filepath.Join(rootDir, cipherWD))
+		if err != nil {
+			return "", err
+		}
+		cName := cipherName
+		if IsLongContent(cName) {
+			cName, err = ReadLongName(filepath.Join(rootDir, cipherWD, cipherName))
+			if err != nil {
+				return "", err
+			}
+		}
+		plainName, err := be.DecryptName(cName, iv)
+		if err != nil {
+			return "", err
+		}
+		cipherWD = filepath.Join(cipherWD, cipherName)
+		plainWD = filepath.Join(plainWD, plainName)
+	}
+	return plainWD, nil
+}
+
 // Dir is like filepath.Dir but returns "" instead of ".".
 func Dir(path string) string {
 	d := filepath.Dir(path)
@@ -0,0 +1,245 @@
+package nametransform
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/rfjakob/gocryptfs/internal/cryptocore"
+)
+
+// pathErrno returns the errno wrapped in the *os.PathError "err"
+func pathErrno(err error) error {
+	if pe, ok := err.(*os.PathError); ok {
+		return pe.Err
+	}
+	return err
+}
+
+// TestEncryptPathDirIVErrno checks that walking through a file gives ENOTDIR
+// and walking through a missing directory gives ENOENT.
+func TestEncryptPathDirIVErrno(t *testing.T) {
+	rootDir, err := ioutil.TempDir("", "gocryptfs_diriv")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(rootDir)
+	if err = WriteDirIV(nil, rootDir); err != nil {
+		t.Fatal(err)
+	}
+	cc := cryptocore.New(make([]byte, cryptocore.KeyLen), cryptocore.BackendGoGCM, 128, true, false)
+	n := New(cc.EMECipher, true, true)
+	// Create the regular file "file" in the backing directory
+	cFile, err := n.EncryptPathDirIV("file", rootDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = ioutil.WriteFile(filepath.Join(rootDir, cFile), nil, 0600); err != nil {
+		t.Fatal(err)
+	}
+	_, err = n.EncryptPathDirIV("file/x", rootDir)
+	if pathErrno(err) != syscall.ENOTDIR {
+		t.Errorf("walking through a file: want ENOTDIR, got %v", err)
+	}
+	_, err = n.EncryptPathDirIV("missing/x", rootDir)
+	if pathErrno(err) != syscall.ENOENT {
+		t.Errorf("walking through a missing directory: want ENOENT, got %v", err)
+	}
+	// Also through a deeper path, where the last existing component is a file
+	_, err = n.EncryptPathDirIV("file/x/y", rootDir)
+	if pathErrno(err) != syscall.ENOTDIR {
+		t.Errorf("walking through a file (deep): want ENOTDIR, got %v", err)
+	}
+}
+
+// A directory without gocryptfs.diriv must be distinguishable from a missing
+// directory
+func TestReadDirIVMissing(t *testing.T) {
+	dir, err := ioutil.TempDir("", "gocryptfs_diriv")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	_, err = ReadDirIV(dir)
+	if _, ok := err.(*DirIVMissingError); !ok {
+		t.Errorf("ReadDirIV: want DirIVMissingError, got %#v", err)
+	}
+	dirfd, err := os.Open(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = ReadDirIVAt(dirfd)
+	dirfd.Close()
+	if _, ok := err.(*DirIVMissingError); !ok {
+		t.Errorf("ReadDirIVAt: want DirIVMissingError, got %#v", err)
+	}
+	_, err = ReadDirIV(dir + "/missing")
+	if !os.IsNotExist(err) {
+		t.Errorf("missing directory: want ENOENT, got %v", err)
+	}
+	// A directory that has been deleted while we have it open
+	dirfd, err = os.Open(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer dirfd.Close()
+	if err = os.Remove(dir); err != nil {
+		t.Fatal(err)
+	}
+	_, err = ReadDirIVAt(dirfd)
+	if !os.IsNotExist(err) {
+		t.Errorf("deleted directory: want ENOENT, got %v", err)
+	}
+}
+
+// RetryDirIV must retry ESTALE and ETIMEDOUT, up to the configured limit, and
+// must not retry other errors. A missing diriv is checked again once.
+func TestRetryDirIV(t *testing.T) {
+	oldDelay, oldRetries := dirIVRetryDelay, dirIVRetries
+	defer func() {
+		dirIVRetryDelay, dirIVRetries = oldDelay, oldRetries
+	}()
+	dirIVRetryDelay = time.Microsecond
+	var calls int
+	// fail returns an op that fails with "err" for the first "n" calls
+	fail := func(n int, err error) func() error {
+		calls = 0
+		return func() error {
+			calls++
+			if calls <= n {
+				return &os.PathError{Op: "open", Path: "/x", Err: err}
+			}
+			return nil
+		}
+	}
+	SetDirIVRetries(3)
+	if err := RetryDirIV(fail(3, syscall.ESTALE)); err != nil || calls != 4 {
+		t.Errorf("ESTALE: err=%v calls=%d", err, calls)
+	}
+	if err := RetryDirIV(fail(4, syscall.ETIMEDOUT)); err == nil || calls != 4 {
+		t.Errorf("ETIMEDOUT beyond the limit: err=%v calls=%d", err, calls)
+	}
+	// A local disk error is not transient
+	if err := RetryDirIV(fail(1, syscall.EIO)); err == nil || calls != 1 {
+		t.Errorf("EIO: err=%v calls=%d", err, calls)
+	}
+	if err := RetryDirIV(fail(1, syscall.ENOENT)); !os.IsNotExist(err) || calls != 1 {
+		t.Errorf("ENOENT: err=%v calls=%d", err, calls)
+	}
+	SetDirIVRetries(0)
+	if err := RetryDirIV(fail(1, syscall.ESTALE)); err == nil || calls != 1 {
+		t.Errorf("retries disabled: err=%v calls=%d", err, calls)
+	}
+	// missing returns an op that reports a missing diriv for the first "n"
+	// calls and then ENOENT, like a concurrent Rmdir
+	missing := func(n int) func() error {
+		calls = 0
+		return func() error {
+			calls++
+			if calls <= n {
+				return &DirIVMissingError{Dir: "/x"}
+			}
+			return syscall.ENOENT
+		}
+	}
+	if err := RetryDirIV(missing(1)); err != syscall.ENOENT || calls != 2 {
+		t.Errorf("concurrent Rmdir: err=%v calls=%d", err, calls)
+	}
+	if _, ok := RetryDirIV(missing(2)).(*DirIVMissingError); !ok || calls != 2 {
+		t.Errorf("missing diriv: calls=%d", calls)
+	}
+}
+
+// A directory that is being removed, which renames gocryptfs.diriv away
+// before it removes the directory, must not give a DirIVMissingError
+func TestRetryDirIVConcurrentRmdir(t *testing.T) {
+	oldDelay := dirIVRetryDelay
+	defer func() { dirIVRetryDelay = oldDelay }()
+	dirIVRetryDelay = 100 * time.Millisecond
+	dir, err := ioutil.TempDir("", "gocryptfs_diriv")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	// gocryptfs.diriv has already been renamed away
+	d := dir + "/d"
+	if err = os.Mkdir(d, 0700); err != nil {
+		t.Fatal(err)
+	}
+	first := make(chan struct{})
+	res := make(chan error)
+	go func() {
+		calls := 0
+		res <- RetryDirIV(func() error {
+			_, err := ReadDirIV(d)
+			if calls++; calls == 1 {
+				close(first)
+			}
+			return err
+		})
+	}()
+	<-first
+	if err = syscall.Rmdir(d); err != nil {
+		t.Fatal(err)
+	}
+	if err = <-res; !os.IsNotExist(err) {
+		t.Errorf("want ENOENT, got %v", err)
+	}
+}
+
+// DecryptPathDirIV must undo EncryptPathDirIV for nested paths, including
+// long names
+func TestDecryptPathDirIV(t *testing.T) {
+	rootDir, err := ioutil.TempDir("", "gocryptfs_diriv")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(rootDir)
+	if err = WriteDirIV(nil, rootDir); err != nil {
+		t.Fatal(err)
+	}
+	cc := cryptocore.New(make([]byte, cryptocore.KeyLen), cryptocore.BackendGoGCM, 128, true, false)
+	n := New(cc.EMECipher, true, true)
+	long := strings.Repeat("x", 200)
+	// Create the directories "a" and "a/LONG"
+	for _, dir := range []string{"a", "a/" + long} {
+		cDir, err := n.EncryptPathDirIV(dir, rootDir)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err = os.Mkdir(filepath.Join(rootDir, cDir), 0700); err != nil {
+			t.Fatal(err)
+		}
+		if err = WriteDirIV(nil, filepath.Join(rootDir, cDir)); err != nil {
+			t.Fatal(err)
+		}
+		if IsLongContent(filepath.Base(cDir)) {
+			parent, _ := os.Open(filepath.Join(rootDir, filepath.Dir(cDir)))
+			err = n.WriteLongName(parent, filepath.Base(cDir), long)
+			parent.Close()
+			if err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	for _, plain := range []string{"", "a", "a/" + long, "a/" + long + "/file"} {
+		cPath, err := n.EncryptPathDirIV(plain, rootDir)
+		if err != nil {
+			t.Fatal(err)
+		}
+		have, err := n.DecryptPathDirIV(cPath, rootDir)
+		if err != nil {
+			t.Fatalf("%q: %v", plain, err)
+		}
+		if have != plain {
+			t.Errorf("want %q, have %q", plain, have)
+		}
+	}
+	if _, err = n.DecryptPathDirIV("bogus", rootDir); err == nil {
+		t.Error("decrypting a bogus name succeeded")
+	}
+}
@@ -1,6 +1,7 @@
 package dirivcache
 
 import (
+	"container/list"
 	"log"
 	"strings"
 	"sync"
@@ -8,22 +9,31 @@ import (
 )
 
 const (
-	maxEntries = 100
-	expireTime = 1 * time.Second
+	// DefaultMaxEntries is the capacity of a DirIVCache unless changed with
+	// SetMaxEntries.
+	DefaultMaxEntries = 100
+	expireTime        = 1 * time.Second
 )
 
 type cacheEntry struct {
+	// Relative plaintext path of the directory, the key in DirIVCache.data.
+	dir string
 	// DirIV of the directory.
 	iv []byte
 	// Relative ciphertext path of the directory.
 	cDir string
 }
 
-// DirIVCache stores up to "maxEntries" directory IVs.
+// DirIVCache stores up to "maxEntries" directory IVs. When it is full, the
+// least recently used entry is evicted. The zero value is ready to use.
 type DirIVCache struct {
 	// data in the cache, indexed by relative plaintext path
-	// of the directory.
-	data map[string]cacheEntry
+	// of the directory. The values are elements of "lru".
+	data map[string]*list.Element
+	// lru holds *cacheEntry values, most recently used first
+	lru *list.List
+	// maxEntries is the capacity. Zero means DefaultMaxEntries.
+	maxEntries int
 
 	// The DirIV of the root directory gets special treatment because it
 	// cannot change (the root directory cannot be renamed or deleted).
@@ -37,15 +47,38 @@ type DirIVCache struct {
 	// getattr cache.
 	expiry time.Time
 
-	sync.RWMutex
+	// hits and misses count the Lookup results, see Stats
+	hits, misses uint64
+
+	sync.Mutex
 }
 
 // Lookup - fetch entry for "dir" (relative plaintext path) from the cache.
 // Returns the directory IV and the relative encrypted path, or (nil, "")
 // if the entry was not found.
 func (c *DirIVCache) Lookup(dir string) (iv []byte, cDir string) {
-	c.RLock()
-	defer c.RUnlock()
+	// Lookup updates the LRU order, so we need the write lock
+	c.Lock()
+	defer c.Unlock()
+	iv, cDir = c.lookup(dir)
+	if iv != nil {
+		c.hits++
+	} else {
+		c.misses++
+	}
+	return iv, cDir
+}
+
+// Stats returns the number of Lookup calls that found an entry (hits) and
+// that did not (misses).
+func (c *DirIVCache) Stats() (hits uint64, misses uint64) {
+	c.Lock()
+	defer c.Unlock()
+	return c.hits, c.misses
+}
+
+// lookup implements Lookup. Must be called with the lock held.
+func (c *DirIVCache) lookup(dir string) (iv []byte, cDir string) {
 	if dir == "" {
 		return c.rootDirIV, ""
 	}
@@ -54,9 +87,15 @@ func (c *DirIVCache) Lookup(dir string) (iv []byte, cDir string) {
 	}
 	if time.Since(c.expiry) > 0 {
 		c.data = nil
+		c.lru = nil
+		return nil, ""
+	}
+	e := c.data[dir]
+	if e == nil {
 		return nil, ""
 	}
-	v := c.data[dir]
+	c.lru.MoveToFront(e)
+	v := e.Value.(*cacheEntry)
 	return v.iv, v.cDir
 }
 
@@ -78,25 +117,81 @@ func (c *DirIVCache) Store(dir string, iv []byte, cDir string) {
 	}
 	// Clear() may have cleared c.data: re-initialize
 	if c.data == nil {
-		c.data = make(map[string]cacheEntry, maxEntries)
+		c.data = make(map[string]*list.Element)
+		c.lru = list.New()
 		// Set expiry time one second into the future
 		c.expiry = time.Now().Add(expireTime)
 	}
-	// Delete a random entry from the map if reached maxEntries
-	if len(c.data) >= maxEntries {
-		for k := range c.data {
-			delete(c.data, k)
-			break
+	if e := c.data[dir]; e != nil {
+		e.Value = &cacheEntry{dir, iv, cDir}
+		c.lru.MoveToFront(e)
+		return
+	}
+	// Evict the least recently used entries if we have reached maxEntries
+	for len(c.data) >= c.capacity() {
+		c.remove(c.lru.Back())
+	}
+	c.data[dir] = c.lru.PushFront(&cacheEntry{dir, iv, cDir})
+}
+
+// capacity returns the maximum number of entries. Must be called with the
+// lock held.
+func (c *DirIVCache) capacity() int {
+	if c.maxEntries <= 0 {
+		return DefaultMaxEntries
+	}
+	return c.maxEntries
+}
+
+// remove drops the list element "e" from the cache. Must be called with the
+// lock held.
+func (c *DirIVCache) remove(e *list.Element) {
+	delete(c.data, e.Value.(*cacheEntry).dir)
+	c.lru.Remove(e)
+}
+
+// SetMaxEntries changes the capacity of the cache to "n" entries (at least
+// one). Surplus entries are evicted.
+func (c *DirIVCache) SetMaxEntries(n int) {
+	c.Lock()
+	defer c.Unlock()
+	if n < 1 {
+		n = 1
+	}
+	c.maxEntries = n
+	for c.data != nil && len(c.data) > n {
+		c.remove(c.lru.Back())
+	}
+}
+
+// Delete drops the entry for directory "dir" (relative plaintext path) and
+// all entries below it, as their ciphertext paths contain the ciphertext
+// path of "dir".
+// Called from fusefrontend when a directory is renamed or deleted.
+func (c *DirIVCache) Delete(dir string) {
+	c.Lock()
+	defer c.Unlock()
+	if c.data == nil {
+		return
+	}
+	if dir == "" {
+		// The root directory contains everything
+		c.data = nil
+		c.lru = nil
+		return
+	}
+	for k, e := range c.data {
+		if k == dir || strings.HasPrefix(k, dir+"/") {
+			c.remove(e)
 		}
 	}
-	c.data[dir] = cacheEntry{iv, cDir}
 }
 
 // Clear ... clear the cache.
-// Called from fusefrontend when directories are renamed or deleted.
 func (c *DirIVCache) Clear() {
 	c.Lock()
 	defer c.Unlock()
 	// Will be re-initialized in the next Store()
 	c.data = nil
+	c.lru = nil
 }
@@ -0,0 +1,72 @@
+package dirivcache
+
+import (
+	"fmt"
+	"testing"
+)
+
+func TestLRU(t *testing.T) {
+	var c DirIVCache
+	c.SetMaxEntries(3)
+	iv := []byte("0123456789abcdef")
+	c.Store("a", iv, "A")
+	c.Store("b", iv, "B")
+	c.Store("c", iv, "C")
+	// "a" is now the most recently used entry, so "b" is evicted
+	if _, cDir := c.Lookup("a"); cDir != "A" {
+		t.Fatalf("a: got %q", cDir)
+	}
+	c.Store("d", iv, "D")
+	if v, _ := c.Lookup("b"); v != nil {
+		t.Error("b should have been evicted")
+	}
+	for _, d := range []string{"a", "c", "d"} {
+		if v, _ := c.Lookup(d); v == nil {
+			t.Errorf("%s should still be cached", d)
+		}
+	}
+	// Shrinking evicts the least recently used entries
+	c.SetMaxEntries(1)
+	if v, _ := c.Lookup("d"); v == nil {
+		t.Error("d should still be cached")
+	}
+	if v, _ := c.Lookup("a"); v != nil {
+		t.Error("a should have been evicted")
+	}
+}
+
+func TestDefaultMaxEntries(t *testing.T) {
+	var c DirIVCache
+	iv := []byte("0123456789abcdef")
+	for i := 0; i <= DefaultMaxEntries; i++ {
+		c.Store(fmt.Sprintf("%d", i), iv, fmt.Sprintf("c%d", i))
+	}
+	if len(c.data) != DefaultMaxEntries || c.lru.Len() != DefaultMaxEntries {
+		t.Errorf("wrong size: %d %d", len(c.data), c.lru.Len())
+	}
+	if v, _ := c.Lookup("0"); v != nil {
+		t.Error("oldest entry should have been evicted")
+	}
+}
+
+func TestDelete(t *testing.T) {
+	var c DirIVCache
+	iv := []byte("0123456789abcdef")
+	c.Store("", iv, "")
+	c.Store("a", iv, "A")
+	c.Store("a/b", iv, "A/B")
+	c.Store("ab", iv, "AB")
+	c.Delete("a")
+	for _, d := range []string{"a", "a/b"} {
+		if v, _ := c.Lookup(d); v != nil {
+			t.Errorf("%s should have been deleted", d)
+		}
+	}
+	if _, cDir := c.Lookup("ab"); cDir != "AB" {
+		t.Error("ab should still be cached")
+	}
+	// The root DirIV is never dropped
+	if v, _ := c.Lookup(""); v == nil {
+		t.Error("root DirIV was dropped")
+	}
+}
@@ -105,7 +105,10 @@ func (n *NameTransform) WriteLongName(dirfd *os.File, hashName string, plainName
 
 	// Encrypt the basename
 	dirIV, err := ReadDirIVAt(dirfd)
-	if err != nil {
+	if _, ok := err.(*DirIVMissingError); ok {
+		tlog.Warn.Printf("WriteLongName: %v", err)
+		return syscall.EIO
+	} else if err != nil {
 		return err
 	}
 	cName := n.EncryptName(plainName, dirIV)
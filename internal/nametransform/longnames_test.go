@@ -1,7 +1,13 @@
 package nametransform
 
 import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
 	"testing"
+
+	"github.com/rfjakob/gocryptfs/internal/cryptocore"
 )
 
 func TestIsLongName(t *testing.T) {
@@ -20,3 +26,60 @@ func TestIsLongName(t *testing.T) {
 		t.Errorf("False positive")
 	}
 }
+
+// TestLongNameThreshold checks that names are hashed exactly when the
+// encrypted name would exceed 255 bytes, and that the ".name" file gives back
+// the full encrypted name.
+func TestLongNameThreshold(t *testing.T) {
+	cc := cryptocore.New(make([]byte, cryptocore.KeyLen), cryptocore.BackendGoGCM, 128, true, false)
+	for _, raw64 := range []bool{false, true} {
+		n := New(cc.EMECipher, true, raw64)
+		iv := make([]byte, DirIVLen)
+		// 175 bytes are padded to 176 and encode to <= 236 characters.
+		// 176 bytes are padded to 192 and encode to 256 characters.
+		if cName := n.encryptAndHashName(strings.Repeat("x", 175), iv); IsLongContent(cName) {
+			t.Errorf("raw64=%v: 175 bytes should not be hashed", raw64)
+		}
+		long := strings.Repeat("x", 176)
+		hName := n.encryptAndHashName(long, iv)
+		if !IsLongContent(hName) {
+			t.Fatalf("raw64=%v: 176 bytes should be hashed", raw64)
+		}
+		// Round trip through the ".name" file
+		dir, err := ioutil.TempDir("", "gocryptfs_longname")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer os.RemoveAll(dir)
+		if err = WriteDirIV(nil, dir); err != nil {
+			t.Fatal(err)
+		}
+		dirfd, err := os.Open(dir)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer dirfd.Close()
+		dirIV, err := ReadDirIVAt(dirfd)
+		if err != nil {
+			t.Fatal(err)
+		}
+		hName = n.encryptAndHashName(long, dirIV)
+		if err = n.WriteLongName(dirfd, hName, long); err != nil {
+			t.Fatal(err)
+		}
+		cName, err := ReadLongName(filepath.Join(dir, hName))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if n.HashLongName(cName) != hName {
+			t.Errorf("raw64=%v: hash of the stored name does not match", raw64)
+		}
+		pName, err := n.DecryptName(cName, dirIV)
+		if err != nil || pName != long {
+			t.Errorf("raw64=%v: decrypt of the stored name failed: %q, %v", raw64, pName, err)
+		}
+		if err = DeleteLongName(dirfd, hName); err != nil {
+			t.Error(err)
+		}
+	}
+}
@@ -21,6 +21,9 @@ type NameTransform struct {
 	// B64 = either base64.URLEncoding or base64.RawURLEncoding, depeding
 	// on the Raw64 feature flag
 	B64 *base64.Encoding
+	// caseInsensitive is set by SetCaseInsensitive
+	caseInsensitive bool
+	foldCache       foldCache
 }
 
 // New returns a new NameTransform instance.
@@ -57,11 +57,13 @@ type table struct {
 
 // Entry is an entry in the open file table
 type Entry struct {
-	// Reference count
-	refCount int
 	// ContentLock guards the file content from concurrent writes. Every writer
 	// must take this lock before modifying the file content.
+	// It must be the first element of the struct to guarantee 64-bit alignment
+	// of its counter.
 	ContentLock countingMutex
+	// Reference count
+	refCount int
 	// HeaderLock guards the file ID (in this struct) and the file header (on
 	// disk). Take HeaderLock.RLock() to make sure the file ID does not change
 	// behind your back. If you modify the file ID, you must take
@@ -101,14 +103,30 @@ func Unregister(qi QIno) {
 
 // countingMutex incrementes t.writeLockCount on each Lock() call.
 type countingMutex struct {
+	// gen is incremented on Lock() and on Unlock(), so it is odd while a
+	// writer holds the lock. Accessed atomically, must be the first element.
+	gen uint64
 	sync.Mutex
 }
 
 func (c *countingMutex) Lock() {
 	c.Mutex.Lock()
+	atomic.AddUint64(&c.gen, 1)
 	atomic.AddUint64(&t.writeOpCount, 1)
 }
 
+func (c *countingMutex) Unlock() {
+	atomic.AddUint64(&c.gen, 1)
+	c.Mutex.Unlock()
+}
+
+// Generation returns a counter that changes whenever a writer takes or
+// releases the lock. Data read without holding the lock is consistent if the
+// generation was even before the read and is unchanged after it.
+func (c *countingMutex) Generation() uint64 {
+	return atomic.LoadUint64(&c.gen)
+}
+
 // WriteOpCount returns the write lock counter value. This value is encremented
 // each time writeLock.Lock() on a file table entry is called.
 func WriteOpCount() uint64 {
@@ -0,0 +1,26 @@
+package readpassword
+
+import (
+	"os"
+	"testing"
+)
+
+// Two passwords (like "-passwd" needs them) from the same fd, the second one
+// terminated by EOF
+func TestFd(t *testing.T) {
+	r, w, err := os.Pipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+	_, err = w.Write([]byte("oldpw\nnewpw"))
+	w.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, want := range []string{"oldpw", "newpw"} {
+		if have := Fd(r); have != want {
+			t.Errorf("want=%q have=%q", want, have)
+		}
+	}
+}
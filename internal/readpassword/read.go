@@ -6,8 +6,10 @@ import (
 	"io"
 	"os"
 	"os/exec"
+	"os/signal"
 	"strings"
 	"sync"
+	"syscall"
 	"time"
 
 	"golang.org/x/crypto/ssh/terminal"
@@ -56,6 +58,9 @@ func Twice(extpass string) string {
 func readPasswordTerminal(prompt string) string {
 	fd := int(os.Stdin.Fd())
 	fmt.Fprintf(os.Stderr, prompt)
+	// terminal.ReadPassword disables echo. Make sure it is enabled again if
+	// the user hits Ctrl-C.
+	defer restoreTerminalOnSignal(fd)()
 	// terminal.ReadPassword removes the trailing newline
 	p, err := terminal.ReadPassword(fd)
 	if err != nil {
@@ -70,6 +75,33 @@ func readPasswordTerminal(prompt string) string {
 	return string(p)
 }
 
+// restoreTerminalOnSignal saves the state of terminal "fd" and restores it
+// before exiting on SIGINT or SIGTERM. Call the returned function to go back to
+// the default signal handling.
+func restoreTerminalOnSignal(fd int) (stop func()) {
+	oldState, err := terminal.GetState(fd)
+	if err != nil {
+		return func() {}
+	}
+	ch := make(chan os.Signal, 1)
+	done := make(chan struct{})
+	signal.Notify(ch, os.Interrupt, syscall.SIGTERM)
+	go func() {
+		select {
+		case sig := <-ch:
+			terminal.Restore(fd, oldState)
+			fmt.Fprintf(os.Stderr, "\n")
+			tlog.Fatal.Printf("Password entry interrupted by %v", sig)
+			os.Exit(exitcodes.SigInt)
+		case <-done:
+		}
+	}()
+	return func() {
+		signal.Stop(ch)
+		close(done)
+	}
+}
+
 // readPasswordStdin reads a line from stdin.
 // It exits with a fatal error on read error or empty result.
 func readPasswordStdin() string {
@@ -123,6 +155,20 @@ func readPasswordExtpass(extpass string) string {
 	return p
 }
 
+// Fd reads a line from "f", which is an already-open file descriptor passed
+// via "-passfd". "f" is not closed so that further passwords can be read from
+// it, for example the new password for "-passwd".
+// Exits on read error or empty result.
+func Fd(f *os.File) string {
+	tlog.Info.Printf("Reading password from fd %d", f.Fd())
+	p := readLineUnbuffered(f)
+	if len(p) == 0 {
+		tlog.Fatal.Printf("Got empty password from fd %d", f.Fd())
+		os.Exit(exitcodes.ReadPassword)
+	}
+	return p
+}
+
 // readLineUnbuffered reads single bytes from "r" util it gets "\n" or EOF.
 // The returned string does NOT contain the trailing "\n".
 func readLineUnbuffered(r io.Reader) (l string) {
@@ -0,0 +1,96 @@
+package readpassword
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+	"syscall"
+	"testing"
+	"time"
+	"unsafe"
+
+	"github.com/rfjakob/gocryptfs/internal/exitcodes"
+)
+
+// openPty opens a new pseudo-terminal and returns the master and the slave
+func openPty(t *testing.T) (master *os.File, slave *os.File) {
+	master, err := os.OpenFile("/dev/ptmx", os.O_RDWR, 0)
+	if err != nil {
+		t.Skipf("no pseudo-terminal available: %v", err)
+	}
+	var n uint32
+	_, _, errno := syscall.Syscall(syscall.SYS_IOCTL, master.Fd(), syscall.TIOCGPTN, uintptr(unsafe.Pointer(&n)))
+	if errno != 0 {
+		t.Fatal(errno)
+	}
+	var unlock int32
+	_, _, errno = syscall.Syscall(syscall.SYS_IOCTL, master.Fd(), syscall.TIOCSPTLCK, uintptr(unsafe.Pointer(&unlock)))
+	if errno != 0 {
+		t.Fatal(errno)
+	}
+	slave, err = os.OpenFile(fmt.Sprintf("/dev/pts/%d", n), os.O_RDWR, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return master, slave
+}
+
+func echoEnabled(t *testing.T, f *os.File) bool {
+	var termios syscall.Termios
+	_, _, errno := syscall.Syscall(syscall.SYS_IOCTL, f.Fd(), syscall.TCGETS, uintptr(unsafe.Pointer(&termios)))
+	if errno != 0 {
+		t.Fatal(errno)
+	}
+	return termios.Lflag&syscall.ECHO != 0
+}
+
+// Ctrl-C during the password prompt must restore the terminal echo
+func TestTerminalInterrupt(t *testing.T) {
+	if os.Getenv("TEST_SLAVE") == "1" {
+		readPasswordTerminal("Password: ")
+		os.Exit(1)
+	}
+	master, slave := openPty(t)
+	defer master.Close()
+	defer slave.Close()
+	// Drain the output so the child never blocks on a full pty buffer
+	go func() {
+		buf := make([]byte, 1000)
+		for {
+			if _, err := master.Read(buf); err != nil {
+				return
+			}
+		}
+	}()
+	if !echoEnabled(t, slave) {
+		t.Fatal("echo is off on a new pty")
+	}
+	cmd := exec.Command(os.Args[0], "-test.run=TestTerminalInterrupt$")
+	cmd.Env = append(os.Environ(), "TEST_SLAVE=1")
+	cmd.Stdin = slave
+	cmd.Stdout = slave
+	cmd.Stderr = slave
+	if err := cmd.Start(); err != nil {
+		t.Fatal(err)
+	}
+	// Wait for the prompt to disable the echo
+	for i := 0; echoEnabled(t, slave); i++ {
+		if i > 1000 {
+			cmd.Process.Kill()
+			t.Fatal("timeout waiting for the password prompt")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	cmd.Process.Signal(os.Interrupt)
+	err := cmd.Wait()
+	exitErr, ok := err.(*exec.ExitError)
+	if !ok {
+		t.Fatalf("child should have failed: %v", err)
+	}
+	if code := exitErr.Sys().(syscall.WaitStatus).ExitStatus(); code != exitcodes.SigInt {
+		t.Errorf("wrong exit code %d", code)
+	}
+	if !echoEnabled(t, slave) {
+		t.Error("echo was not restored")
+	}
+}
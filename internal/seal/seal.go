@@ -0,0 +1,245 @@
+// Package seal implements the integrity seal that reverse mode adds to the
+// encrypted view when "-reverse-seal" is passed.
+//
+// Every directory gets a "gocryptfs.seal" file with one line per directory
+// entry:
+//
+//	<hex HMAC-SHA256>  <kind> <name>
+//
+// The HMAC covers the ciphertext path of the entry, its kind and its content
+// (file content or symlink target). The content of a directory is its own
+// gocryptfs.seal file, so the seals are chained up to the root directory, and
+// a subdirectory that is rolled back together with its seal file is detected
+// in the parent. A trailer line carries an HMAC over the directory path and
+// all entry lines, so that removing, adding or renaming entries is detected
+// as well.
+package seal
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"hash"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+const (
+	// Filename is the name of the seal file in every directory
+	Filename = "gocryptfs.seal"
+	// trailerName is the name used for the trailer line
+	trailerName = "."
+)
+
+// Kind is the type of a directory entry
+type Kind byte
+
+const (
+	// KindFile is a regular file
+	KindFile Kind = 'f'
+	// KindDir is a directory
+	KindDir Kind = 'd'
+	// KindSymlink is a symbolic link
+	KindSymlink Kind = 'l'
+	// KindOther is everything else (device nodes, fifos, sockets)
+	KindOther Kind = 'o'
+	// kindTrailer marks the trailer line
+	kindTrailer Kind = 't'
+)
+
+// Entry is one line of a seal file
+type Entry struct {
+	Name string
+	Kind Kind
+	MAC  []byte
+}
+
+// NewHash returns the HMAC for the entry at ciphertext path "cPath". The
+// caller writes the file content, symlink target or the seal file of the
+// subdirectory to it and gets the MAC using Sum(nil).
+func NewHash(key []byte, cPath string, kind Kind) hash.Hash {
+	h := hmac.New(sha256.New, key)
+	h.Write([]byte(cPath))
+	h.Write([]byte{0, byte(kind)})
+	return h
+}
+
+type entriesByName []Entry
+
+func (e entriesByName) Len() int           { return len(e) }
+func (e entriesByName) Less(i, j int) bool { return e[i].Name < e[j].Name }
+func (e entriesByName) Swap(i, j int)      { e[i], e[j] = e[j], e[i] }
+
+func formatLine(b *bytes.Buffer, e Entry) {
+	fmt.Fprintf(b, "%s  %c %s\n", hex.EncodeToString(e.MAC), e.Kind, e.Name)
+}
+
+// Format returns the content of the seal file of directory "cDir" (ciphertext
+// path). The entries are sorted by name.
+func Format(key []byte, cDir string, entries []Entry) []byte {
+	sort.Sort(entriesByName(entries))
+	var b bytes.Buffer
+	for _, e := range entries {
+		formatLine(&b, e)
+	}
+	h := NewHash(key, cDir, kindTrailer)
+	h.Write(b.Bytes())
+	formatLine(&b, Entry{Name: trailerName, Kind: kindTrailer, MAC: h.Sum(nil)})
+	return b.Bytes()
+}
+
+// Verify parses the seal file "data" of directory "cDir" and checks the
+// trailer. It returns the entries, or an error if the seal file is malformed
+// or has been modified.
+func Verify(key []byte, cDir string, data []byte) ([]Entry, error) {
+	lines := strings.SplitAfter(string(data), "\n")
+	if len(lines) < 2 || lines[len(lines)-1] != "" {
+		return nil, fmt.Errorf("truncated seal file")
+	}
+	lines = lines[:len(lines)-1]
+	var entries []Entry
+	for _, l := range lines {
+		e, err := parseLine(l)
+		if err != nil {
+			return nil, err
+		}
+		entries = append(entries, e)
+	}
+	trailer := entries[len(entries)-1]
+	entries = entries[:len(entries)-1]
+	if trailer.Kind != kindTrailer || trailer.Name != trailerName {
+		return nil, fmt.Errorf("missing trailer")
+	}
+	h := NewHash(key, cDir, kindTrailer)
+	h.Write([]byte(strings.Join(lines[:len(lines)-1], "")))
+	if !hmac.Equal(h.Sum(nil), trailer.MAC) {
+		return nil, fmt.Errorf("seal file has been modified or moved")
+	}
+	return entries, nil
+}
+
+func parseLine(l string) (e Entry, err error) {
+	// "<64 hex>  <kind> <name>\n"
+	const macHex = 2 * sha256.Size
+	if len(l) < macHex+6 || l[macHex:macHex+2] != "  " || l[macHex+3] != ' ' {
+		return e, fmt.Errorf("malformed line %q", l)
+	}
+	e.MAC, err = hex.DecodeString(l[:macHex])
+	if err != nil {
+		return e, fmt.Errorf("malformed line %q: %v", l, err)
+	}
+	e.Kind = Kind(l[macHex+2])
+	e.Name = l[macHex+4 : len(l)-1]
+	return e, nil
+}
+
+// FileKind returns the Kind for the file mode "mode"
+func FileKind(mode os.FileMode) Kind {
+	switch {
+	case mode.IsDir():
+		return KindDir
+	case mode&os.ModeSymlink != 0:
+		return KindSymlink
+	case mode.IsRegular():
+		return KindFile
+	}
+	return KindOther
+}
+
+// Problem is a mismatch found by CheckDir
+type Problem struct {
+	// Path is the ciphertext path relative to the root
+	Path string
+	Msg  string
+}
+
+// CheckDir verifies the entries of directory "cDir" (ciphertext path relative
+// to "root") against the seal file in it. It returns the mismatches it
+// found. The error is only set if the seal file could not be read; it
+// satisfies os.IsNotExist if there is no seal file.
+func CheckDir(key []byte, root string, cDir string) ([]Problem, error) {
+	absDir := filepath.Join(root, cDir)
+	data, err := ioutil.ReadFile(filepath.Join(absDir, Filename))
+	if err != nil {
+		return nil, err
+	}
+	sealed, err := Verify(key, cDir, data)
+	if err != nil {
+		return []Problem{{filepath.Join(cDir, Filename), err.Error()}}, nil
+	}
+	want := make(map[string]Entry)
+	for _, e := range sealed {
+		want[e.Name] = e
+	}
+	fis, err := ioutil.ReadDir(absDir)
+	if err != nil {
+		return []Problem{{cDir, err.Error()}}, nil
+	}
+	var problems []Problem
+	for _, fi := range fis {
+		name := fi.Name()
+		if name == Filename {
+			continue
+		}
+		cPath := filepath.Join(cDir, name)
+		e, ok := want[name]
+		if !ok {
+			problems = append(problems, Problem{cPath, "not listed in " + Filename})
+			continue
+		}
+		delete(want, name)
+		mac, err := fileMAC(key, root, cPath, FileKind(fi.Mode()))
+		if err != nil {
+			problems = append(problems, Problem{cPath, err.Error()})
+		} else if e.Kind != FileKind(fi.Mode()) || !hmac.Equal(mac, e.MAC) {
+			problems = append(problems, Problem{cPath, "does not match " + Filename})
+		}
+	}
+	var missing []string
+	for name := range want {
+		missing = append(missing, name)
+	}
+	sort.Strings(missing)
+	for _, name := range missing {
+		problems = append(problems, Problem{filepath.Join(cDir, name), "listed in " + Filename + " but missing"})
+	}
+	return problems, nil
+}
+
+// fileMAC computes the MAC of the entry "cPath" on disk
+func fileMAC(key []byte, root string, cPath string, kind Kind) ([]byte, error) {
+	h := NewHash(key, cPath, kind)
+	absPath := filepath.Join(root, cPath)
+	switch kind {
+	case KindSymlink:
+		target, err := os.Readlink(absPath)
+		if err != nil {
+			return nil, err
+		}
+		h.Write([]byte(target))
+	case KindDir:
+		data, err := ioutil.ReadFile(filepath.Join(absPath, Filename))
+		if os.IsNotExist(err) {
+			return nil, fmt.Errorf("%s is missing", Filename)
+		} else if err != nil {
+			return nil, err
+		}
+		h.Write(data)
+	case KindFile:
+		f, err := os.Open(absPath)
+		if err != nil {
+			return nil, err
+		}
+		defer f.Close()
+		if _, err = io.Copy(h, f); err != nil {
+			return nil, err
+		}
+	}
+	return h.Sum(nil), nil
+}
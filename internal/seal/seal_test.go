@@ -0,0 +1,39 @@
+package seal
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+)
+
+func TestFormatVerify(t *testing.T) {
+	key := make([]byte, 32)
+	entries := []Entry{
+		{Name: "b", Kind: KindFile, MAC: NewHash(key, "dir/b", KindFile).Sum(nil)},
+		{Name: "a", Kind: KindDir, MAC: NewHash(key, "dir/a", KindDir).Sum(nil)},
+	}
+	data := Format(key, "dir", entries)
+	have, err := Verify(key, "dir", data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(have) != 2 || have[0].Name != "a" || have[1].Kind != KindFile || !bytes.Equal(have[1].MAC, entries[1].MAC) {
+		t.Errorf("wrong entries: %v", have)
+	}
+	// The seal of one directory is not valid for another
+	if _, err = Verify(key, "other", data); err == nil {
+		t.Error("moved seal file was accepted")
+	}
+	// Dropping an entry must be detected
+	lines := strings.SplitAfter(string(data), "\n")
+	if _, err = Verify(key, "dir", []byte(strings.Join(lines[1:], ""))); err == nil {
+		t.Error("dropped entry was not detected")
+	}
+	// Wrong key
+	if _, err = Verify(bytes.Repeat([]byte{1}, 32), "dir", data); err == nil {
+		t.Error("wrong key was accepted")
+	}
+	if _, err = Verify(key, "dir", data[:len(data)-1]); err == nil {
+		t.Error("truncated file was accepted")
+	}
+}
@@ -0,0 +1,70 @@
+package speed
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"time"
+
+	"github.com/rfjakob/gocryptfs/internal/configfile"
+)
+
+const (
+	// scryptBenchTarget is the password hashing time that RunScrypt
+	// recommends staying under.
+	scryptBenchTarget = time.Second
+	// The range of logN values tried, same as what "-scryptn" accepts
+	scryptBenchMinLogN = 10
+	scryptBenchMaxLogN = 28
+)
+
+// RunScrypt implements "-scrypt-bench". It times the scrypt key derivation
+// for increasing logN values and prints a table that recommends the highest
+// logN that stays under one second.
+func RunScrypt() {
+	scryptTable(os.Stdout, scryptBenchTarget, timeScrypt)
+}
+
+// timeScrypt measures one key derivation at "logN", using the same code as
+// gocryptfs.conf.
+func timeScrypt(logN int) time.Duration {
+	s := configfile.NewScryptKDF(logN)
+	t0 := time.Now()
+	s.DeriveKey("benchmark")
+	return time.Since(t0)
+}
+
+// scryptTable measures logN values using "measure" until one takes longer
+// than "target", prints the results to "w" and returns the recommended logN.
+func scryptTable(w io.Writer, target time.Duration, measure func(logN int) time.Duration) (recommended int) {
+	recommended = scryptBenchMinLogN
+	var times []time.Duration
+	for logN := scryptBenchMinLogN; logN <= scryptBenchMaxLogN; logN++ {
+		d := measure(logN)
+		times = append(times, d)
+		if d > target {
+			break
+		}
+		recommended = logN
+	}
+	fmt.Fprintf(w, "logN\tmemory\t\ttime\n")
+	for i, d := range times {
+		logN := scryptBenchMinLogN + i
+		// scrypt uses 128 * r * N bytes, and r is always 8
+		fmt.Fprintf(w, "%d\t%6d MiB\t%8.3f s", logN, 1<<uint(logN)/1024, d.Seconds())
+		if logN == recommended {
+			fmt.Fprintf(w, "\t<- recommended")
+		}
+		if logN == configfile.ScryptDefaultLogN {
+			fmt.Fprintf(w, "\t(default)")
+		}
+		fmt.Fprintf(w, "\n")
+	}
+	if times[0] > target {
+		fmt.Fprintf(w, "Even the minimum logN=%d takes longer than %v on this machine.\n",
+			scryptBenchMinLogN, target)
+	}
+	fmt.Fprintf(w, "Recommended: -scryptn %d (highest value that takes less than %v)\n",
+		recommended, target)
+	return recommended
+}
@@ -13,7 +13,10 @@ ok  	github.com/rfjakob/gocryptfs/internal/speed	6.022s
 */
 
 import (
+	"bytes"
+	"strings"
 	"testing"
+	"time"
 )
 
 func BenchmarkStupidGCM(b *testing.B) {
@@ -27,3 +30,26 @@ func BenchmarkGoGCM(b *testing.B) {
 func BenchmarkAESSIV(b *testing.B) {
 	bAESSIV(b)
 }
+
+// TestScryptTable uses simulated timings that double with each logN
+func TestScryptTable(t *testing.T) {
+	var buf bytes.Buffer
+	measure := func(logN int) time.Duration {
+		return time.Millisecond << uint(logN-scryptBenchMinLogN)
+	}
+	// 2^9 ms = 512ms at logN=19, 1024ms at logN=20
+	if r := scryptTable(&buf, time.Second, measure); r != 19 {
+		t.Errorf("want 19, got %d", r)
+	}
+	if !strings.Contains(buf.String(), "19\t") || !strings.Contains(buf.String(), "<- recommended") {
+		t.Errorf("unexpected output:\n%s", buf.String())
+	}
+	// Everything too slow
+	if r := scryptTable(&buf, time.Microsecond, measure); r != scryptBenchMinLogN {
+		t.Errorf("want %d, got %d", scryptBenchMinLogN, r)
+	}
+	// The real thing, with a target that stops after the first step
+	if r := scryptTable(&buf, 0, timeScrypt); r != scryptBenchMinLogN {
+		t.Errorf("want %d, got %d", scryptBenchMinLogN, r)
+	}
+}
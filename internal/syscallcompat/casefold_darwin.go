@@ -0,0 +1,7 @@
+package syscallcompat
+
+// IsCasefold is not implemented on Darwin and always returns false.
+// Note that APFS and HFS+ are usually case-insensitive anyway.
+func IsCasefold(dir string) (bool, error) {
+	return false, nil
+}
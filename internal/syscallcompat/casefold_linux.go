@@ -0,0 +1,35 @@
+package syscallcompat
+
+import (
+	"syscall"
+	"unsafe"
+)
+
+// FS_IOC_GETFLAGS is _IOR('f', 1, long), so the value depends on the size
+// of "long".
+const _FS_IOC_GETFLAGS = 0x80006601 | uintptr(unsafe.Sizeof(uintptr(0)))<<16
+
+// _FS_CASEFOLD_FL is the inode flag for case-insensitive directories
+// (ext4 "casefold" feature, "chattr +F").
+const _FS_CASEFOLD_FL = 0x40000000
+
+// IsCasefold returns true if "dir" is a case-insensitive directory.
+// Filesystems that do not support reading the inode flags return false and
+// no error.
+func IsCasefold(dir string) (bool, error) {
+	fd, err := syscall.Open(dir, syscall.O_RDONLY|syscall.O_DIRECTORY, 0)
+	if err != nil {
+		return false, err
+	}
+	defer syscall.Close(fd)
+	// The kernel only writes an int, even though the ioctl number says "long"
+	var flags int32
+	_, _, errno := syscall.Syscall(syscall.SYS_IOCTL, uintptr(fd), _FS_IOC_GETFLAGS, uintptr(unsafe.Pointer(&flags)))
+	if errno == syscall.ENOTTY || errno == syscall.EINVAL || errno == syscall.EOPNOTSUPP {
+		return false, nil
+	}
+	if errno != 0 {
+		return false, errno
+	}
+	return flags&_FS_CASEFOLD_FL != 0, nil
+}
@@ -0,0 +1,35 @@
+package syscallcompat
+
+import (
+	"os"
+	"os/exec"
+	"testing"
+)
+
+func TestIsCasefold(t *testing.T) {
+	cf, err := IsCasefold(tmpDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cf {
+		t.Skip("tmpDir is already case-insensitive")
+	}
+	dir := tmpDir + "/casefold"
+	err = os.Mkdir(dir, 0700)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(dir)
+	// Only works on ext4 with the casefold feature enabled
+	out, err := exec.Command("chattr", "+F", dir).CombinedOutput()
+	if err != nil {
+		t.Skipf("chattr +F failed: %v, %s", err, out)
+	}
+	cf, err = IsCasefold(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !cf {
+		t.Error("casefold flag not detected")
+	}
+}
@@ -84,10 +84,17 @@ func getdents(fd int) ([]fuse.DirEntry, error) {
 			continue
 		}
 		mode, err := convertDType(fd, name, s.Type)
-		if err != nil {
-			// The file may have been deleted in the meantime. Just skip it
+		if err == syscall.ENOENT {
+			// The file has been deleted in the meantime. Just skip it
 			// and go on.
 			continue
+		} else if err != nil {
+			// We could not find out the type (stat may fail with EACCES
+			// if we can read but not search the directory). Pass the entry
+			// on with an unknown type instead of hiding it, callers like
+			// the kernel know that they have to stat it themselves.
+			tlog.Debug.Printf("Getdents: %q: could not get type: %v", name, err)
+			mode = 0
 		}
 		entries = append(entries, fuse.DirEntry{
 			Ino:  s.Ino,
@@ -124,6 +131,9 @@ func getdentsName(s unix.Dirent) (string, error) {
 var dtUnknownWarnOnce sync.Once
 
 // convertDType converts a Dirent.Type to at Stat_t.Mode value.
+// Some backing filesystems (older XFS, some network filesystems) always
+// return DT_UNKNOWN. We detect this on the first such entry, warn once and
+// fall back to stat() for every entry that lacks the type.
 func convertDType(dirfd int, name string, dtype uint8) (uint32, error) {
 	if dtype != syscall.DT_UNKNOWN {
 		// Shift up by four octal digits = 12 bits
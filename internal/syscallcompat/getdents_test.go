@@ -116,3 +116,49 @@ func testGetdents(t *testing.T) {
 		}
 	}
 }
+
+// Simulate a backing filesystem that returns DT_UNKNOWN for all entries.
+// The stat() fallback must find out the correct types.
+func TestConvertDTypeUnknown(t *testing.T) {
+	dir, err := ioutil.TempDir(tmpDir, "TestConvertDTypeUnknown")
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := map[string]uint32{
+		"file":    syscall.S_IFREG,
+		"dir":     syscall.S_IFDIR,
+		"symlink": syscall.S_IFLNK,
+		"fifo":    syscall.S_IFIFO,
+	}
+	if err = ioutil.WriteFile(dir+"/file", nil, 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err = os.Mkdir(dir+"/dir", 0700); err != nil {
+		t.Fatal(err)
+	}
+	if err = os.Symlink("dir", dir+"/symlink"); err != nil {
+		t.Fatal(err)
+	}
+	if err = syscall.Mkfifo(dir+"/fifo", 0600); err != nil {
+		t.Fatal(err)
+	}
+	fd, err := os.Open(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer fd.Close()
+	for name, typ := range want {
+		mode, err := convertDType(int(fd.Fd()), name, syscall.DT_UNKNOWN)
+		if err != nil {
+			t.Errorf("%s: %v", name, err)
+		} else if mode != typ {
+			t.Errorf("%s: got %#o, want %#o", name, mode, typ)
+		}
+	}
+	// Entries that disappeared are reported as ENOENT so Getdents can skip
+	// them
+	_, err = convertDType(int(fd.Fd()), "gone", syscall.DT_UNKNOWN)
+	if err != syscall.ENOENT {
+		t.Errorf("want ENOENT, got %v", err)
+	}
+}
@@ -29,6 +29,17 @@ func Dup3(oldfd int, newfd int, flags int) (err error) {
 	return syscall.Dup2(oldfd, newfd)
 }
 
+// Fdatasync is not available on Darwin, so we use Fsync instead.
+func Fdatasync(fd int) (err error) {
+	return syscall.Fsync(fd)
+}
+
+// DropCache is not available on Darwin (there is no posix_fadvise), so the
+// next read may be served from the page cache.
+func DropCache(fd int, off int64, len int64) (err error) {
+	return nil
+}
+
 ////////////////////////////////////////////////////////
 //// Emulated Syscalls (see emulate.go) ////////////////
 ////////////////////////////////////////////////////////
@@ -72,3 +83,21 @@ func Fstatat(dirfd int, path string, stat *unix.Stat_t, flags int) (err error) {
 func Getdents(fd int) ([]fuse.DirEntry, error) {
 	return emulateGetdents(fd)
 }
+
+// Extended attributes are not implemented on Darwin yet.
+
+func Lgetxattr(path string, attr string) ([]byte, error) {
+	return nil, syscall.ENOTSUP
+}
+
+func Lsetxattr(path string, attr string, data []byte, flags int) error {
+	return syscall.ENOTSUP
+}
+
+func Llistxattr(path string) ([]string, error) {
+	return nil, syscall.ENOTSUP
+}
+
+func Lremovexattr(path string, attr string) error {
+	return syscall.ENOTSUP
+}
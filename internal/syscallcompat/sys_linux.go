@@ -2,6 +2,7 @@
 package syscallcompat
 
 import (
+	"strings"
 	"sync"
 	"syscall"
 
@@ -78,6 +79,17 @@ func Dup3(oldfd int, newfd int, flags int) (err error) {
 	return syscall.Dup3(oldfd, newfd, flags)
 }
 
+// Fdatasync syscall.
+func Fdatasync(fd int) (err error) {
+	return syscall.Fdatasync(fd)
+}
+
+// DropCache asks the kernel to drop the page cache for the range, so the next
+// read comes from the storage device. Dirty pages must be synced first.
+func DropCache(fd int, off int64, len int64) (err error) {
+	return unix.Fadvise(fd, off, len, unix.FADV_DONTNEED)
+}
+
 // Fchmodat syscall.
 func Fchmodat(dirfd int, path string, mode uint32, flags int) (err error) {
 	// Why would we ever want to call this without AT_SYMLINK_NOFOLLOW?
@@ -122,3 +134,63 @@ func Fstatat(dirfd int, path string, stat *unix.Stat_t, flags int) (err error) {
 func Getdents(fd int) ([]fuse.DirEntry, error) {
 	return getdents(fd)
 }
+
+// Lgetxattr returns the value of the extended attribute "attr" of "path"
+// without following symlinks. The buffer is sized automatically.
+func Lgetxattr(path string, attr string) ([]byte, error) {
+	for {
+		sz, err := unix.Lgetxattr(path, attr, nil)
+		if err != nil {
+			return nil, err
+		}
+		buf := make([]byte, sz)
+		sz, err = unix.Lgetxattr(path, attr, buf)
+		if err == syscall.ERANGE {
+			// The value has grown in the meantime
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		return buf[:sz], nil
+	}
+}
+
+// Lsetxattr sets the extended attribute "attr" of "path" without following
+// symlinks.
+func Lsetxattr(path string, attr string, data []byte, flags int) error {
+	return unix.Lsetxattr(path, attr, data, flags)
+}
+
+// Llistxattr returns the names of the extended attributes of "path"
+// without following symlinks.
+func Llistxattr(path string) ([]string, error) {
+	for {
+		sz, err := unix.Llistxattr(path, nil)
+		if err != nil {
+			return nil, err
+		}
+		buf := make([]byte, sz)
+		sz, err = unix.Llistxattr(path, buf)
+		if err == syscall.ERANGE {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		// The names are NUL-terminated
+		var names []string
+		for _, n := range strings.Split(string(buf[:sz]), "\x00") {
+			if n != "" {
+				names = append(names, n)
+			}
+		}
+		return names, nil
+	}
+}
+
+// Lremovexattr removes the extended attribute "attr" of "path" without
+// following symlinks.
+func Lremovexattr(path string, attr string) error {
+	return unix.Lremovexattr(path, attr)
+}
@@ -5,9 +5,13 @@ package tlog
 import (
 	"encoding/json"
 	"fmt"
+	"io"
 	"log"
 	"log/syslog"
 	"os"
+	"strings"
+	"sync"
+	"time"
 
 	"golang.org/x/crypto/ssh/terminal"
 )
@@ -52,6 +56,14 @@ type toggledLogger struct {
 	// Private prefix and postfix are used for coloring
 	prefix  string
 	postfix string
+	// level is the name of the log level in JSON output
+	level string
+	// json makes the logger emit JSON objects, see SwitchToJSON
+	json bool
+	// syslogWriter is the current syslog connection and syslogPrio its
+	// priority, set by SwitchToSyslog. Used by Reopen.
+	syslogWriter *syslog.Writer
+	syslogPrio   syslog.Priority
 
 	*log.Logger
 }
@@ -60,7 +72,7 @@ func (l *toggledLogger) Printf(format string, v ...interface{}) {
 	if !l.Enabled {
 		return
 	}
-	l.Logger.Printf(l.prefix + fmt.Sprintf(format, v...) + l.postfix)
+	l.output(fmt.Sprintf(format, v...))
 	if l.Wpanic {
 		l.Logger.Panic(wpanicMsg + fmt.Sprintf(format, v...))
 	}
@@ -69,12 +81,38 @@ func (l *toggledLogger) Println(v ...interface{}) {
 	if !l.Enabled {
 		return
 	}
-	l.Logger.Println(l.prefix + fmt.Sprint(v...) + l.postfix)
+	l.output(fmt.Sprint(v...))
 	if l.Wpanic {
 		l.Logger.Panic(wpanicMsg + fmt.Sprint(v...))
 	}
 }
 
+// jsonLine is one log message in JSON output
+type jsonLine struct {
+	Level     string `json:"level"`
+	Time      string `json:"time"`
+	Msg       string `json:"msg"`
+	Component string `json:"component"`
+}
+
+// output writes "msg", either colored or as a JSON object
+func (l *toggledLogger) output(msg string) {
+	if !l.json {
+		l.Logger.Print(l.prefix + msg + l.postfix)
+		return
+	}
+	js, err := json.Marshal(jsonLine{
+		Level:     l.level,
+		Time:      time.Now().Format(time.RFC3339Nano),
+		Msg:       strings.TrimRight(msg, "\n"),
+		Component: ProgramName,
+	})
+	if err != nil {
+		js = []byte(err.Error())
+	}
+	l.Logger.Print(string(js))
+}
+
 // Debug logs debug messages
 // Can be enabled by passing "-d"
 var Debug *toggledLogger
@@ -101,24 +139,45 @@ func init() {
 	}
 
 	Debug = &toggledLogger{
+		level:  "debug",
 		Logger: log.New(os.Stdout, "", 0),
 	}
 	Info = &toggledLogger{
 		Enabled: true,
+		level:   "info",
 		Logger:  log.New(os.Stdout, "", 0),
 	}
 	Warn = &toggledLogger{
 		Enabled: true,
+		level:   "warn",
 		Logger:  log.New(os.Stderr, "", 0),
 	}
 	Fatal = &toggledLogger{
 		Enabled: true,
+		level:   "fatal",
 		Logger:  log.New(os.Stderr, "", 0),
 		prefix:  ColorRed,
 		postfix: ColorReset,
 	}
 }
 
+// SwitchToJSON makes all loggers write one JSON object per message, with the
+// fields "level", "time", "msg" and "component", for log aggregators.
+// Terminal colors are disabled. The default logger used by go-fuse is not
+// affected.
+func SwitchToJSON() {
+	ColorReset = ""
+	ColorGrey = ""
+	ColorRed = ""
+	ColorGreen = ""
+	ColorYellow = ""
+	for _, l := range []*toggledLogger{Debug, Info, Warn, Fatal} {
+		l.json = true
+		l.prefix = ""
+		l.postfix = ""
+	}
+}
+
 // SwitchToSyslog redirects the output of this logger to syslog.
 func (l *toggledLogger) SwitchToSyslog(p syslog.Priority) {
 	w, err := syslog.New(p, ProgramName)
@@ -126,9 +185,35 @@ func (l *toggledLogger) SwitchToSyslog(p syslog.Priority) {
 		Warn.Printf("SwitchToSyslog: %v", err)
 	} else {
 		l.SetOutput(w)
+		l.syslogWriter = w
+		l.syslogPrio = p
+	}
+}
+
+// Reopen re-establishes the syslog connection of this logger. This is a no-op
+// if the logger was not switched to syslog. On error, the old connection is
+// kept.
+func (l *toggledLogger) Reopen() error {
+	if l.syslogWriter == nil {
+		return nil
+	}
+	w, err := syslog.New(l.syslogPrio, ProgramName)
+	if err != nil {
+		return err
 	}
+	// SetOutput waits for messages that are being written, so nobody uses
+	// the old connection after it returns
+	l.SetOutput(w)
+	l.syslogWriter.Close()
+	l.syslogWriter = w
+	return nil
 }
 
+// stdSyslogWriter and stdSyslogPrio are the syslog connection of the default
+// log.Logger, set by SwitchLoggerToSyslog
+var stdSyslogWriter *syslog.Writer
+var stdSyslogPrio syslog.Priority
+
 // SwitchLoggerToSyslog redirects the default log.Logger that the go-fuse lib uses
 // to syslog.
 func SwitchLoggerToSyslog(p syslog.Priority) {
@@ -140,5 +225,95 @@ func SwitchLoggerToSyslog(p syslog.Priority) {
 		// Disable printing the timestamp, syslog already provides that
 		log.SetFlags(0)
 		log.SetOutput(w)
+		stdSyslogWriter = w
+		stdSyslogPrio = p
+	}
+}
+
+// LogFile is a log file that can be reopened after it has been rotated away.
+// It is safe for concurrent use.
+type LogFile struct {
+	path string
+	mu   sync.Mutex
+	f    *os.File
+}
+
+// OpenLogFile opens "path" for appending, creating it if needed.
+func OpenLogFile(path string) (*LogFile, error) {
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600)
+	if err != nil {
+		return nil, err
+	}
+	return &LogFile{path: path, f: f}, nil
+}
+
+// Write implements io.Writer
+func (lf *LogFile) Write(p []byte) (int, error) {
+	lf.mu.Lock()
+	defer lf.mu.Unlock()
+	return lf.f.Write(p)
+}
+
+// File returns the currently open file
+func (lf *LogFile) File() *os.File {
+	lf.mu.Lock()
+	defer lf.mu.Unlock()
+	return lf.f
+}
+
+// Reopen opens the path again and closes the old file. On error, the old
+// file is kept.
+func (lf *LogFile) Reopen() error {
+	f, err := os.OpenFile(lf.path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600)
+	if err != nil {
+		return err
+	}
+	lf.mu.Lock()
+	old := lf.f
+	lf.f = f
+	lf.mu.Unlock()
+	return old.Close()
+}
+
+// SwitchToFile redirects all loggers and the default log.Logger that go-fuse
+// uses to "lf". Fatal errors are also written to stderr so they are visible
+// on the terminal.
+func SwitchToFile(lf *LogFile) {
+	Debug.SetOutput(lf)
+	Info.SetOutput(lf)
+	Warn.SetOutput(lf)
+	Fatal.SetOutput(io.MultiWriter(os.Stderr, lf))
+	log.SetOutput(lf)
+	logFile = lf
+}
+
+// logFile is set by SwitchToFile
+var logFile *LogFile
+
+// Reopen re-establishes the log outputs after log rotation: the syslog
+// connections of all loggers are reconnected, and the log file set by
+// SwitchToFile is opened again. Outputs that were not redirected are left
+// alone. Returns the first error.
+func Reopen() (err error) {
+	if logFile != nil {
+		err = logFile.Reopen()
+	}
+	for _, l := range []*toggledLogger{Debug, Info, Warn, Fatal} {
+		if err2 := l.Reopen(); err == nil {
+			err = err2
+		}
+	}
+	if stdSyslogWriter != nil {
+		w, err2 := syslog.New(stdSyslogPrio, ProgramName)
+		if err2 != nil {
+			if err == nil {
+				err = err2
+			}
+		} else {
+			log.SetOutput(w)
+			stdSyslogWriter.Close()
+			stdSyslogWriter = w
+		}
 	}
+	return err
 }
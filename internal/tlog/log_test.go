@@ -0,0 +1,86 @@
+package tlog
+
+import (
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestJSONOutput(t *testing.T) {
+	var buf bytes.Buffer
+	l := &toggledLogger{
+		Enabled: true,
+		level:   "warn",
+		prefix:  "\033[31m",
+		postfix: "\033[0m",
+		Logger:  log.New(&buf, "", 0),
+	}
+	l.Printf("100%% %s\n", "done")
+	if have := buf.String(); have != "\033[31m100% done\n\033[0m\n" {
+		t.Errorf("wrong text output %q", have)
+	}
+	buf.Reset()
+	l.json = true
+	l.prefix = ""
+	l.postfix = ""
+	l.Printf("100%% %s\n", "done")
+	l.Println("second")
+	lines := strings.Split(strings.TrimRight(buf.String(), "\n"), "\n")
+	if len(lines) != 2 {
+		t.Fatalf("want 2 lines, have %q", buf.String())
+	}
+	var m jsonLine
+	if err := json.Unmarshal([]byte(lines[0]), &m); err != nil {
+		t.Fatal(err)
+	}
+	if m.Level != "warn" || m.Msg != "100% done" || m.Component != ProgramName {
+		t.Errorf("wrong fields: %+v", m)
+	}
+	if _, err := time.Parse(time.RFC3339Nano, m.Time); err != nil {
+		t.Error(err)
+	}
+}
+
+// After the log file has been rotated away, Reopen must create it again and
+// new messages must go there
+func TestLogFileReopen(t *testing.T) {
+	dir, err := ioutil.TempDir("", "gocryptfs_logfile")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "log")
+	lf, err := OpenLogFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer lf.File().Close()
+	l := &toggledLogger{Enabled: true, Logger: log.New(lf, "", 0)}
+	l.Println("one")
+	if err = os.Rename(path, path+".1"); err != nil {
+		t.Fatal(err)
+	}
+	if err = lf.Reopen(); err != nil {
+		t.Fatal(err)
+	}
+	l.Println("two")
+	for p, want := range map[string]string{path + ".1": "one\n", path: "two\n"} {
+		have, err := ioutil.ReadFile(p)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(have) != want {
+			t.Errorf("%s: want %q, have %q", p, want, have)
+		}
+	}
+	// A logger that was not switched to syslog is left alone
+	if err = l.Reopen(); err != nil {
+		t.Error(err)
+	}
+}
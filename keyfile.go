@@ -0,0 +1,74 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"io/ioutil"
+	"os"
+
+	"github.com/rfjakob/gocryptfs/internal/cryptocore"
+	"github.com/rfjakob/gocryptfs/internal/exitcodes"
+	"github.com/rfjakob/gocryptfs/internal/readpassword"
+	"github.com/rfjakob/gocryptfs/internal/tlog"
+)
+
+// readKeyfile reads the whole keyfile at "path".
+// Exits on read error or if the file is empty.
+func readKeyfile(path string) []byte {
+	kf, err := ioutil.ReadFile(path)
+	if err != nil {
+		tlog.Fatal.Printf("Could not read keyfile: %v", err)
+		os.Exit(exitcodes.ReadPassword)
+	}
+	if len(kf) == 0 {
+		tlog.Fatal.Printf("Keyfile %q is empty", path)
+		os.Exit(exitcodes.ReadPassword)
+	}
+	return kf
+}
+
+// mixKeyfile combines the keyfile contents and the password into the string
+// that is passed to scrypt. In keyfile-only mode, the password is empty.
+//
+// The result is HMAC-SHA256(key=keyfile, msg=password), hex-encoded.
+func mixKeyfile(keyfile []byte, pw string) string {
+	mac := hmac.New(sha256.New, keyfile)
+	mac.Write([]byte(pw))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// readPassword returns the secret that unlocks the master key. Depending on
+// the "-keyfile" and "-keyfile-password" options this is the password, a value
+// derived from the keyfile, or a combination of both.
+func readPassword(args *argContainer) string {
+	var pw string
+	if args._passfd != nil {
+		pw = readpassword.Fd(args._passfd)
+	} else if args.keyfile == "" || args.keyfile_password {
+		pw = readpassword.Once(args.extpass)
+	}
+	if args.keyfile != "" {
+		kf := readKeyfile(args.keyfile)
+		pw = mixKeyfile(kf, pw)
+		cryptocore.Wipe(kf)
+	}
+	return pw
+}
+
+// readPasswordTwice is like readPassword, but asks for the password twice
+// when it comes from the terminal. Used when a new password is set.
+func readPasswordTwice(args *argContainer) string {
+	var pw string
+	if args._passfd != nil {
+		pw = readpassword.Fd(args._passfd)
+	} else if args.keyfile == "" || args.keyfile_password {
+		pw = readpassword.Twice(args.extpass)
+	}
+	if args.keyfile != "" {
+		kf := readKeyfile(args.keyfile)
+		pw = mixKeyfile(kf, pw)
+		cryptocore.Wipe(kf)
+	}
+	return pw
+}
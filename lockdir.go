@@ -0,0 +1,47 @@
+package main
+
+import (
+	"os"
+	"syscall"
+
+	"github.com/rfjakob/gocryptfs/internal/exitcodes"
+	"github.com/rfjakob/gocryptfs/internal/tlog"
+)
+
+// lockCipherdir takes an exclusive flock(2) on the CIPHERDIR so that a second
+// read-write mount of the same CIPHERDIR is refused. Two gocryptfs instances
+// writing to the same CIPHERDIR can corrupt the files and the gocryptfs.diriv
+// files.
+// The lock is released when the returned file is closed or the process exits.
+// With "-sharedstorage" a conflict is only a warning.
+func lockCipherdir(args *argContainer) *os.File {
+	// Read-only and reverse mounts do not write to CIPHERDIR
+	if args.ro || args.reverse {
+		return nil
+	}
+	f, err := os.Open(args.cipherdir)
+	if err != nil {
+		tlog.Fatal.Printf("Could not open cipherdir: %v", err)
+		os.Exit(exitcodes.CipherDir)
+	}
+	err = syscall.Flock(int(f.Fd()), syscall.LOCK_EX|syscall.LOCK_NB)
+	if err == nil {
+		return f
+	}
+	f.Close()
+	if err != syscall.EWOULDBLOCK {
+		// Some filesystems (for example some network filesystems) do not
+		// support flock. We cannot do anything about it.
+		tlog.Warn.Printf("Could not lock cipherdir, not protected against concurrent mounts: %v", err)
+		return nil
+	}
+	if args.sharedstorage {
+		tlog.Warn.Printf("Cipherdir %q is already mounted read-write by another gocryptfs instance, "+
+			"continuing because of -sharedstorage", args.cipherdir)
+		return nil
+	}
+	tlog.Fatal.Printf("Cipherdir %q is already mounted read-write by another gocryptfs instance. "+
+		"Mount it with -ro, or pass -sharedstorage if this is intentional.", args.cipherdir)
+	os.Exit(exitcodes.CipherDirLocked)
+	return nil
+}
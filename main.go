@@ -1,6 +1,7 @@
 package main
 
 import (
+	"encoding/json"
 	"fmt"
 	"os"
 	"path/filepath"
@@ -12,10 +13,14 @@ import (
 
 	"github.com/rfjakob/gocryptfs/internal/configfile"
 	"github.com/rfjakob/gocryptfs/internal/contentenc"
+	"github.com/rfjakob/gocryptfs/internal/cryptocore"
 	"github.com/rfjakob/gocryptfs/internal/exitcodes"
+	"github.com/rfjakob/gocryptfs/internal/fusefrontend_reverse"
+	"github.com/rfjakob/gocryptfs/internal/nametransform"
 	"github.com/rfjakob/gocryptfs/internal/readpassword"
 	"github.com/rfjakob/gocryptfs/internal/speed"
 	"github.com/rfjakob/gocryptfs/internal/stupidgcm"
+	"github.com/rfjakob/gocryptfs/internal/syscallcompat"
 	"github.com/rfjakob/gocryptfs/internal/tlog"
 )
 
@@ -37,53 +42,131 @@ func loadConfig(args *argContainer) (masterkey []byte, confFile *configfile.Conf
 	fd, err := os.Open(args.config)
 	if err != nil {
 		tlog.Fatal.Printf("Cannot open config file: %v", err)
+		if os.IsNotExist(err) && checkDirEmpty(args.cipherdir) != nil {
+			printMissingConfHelp(args)
+		}
 		return nil, nil, exitcodes.NewErr(err.Error(), exitcodes.OpenConf)
 	}
+	fi, err := fd.Stat()
 	fd.Close()
+	if err == nil && fi.Mode().Perm()&0077 != 0 {
+		msg := fmt.Sprintf("Config file %q is accessible by group or others (mode %04o). "+
+			"It contains the encrypted master key, please run: chmod 400 %s",
+			args.config, fi.Mode().Perm(), args.config)
+		if args.strictperms {
+			tlog.Fatal.Printf("%s", msg)
+			return nil, nil, exitcodes.NewErr("config file permissions too loose", exitcodes.LoadConf)
+		}
+		// Not tlog.Warn: -wpanic must not turn this into a crash, config
+		// files copied around or checked out from git are usually 0644
+		tlog.Info.Printf(tlog.ColorYellow + msg + tlog.ColorReset)
+	}
 	// The user has passed the master key (probably because he forgot the
 	// password).
-	if args.masterkey != "" {
-		masterkey = parseMasterKey(args.masterkey)
+	if masterkey = explicitMasterKey(args); masterkey != nil {
 		_, confFile, err = configfile.LoadConfFile(args.config, "")
 	} else {
-		pw := readpassword.Once(args.extpass)
+		// Ask for the keyfile before prompting for a password that cannot
+		// work without it
+		_, confFile, err = configfile.LoadConfFile(args.config, "")
+		if err == nil && confFile.IsFeatureFlagSet(configfile.FlagKeyfile) && args.keyfile == "" {
+			tlog.Fatal.Printf("This filesystem can only be unlocked with its keyfile, please pass -keyfile")
+			return nil, nil, exitcodes.NewErr("keyfile missing", exitcodes.Usage)
+		}
+		pw := readPassword(args)
 		tlog.Info.Println("Decrypting master key")
 		masterkey, confFile, err = configfile.LoadConfFile(args.config, pw)
 	}
 	if err != nil {
+		cryptocore.Wipe(masterkey)
 		tlog.Fatal.Println(err)
 		return nil, nil, err
 	}
 	return masterkey, confFile, nil
 }
 
+// isCasefold is syscallcompat.IsCasefold, replaced in the tests
+var isCasefold = syscallcompat.IsCasefold
+
+// casefoldCollision returns true if encrypted file names in args.cipherdir
+// could collide: base64 file names that only differ in case would collide in
+// a case-insensitive CIPHERDIR. Reverse mode does not store ciphertext names.
+func casefoldCollision(args *argContainer) bool {
+	if args.reverse || args.plaintextnames {
+		return false
+	}
+	cf, _ := isCasefold(args.cipherdir)
+	return cf
+}
+
+// printMissingConfHelp explains how to recover when CIPHERDIR contains data but
+// the config file is missing. Printed on the Fatal logger, next to the error,
+// so that "-q" does not hide it.
+func printMissingConfHelp(args *argContainer) {
+	tlog.Fatal.Printf(`CIPHERDIR %q is not empty, but the config file is missing.
+If you have the master key, you can still access your files:
+  * Mount using "-masterkey", for example:
+      %s -masterkey=XXXXXXXX-... %s MOUNTPOINT
+  * Or create a new config file: run "%s -init" on a new, empty directory
+    (using the same options as when CIPHERDIR was created), copy the resulting
+    gocryptfs.conf to %q, and set your master key and a new password using
+      %s -passwd -masterkey=XXXXXXXX-... %s
+If you use a custom config file location, pass it with "-config".`,
+		args.cipherdir, tlog.ProgramName, args.cipherdir, tlog.ProgramName, args.config,
+		tlog.ProgramName, args.cipherdir)
+}
+
+// checkPassword - decrypt the master key of the config file to check the
+// password, without mounting. Exits with exitcodes.PasswordIncorrect if the
+// password is wrong.
+// Does not return.
+func checkPassword(args *argContainer) {
+	masterkey, _, err := loadConfig(args)
+	if err != nil {
+		exitcodes.Exit(err)
+	}
+	cryptocore.Wipe(masterkey)
+	readpassword.CheckTrailingGarbage()
+	tlog.Info.Println(tlog.ColorGreen + "Password correct." + tlog.ColorReset)
+	os.Exit(0)
+}
+
 // changePassword - change the password of config file "filename"
 func changePassword(args *argContainer) {
+	// "-old-keyfile" and "-new-keyfile" switch between password and keyfile
+	// or rotate the keyfile. Otherwise, "-keyfile" applies to both secrets.
+	switchKeyfile := args.old_keyfile != "" || args.new_keyfile != ""
+	if switchKeyfile {
+		args.keyfile = args.old_keyfile
+	}
 	masterkey, confFile, err := loadConfig(args)
 	if err != nil {
 		exitcodes.Exit(err)
 	}
-	tlog.Info.Println("Please enter your new password.")
-	newPw := readpassword.Twice(args.extpass)
+	if switchKeyfile {
+		args.keyfile = args.new_keyfile
+	}
+	if args._passfd == nil && (args.keyfile == "" || args.keyfile_password) {
+		tlog.Info.Println("Please enter your new password.")
+	}
+	newPw := readPasswordTwice(args)
 	readpassword.CheckTrailingGarbage()
+	confFile.SetFeatureFlag(configfile.FlagKeyfile, args.keyfile != "")
 	confFile.EncryptKey(masterkey, newPw, confFile.ScryptObject.LogN())
-	if args.masterkey != "" {
-		bak := args.config + ".bak"
-		err = os.Link(args.config, bak)
-		if err != nil {
-			tlog.Fatal.Printf("Could not create backup file: %v", err)
-			os.Exit(exitcodes.Init)
-		}
-		tlog.Info.Printf(tlog.ColorGrey+
-			"A copy of the old config file has been created at %q.\n"+
-			"Delete it after you have verified that you can access your files with the new password."+
-			tlog.ColorReset, bak)
-	}
+	cryptocore.Wipe(masterkey)
 	err = confFile.WriteFile()
 	if err != nil {
 		tlog.Fatal.Println(err)
 		os.Exit(exitcodes.WriteConf)
 	}
+	// WriteFile keeps a copy of the old config file. It still holds the
+	// master key encrypted with the old password, so this is printed even
+	// with "-q".
+	tlog.Warn.Printf(tlog.ColorYellow+
+		"WARNING: The old config file has been kept at %q.\n"+
+		"It still unlocks your files with the OLD password.\n"+
+		"Delete it after you have verified that you can access your files with the new password."+
+		tlog.ColorReset, args.config+configfile.ConfBackupSuffix)
 	tlog.Info.Printf(tlog.ColorGreen + "Password changed." + tlog.ColorReset)
 	os.Exit(0)
 }
@@ -103,6 +186,45 @@ func printVersion() {
 		tlog.ProgramName, GitVersion, buildFlags, GitVersionFuse, built)
 }
 
+// gcmBackend returns the GCM backend selected by "-openssl"
+func gcmBackend(args *argContainer) cryptocore.AEADTypeEnum {
+	if args.openssl {
+		return cryptocore.BackendOpenSSL
+	}
+	return cryptocore.BackendGoGCM
+}
+
+// versionInfo is the output of "-version -json"
+type versionInfo struct {
+	Version        string `json:"version"`
+	GoFuseVersion  string `json:"goFuseVersion"`
+	BuildDate      string `json:"buildDate"`
+	GoVersion      string `json:"goVersion"`
+	OnDiskFormat   int    `json:"onDiskFormat"`
+	WithoutOpenssl bool   `json:"withoutOpenssl"`
+	// GCMBackend is "OpenSSL" or "Go-GCM", see "-openssl"
+	GCMBackend string `json:"gcmBackend"`
+	// AESInstructions is "yes", "no" or "unknown"
+	AESInstructions string `json:"aesInstructions"`
+}
+
+// printVersionJSON prints the version information as JSON to stdout, for
+// scripts.
+func printVersionJSON(args *argContainer) {
+	v := versionInfo{
+		Version:         GitVersion,
+		GoFuseVersion:   GitVersionFuse,
+		BuildDate:       BuildDate,
+		GoVersion:       runtime.Version(),
+		OnDiskFormat:    contentenc.CurrentVersion,
+		WithoutOpenssl:  stupidgcm.BuiltWithoutOpenssl,
+		GCMBackend:      gcmBackend(args).String(),
+		AESInstructions: cryptocore.AESInstructions(),
+	}
+	js, _ := json.MarshalIndent(v, "", "\t")
+	fmt.Println(string(js))
+}
+
 func main() {
 	mxp := runtime.GOMAXPROCS(0)
 	if mxp < 4 {
@@ -113,10 +235,14 @@ func main() {
 	// Parse all command-line options (i.e. arguments starting with "-")
 	// into "args". Path arguments are parsed below.
 	args := parseCliOpts()
+	// "-logjson"
+	if args.logjson {
+		tlog.SwitchToJSON()
+	}
 	// Fork a child into the background if "-fg" is not set AND we are mounting
 	// a filesystem. The child will do all the work.
 	if !args.fg && flagSet.NArg() == 2 {
-		ret := forkChild()
+		ret := forkChild(&args)
 		os.Exit(ret)
 	}
 	if args.debug {
@@ -126,7 +252,13 @@ func main() {
 	if args.version {
 		tlog.Debug.Printf("openssl=%v\n", args.openssl)
 		tlog.Debug.Printf("on-disk format %d\n", contentenc.CurrentVersion)
-		printVersion()
+		if args.json {
+			printVersionJSON(&args)
+		} else {
+			printVersion()
+			// The backend that a mount with the same options would use
+			fmt.Printf("GCM backend: %s\n", cryptocore.BackendDescription(gcmBackend(&args)))
+		}
 		os.Exit(0)
 	}
 	// "-hh"
@@ -139,10 +271,23 @@ func main() {
 		speed.Run()
 		os.Exit(0)
 	}
+	// "-scrypt-bench"
+	if args.scrypt_bench {
+		speed.RunScrypt()
+		os.Exit(0)
+	}
 	if args.wpanic {
 		tlog.Warn.Wpanic = true
 		tlog.Debug.Printf("Panicking on warnings")
 	}
+	// "-unmount"
+	if args.unmount {
+		if flagSet.NArg() != 1 {
+			tlog.Fatal.Printf("Usage: %s -unmount MOUNTPOINT", tlog.ProgramName)
+			os.Exit(exitcodes.Usage)
+		}
+		unmount(flagSet.Arg(0)) // does not return
+	}
 	// Every operation below requires CIPHERDIR. Exit if we don't have it.
 	if flagSet.NArg() == 0 {
 		if flagSet.NFlag() == 0 {
@@ -166,10 +311,26 @@ func main() {
 	if args.quiet {
 		tlog.Info.Enabled = false
 	}
+	// "-diriv-retries"
+	nametransform.SetDirIVRetries(args.diriv_retries)
+	// "-logfile"
+	if args.logfile != "" {
+		args._logfile, err = tlog.OpenLogFile(args.logfile)
+		if err != nil {
+			tlog.Fatal.Printf("Could not open logfile: %v", err)
+			os.Exit(exitcodes.Usage)
+		}
+		tlog.SwitchToFile(args._logfile)
+	}
 	// "-reverse" implies "-aessiv"
 	if args.reverse {
 		args.aessiv = true
 	}
+	if casefoldCollision(&args) {
+		tlog.Fatal.Printf("Invalid cipherdir: %q is case-insensitive (ext4 casefold), "+
+			"encrypted file names would collide", args.cipherdir)
+		os.Exit(exitcodes.CipherDir)
+	}
 	// "-config"
 	if args.config != "" {
 		args.config, err = filepath.Abs(args.config)
@@ -184,6 +345,35 @@ func main() {
 	} else {
 		args.config = filepath.Join(args.cipherdir, configfile.ConfDefaultName)
 	}
+	// "-tmpdir"
+	if args.tmpdir != "" {
+		fi, err := os.Stat(args.tmpdir)
+		if err != nil || !fi.IsDir() {
+			tlog.Fatal.Printf("Invalid \"-tmpdir\" setting: %q is not a directory", args.tmpdir)
+			os.Exit(exitcodes.Usage)
+		}
+		configfile.TmpDir = args.tmpdir
+	}
+	configfile.AcceptUnknownFlags = args.acceptunknownflags
+	// "-reverse-exclude-from"
+	if args.reverse_exclude_from != "" {
+		args._excludePatterns, err = readExcludeFile(args.reverse_exclude_from)
+		if err != nil {
+			tlog.Fatal.Printf("Invalid \"-reverse-exclude-from\" setting: %v", err)
+			os.Exit(exitcodes.Usage)
+		}
+	}
+	// "-reverse-bind-mounts"
+	if args.reverse {
+		args._hiddenMounts, err = fusefrontend_reverse.FindBindMounts(args.cipherdir, args.reverse_bind_mounts)
+		if err != nil {
+			tlog.Fatal.Printf("-reverse-bind-mounts: could not read the mount table: %v", err)
+			os.Exit(exitcodes.Usage)
+		}
+		for _, m := range args._hiddenMounts {
+			tlog.Info.Printf("Hiding bind mount %q", m)
+		}
+	}
 	// "-force_owner"
 	if args.force_owner != "" {
 		var uidNum, gidNum int64
@@ -204,6 +394,14 @@ func main() {
 		}
 		args._forceOwner = &fuse.Owner{Uid: uint32(uidNum), Gid: uint32(gidNum)}
 	}
+	// Exit code of doMount(). The deferred function is registered before the
+	// profile writers below so that it runs after them.
+	var ret int
+	defer func() {
+		if ret != 0 {
+			os.Exit(ret)
+		}
+	}()
 	// "-cpuprofile"
 	if args.cpuprofile != "" {
 		onExitFunc := setupCpuprofile(args.cpuprofile)
@@ -220,7 +418,7 @@ func main() {
 		defer onExitFunc()
 	}
 	if args.cpuprofile != "" || args.memprofile != "" || args.trace != "" {
-		tlog.Info.Printf("Note: You must unmount gracefully, otherwise the profile file(s) will stay empty!\n")
+		tlog.Info.Printf("Note: You must unmount gracefully or stop gocryptfs with SIGINT/SIGTERM, otherwise the profile file(s) will stay empty!\n")
 	}
 	// "-openssl"
 	if !args.openssl {
@@ -229,8 +427,10 @@ func main() {
 		tlog.Debug.Printf("OpenSSL enabled")
 	}
 	// Operation flags
-	if args.info && args.init || args.info && args.passwd || args.passwd && args.init {
-		tlog.Fatal.Printf("At most one of -info, -init, -passwd is allowed")
+	if args.info && args.init || args.info && args.passwd || args.passwd && args.init ||
+		args.detect && (args.info || args.init || args.passwd) ||
+		args.fsck && (args.info || args.detect || args.init || args.passwd) {
+		tlog.Fatal.Printf("At most one of -info, -detect, -init, -passwd, -fsck is allowed")
 		os.Exit(exitcodes.Usage)
 	}
 	// "-info"
@@ -239,7 +439,15 @@ func main() {
 			tlog.Fatal.Printf("Usage: %s -info CIPHERDIR", tlog.ProgramName)
 			os.Exit(exitcodes.Usage)
 		}
-		info(args.config) // does not return
+		info(args.config, gcmBackend(&args)) // does not return
+	}
+	// "-detect"
+	if args.detect {
+		if flagSet.NArg() > 1 {
+			tlog.Fatal.Printf("Usage: %s -detect CIPHERDIR", tlog.ProgramName)
+			os.Exit(exitcodes.Usage)
+		}
+		detect(args.cipherdir) // does not return
 	}
 	// "-init"
 	if args.init {
@@ -257,6 +465,66 @@ func main() {
 		}
 		changePassword(&args) // does not return
 	}
+	// "-check-password"
+	if args.check_password {
+		if flagSet.NArg() != 1 {
+			tlog.Fatal.Printf("Usage: %s -check-password [OPTIONS] CIPHERDIR", tlog.ProgramName)
+			os.Exit(exitcodes.Usage)
+		}
+		checkPassword(&args) // does not return
+	}
+	// "-setflag", "-unsetflag"
+	if args.setflag != "" || args.unsetflag != "" {
+		if flagSet.NArg() != 1 {
+			tlog.Fatal.Printf("Usage: %s -setflag|-unsetflag FLAG [OPTIONS] CIPHERDIR", tlog.ProgramName)
+			os.Exit(exitcodes.Usage)
+		}
+		if args.setflag != "" {
+			setFeatureFlag(&args, args.setflag, true) // does not return
+		}
+		setFeatureFlag(&args, args.unsetflag, false) // does not return
+	}
+	// "-fsck"
+	if args.fsck {
+		if flagSet.NArg() != 1 {
+			tlog.Fatal.Printf("Usage: %s -fsck [OPTIONS] CIPHERDIR", tlog.ProgramName)
+			os.Exit(exitcodes.Usage)
+		}
+		fsck(&args) // does not return
+	}
+	// "-reverse-test"
+	if args.reverse_test {
+		if flagSet.NArg() != 1 {
+			tlog.Fatal.Printf("Usage: %s -reverse-test [OPTIONS] SOURCEDIR", tlog.ProgramName)
+			os.Exit(exitcodes.Usage)
+		}
+		reverseTest(args.cipherdir) // does not return
+	}
+	// "-reverse-index"
+	if args.reverse_index != "" {
+		if flagSet.NArg() != 1 {
+			tlog.Fatal.Printf("Usage: %s -reverse -reverse-index STATEDIR [OPTIONS] SOURCEDIR", tlog.ProgramName)
+			os.Exit(exitcodes.Usage)
+		}
+		reverseIndex(&args) // does not return
+	}
+	// "-export-subtree"
+	if args.export_subtree != "" {
+		if flagSet.NArg() != 2 {
+			tlog.Fatal.Printf("Usage: %s -export-subtree PLAINTEXTPATH [OPTIONS] CIPHERDIR DEST", tlog.ProgramName)
+			os.Exit(exitcodes.Usage)
+		}
+		dest, _ := filepath.Abs(flagSet.Arg(1))
+		exportSubtree(&args, dest) // does not return
+	}
+	// "-encrypt-name", "-decrypt-name"
+	if args.encrypt_name != "" || args.decrypt_name != "" {
+		if flagSet.NArg() != 1 || (args.encrypt_name != "" && args.decrypt_name != "") {
+			tlog.Fatal.Printf("Usage: %s -encrypt-name PLAINTEXTPATH|-decrypt-name CIPHERTEXTPATH [OPTIONS] CIPHERDIR", tlog.ProgramName)
+			os.Exit(exitcodes.Usage)
+		}
+		translateName(&args) // does not return
+	}
 	// Default operation: mount.
 	if flagSet.NArg() != 2 {
 		prettyArgs := prettyArgs()
@@ -265,10 +533,6 @@ func main() {
 		tlog.Fatal.Printf("Usage: %s [OPTIONS] CIPHERDIR MOUNTPOINT [-o COMMA-SEPARATED-OPTIONS]", tlog.ProgramName)
 		os.Exit(exitcodes.Usage)
 	}
-	ret := doMount(&args)
-	if ret != 0 {
-		os.Exit(ret)
-	}
-	// Don't call os.Exit on success to give deferred functions a chance to
-	// run
+	// Don't call os.Exit here to give the deferred functions a chance to run
+	ret = doMount(&args)
 }
@@ -0,0 +1,36 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/rfjakob/gocryptfs/internal/syscallcompat"
+)
+
+// A case-insensitive CIPHERDIR must be refused unless no encrypted names are
+// stored in it
+func TestCasefoldCollision(t *testing.T) {
+	defer func() { isCasefold = syscallcompat.IsCasefold }()
+	testcases := []struct {
+		casefold       bool
+		reverse        bool
+		plaintextnames bool
+		want           bool
+	}{
+		{false, false, false, false},
+		{true, false, false, true},
+		{true, true, false, false},
+		{true, false, true, false},
+	}
+	for _, tc := range testcases {
+		isCasefold = func(dir string) (bool, error) {
+			if dir != "/cipher" {
+				t.Errorf("wrong dir %q", dir)
+			}
+			return tc.casefold, nil
+		}
+		args := argContainer{cipherdir: "/cipher", reverse: tc.reverse, plaintextnames: tc.plaintextnames}
+		if have := casefoldCollision(&args); have != tc.want {
+			t.Errorf("%+v: want %v, have %v", tc, tc.want, have)
+		}
+	}
+}
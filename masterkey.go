@@ -1,7 +1,10 @@
 package main
 
 import (
+	"crypto/sha256"
 	"encoding/hex"
+	"fmt"
+	"io/ioutil"
 	"os"
 	"strings"
 
@@ -44,22 +47,94 @@ paper and store it in a drawer. Use "-q" to suppress this message.
 `, tlog.ColorGrey+hChunked+tlog.ColorReset)
 }
 
+// explicitMasterKey returns the master key passed via "-masterkey" or
+// "-masterkey-file", or nil if there is none.
+// Calls os.Exit on failure
+func explicitMasterKey(args *argContainer) []byte {
+	if args.masterkey != "" {
+		return parseMasterKey(args.masterkey)
+	}
+	if args.masterkey_file != "" {
+		return readMasterKeyFile(args.masterkey_file)
+	}
+	return nil
+}
+
 // parseMasterKey - Parse a hex-encoded master key that was passed on the command line
 // Calls os.Exit on failure
 func parseMasterKey(masterkey string) []byte {
-	masterkey = strings.Replace(masterkey, "-", "", -1)
-	key, err := hex.DecodeString(masterkey)
+	key, err := decodeMasterKey([]byte(masterkey))
 	if err != nil {
 		tlog.Fatal.Printf("Could not parse master key: %v", err)
 		os.Exit(exitcodes.MasterKey)
 	}
-	if len(key) != cryptocore.KeyLen {
-		tlog.Fatal.Printf("Master key has length %d but we require length %d", len(key), cryptocore.KeyLen)
-		os.Exit(exitcodes.MasterKey)
-	}
 	tlog.Info.Printf("Using explicit master key.")
 	tlog.Info.Printf(tlog.ColorYellow +
 		"THE MASTER KEY IS VISIBLE VIA \"ps ax\" AND MAY BE STORED IN YOUR SHELL HISTORY!\n" +
 		"ONLY USE THIS MODE FOR EMERGENCIES." + tlog.ColorReset)
 	return key
 }
+
+// readMasterKeyFile reads a hex-encoded master key from the file "path"
+// ("-masterkey-file"). Other than the key, the file may only contain dashes
+// and one trailing newline.
+// Calls os.Exit on failure
+func readMasterKeyFile(path string) []byte {
+	buf, err := ioutil.ReadFile(path)
+	if err != nil {
+		tlog.Fatal.Printf("Could not read master key file: %v", err)
+		os.Exit(exitcodes.MasterKey)
+	}
+	key, err := decodeMasterKey(buf)
+	cryptocore.Wipe(buf)
+	if err != nil {
+		tlog.Fatal.Printf("Could not parse master key file %q: %v", path, err)
+		os.Exit(exitcodes.MasterKey)
+	}
+	tlog.Info.Printf("Using master key from file %q.", path)
+	return key
+}
+
+// decodeMasterKey decodes the hex-encoded master key "h", as printed by
+// printMasterKey. Dashes are ignored, one trailing newline is allowed.
+func decodeMasterKey(h []byte) ([]byte, error) {
+	if n := len(h); n > 0 && h[n-1] == '\n' {
+		h = h[:n-1]
+	}
+	clean := make([]byte, 0, len(h))
+	for _, c := range h {
+		if c != '-' {
+			clean = append(clean, c)
+		}
+	}
+	defer cryptocore.Wipe(clean)
+	key := make([]byte, hex.DecodedLen(len(clean)))
+	_, err := hex.Decode(key, clean)
+	if err == nil && len(key) != cryptocore.KeyLen {
+		err = fmt.Errorf("master key has length %d but we require length %d", len(key), cryptocore.KeyLen)
+	}
+	if err != nil {
+		cryptocore.Wipe(key)
+		return nil, err
+	}
+	return key, nil
+}
+
+// masterKeyFingerprint returns a short, non-secret identifier for "key":
+// the first 16 bytes of its SHA256 hash, hex-encoded.
+func masterKeyFingerprint(key []byte) string {
+	h := sha256.Sum256(key)
+	return hex.EncodeToString(h[:16])
+}
+
+// checkFingerprint compares the fingerprint of "key" against "expect" (as
+// passed via "-expect-fingerprint"). Dashes and case are ignored.
+// Calls os.Exit on mismatch.
+func checkFingerprint(key []byte, expect string) {
+	expect = strings.ToLower(strings.Replace(expect, "-", "", -1))
+	have := masterKeyFingerprint(key)
+	if expect != have {
+		tlog.Fatal.Printf("Master key fingerprint mismatch: expected %s, have %s", expect, have)
+		os.Exit(exitcodes.FingerprintMismatch)
+	}
+}
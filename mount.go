@@ -3,6 +3,8 @@ package main
 import (
 	"encoding/json"
 	"fmt"
+	"io"
+	"io/ioutil"
 	"log/syslog"
 	"net"
 	"os"
@@ -13,6 +15,7 @@ import (
 	"runtime"
 	"runtime/debug"
 	"strings"
+	"sync/atomic"
 	"syscall"
 	"time"
 
@@ -40,30 +43,40 @@ func doMount(args *argContainer) int {
 		tlog.Fatal.Printf("Invalid mountpoint: %v", err)
 		os.Exit(exitcodes.MountPoint)
 	}
+	// If the mountpoint is a symlink (or inside a symlinked directory), mount
+	// on the real directory. The kernel would follow the symlink anyway, but
+	// the checks below and the unmount on exit must see the real path.
+	if realMnt, err2 := filepath.EvalSymlinks(args.mountpoint); err2 == nil && realMnt != args.mountpoint {
+		tlog.Info.Printf("Mountpoint %q is a symlink, mounting on %q", args.mountpoint, realMnt)
+		args.mountpoint = realMnt
+	}
+	realCipherdir := args.cipherdir
+	if d, err2 := filepath.EvalSymlinks(args.cipherdir); err2 == nil {
+		realCipherdir = d
+	}
 	// We cannot mount "/home/user/.cipher" at "/home/user" because the mount
 	// will hide ".cipher" also for us.
-	if args.cipherdir == args.mountpoint || strings.HasPrefix(args.cipherdir, args.mountpoint+"/") {
+	if realCipherdir == args.mountpoint || strings.HasPrefix(realCipherdir, args.mountpoint+"/") {
 		tlog.Fatal.Printf("Mountpoint %q would shadow cipherdir %q, this is not supported",
 			args.mountpoint, args.cipherdir)
 		os.Exit(exitcodes.MountPoint)
 	}
 	// Reverse-mounting "/foo" at "/foo/mnt" means we would be recursively
 	// encrypting ourselves.
-	if strings.HasPrefix(args.mountpoint, args.cipherdir+"/") {
+	if strings.HasPrefix(args.mountpoint, realCipherdir+"/") {
 		tlog.Fatal.Printf("Mountpoint %q is contained in cipherdir %q, this is not supported",
 			args.mountpoint, args.cipherdir)
 		os.Exit(exitcodes.MountPoint)
 	}
-	if args.nonempty {
-		err = checkDir(args.mountpoint)
-	} else {
-		err = checkDirEmpty(args.mountpoint)
-		// OSXFuse will create the mountpoint for us ( https://github.com/rfjakob/gocryptfs/issues/194 )
-		if runtime.GOOS == "darwin" && os.IsNotExist(err) {
-			tlog.Info.Printf("Mountpoint %q does not exist, but should be created by OSXFuse",
-				args.mountpoint)
-			err = nil
-		}
+	err = checkMountpoint(args)
+	if isStaleMount(err) {
+		tlog.Fatal.Printf("Mountpoint %q looks like a stale FUSE mount (%v). "+
+			"Unmount it using \"fusermount -u -z\".", args.mountpoint, err)
+		os.Exit(exitcodes.MountPoint)
+	}
+	if _, ok := err.(*dirNotEmptyError); ok {
+		tlog.Fatal.Printf("Invalid mountpoint: %v. Pass \"-nonempty\" to mount over the files in it.", err)
+		os.Exit(exitcodes.MountPoint)
 	}
 	if err != nil {
 		tlog.Fatal.Printf("Invalid mountpoint: %v", err)
@@ -90,12 +103,17 @@ func doMount(args *argContainer) int {
 			}
 		}()
 	}
+	// Refuse a second read-write mount of the same CIPHERDIR before asking
+	// the user for the password. The lock is held until we exit.
+	if lock := lockCipherdir(args); lock != nil {
+		defer lock.Close()
+	}
 	// Get master key (may prompt for the password)
 	var masterkey []byte
 	var confFile *configfile.ConfFile
-	if args.masterkey != "" {
-		// "-masterkey"
-		masterkey = parseMasterKey(args.masterkey)
+	if args.masterkey != "" || args.masterkey_file != "" {
+		// "-masterkey" or "-masterkey-file"
+		masterkey = explicitMasterKey(args)
 	} else if args.zerokey {
 		// "-zerokey"
 		tlog.Info.Printf("Using all-zero dummy master key.")
@@ -117,18 +135,29 @@ func doMount(args *argContainer) int {
 		readpassword.CheckTrailingGarbage()
 		printMasterKey(masterkey)
 	}
+	tlog.Info.Printf("Master key fingerprint: %s", masterKeyFingerprint(masterkey))
+	// "-expect-fingerprint"
+	if args.expect_fingerprint != "" {
+		checkFingerprint(masterkey, args.expect_fingerprint)
+	}
 	// We cannot use JSON for pretty-printing as the fields are unexported
 	tlog.Debug.Printf("cli args: %#v", args)
 	// Initialize FUSE server
 	srv := initFuseFrontend(masterkey, args, confFile)
 	tlog.Info.Println(tlog.ColorGreen + "Filesystem mounted and ready." + tlog.ColorReset)
+	if args.status_json {
+		printStatusJSON(os.Stdout, args, "mounted")
+	}
 	// We have been forked into the background, as evidenced by the set
 	// "notifypid".
 	if args.notifypid > 0 {
 		// Chdir to the root directory so we don't block unmounting the CWD
 		os.Chdir("/")
-		// Switch to syslog
-		if !args.nosyslog {
+		if args._logfile != nil {
+			// Send everything, including stdout and stderr, to the logfile
+			redirectStdFdsToFile(args._logfile.File())
+			tlog.Fatal.SetOutput(args._logfile)
+		} else if !args.nosyslog {
 			// Switch all of our logs and the generic logger to syslog
 			tlog.Info.SwitchToSyslog(syslog.LOG_USER | syslog.LOG_INFO)
 			tlog.Debug.SwitchToSyslog(syslog.LOG_USER | syslog.LOG_DEBUG)
@@ -154,14 +183,47 @@ func doMount(args *argContainer) int {
 	// This prevents a dangling "Transport endpoint is not connected"
 	// mountpoint if the user hits CTRL-C.
 	handleSigint(srv, args.mountpoint)
+	handleSighup(args)
 	// Return memory that was allocated for scrypt (64M by default!) and other
 	// stuff that is no longer needed to the OS
 	debug.FreeOSMemory()
+	// The filesystem is already mounted. Requests that arrive before
+	// srv.Serve() starts wait in the kernel queue.
+	sdNotify("READY=1")
 	// Jump into server loop. Returns when it gets an umount request from the kernel.
 	srv.Serve()
+	sdNotify("STOPPING=1")
+	if args.status_json {
+		printStatusJSON(os.Stdout, args, "unmounted")
+	}
+	if atomic.LoadInt32(&gotSigint) != 0 {
+		return exitcodes.SigInt
+	}
 	return 0
 }
 
+// statusEvent is printed by "-status-json"
+type statusEvent struct {
+	// Event is "mounted" or "unmounted"
+	Event      string `json:"event"`
+	Cipherdir  string `json:"cipherdir"`
+	Mountpoint string `json:"mountpoint"`
+	// Pid is the process that serves the filesystem
+	Pid int `json:"pid"`
+}
+
+// printStatusJSON writes "event" as a single JSON line to "w". Unlike the
+// log messages, this is not affected by "-q".
+func printStatusJSON(w io.Writer, args *argContainer, event string) {
+	j, _ := json.Marshal(statusEvent{
+		Event:      event,
+		Cipherdir:  args.cipherdir,
+		Mountpoint: args.mountpoint,
+		Pid:        os.Getpid(),
+	})
+	w.Write(append(j, '\n'))
+}
+
 // setOpenFileLimit tries to increase the open file limit to 4096 (the default hard
 // limit on Linux).
 func setOpenFileLimit() {
@@ -182,11 +244,10 @@ func setOpenFileLimit() {
 	}
 }
 
-// initFuseFrontend - initialize gocryptfs/fusefrontend
+// makeFrontendArgs reconciliates CLI and config file arguments into a
+// fusefrontend.Args struct that is passed to the filesystem implementation.
 // Calls os.Exit on errors
-func initFuseFrontend(masterkey []byte, args *argContainer, confFile *configfile.ConfFile) *fuse.Server {
-	// Reconciliate CLI and config file arguments into a fusefrontend.Args struct
-	// that is passed to the filesystem implementation
+func makeFrontendArgs(args *argContainer, confFile *configfile.ConfFile) fusefrontend.Args {
 	cryptoBackend := cryptocore.BackendGoGCM
 	if args.openssl {
 		cryptoBackend = cryptocore.BackendOpenSSL
@@ -200,17 +261,30 @@ func initFuseFrontend(masterkey []byte, args *argContainer, confFile *configfile
 		args.allow_other = true
 	}
 	frontendArgs := fusefrontend.Args{
-		Cipherdir:      args.cipherdir,
-		PlaintextNames: args.plaintextnames,
-		LongNames:      args.longnames,
-		CryptoBackend:  cryptoBackend,
-		ConfigCustom:   args._configCustom,
-		Raw64:          args.raw64,
-		NoPrealloc:     args.noprealloc,
-		HKDF:           args.hkdf,
-		SerializeReads: args.serialize_reads,
-		ForceDecode:    args.forcedecode,
-		ForceOwner:     args._forceOwner,
+		Cipherdir:         args.cipherdir,
+		PlaintextNames:    args.plaintextnames,
+		LongNames:         args.longnames,
+		CryptoBackend:     cryptoBackend,
+		ConfigCustom:      args._configCustom,
+		Raw64:             args.raw64,
+		NoPrealloc:        args.noprealloc,
+		HKDF:              args.hkdf,
+		SerializeReads:    args.serialize_reads,
+		ForceDecode:       args.forcedecode,
+		ForceOwner:        args._forceOwner,
+		VerifyAfterWrite:  args.verify_after_write,
+		ReadOnly:          args.ro,
+		StrictSync:        args.strict_sync,
+		Progress:          args.progress,
+		ExcludePatterns:   args._excludePatterns,
+		HiddenPaths:       args._hiddenMounts,
+		DirIVCacheSize:    args.diriv_cache_size,
+		BlockCache:        args.blockcache,
+		ReadAhead:         args.readahead,
+		PanicOnCorruption: args.panic_on_corruption,
+		Sparse:            args.sparse,
+		Seal:              args.reverse_seal,
+		CaseInsensitive:   args.caseinsensitive,
 	}
 	// confFile is nil when "-zerokey" or "-masterkey" was used
 	if confFile != nil {
@@ -224,16 +298,49 @@ func initFuseFrontend(masterkey []byte, args *argContainer, confFile *configfile
 			tlog.Fatal.Printf("AES-SIV is required by reverse mode, but not enabled in the config file")
 			os.Exit(exitcodes.Usage)
 		}
+		if args.reverse {
+			if err := fusefrontend_reverse.CheckReverseFormat(confFile.ReverseFormat); err != nil {
+				tlog.Fatal.Printf("%v. Please upgrade gocryptfs.", err)
+				os.Exit(exitcodes.Usage)
+			}
+			frontendArgs.ReverseFormat = confFile.ReverseFormat
+		}
+	}
+	// The seal file lists one name per line
+	if frontendArgs.Seal && frontendArgs.PlaintextNames {
+		tlog.Fatal.Printf("The -reverse-seal option does not work with -plaintextnames")
+		os.Exit(exitcodes.Usage)
+	}
+	if frontendArgs.CaseInsensitive && frontendArgs.PlaintextNames {
+		tlog.Fatal.Printf("The -caseinsensitive option does not work with -plaintextnames")
+		os.Exit(exitcodes.Usage)
 	}
 	// If allow_other is set and we run as root, try to give newly created files to
 	// the right user.
 	if args.allow_other && os.Getuid() == 0 {
-		frontendArgs.PreserveOwner = true
+		if rootSquashed(args.cipherdir) {
+			// Every chown would fail with EPERM
+			tlog.Warn.Printf("Root cannot write to CIPHERDIR, it is probably on NFS with root_squash. " +
+				"New files will be owned by the squashed user, and operations of local users that " +
+				"need root rights on CIPHERDIR will fail with EACCES.")
+		} else {
+			frontendArgs.PreserveOwner = true
+		}
 	}
+	return frontendArgs
+}
+
+// initFuseFrontend - initialize gocryptfs/fusefrontend
+// Calls os.Exit on errors
+func initFuseFrontend(masterkey []byte, args *argContainer, confFile *configfile.ConfFile) *fuse.Server {
+	frontendArgs := makeFrontendArgs(args, confFile)
+	tlog.Info.Printf("Crypto backend: %s", cryptocore.BackendDescription(frontendArgs.CryptoBackend))
 	jsonBytes, _ := json.MarshalIndent(frontendArgs, "", "\t")
 	tlog.Debug.Printf("frontendArgs: %s", string(jsonBytes))
 	var finalFs pathfs.FileSystem
 	var ctlSockBackend ctlsock.Interface
+	// lastAccess is used by "-idle" (forward mode only)
+	var lastAccess func() time.Time
 	// pathFsOpts are passed into go-fuse/pathfs
 	pathFsOpts := &pathfs.PathNodeFsOptions{ClientInodes: true}
 	if args.sharedstorage {
@@ -257,33 +364,87 @@ func initFuseFrontend(masterkey []byte, args *argContainer, confFile *configfile
 		fs := fusefrontend.NewFS(masterkey, frontendArgs)
 		finalFs = fs
 		ctlSockBackend = fs
+		lastAccess = fs.LastAccess
 	}
 	// fusefrontend / fusefrontend_reverse have initialized their crypto with
 	// derived keys (HKDF), we can purge the master key from memory.
-	for i := range masterkey {
-		masterkey[i] = 0
+	cryptocore.Wipe(masterkey)
+	pathFs := pathfs.NewPathNodeFs(finalFs, pathFsOpts)
+	// sharedstorage mode sets the cache timeouts to zero by default, see
+	// parseCliOpts
+	fuseOpts := &nodefs.Options{
+		NegativeTimeout: args.negative_timeout,
+		AttrTimeout:     args.attr_timeout,
+		EntryTimeout:    args.entry_timeout,
 	}
+	conn := nodefs.NewFileSystemConnector(pathFs.Root(), fuseOpts)
+	mOpts := makeMountOptions(args)
+	srv, err := fuse.NewServer(conn.RawFS(), args.mountpoint, &mOpts)
+	if err != nil {
+		tlog.Fatal.Printf("fuse.NewServer failed: %v", err)
+		if runtime.GOOS == "darwin" {
+			tlog.Info.Printf("Maybe you should run: /Library/Filesystems/osxfuse.fs/Contents/Resources/load_osxfuse")
+		}
+		os.Exit(exitcodes.FuseNewServer)
+	}
+	srv.SetDebug(args.fusedebug)
 	// We have opened the socket early so that we cannot fail here after
 	// asking the user for the password
 	if args._ctlsockFd != nil {
-		go ctlsock.Serve(args._ctlsockFd, ctlSockBackend)
-	}
-	pathFs := pathfs.NewPathNodeFs(finalFs, pathFsOpts)
-	var fuseOpts *nodefs.Options
-	if args.sharedstorage {
-		// sharedstorage mode sets all cache timeouts to zero so changes to the
-		// backing shared storage show up immediately.
-		fuseOpts = &nodefs.Options{}
-	} else {
-		fuseOpts = &nodefs.Options{
-			// These options are to be compatible with libfuse defaults,
-			// making benchmarking easier.
-			NegativeTimeout: time.Second,
-			AttrTimeout:     time.Second,
-			EntryTimeout:    time.Second,
+		info := &ctlsock.MountInfo{
+			Cipherdir:  args.cipherdir,
+			Mountpoint: args.mountpoint,
+			Start:      time.Now(),
+			Unmount:    srv.Unmount,
 		}
+		if fs, ok := ctlSockBackend.(*fusefrontend.FS); ok {
+			info.Stats = fs.Stats
+		}
+		go ctlsock.Serve(args._ctlsockFd, ctlSockBackend, info)
 	}
-	conn := nodefs.NewFileSystemConnector(pathFs.Root(), fuseOpts)
+	if args.idle > 0 && lastAccess != nil {
+		go idleMonitor(args.idle, lastAccess, srv)
+	}
+
+	// All FUSE file and directory create calls carry explicit permission
+	// information. We need an unrestricted umask to create the files and
+	// directories with the requested permissions.
+	// The umask of the calling process is not lost: we do not request
+	// FUSE_DONT_MASK, so the kernel applies it to the mode before it
+	// reaches us ("mkdir 0777" with umask 022 gives 0755). Our own umask
+	// would mask the mode a second time.
+	syscall.Umask(0000)
+
+	return srv
+}
+
+// checkMountpoint checks that args.mountpoint is an empty directory, or just a
+// directory with "-nonempty".
+func checkMountpoint(args *argContainer) error {
+	if args.nonempty {
+		return checkDir(args.mountpoint)
+	}
+	err := checkDirEmpty(args.mountpoint)
+	// OSXFuse will create the mountpoint for us ( https://github.com/rfjakob/gocryptfs/issues/194 )
+	if runtime.GOOS == "darwin" && os.IsNotExist(err) {
+		tlog.Info.Printf("Mountpoint %q does not exist, but should be created by OSXFuse",
+			args.mountpoint)
+		return nil
+	}
+	return err
+}
+
+const (
+	// fuseName and fuseNameReverse are the filesystem types we mount as,
+	// prefixed with "fuse." by the kernel
+	fuseName        = "gocryptfs"
+	fuseNameReverse = "gocryptfs-reverse"
+)
+
+// makeMountOptions builds the options passed to fusermount and the kernel.
+// "fsname" and "Name" end up in the "source" and "type" fields of
+// /proc/self/mountinfo.
+func makeMountOptions(args *argContainer) fuse.MountOptions {
 	mOpts := fuse.MountOptions{
 		// Writes and reads are usually capped at 128kiB on Linux through
 		// the FUSE_MAX_PAGES_PER_REQ kernel constant in fuse_i.h. Our
@@ -298,6 +459,12 @@ func initFuseFrontend(masterkey []byte, args *argContainer, confFile *configfile
 		tlog.Info.Printf(tlog.ColorYellow + "The option \"-allow_other\" is set. Make sure the file " +
 			"permissions protect your data from unwanted access." + tlog.ColorReset)
 		mOpts.AllowOther = true
+		if os.Getuid() != 0 && !fuseConfAllowsOther(fuseConf) {
+			tlog.Warn.Printf("-allow_other: %s does not contain \"user_allow_other\", "+
+				"fusermount will refuse to mount", fuseConf)
+		}
+	}
+	if args.allow_other || args.default_permissions {
 		// Make the kernel check the file permissions for us
 		mOpts.Options = append(mOpts.Options, "default_permissions")
 	}
@@ -314,11 +481,11 @@ func initFuseFrontend(masterkey []byte, args *argContainer, confFile *configfile
 	if args.fsname != "" {
 		fsname = args.fsname
 	}
-	mOpts.Options = append(mOpts.Options, "fsname="+fsname)
+	mOpts.Options = append(mOpts.Options, "fsname="+escapeMountOption(fsname))
 	// Second column, "Type", will be shown as "fuse." + Name
-	mOpts.Name = "gocryptfs"
+	mOpts.Name = fuseName
 	if args.reverse {
-		mOpts.Name += "-reverse"
+		mOpts.Name = fuseNameReverse
 	}
 
 	// Add a volume name if running osxfuse. Otherwise the Finder will show it as
@@ -339,42 +506,138 @@ func initFuseFrontend(masterkey []byte, args *argContainer, confFile *configfile
 		tlog.Debug.Printf("Adding -ko mount options: %v", parts)
 		mOpts.Options = append(mOpts.Options, parts...)
 	}
-	srv, err := fuse.NewServer(conn.RawFS(), args.mountpoint, &mOpts)
-	if err != nil {
-		tlog.Fatal.Printf("fuse.NewServer failed: %v", err)
-		if runtime.GOOS == "darwin" {
-			tlog.Info.Printf("Maybe you should run: /Library/Filesystems/osxfuse.fs/Contents/Resources/load_osxfuse")
+	return mOpts
+}
+
+// escapeMountOption escapes backslashes and commas in the value of a mount
+// option so that fusermount does not split it into several options.
+func escapeMountOption(v string) string {
+	v = strings.Replace(v, "\\", "\\\\", -1)
+	return strings.Replace(v, ",", "\\,", -1)
+}
+
+// idleMonitor unmounts the filesystem once lastAccess() is longer than
+// "timeout" ago. If the unmount fails, for example because files are still
+// open, it tries again later.
+func idleMonitor(timeout time.Duration, lastAccess func() time.Time, srv *fuse.Server) {
+	// Check often enough that we do not overshoot the timeout by more
+	// than 10%, but at least once a minute
+	interval := timeout / 10
+	if interval > time.Minute {
+		interval = time.Minute
+	}
+	for {
+		time.Sleep(interval)
+		idle := time.Since(lastAccess())
+		if idle < timeout {
+			continue
 		}
-		os.Exit(exitcodes.FuseNewServer)
+		tlog.Info.Printf("Filesystem has been idle for %v, unmounting", idle/time.Second*time.Second)
+		err := srv.Unmount()
+		if err == nil {
+			return
+		}
+		tlog.Info.Printf("Idle unmount failed, retrying later: %v", err)
 	}
-	srv.SetDebug(args.fusedebug)
+}
 
-	// All FUSE file and directory create calls carry explicit permission
-	// information. We need an unrestricted umask to create the files and
-	// directories with the requested permissions.
-	syscall.Umask(0000)
+// rootSquashed returns true if we run as root and cannot write to "dir" even
+// though it is not read-only. This is what NFS with root_squash looks like.
+func rootSquashed(dir string) bool {
+	if os.Getuid() != 0 {
+		return false
+	}
+	err := syscall.Access(dir, 2 /* W_OK */)
+	return err == syscall.EACCES
+}
 
-	return srv
+// fuseConf is the config file of fusermount
+const fuseConf = "/etc/fuse.conf"
+
+// fuseConfAllowsOther returns true if the fuse.conf at "path" contains the
+// "user_allow_other" option. Non-root users need it for "-allow_other".
+// Returns true if the file cannot be read, because then we do not know.
+func fuseConfAllowsOther(path string) bool {
+	content, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return false
+	} else if err != nil {
+		return true
+	}
+	for _, line := range strings.Split(string(content), "\n") {
+		if strings.TrimSpace(line) == "user_allow_other" {
+			return true
+		}
+	}
+	return false
 }
 
+// gotSigint is set to 1 by handleSigint when we got SIGINT or SIGTERM.
+var gotSigint int32
+
+// handleSigint unmounts the filesystem when we get SIGINT or SIGTERM. If the
+// unmount works, srv.Serve() returns and doMount returns exitcodes.SigInt,
+// which gives main() the chance to run its deferred functions (that write
+// the profiles). If it does not work, we fall back to a lazy unmount and exit
+// immediately.
 func handleSigint(srv *fuse.Server, mountpoint string) {
 	ch := make(chan os.Signal, 1)
 	signal.Notify(ch, os.Interrupt)
 	signal.Notify(ch, syscall.SIGTERM)
 	go func() {
 		<-ch
-		err := srv.Unmount()
-		if err != nil {
-			tlog.Warn.Print(err)
-			if runtime.GOOS == "linux" {
-				// MacOSX does not support lazy unmount
-				tlog.Info.Printf("Trying lazy unmount")
-				cmd := exec.Command("fusermount", "-u", "-z", mountpoint)
-				cmd.Stdout = os.Stdout
-				cmd.Stderr = os.Stderr
-				cmd.Run()
-			}
+		atomic.StoreInt32(&gotSigint, 1)
+		sdNotify("STOPPING=1")
+		if clean, _ := unmountOrLazy(srv.Unmount, mountpoint); clean {
+			return
 		}
 		os.Exit(exitcodes.SigInt)
 	}()
 }
+
+// handleSighup reopens the syslog connection or the "-logfile" when we get
+// SIGHUP, which is what log rotation tools send.
+func handleSighup(args *argContainer) {
+	ch := make(chan os.Signal, 1)
+	signal.Notify(ch, syscall.SIGHUP)
+	go func() {
+		for range ch {
+			err := tlog.Reopen()
+			if err != nil {
+				tlog.Warn.Printf("Reopening logs: %v", err)
+				continue
+			}
+			// In the background, stdout and stderr also point to the logfile
+			if args._logfile != nil && !args.fg {
+				redirectStdFdsToFile(args._logfile.File())
+			}
+			tlog.Debug.Printf("Reopened logs after SIGHUP")
+		}
+	}()
+}
+
+// unmountOrLazy calls "unmount". If that fails, it falls back to a lazy
+// unmount of "mountpoint" on Linux (MacOSX does not support lazy unmount).
+// Returns whether the first attempt worked, and the error of the last
+// attempt.
+func unmountOrLazy(unmount func() error, mountpoint string) (clean bool, err error) {
+	err = unmount()
+	if err == nil {
+		return true, nil
+	}
+	tlog.Warn.Print(err)
+	if runtime.GOOS == "linux" {
+		tlog.Info.Printf("Trying lazy unmount")
+		err = lazyUnmount(mountpoint)
+	}
+	return false, err
+}
+
+// lazyUnmount runs "fusermount -u -z" on "mountpoint". Errors are printed by
+// fusermount.
+func lazyUnmount(mountpoint string) error {
+	cmd := exec.Command("fusermount", "-u", "-z", mountpoint)
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	return cmd.Run()
+}
@@ -0,0 +1,149 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"syscall"
+	"testing"
+
+	"github.com/rfjakob/gocryptfs/internal/mountinfo"
+)
+
+func TestFuseConfAllowsOther(t *testing.T) {
+	dir, err := ioutil.TempDir("", "gocryptfs_fuseconf")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	testcases := []struct {
+		content string
+		want    bool
+	}{
+		{"", false},
+		{"# mount_max = 1000\n#user_allow_other\n", false},
+		{"mount_max = 1000\nuser_allow_other\n", true},
+		{"  user_allow_other  ", true},
+	}
+	fn := dir + "/fuse.conf"
+	for _, tc := range testcases {
+		if err = ioutil.WriteFile(fn, []byte(tc.content), 0600); err != nil {
+			t.Fatal(err)
+		}
+		if have := fuseConfAllowsOther(fn); have != tc.want {
+			t.Errorf("%q: want %v, have %v", tc.content, tc.want, have)
+		}
+	}
+	if fuseConfAllowsOther(dir + "/missing") {
+		t.Error("missing file should not allow other")
+	}
+}
+
+// hasOption returns true if "opt" is one of the mount options
+func hasOption(mOpts []string, opt string) bool {
+	for _, o := range mOpts {
+		if o == opt {
+			return true
+		}
+	}
+	return false
+}
+
+func TestMakeMountOptionsFsname(t *testing.T) {
+	args := &argContainer{cipherdir: "/home/user/cipher"}
+	mOpts := makeMountOptions(args)
+	if !hasOption(mOpts.Options, "fsname=/home/user/cipher") {
+		t.Errorf("default fsname missing: %v", mOpts.Options)
+	}
+	if mOpts.Name != "gocryptfs" {
+		t.Errorf("wrong name %q", mOpts.Name)
+	}
+	args.fsname = "myvault"
+	args.reverse = true
+	mOpts = makeMountOptions(args)
+	if !hasOption(mOpts.Options, "fsname=myvault") {
+		t.Errorf("custom fsname missing: %v", mOpts.Options)
+	}
+	if hasOption(mOpts.Options, "fsname=/home/user/cipher") {
+		t.Errorf("cipherdir still used as fsname: %v", mOpts.Options)
+	}
+	if mOpts.Name != "gocryptfs-reverse" {
+		t.Errorf("wrong name %q", mOpts.Name)
+	}
+	// A comma must not split the option
+	args.fsname = `a,b\c`
+	mOpts = makeMountOptions(args)
+	if !hasOption(mOpts.Options, `fsname=a\,b\\c`) {
+		t.Errorf("fsname not escaped: %v", mOpts.Options)
+	}
+}
+
+// A non-empty mountpoint is only accepted with "-nonempty"
+func TestCheckMountpointNonempty(t *testing.T) {
+	dir, err := ioutil.TempDir("", "gocryptfs_mountpoint")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	args := &argContainer{mountpoint: dir}
+	if err = checkMountpoint(args); err != nil {
+		t.Fatalf("empty mountpoint rejected: %v", err)
+	}
+	if err = ioutil.WriteFile(dir+"/.Trash", nil, 0600); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := checkMountpoint(args).(*dirNotEmptyError); !ok {
+		t.Fatal("non-empty mountpoint accepted without -nonempty")
+	}
+	args.nonempty = true
+	if err = checkMountpoint(args); err != nil {
+		t.Fatalf("non-empty mountpoint rejected with -nonempty: %v", err)
+	}
+	// Other errors are not affected
+	args.mountpoint = dir + "/.Trash"
+	if checkMountpoint(args) == nil {
+		t.Error("file accepted as mountpoint")
+	}
+}
+
+func TestIsStaleMount(t *testing.T) {
+	if !isStaleMount(&os.PathError{Op: "stat", Path: "/mnt", Err: syscall.ENOTCONN}) {
+		t.Error("ENOTCONN not detected")
+	}
+	if isStaleMount(&os.PathError{Op: "stat", Path: "/mnt", Err: syscall.ENOENT}) || isStaleMount(nil) {
+		t.Error("false positive")
+	}
+}
+
+func TestIsGocryptfsMount(t *testing.T) {
+	mounts := []mountinfo.Entry{
+		{MountPoint: "/", FsType: "ext4"},
+		{MountPoint: "/mnt/a", FsType: "fuse.gocryptfs"},
+		{MountPoint: "/mnt/b", FsType: "fuse.gocryptfs-reverse"},
+		{MountPoint: "/mnt/c", FsType: "fuse.sshfs"},
+	}
+	for mnt, want := range map[string]bool{"/mnt/a": true, "/mnt/b": true, "/mnt/c": false, "/": false, "/mnt": false} {
+		if have := isGocryptfsMount(mounts, mnt); have != want {
+			t.Errorf("%s: want %v, have %v", mnt, want, have)
+		}
+	}
+}
+
+// The "-status-json" output must be a single line of JSON
+func TestPrintStatusJSON(t *testing.T) {
+	var buf bytes.Buffer
+	args := &argContainer{cipherdir: "/home/user/cipher", mountpoint: "/home/user/\"plain\""}
+	printStatusJSON(&buf, args, "mounted")
+	out := buf.String()
+	if bytes.Count(buf.Bytes(), []byte("\n")) != 1 || out[len(out)-1] != '\n' {
+		t.Fatalf("not a single line: %q", out)
+	}
+	var e statusEvent
+	if err := json.Unmarshal(buf.Bytes(), &e); err != nil {
+		t.Fatal(err)
+	}
+	if e.Event != "mounted" || e.Cipherdir != args.cipherdir || e.Mountpoint != args.mountpoint || e.Pid != os.Getpid() {
+		t.Errorf("wrong content: %+v", e)
+	}
+}
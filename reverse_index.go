@@ -0,0 +1,42 @@
+package main
+
+import (
+	"fmt"
+	"os"
+
+	"github.com/rfjakob/gocryptfs/internal/cryptocore"
+	"github.com/rfjakob/gocryptfs/internal/exitcodes"
+	"github.com/rfjakob/gocryptfs/internal/fusefrontend_reverse"
+	"github.com/rfjakob/gocryptfs/internal/readpassword"
+	"github.com/rfjakob/gocryptfs/internal/tlog"
+)
+
+// reverseIndex compares the encrypted view of the plaintext directory
+// args.cipherdir against the index in args.reverse_index, prints the changed
+// files to stdout and updates the index. Does not mount anything.
+// This is called when you pass the "-reverse-index" option.
+// Does not return.
+func reverseIndex(args *argContainer) {
+	if fi, err := os.Stat(args.reverse_index); err != nil || !fi.IsDir() {
+		tlog.Fatal.Printf("-reverse-index: %q is not a directory", args.reverse_index)
+		os.Exit(exitcodes.Usage)
+	}
+	masterkey, confFile, err := loadConfig(args)
+	if err != nil {
+		exitcodes.Exit(err)
+	}
+	readpassword.CheckTrailingGarbage()
+	rfs := fusefrontend_reverse.NewFS(masterkey, makeFrontendArgs(args, confFile))
+	cryptocore.Wipe(masterkey)
+	res, err := rfs.UpdateIndex(args.reverse_index)
+	if err != nil {
+		tlog.Fatal.Printf("-reverse-index: %v", err)
+		os.Exit(exitcodes.Other)
+	}
+	for _, p := range res.Changed {
+		fmt.Println(p)
+	}
+	tlog.Info.Printf("-reverse-index: %d files, %d changed, %d deleted, %d had to be read",
+		res.Files, len(res.Changed), len(res.Deleted), res.Hashed)
+	os.Exit(0)
+}
@@ -0,0 +1,206 @@
+package main
+
+import (
+	"bytes"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"runtime"
+
+	"github.com/rfjakob/gocryptfs/internal/configfile"
+	"github.com/rfjakob/gocryptfs/internal/exitcodes"
+	"github.com/rfjakob/gocryptfs/internal/tlog"
+)
+
+// reverseTest reverse-mounts the plaintext directory "src", forward-mounts
+// the encrypted view on top and compares the result with "src". Any
+// divergence in names, contents, modes or symlink targets is reported.
+// This is called when you pass the "-reverse-test" option.
+// Does not return.
+func reverseTest(src string) {
+	tmp, err := ioutil.TempDir("", "gocryptfs-reverse-test.")
+	if err != nil {
+		tlog.Fatal.Println(err)
+		os.Exit(exitcodes.Other)
+	}
+	cipher := filepath.Join(tmp, "cipher")
+	plain := filepath.Join(tmp, "plain")
+	for _, d := range []string{cipher, plain} {
+		if err = os.Mkdir(d, 0700); err != nil {
+			tlog.Fatal.Println(err)
+			os.Exit(exitcodes.Other)
+		}
+	}
+	// The mounts get the same options (password source, -config, ...) that
+	// we got
+	opts := reverseTestOpts()
+	ret := reverseTestMount(append([]string{"-reverse"}, opts...), src, cipher)
+	if ret != 0 {
+		os.RemoveAll(tmp)
+		os.Exit(ret)
+	}
+	ret = reverseTestMount(opts, cipher, plain)
+	if ret != 0 {
+		if reverseTestUnmount(cipher) {
+			os.RemoveAll(tmp)
+		}
+		os.Exit(ret)
+	}
+	n := reverseTestCompare(src, plain)
+	// Never delete "tmp" while something is still mounted inside
+	if reverseTestUnmount(plain) && reverseTestUnmount(cipher) {
+		os.RemoveAll(tmp)
+	}
+	if n > 0 {
+		tlog.Fatal.Printf("Reverse test: found %d divergence(s)", n)
+		os.Exit(exitcodes.ReverseTest)
+	}
+	tlog.Info.Printf(tlog.ColorGreen+"Reverse test: %q survived the round trip without divergences"+
+		tlog.ColorReset, src)
+	os.Exit(0)
+}
+
+// reverseTestOpts rebuilds the command line options that were set from the
+// parsed flagSet, without "-reverse-test", "-reverse" and "-fg".
+func reverseTestOpts() (out []string) {
+	flagSet.Visit(func(f *flag.Flag) {
+		switch f.Name {
+		case "reverse-test", "reverse", "fg", "f":
+			return
+		}
+		out = append(out, fmt.Sprintf("-%s=%s", f.Name, f.Value.String()))
+	})
+	return out
+}
+
+// reverseTestMount runs gocryptfs with the options "opts" to mount "from" on
+// "to". It returns once the filesystem is mounted and the child has gone to
+// the background.
+func reverseTestMount(opts []string, from string, to string) int {
+	cmd := exec.Command(os.Args[0], append(opts, from, to)...)
+	cmd.Stdin = os.Stdin
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	err := cmd.Run()
+	if err != nil {
+		tlog.Fatal.Printf("Reverse test: mounting %q on %q failed: %v", from, to, err)
+		return exitcodes.MountPoint
+	}
+	return 0
+}
+
+// reverseTestUnmount unmounts "dir". Returns false (and logs the error) if
+// that failed.
+func reverseTestUnmount(dir string) bool {
+	cmd := exec.Command("fusermount", "-u", dir)
+	if runtime.GOOS != "linux" {
+		cmd = exec.Command("umount", dir)
+	}
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	if err := cmd.Run(); err != nil {
+		tlog.Warn.Printf("Reverse test: unmounting %q failed: %v", dir, err)
+		return false
+	}
+	return true
+}
+
+// reverseTestCompare compares the directory trees "src" and "plain" and
+// returns the number of divergences. Each divergence is logged.
+func reverseTestCompare(src string, plain string) (n int) {
+	report := func(format string, a ...interface{}) {
+		tlog.Warn.Printf("Reverse test: "+format, a...)
+		n++
+	}
+	filepath.Walk(src, func(path string, fi1 os.FileInfo, err error) error {
+		if err != nil {
+			report("%v", err)
+			return nil
+		}
+		rel, _ := filepath.Rel(src, path)
+		if rel == configfile.ConfReverseName {
+			// Hidden in the encrypted view
+			return nil
+		}
+		path2 := filepath.Join(plain, rel)
+		fi2, err := os.Lstat(path2)
+		if err != nil {
+			report("%q is missing: %v", rel, err)
+			if fi1.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if fi1.Mode() != fi2.Mode() {
+			report("%q: mode differs: %v != %v", rel, fi1.Mode(), fi2.Mode())
+			return nil
+		}
+		switch {
+		case fi1.Mode().IsRegular():
+			if err := compareFiles(path, path2); err != nil {
+				report("%q: %v", rel, err)
+			}
+		case fi1.Mode()&os.ModeSymlink != 0:
+			t1, _ := os.Readlink(path)
+			t2, _ := os.Readlink(path2)
+			if t1 != t2 {
+				report("%q: symlink target differs: %q != %q", rel, t1, t2)
+			}
+		case fi1.IsDir():
+			// Entries that only exist in "plain"
+			entries, err := ioutil.ReadDir(path2)
+			if err != nil {
+				report("%q: %v", rel, err)
+				return nil
+			}
+			for _, e := range entries {
+				if _, err := os.Lstat(filepath.Join(path, e.Name())); err != nil {
+					report("%q is unexpected", filepath.Join(rel, e.Name()))
+				}
+			}
+		}
+		return nil
+	})
+	return n
+}
+
+// compareFiles compares the contents of the files "a" and "b".
+func compareFiles(a string, b string) error {
+	f1, err := os.Open(a)
+	if err != nil {
+		return err
+	}
+	defer f1.Close()
+	f2, err := os.Open(b)
+	if err != nil {
+		return err
+	}
+	defer f2.Close()
+	buf1 := make([]byte, 128*1024)
+	buf2 := make([]byte, len(buf1))
+	var off int64
+	for {
+		n1, err1 := io.ReadFull(f1, buf1)
+		n2, err2 := io.ReadFull(f2, buf2)
+		if n1 != n2 || !bytes.Equal(buf1[:n1], buf2[:n2]) {
+			return fmt.Errorf("content differs in the 128kB chunk at offset %d", off)
+		}
+		if err1 == io.EOF || err1 == io.ErrUnexpectedEOF {
+			if err2 != err1 {
+				return fmt.Errorf("length differs")
+			}
+			return nil
+		}
+		if err1 != nil {
+			return err1
+		}
+		if err2 != nil {
+			return err2
+		}
+		off += int64(n1)
+	}
+}
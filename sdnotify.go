@@ -0,0 +1,28 @@
+package main
+
+import (
+	"net"
+	"os"
+
+	"github.com/rfjakob/gocryptfs/internal/tlog"
+)
+
+// sdNotify sends "state" (like "READY=1") to systemd if we have been started
+// as a "Type=notify" service. Does nothing if NOTIFY_SOCKET is not set.
+func sdNotify(state string) {
+	name := os.Getenv("NOTIFY_SOCKET")
+	if name == "" {
+		return
+	}
+	// Names starting with "@" are abstract sockets, Go handles that for us
+	conn, err := net.DialUnix("unixgram", nil, &net.UnixAddr{Name: name, Net: "unixgram"})
+	if err != nil {
+		tlog.Warn.Printf("sdNotify: %v", err)
+		return
+	}
+	defer conn.Close()
+	_, err = conn.Write([]byte(state))
+	if err != nil {
+		tlog.Warn.Printf("sdNotify: %v", err)
+	}
+}
@@ -0,0 +1,40 @@
+package main
+
+import (
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestSdNotify(t *testing.T) {
+	defer os.Setenv("NOTIFY_SOCKET", os.Getenv("NOTIFY_SOCKET"))
+	// Without NOTIFY_SOCKET, sdNotify must do nothing
+	os.Unsetenv("NOTIFY_SOCKET")
+	sdNotify("READY=1")
+
+	dir, err := ioutil.TempDir("", "gocryptfs_sdnotify")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	sock := filepath.Join(dir, "notify")
+	conn, err := net.ListenUnixgram("unixgram", &net.UnixAddr{Name: sock, Net: "unixgram"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	os.Setenv("NOTIFY_SOCKET", sock)
+	sdNotify("READY=1")
+	conn.SetReadDeadline(time.Now().Add(10 * time.Second))
+	buf := make([]byte, 100)
+	n, err := conn.Read(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(buf[:n]) != "READY=1" {
+		t.Errorf("wrong message %q", buf[:n])
+	}
+}
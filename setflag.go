@@ -0,0 +1,110 @@
+package main
+
+import (
+	"io"
+	"os"
+	"path/filepath"
+
+	"github.com/rfjakob/gocryptfs/internal/configfile"
+	"github.com/rfjakob/gocryptfs/internal/cryptocore"
+	"github.com/rfjakob/gocryptfs/internal/exitcodes"
+	"github.com/rfjakob/gocryptfs/internal/nametransform"
+	"github.com/rfjakob/gocryptfs/internal/readpassword"
+	"github.com/rfjakob/gocryptfs/internal/tlog"
+)
+
+// setFeatureFlag enables ("on" = true) or disables the feature flag "name" in
+// the config file and re-encrypts the master key with the same password.
+// Only changes that keep the existing files readable are allowed.
+// This is called when you pass "-setflag" or "-unsetflag".
+// Does not return.
+func setFeatureFlag(args *argContainer, name string, on bool) {
+	flag, ok := configfile.FeatureFlagByName(name)
+	if !ok {
+		tlog.Fatal.Printf("Unknown feature flag %q", name)
+		os.Exit(exitcodes.Usage)
+	}
+	if _, err := os.Stat(args.config); err != nil {
+		tlog.Fatal.Printf("Cannot open config file: %v", err)
+		os.Exit(exitcodes.OpenConf)
+	}
+	pw := readPassword(args)
+	readpassword.CheckTrailingGarbage()
+	masterkey, confFile, err := configfile.LoadConfFile(args.config, pw)
+	if err != nil {
+		tlog.Fatal.Println(err)
+		exitcodes.Exit(err)
+	}
+	if confFile.IsFeatureFlagSet(flag) == on {
+		tlog.Info.Printf("Feature flag %s is already %s, nothing to do", name, onOff(on))
+		os.Exit(0)
+	}
+	logN := confFile.ScryptObject.LogN()
+	switch flag {
+	case configfile.FlagArgon2id:
+		// The flag selects the password hash. Re-encrypting the master key
+		// below switches it.
+		if on {
+			confFile.KDF = configfile.KDFArgon2id
+		} else {
+			confFile.KDF = configfile.KDFScrypt
+			logN = args.scryptn
+		}
+	case configfile.FlagLongNames:
+		// Without the flag, names longer than 176 bytes cannot be created.
+		// Existing ones would become inaccessible.
+		if !on {
+			if longName := findLongName(args.cipherdir); longName != "" {
+				tlog.Fatal.Printf("Cannot unset LongNames: %q is a long file name and would become inaccessible", longName)
+				os.Exit(exitcodes.Usage)
+			}
+		}
+	case configfile.FlagPlaintextNames, configfile.FlagDirIV, configfile.FlagEMENames, configfile.FlagRaw64:
+		tlog.Fatal.Printf("Cannot change %s: it determines how file names are encrypted, existing names "+
+			"would no longer decrypt. Create a new filesystem with -init and copy your files over.", name)
+		os.Exit(exitcodes.Usage)
+	default:
+		tlog.Fatal.Printf("Cannot change %s: it determines how files are encrypted, existing files "+
+			"would no longer decrypt. Create a new filesystem with -init and copy your files over.", name)
+		os.Exit(exitcodes.Usage)
+	}
+	confFile.SetFeatureFlag(flag, on)
+	confFile.EncryptKey(masterkey, pw, logN)
+	cryptocore.Wipe(masterkey)
+	err = confFile.WriteFile()
+	if err != nil {
+		tlog.Fatal.Println(err)
+		os.Exit(exitcodes.WriteConf)
+	}
+	tlog.Info.Printf(tlog.ColorGrey+
+		"A copy of the old config file has been created at %q."+
+		tlog.ColorReset, args.config+configfile.ConfBackupSuffix)
+	tlog.Info.Printf(tlog.ColorGreen+"Feature flag %s is now %s."+tlog.ColorReset, name, onOff(on))
+	os.Exit(0)
+}
+
+// onOff returns "set" or "unset"
+func onOff(on bool) string {
+	if on {
+		return "set"
+	}
+	return "unset"
+}
+
+// findLongName returns the path of a "gocryptfs.longname.*" file below "dir",
+// or the empty string if there is none.
+func findLongName(dir string) (found string) {
+	filepath.Walk(dir, func(path string, fi os.FileInfo, err error) error {
+		if err != nil {
+			tlog.Warn.Printf("findLongName: %v", err)
+			return nil
+		}
+		if nametransform.IsLongContent(fi.Name()) {
+			found = path
+			// Stop the walk
+			return io.EOF
+		}
+		return nil
+	})
+	return found
+}
@@ -3,14 +3,22 @@ package cli
 // Test CLI operations like "-init", "-password" etc
 
 import (
+	"bufio"
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
 	"io/ioutil"
 	"os"
 	"os/exec"
+	"strings"
 	"syscall"
 	"testing"
 	"time"
 
 	"github.com/rfjakob/gocryptfs/internal/configfile"
+	"github.com/rfjakob/gocryptfs/internal/contentenc"
 	"github.com/rfjakob/gocryptfs/internal/exitcodes"
 
 	"github.com/rfjakob/gocryptfs/tests/test_helpers"
@@ -63,6 +71,103 @@ func TestInitReverse(t *testing.T) {
 	}
 }
 
+// Test that -init refuses to create a filesystem inside an existing one
+// unless -force_init is passed
+func TestInitNested(t *testing.T) {
+	dir := test_helpers.InitFS(t)
+	for _, extra := range [][]string{nil, {"-reverse"}} {
+		args := append([]string{"-q", "-init", "-extpass", "echo test", "-scryptn=10"}, extra...)
+		cmd := exec.Command(test_helpers.GocryptfsBinary, append(args, dir)...)
+		err := cmd.Run()
+		if err == nil {
+			t.Fatalf("%v: -init on an existing filesystem should have failed", extra)
+		}
+		exitCode := err.(*exec.ExitError).Sys().(syscall.WaitStatus).ExitStatus()
+		if exitCode != exitcodes.Init {
+			t.Errorf("%v: want=%d, got=%d", extra, exitcodes.Init, exitCode)
+		}
+	}
+	cmd := exec.Command(test_helpers.GocryptfsBinary, "-q", "-init", "-extpass", "echo test",
+		"-scryptn=10", "-reverse", "-force_init", dir)
+	out, err := cmd.CombinedOutput()
+	if err != nil {
+		t.Errorf("-force_init: %v\n%s", err, out)
+	}
+}
+
+// Test "-version -json"
+func TestVersionJSON(t *testing.T) {
+	cmd := exec.Command(test_helpers.GocryptfsBinary, "-version", "-json")
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+	out, err := cmd.Output()
+	if err != nil {
+		t.Fatalf("%v\n%s", err, stderr.String())
+	}
+	var v struct {
+		Version      string
+		GoVersion    string
+		OnDiskFormat int
+		GCMBackend   string
+	}
+	if err = json.Unmarshal(out, &v); err != nil {
+		t.Fatalf("invalid JSON: %v\n%s", err, out)
+	}
+	if v.Version == "" || !strings.HasPrefix(v.GoVersion, "go") {
+		t.Errorf("missing fields: %s", out)
+	}
+	if v.OnDiskFormat != contentenc.CurrentVersion {
+		t.Errorf("wrong onDiskFormat %d", v.OnDiskFormat)
+	}
+	if v.GCMBackend != "OpenSSL" && v.GCMBackend != "Go-GCM" {
+		t.Errorf("wrong gcmBackend %q", v.GCMBackend)
+	}
+	// "-json" alone is a usage error
+	cmd = exec.Command(test_helpers.GocryptfsBinary, "-json")
+	err = cmd.Run()
+	if err == nil {
+		t.Fatal("-json without -version should fail")
+	}
+	exitCode := err.(*exec.ExitError).Sys().(syscall.WaitStatus).ExitStatus()
+	if exitCode != exitcodes.Usage {
+		t.Errorf("-json without -version: want=%d, got=%d", exitcodes.Usage, exitCode)
+	}
+}
+
+// Test -info. It must not ask for the password.
+func TestInfo(t *testing.T) {
+	dir := test_helpers.InitFS(t)
+	cmd := exec.Command(test_helpers.GocryptfsBinary, "-info", dir)
+	out, err := cmd.CombinedOutput()
+	if err != nil {
+		t.Fatalf("%v\n%s", err, out)
+	}
+	for _, want := range []string{"\nVersion:      2\n", " GCMIV128 ", " LogN=10 ", "\nBackend:      Go-GCM, "} {
+		if !strings.Contains(string(out), want) {
+			t.Errorf("output does not contain %q:\n%s", want, out)
+		}
+	}
+	// Missing and malformed config files
+	os.Remove(dir + "/" + configfile.ConfDefaultName)
+	for _, content := range []string{"", "{garbage"} {
+		if content != "" {
+			err = ioutil.WriteFile(dir+"/"+configfile.ConfDefaultName, []byte(content), 0600)
+			if err != nil {
+				t.Fatal(err)
+			}
+		}
+		cmd = exec.Command(test_helpers.GocryptfsBinary, "-info", dir)
+		err = cmd.Run()
+		if err == nil {
+			t.Fatalf("content %q: -info should have failed", content)
+		}
+		exitCode := err.(*exec.ExitError).Sys().(syscall.WaitStatus).ExitStatus()
+		if exitCode != exitcodes.LoadConf {
+			t.Errorf("content %q: want=%d, got=%d", content, exitcodes.LoadConf, exitCode)
+		}
+	}
+}
+
 func testPasswd(t *testing.T, dir string, extraArgs ...string) {
 	// Change password using "-extpass"
 	args := []string{"-q", "-passwd", "-extpass", "echo test"}
@@ -232,6 +337,56 @@ func TestRo(t *testing.T) {
 	_, err = os.Create(file)
 	if err == nil {
 		t.Errorf("Create should have failed")
+	} else if err.(*os.PathError).Err != syscall.EROFS {
+		t.Errorf("Create: want EROFS, got %v", err)
+	}
+}
+
+// Test "-default_permissions"
+func TestDefaultPermissions(t *testing.T) {
+	dir := test_helpers.InitFS(t)
+	mnt := dir + ".mnt"
+	test_helpers.MountOrFatal(t, dir, mnt, "-default_permissions", "-extpass=echo test")
+	defer test_helpers.UnmountPanic(mnt)
+	mounts, err := ioutil.ReadFile("/proc/self/mounts")
+	if err != nil {
+		t.Skip(err)
+	}
+	found := false
+	for _, line := range strings.Split(string(mounts), "\n") {
+		fields := strings.Fields(line)
+		if len(fields) >= 4 && fields[1] == mnt {
+			found = strings.Contains(fields[3], "default_permissions")
+		}
+	}
+	if !found {
+		t.Errorf("default_permissions is not set on %q", mnt)
+	}
+	// Root bypasses the permission checks
+	if os.Getuid() == 0 {
+		return
+	}
+	file := mnt + "/file"
+	err = ioutil.WriteFile(file, []byte("xyz"), 0000)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = os.Open(file)
+	if err == nil {
+		t.Errorf("Open should have failed")
+	} else if err.(*os.PathError).Err != syscall.EACCES {
+		t.Errorf("Open: want EACCES, got %v", err)
+	}
+}
+
+// Test that "-idle" unmounts the filesystem when it is not used
+func TestIdle(t *testing.T) {
+	dir := test_helpers.InitFS(t)
+	mnt := dir + ".mnt"
+	test_helpers.MountOrFatal(t, dir, mnt, "-idle=1s", "-extpass=echo test")
+	time.Sleep(3 * time.Second)
+	if err := test_helpers.UnmountErr(mnt); err == nil {
+		t.Errorf("filesystem was still mounted")
 	}
 }
 
@@ -415,3 +570,945 @@ func TestMountBackground(t *testing.T) {
 		t.Fatal("timeout")
 	}
 }
+
+// writeKeyfile creates a keyfile with "content" in TmpDir and returns its path
+func writeKeyfile(t *testing.T, content string) string {
+	f, err := ioutil.TempFile(test_helpers.TmpDir, "keyfile")
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = f.WriteString(content)
+	f.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return f.Name()
+}
+
+// mixTestKeyfile returns the secret gocryptfs derives from the keyfile "kf"
+// and the password "pw"
+func mixTestKeyfile(t *testing.T, kf string, pw string) string {
+	content, err := ioutil.ReadFile(kf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	mac := hmac.New(sha256.New, content)
+	mac.Write([]byte(pw))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// Test "-init" and mount with "-keyfile" and no password
+func TestKeyfile(t *testing.T) {
+	kf := writeKeyfile(t, "keyfile-content")
+	cDir, err := ioutil.TempDir(test_helpers.TmpDir, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	cmd := exec.Command(test_helpers.GocryptfsBinary, "-q", "-init", "-scryptn=10", "-keyfile", kf, cDir)
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	err = cmd.Run()
+	if err != nil {
+		t.Fatal(err)
+	}
+	pDir := cDir + ".mnt"
+	test_helpers.MountOrFatal(t, cDir, pDir, "-keyfile", kf)
+	test_helpers.UnmountPanic(pDir)
+	// A different keyfile must be rejected
+	wrong := writeKeyfile(t, "WRONG")
+	err = test_helpers.Mount(cDir, pDir, false, "-keyfile", wrong, "-wpanic=false")
+	if err == nil {
+		test_helpers.UnmountPanic(pDir)
+		t.Fatal("mount with wrong keyfile should have failed")
+	}
+	exitCode := err.(*exec.ExitError).Sys().(syscall.WaitStatus).ExitStatus()
+	if exitCode != exitcodes.PasswordIncorrect {
+		t.Errorf("want=%d, got=%d", exitcodes.PasswordIncorrect, exitCode)
+	}
+}
+
+// Test "-keyfile" combined with "-keyfile-password"
+func TestKeyfilePassword(t *testing.T) {
+	kf := writeKeyfile(t, "keyfile-content")
+	cDir := test_helpers.InitFS(t, "-keyfile", kf, "-keyfile-password")
+	pDir := cDir + ".mnt"
+	test_helpers.MountOrFatal(t, cDir, pDir, "-keyfile", kf, "-keyfile-password", "-extpass", "echo test")
+	test_helpers.UnmountPanic(pDir)
+	// The password alone must not be enough
+	err := test_helpers.Mount(cDir, pDir, false, "-extpass", "echo test", "-wpanic=false")
+	if err == nil {
+		test_helpers.UnmountPanic(pDir)
+		t.Fatal("mount without keyfile should have failed")
+	}
+	// Neither is the keyfile alone
+	err = test_helpers.Mount(cDir, pDir, false, "-keyfile", kf, "-wpanic=false")
+	if err == nil {
+		test_helpers.UnmountPanic(pDir)
+		t.Fatal("mount without password should have failed")
+	}
+}
+
+// A filesystem created with "-keyfile" must refuse to mount without it, before
+// asking for a password. "-passwd -masterkey" drops the requirement.
+func TestKeyfileRequired(t *testing.T) {
+	kf := writeKeyfile(t, "keyfile-content")
+	cDir := test_helpers.InitFS(t, "-keyfile", kf, "-keyfile-password")
+	_, c, err := configfile.LoadConfFile(cDir+"/"+configfile.ConfDefaultName, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !c.IsFeatureFlagSet(configfile.FlagKeyfile) {
+		t.Fatal("Keyfile flag is not set")
+	}
+	pDir := cDir + ".mnt"
+	err = test_helpers.Mount(cDir, pDir, false, "-extpass", "echo test", "-wpanic=false")
+	if err == nil {
+		test_helpers.UnmountPanic(pDir)
+		t.Fatal("mount without keyfile should have failed")
+	}
+	exitCode := err.(*exec.ExitError).Sys().(syscall.WaitStatus).ExitStatus()
+	if exitCode != exitcodes.Usage {
+		t.Errorf("want=%d, got=%d", exitcodes.Usage, exitCode)
+	}
+	// "-passwd" also asks for the keyfile
+	cmd := exec.Command(test_helpers.GocryptfsBinary, "-q", "-passwd", "-extpass", "echo test", cDir)
+	err = cmd.Run()
+	if err == nil {
+		t.Fatal("-passwd without keyfile should have failed")
+	}
+	// Replace the keyfile with a plain password
+	key, _, err := configfile.LoadConfFile(cDir+"/"+configfile.ConfDefaultName, mixTestKeyfile(t, kf, "test"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	cmd = exec.Command(test_helpers.GocryptfsBinary, "-q", "-passwd", "-masterkey", hex.EncodeToString(key), cDir)
+	cmd.Stdin = strings.NewReader("newpasswd\n")
+	cmd.Stderr = os.Stderr
+	if err = cmd.Run(); err != nil {
+		t.Fatal(err)
+	}
+	_, c, err = configfile.LoadConfFile(cDir+"/"+configfile.ConfDefaultName, "newpasswd")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if c.IsFeatureFlagSet(configfile.FlagKeyfile) {
+		t.Error("Keyfile flag is still set")
+	}
+}
+
+// "-passwd" with "-old-keyfile" and "-new-keyfile" switches from password to
+// keyfile, rotates the keyfile and switches back to a password
+func TestPasswdSwitchKeyfile(t *testing.T) {
+	cDir := test_helpers.InitFS(t)
+	conf := cDir + "/" + configfile.ConfDefaultName
+	kf1 := writeKeyfile(t, "keyfile-1")
+	kf2 := writeKeyfile(t, "keyfile-2")
+	passwd := func(args ...string) {
+		args = append([]string{"-q", "-passwd"}, args...)
+		cmd := exec.Command(test_helpers.GocryptfsBinary, append(args, cDir)...)
+		cmd.Stdout = os.Stdout
+		cmd.Stderr = os.Stderr
+		if err := cmd.Run(); err != nil {
+			t.Fatalf("%q: %v", args, err)
+		}
+	}
+	check := func(secret string, keyfileFlag bool) {
+		_, c, err := configfile.LoadConfFile(conf, secret)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if c.IsFeatureFlagSet(configfile.FlagKeyfile) != keyfileFlag {
+			t.Errorf("Keyfile flag should be %v", keyfileFlag)
+		}
+	}
+	passwd("-extpass", "echo test", "-new-keyfile", kf1)
+	check(mixTestKeyfile(t, kf1, ""), true)
+	passwd("-old-keyfile", kf1, "-new-keyfile", kf2)
+	check(mixTestKeyfile(t, kf2, ""), true)
+	passwd("-old-keyfile", kf2, "-extpass", "echo newpasswd")
+	check("newpasswd", false)
+	// -old-keyfile and -new-keyfile replace -keyfile
+	cmd := exec.Command(test_helpers.GocryptfsBinary, "-q", "-passwd", "-keyfile", kf1, "-new-keyfile", kf2, cDir)
+	err := cmd.Run()
+	exitCode := err.(*exec.ExitError).Sys().(syscall.WaitStatus).ExitStatus()
+	if exitCode != exitcodes.Usage {
+		t.Errorf("want=%d, got=%d", exitcodes.Usage, exitCode)
+	}
+}
+
+// Test "-expect-fingerprint" with a matching and a mismatching fingerprint
+func TestExpectFingerprint(t *testing.T) {
+	cDir := test_helpers.InitFS(t)
+	key, _, err := configfile.LoadConfFile(cDir+"/"+configfile.ConfDefaultName, "test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	h := sha256.Sum256(key)
+	fp := hex.EncodeToString(h[:16])
+	pDir := cDir + ".mnt"
+	test_helpers.MountOrFatal(t, cDir, pDir, "-extpass", "echo test", "-expect-fingerprint", fp)
+	test_helpers.UnmountPanic(pDir)
+	// Flip the last hex digit
+	wrong := fp[:len(fp)-1] + "0"
+	if wrong == fp {
+		wrong = fp[:len(fp)-1] + "1"
+	}
+	err = test_helpers.Mount(cDir, pDir, false, "-extpass", "echo test", "-expect-fingerprint", wrong, "-wpanic=false")
+	if err == nil {
+		test_helpers.UnmountPanic(pDir)
+		t.Fatal("mount with wrong fingerprint should have failed")
+	}
+	exitCode := err.(*exec.ExitError).Sys().(syscall.WaitStatus).ExitStatus()
+	if exitCode != exitcodes.FingerprintMismatch {
+		t.Errorf("want=%d, got=%d", exitcodes.FingerprintMismatch, exitCode)
+	}
+}
+
+// TestSigintProfile checks that the CPU profile gets written when gocryptfs
+// is stopped with SIGINT.
+func TestSigintProfile(t *testing.T) {
+	dir := test_helpers.InitFS(t)
+	mnt := dir + ".mnt"
+	err := os.Mkdir(mnt, 0700)
+	if err != nil {
+		t.Fatal(err)
+	}
+	prof := dir + ".cpuprofile"
+	cmd := exec.Command(test_helpers.GocryptfsBinary, "-q", "-fg", "-nosyslog",
+		"-extpass", "echo test", "-cpuprofile", prof, dir, mnt)
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	err = cmd.Start()
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Wait for the mount to show up
+	var st1, st2 syscall.Stat_t
+	for i := 0; ; i++ {
+		if syscall.Stat(dir, &st1) == nil && syscall.Stat(mnt, &st2) == nil && st1.Dev != st2.Dev {
+			break
+		}
+		if i > 50 {
+			cmd.Process.Kill()
+			t.Fatal("timeout waiting for mount")
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+	cmd.Process.Signal(os.Interrupt)
+	err = cmd.Wait()
+	if err == nil {
+		t.Errorf("want exit code %d, got 0", exitcodes.SigInt)
+	} else {
+		exitCode := err.(*exec.ExitError).Sys().(syscall.WaitStatus).ExitStatus()
+		if exitCode != exitcodes.SigInt {
+			t.Errorf("want=%d, got=%d", exitcodes.SigInt, exitCode)
+		}
+	}
+	fi, err := os.Stat(prof)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fi.Size() == 0 {
+		t.Error("CPU profile is empty")
+	}
+}
+
+// TestLogfile checks that Info and Warn messages end up in the "-logfile" file
+// when gocryptfs runs in the background.
+func TestLogfile(t *testing.T) {
+	dir := test_helpers.InitFS(t)
+	mnt := dir + ".mnt"
+	logfile := dir + ".log"
+	err := os.Mkdir(mnt, 0700)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// An invalid file name in CIPHERDIR triggers a warning on readdir
+	err = ioutil.WriteFile(dir+"/invalid", nil, 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cmd := exec.Command(test_helpers.GocryptfsBinary, "-extpass", "echo test", "-logfile", logfile, dir, mnt)
+	err = cmd.Run()
+	if err != nil {
+		t.Fatal(err)
+	}
+	ioutil.ReadDir(mnt)
+	test_helpers.UnmountPanic(mnt)
+	content, err := ioutil.ReadFile(logfile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, want := range []string{"Filesystem mounted and ready", "invalid entry"} {
+		if !strings.Contains(string(content), want) {
+			t.Errorf("logfile does not contain %q. Content:\n%s", want, content)
+		}
+	}
+}
+
+// TestExportSubtree exports a subdirectory and checks that the result matches
+// what the mount shows.
+func TestExportSubtree(t *testing.T) {
+	dir := test_helpers.InitFS(t)
+	mnt := dir + ".mnt"
+	test_helpers.MountOrFatal(t, dir, mnt, "-extpass", "echo test")
+	err := os.MkdirAll(mnt+"/a/b", 0750)
+	if err != nil {
+		t.Fatal(err)
+	}
+	content := []byte("exported content")
+	err = ioutil.WriteFile(mnt+"/a/b/file", content, 0640)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = os.Symlink("file", mnt+"/a/b/link")
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = ioutil.WriteFile(mnt+"/notexported", content, 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	mtime := time.Date(2010, 1, 2, 3, 4, 5, 0, time.UTC)
+	err = os.Chtimes(mnt+"/a/b/file", mtime, mtime)
+	if err != nil {
+		t.Fatal(err)
+	}
+	fiMnt, err := os.Stat(mnt + "/a/b/file")
+	if err != nil {
+		t.Fatal(err)
+	}
+	test_helpers.UnmountPanic(mnt)
+
+	dest := dir + ".export"
+	cmd := exec.Command(test_helpers.GocryptfsBinary, "-q", "-extpass", "echo test",
+		"-export-subtree", "a", dir, dest)
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	err = cmd.Run()
+	if err != nil {
+		t.Fatal(err)
+	}
+	have, err := ioutil.ReadFile(dest + "/b/file")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(have, content) {
+		t.Errorf("wrong content: %q", have)
+	}
+	fi, err := os.Stat(dest + "/b/file")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fi.Mode() != fiMnt.Mode() {
+		t.Errorf("wrong mode: want=%v have=%v", fiMnt.Mode(), fi.Mode())
+	}
+	if !fi.ModTime().Equal(fiMnt.ModTime()) {
+		t.Errorf("wrong mtime: want=%v have=%v", fiMnt.ModTime(), fi.ModTime())
+	}
+	fi, err = os.Stat(dest + "/b")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fi.Mode().Perm() != 0750 {
+		t.Errorf("wrong dir mode: %v", fi.Mode())
+	}
+	target, err := os.Readlink(dest + "/b/link")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if target != "file" {
+		t.Errorf("wrong symlink target: %q", target)
+	}
+	if _, err = os.Lstat(dest + "/notexported"); err == nil {
+		t.Error("file outside of the subtree was exported")
+	}
+}
+
+// TestMissingConfHelp checks that we explain how to recover when CIPHERDIR has
+// data but gocryptfs.conf is missing, also with "-q"
+func TestMissingConfHelp(t *testing.T) {
+	dir := test_helpers.InitFS(t)
+	err := os.Remove(dir + "/" + configfile.ConfDefaultName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	mnt := dir + ".mnt"
+	err = os.Mkdir(mnt, 0700)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, q := range []string{"-q=false", "-q"} {
+		cmd := exec.Command(test_helpers.GocryptfsBinary, q, "-extpass", "echo test", dir, mnt)
+		out, err := cmd.CombinedOutput()
+		if err == nil {
+			t.Fatalf("%s: mount without config file should have failed", q)
+		}
+		exitCode := err.(*exec.ExitError).Sys().(syscall.WaitStatus).ExitStatus()
+		if exitCode != exitcodes.OpenConf {
+			t.Errorf("%s: want=%d, got=%d", q, exitcodes.OpenConf, exitCode)
+		}
+		if !strings.Contains(string(out), "-masterkey") {
+			t.Errorf("%s: output does not mention -masterkey:\n%s", q, out)
+		}
+	}
+}
+
+// Test that "-detect" infers the feature flags from example filesystems
+// without the config file
+func TestDetect(t *testing.T) {
+	testCases := []struct {
+		dir   string
+		flags string
+	}{
+		{"v1.3", "FeatureFlags (likely): DirIV EMENames Raw64 LongNames\n"},
+		{"v0.7-plaintextnames", "FeatureFlags (likely): PlaintextNames\n"},
+	}
+	for _, tc := range testCases {
+		cmd := exec.Command(test_helpers.GocryptfsBinary, "-detect", "../example_filesystems/"+tc.dir)
+		out, err := cmd.CombinedOutput()
+		if err != nil {
+			t.Fatalf("%s: %v\n%s", tc.dir, err, out)
+		}
+		if !strings.Contains(string(out), "best-effort") {
+			t.Errorf("%s: output is not marked as best-effort:\n%s", tc.dir, out)
+		}
+		if !strings.Contains(string(out), tc.flags) {
+			t.Errorf("%s: want %q, got:\n%s", tc.dir, tc.flags, out)
+		}
+	}
+}
+
+// Test that a second read-write mount of the same CIPHERDIR is refused
+func TestDoubleMount(t *testing.T) {
+	dir := test_helpers.InitFS(t)
+	mnt1 := dir + ".mnt1"
+	mnt2 := dir + ".mnt2"
+	for _, m := range []string{mnt1, mnt2} {
+		err := os.Mkdir(m, 0700)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	test_helpers.MountOrFatal(t, dir, mnt1, "-extpass", "echo test")
+	defer test_helpers.UnmountPanic(mnt1)
+	cmd := exec.Command(test_helpers.GocryptfsBinary, "-q", "-fg", "-extpass", "echo test", dir, mnt2)
+	err := cmd.Run()
+	if err == nil {
+		test_helpers.UnmountPanic(mnt2)
+		t.Fatal("second read-write mount should have been refused")
+	}
+	exitCode := err.(*exec.ExitError).Sys().(syscall.WaitStatus).ExitStatus()
+	if exitCode != exitcodes.CipherDirLocked {
+		t.Errorf("want=%d, got=%d", exitcodes.CipherDirLocked, exitCode)
+	}
+	// A read-only mount is harmless and must work
+	test_helpers.MountOrFatal(t, dir, mnt2, "-extpass", "echo test", "-ro")
+	test_helpers.UnmountPanic(mnt2)
+}
+
+// Test that "-reverse-test" finds no divergences on a varied source tree
+func TestReverseTest(t *testing.T) {
+	dir := test_helpers.InitFS(t, "-reverse")
+	files := map[string]int{
+		"empty":                            0,
+		"small":                            1,
+		"block":                            4096,
+		"dir1/partial":                     5000,
+		"dir1/dir2/big":                    300 * 1024,
+		"dir1/" + strings.Repeat("x", 240): 10,
+	}
+	for name, size := range files {
+		path := dir + "/" + name
+		err := os.MkdirAll(path[:strings.LastIndex(path, "/")], 0755)
+		if err != nil {
+			t.Fatal(err)
+		}
+		data := make([]byte, size)
+		for i := range data {
+			data[i] = byte(i)
+		}
+		err = ioutil.WriteFile(path, data, 0640)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := os.Mkdir(dir+"/emptydir", 0700); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Symlink("dir1/partial", dir+"/link"); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chmod(dir+"/small", 0755); err != nil {
+		t.Fatal(err)
+	}
+	cmd := exec.Command(test_helpers.GocryptfsBinary, "-reverse-test", "-extpass", "echo test", dir)
+	out, err := cmd.CombinedOutput()
+	if err != nil {
+		t.Fatalf("reverse test failed: %v\n%s", err, out)
+	}
+}
+
+// Test that "-fsck" accepts an intact filesystem and reports corrupted blocks
+// and undecryptable names
+func TestFsck(t *testing.T) {
+	dir := test_helpers.TmpDir + "/TestFsck"
+	err := exec.Command("cp", "-a", "../example_filesystems/v1.3", dir).Run()
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The config backup created by "-passwd" is not a problem
+	err = exec.Command("cp", "-a", dir+"/gocryptfs.conf", dir+"/gocryptfs.conf.bak").Run()
+	if err != nil {
+		t.Fatal(err)
+	}
+	cmd := exec.Command(test_helpers.GocryptfsBinary, "-fsck", "-extpass", "echo test", dir)
+	out, err := cmd.CombinedOutput()
+	if err != nil {
+		t.Fatalf("fsck of an intact filesystem failed: %v\n%s", err, out)
+	}
+	// Flip a bit in the (only) block of a file
+	fn := dir + "/mGj2_hdnHe34Sp0iIQUwuw"
+	err = os.Chmod(fn, 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f, err := os.OpenFile(fn, os.O_RDWR, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	buf := make([]byte, 1)
+	_, err = f.ReadAt(buf, 40)
+	if err != nil {
+		t.Fatal(err)
+	}
+	buf[0] ^= 1
+	_, err = f.WriteAt(buf, 40)
+	f.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	// A name that is not valid base64
+	err = ioutil.WriteFile(dir+"/x", nil, 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	before, err := ioutil.ReadFile(fn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cmd = exec.Command(test_helpers.GocryptfsBinary, "-fsck", "-extpass", "echo test", dir)
+	out, err = cmd.CombinedOutput()
+	if err == nil {
+		t.Fatalf("fsck did not detect the corruption:\n%s", out)
+	}
+	exitCode := err.(*exec.ExitError).Sys().(syscall.WaitStatus).ExitStatus()
+	if exitCode != exitcodes.FsckErrors {
+		t.Errorf("want=%d, got=%d", exitcodes.FsckErrors, exitCode)
+	}
+	for _, want := range []string{"/mGj2_hdnHe34Sp0iIQUwuw\": block 0", "\"/x\": could not decrypt name", "found 2 problem(s)"} {
+		if !strings.Contains(string(out), want) {
+			t.Errorf("output does not contain %q:\n%s", want, out)
+		}
+	}
+	// fsck must not repair or otherwise touch anything
+	after, err := ioutil.ReadFile(fn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(before, after) {
+		t.Error("fsck modified the file")
+	}
+	// "-require-seal" reports the missing seal files
+	cmd = exec.Command(test_helpers.GocryptfsBinary, "-fsck", "-require-seal", "-extpass", "echo test", dir)
+	out, _ = cmd.CombinedOutput()
+	if !strings.Contains(string(out), "\"/\": gocryptfs.seal is missing") {
+		t.Errorf("missing seal was not reported:\n%s", out)
+	}
+}
+
+// runPassfd runs gocryptfs with "args" and passes "input" through a pipe on
+// fd 3
+func runPassfd(t *testing.T, input string, args ...string) error {
+	r, w, err := os.Pipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	cmd := exec.Command(test_helpers.GocryptfsBinary, args...)
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	cmd.ExtraFiles = []*os.File{r}
+	if err = cmd.Start(); err != nil {
+		t.Fatal(err)
+	}
+	r.Close()
+	w.Write([]byte(input))
+	w.Close()
+	return cmd.Wait()
+}
+
+// Test that "-passfd" works for -init, -passwd and mounting, and that the
+// password is read from the fd and not from the command line
+func TestPassfd(t *testing.T) {
+	dir, err := ioutil.TempDir(test_helpers.TmpDir, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = runPassfd(t, "test\n", "-q", "-init", "-scryptn=10", "-passfd", "3", dir)
+	if err != nil {
+		t.Fatalf("-init failed: %v", err)
+	}
+	// Old and new password, one per line
+	err = runPassfd(t, "test\nnewpasswd\n", "-q", "-passwd", "-passfd", "3", dir)
+	if err != nil {
+		t.Fatalf("-passwd failed: %v", err)
+	}
+	// "-fsck" checks the password without needing FUSE
+	err = runPassfd(t, "test", "-q", "-fsck", "-passfd", "3", dir)
+	if err == nil {
+		t.Error("old password was accepted")
+	}
+	err = runPassfd(t, "newpasswd", "-q", "-fsck", "-passfd", "3", dir)
+	if err != nil {
+		t.Errorf("new password was rejected: %v", err)
+	}
+	// -passfd and -extpass are mutually exclusive
+	err = runPassfd(t, "newpasswd\n", "-q", "-fsck", "-passfd", "3", "-extpass", "echo newpasswd", dir)
+	exitCode := err.(*exec.ExitError).Sys().(syscall.WaitStatus).ExitStatus()
+	if exitCode != exitcodes.Usage {
+		t.Errorf("want exit code %d, got %d", exitcodes.Usage, exitCode)
+	}
+	// Mounting goes through forkChild, which must pass the fd on
+	mnt := dir + ".mnt"
+	if err = os.Mkdir(mnt, 0700); err != nil {
+		t.Fatal(err)
+	}
+	err = runPassfd(t, "newpasswd\n", "-q", "-passfd", "3", dir, mnt)
+	if err != nil {
+		t.Fatalf("mount failed: %v", err)
+	}
+	test_helpers.UnmountPanic(mnt)
+}
+
+// Test mounting on a symlink to a directory. The filesystem must end up on
+// the target, and the empty-check must look at the target.
+func TestMountSymlink(t *testing.T) {
+	dir := test_helpers.InitFS(t)
+	mnt := dir + ".mnt"
+	link := dir + ".link"
+	if err := os.Mkdir(mnt, 0700); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Symlink(mnt, link); err != nil {
+		t.Fatal(err)
+	}
+	// A non-empty target must be refused although the symlink itself is not a
+	// directory
+	if err := ioutil.WriteFile(mnt+"/file", nil, 0600); err != nil {
+		t.Fatal(err)
+	}
+	err := test_helpers.Mount(dir, link, false, "-extpass=echo test")
+	if err == nil {
+		t.Fatal("mounting on a symlink to a non-empty directory should have failed")
+	}
+	exitCode := err.(*exec.ExitError).Sys().(syscall.WaitStatus).ExitStatus()
+	if exitCode != exitcodes.MountPoint {
+		t.Errorf("want exit code %d, got %d", exitcodes.MountPoint, exitCode)
+	}
+	if err = os.Remove(mnt + "/file"); err != nil {
+		t.Fatal(err)
+	}
+	test_helpers.MountOrFatal(t, dir, link, "-extpass=echo test")
+	defer test_helpers.UnmountPanic(mnt)
+	// The symlink must still be a symlink, and the mount must be visible
+	// through both paths
+	fi, err := os.Lstat(link)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fi.Mode()&os.ModeSymlink == 0 {
+		t.Errorf("%q is no longer a symlink", link)
+	}
+	if err = ioutil.WriteFile(link+"/file2", []byte("x"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = os.Stat(mnt + "/file2"); err != nil {
+		t.Error(err)
+	}
+}
+
+// Test -passwd with -masterkey-file, and the checks on the master key file
+func TestMasterkeyFile(t *testing.T) {
+	dir := test_helpers.InitFS(t)
+	conf, err := ioutil.ReadFile("gocryptfs.conf.b9e5ba23")
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = ioutil.WriteFile(dir+"/gocryptfs.conf", conf, 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyFile := dir + ".masterkey"
+	err = ioutil.WriteFile(keyFile, []byte("b9e5ba23-981a22b8-c8d790d8-627add29-f680513f-b7b7035f-d203fb83-21d82205\n"), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cmd := exec.Command(test_helpers.GocryptfsBinary, "-q", "-passwd", "-masterkey-file", keyFile, dir)
+	cmd.Stdin = strings.NewReader("newpasswd\n")
+	out, err := cmd.CombinedOutput()
+	if err != nil {
+		t.Fatalf("-passwd -masterkey-file failed: %v\n%s", err, out)
+	}
+	// The new password must work
+	cmd = exec.Command(test_helpers.GocryptfsBinary, "-q", "-passwd", "-extpass", "echo newpasswd", dir)
+	out, err = cmd.CombinedOutput()
+	if err != nil {
+		t.Fatalf("new password does not work: %v\n%s", err, out)
+	}
+	// Errors
+	badFile := dir + ".badkey"
+	err = ioutil.WriteFile(badFile, []byte("b9e5ba23-981a22b8 c8d790d8-627add29-f680513f-b7b7035f-d203fb83-21d82205\n"), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	testCases := []struct {
+		args []string
+		code int
+	}{
+		{[]string{"-masterkey-file", badFile}, exitcodes.MasterKey},
+		{[]string{"-masterkey-file", dir + ".nonexistent"}, exitcodes.MasterKey},
+		{[]string{"-masterkey-file", keyFile, "-masterkey", "b9e5ba23"}, exitcodes.Usage},
+	}
+	for _, tc := range testCases {
+		args := append([]string{"-q", "-passwd"}, tc.args...)
+		cmd = exec.Command(test_helpers.GocryptfsBinary, append(args, dir)...)
+		cmd.Stdin = strings.NewReader("newpasswd\n")
+		err = cmd.Run()
+		if err == nil {
+			t.Errorf("%v: should have failed", tc.args)
+			continue
+		}
+		exitCode := err.(*exec.ExitError).Sys().(syscall.WaitStatus).ExitStatus()
+		if exitCode != tc.code {
+			t.Errorf("%v: want=%d, got=%d", tc.args, tc.code, exitCode)
+		}
+	}
+}
+
+// Test that "-unmount" refuses a directory that is not a gocryptfs mount
+func TestUnmountNotMounted(t *testing.T) {
+	dir := test_helpers.InitFS(t)
+	cmd := exec.Command(test_helpers.GocryptfsBinary, "-unmount", dir)
+	out, err := cmd.CombinedOutput()
+	if err == nil {
+		t.Fatalf("-unmount of a plain directory succeeded:\n%s", out)
+	}
+	exitCode := err.(*exec.ExitError).Sys().(syscall.WaitStatus).ExitStatus()
+	if exitCode != exitcodes.MountPoint {
+		t.Errorf("want=%d, got=%d", exitcodes.MountPoint, exitCode)
+	}
+	if !strings.Contains(string(out), "not a gocryptfs mount") {
+		t.Errorf("unexpected output:\n%s", out)
+	}
+}
+
+// "-check-password" must exit with 0 for the right and with
+// exitcodes.PasswordIncorrect for a wrong password
+func TestCheckPassword(t *testing.T) {
+	dir := test_helpers.InitFS(t)
+	cmd := exec.Command(test_helpers.GocryptfsBinary, "-q", "-check-password", "-extpass", "echo test", dir)
+	out, err := cmd.CombinedOutput()
+	if err != nil {
+		t.Fatalf("right password was rejected: %v\n%s", err, out)
+	}
+	if len(out) != 0 {
+		t.Errorf("unexpected output with -q:\n%s", out)
+	}
+	cmd = exec.Command(test_helpers.GocryptfsBinary, "-q", "-check-password", "-extpass", "echo wrong", dir)
+	out, err = cmd.CombinedOutput()
+	if err == nil {
+		t.Fatalf("wrong password was accepted:\n%s", out)
+	}
+	exitCode := err.(*exec.ExitError).Sys().(syscall.WaitStatus).ExitStatus()
+	if exitCode != exitcodes.PasswordIncorrect {
+		t.Errorf("want=%d, got=%d", exitcodes.PasswordIncorrect, exitCode)
+	}
+}
+
+// setFlag runs "gocryptfs -setflag" or "-unsetflag" and returns the exit
+// code
+func setFlag(t *testing.T, dir string, action string, flag string) int {
+	cmd := exec.Command(test_helpers.GocryptfsBinary, "-q", action, flag, "-extpass", "echo test", "-scryptn=10", dir)
+	out, err := cmd.CombinedOutput()
+	if err == nil {
+		return 0
+	}
+	exitCode := err.(*exec.ExitError).Sys().(syscall.WaitStatus).ExitStatus()
+	t.Logf("%s %s: exit code %d:\n%s", action, flag, exitCode, out)
+	return exitCode
+}
+
+// Switching the password hash must keep the master key, changing the content
+// encryption must be refused
+func TestSetFlag(t *testing.T) {
+	dir := test_helpers.InitFS(t)
+	conf := dir + "/" + configfile.ConfDefaultName
+	key1, _, err := configfile.LoadConfFile(conf, "test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if code := setFlag(t, dir, "-setflag", "Argon2id"); code != 0 {
+		t.Fatalf("-setflag Argon2id failed")
+	}
+	key2, cf, err := configfile.LoadConfFile(conf, "test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cf.KDF != configfile.KDFArgon2id || !cf.IsFeatureFlagSet(configfile.FlagArgon2id) {
+		t.Errorf("KDF=%q, flags=%v", cf.KDF, cf.FeatureFlags)
+	}
+	// The scrypt parameters are no longer used and must be gone
+	if cf.ScryptObject.Salt != nil || cf.ScryptObject.N != 0 {
+		t.Errorf("stale ScryptObject: %+v", cf.ScryptObject)
+	}
+	if !bytes.Equal(key1, key2) {
+		t.Error("master key changed")
+	}
+	if code := setFlag(t, dir, "-unsetflag", "Argon2id"); code != 0 {
+		t.Fatalf("-unsetflag Argon2id failed")
+	}
+	if _, cf, err = configfile.LoadConfFile(conf, "test"); err != nil {
+		t.Fatal(err)
+	}
+	if cf.KDF != configfile.KDFScrypt || cf.Argon2idObject != nil {
+		t.Errorf("KDF=%q, Argon2idObject=%v", cf.KDF, cf.Argon2idObject)
+	}
+	if code := setFlag(t, dir, "-unsetflag", "HKDF"); code != exitcodes.Usage {
+		t.Errorf("-unsetflag HKDF: want exit code %d, got %d", exitcodes.Usage, code)
+	}
+	if code := setFlag(t, dir, "-setflag", "StrangeFeatureFlag"); code != exitcodes.Usage {
+		t.Errorf("unknown flag: want exit code %d, got %d", exitcodes.Usage, code)
+	}
+}
+
+// translateName runs "gocryptfs -encrypt-name" or "-decrypt-name" and returns
+// the printed path
+func translateName(t *testing.T, dir string, action string, path string) string {
+	cmd := exec.Command(test_helpers.GocryptfsBinary, "-q", action, path, "-extpass", "echo test", dir)
+	cmd.Stderr = os.Stderr
+	out, err := cmd.Output()
+	if err != nil {
+		t.Fatalf("%s %q: %v", action, path, err)
+	}
+	return strings.TrimSuffix(string(out), "\n")
+}
+
+// Test "-encrypt-name" and "-decrypt-name" on a nested path
+func TestTranslateName(t *testing.T) {
+	dir := test_helpers.InitFS(t)
+	// Create the directory "dir" in CIPHERDIR without mounting
+	cDir := translateName(t, dir, "-encrypt-name", "dir")
+	if err := os.Mkdir(dir+"/"+cDir, 0700); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(dir+"/"+cDir+"/gocryptfs.diriv", bytes.Repeat([]byte{1}, 16), 0400); err != nil {
+		t.Fatal(err)
+	}
+	cPath := translateName(t, dir, "-encrypt-name", "/dir/file.txt")
+	if !strings.HasPrefix(cPath, cDir+"/") || strings.Contains(cPath, "file.txt") {
+		t.Errorf("wrong ciphertext path %q", cPath)
+	}
+	if plain := translateName(t, dir, "-decrypt-name", cPath); plain != "dir/file.txt" {
+		t.Errorf("want %q, have %q", "dir/file.txt", plain)
+	}
+	// A missing parent directory is an error
+	cmd := exec.Command(test_helpers.GocryptfsBinary, "-q", "-encrypt-name", "missing/file", "-extpass", "echo test", dir)
+	if err := cmd.Run(); err == nil {
+		t.Error("-encrypt-name through a missing directory succeeded")
+	}
+}
+
+// A config file that is readable by others gives a warning, and an error
+// with "-strictperms"
+func TestStrictPerms(t *testing.T) {
+	dir := test_helpers.InitFS(t)
+	conf := dir + "/" + configfile.ConfDefaultName
+	fi, err := os.Stat(conf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fi.Mode().Perm() != 0400 {
+		t.Errorf("-init created the config file with mode %04o", fi.Mode().Perm())
+	}
+	if err = os.Chmod(conf, 0644); err != nil {
+		t.Fatal(err)
+	}
+	cmd := exec.Command(test_helpers.GocryptfsBinary, "-check-password", "-extpass", "echo test", dir)
+	out, err := cmd.CombinedOutput()
+	if err != nil {
+		t.Fatalf("loose permissions without -strictperms failed: %v\n%s", err, out)
+	}
+	if !strings.Contains(string(out), "chmod 400") {
+		t.Errorf("no warning:\n%s", out)
+	}
+	cmd = exec.Command(test_helpers.GocryptfsBinary, "-q", "-strictperms", "-check-password", "-extpass", "echo test", dir)
+	err = cmd.Run()
+	if err == nil {
+		t.Fatal("loose permissions with -strictperms were accepted")
+	}
+	exitCode := err.(*exec.ExitError).Sys().(syscall.WaitStatus).ExitStatus()
+	if exitCode != exitcodes.LoadConf {
+		t.Errorf("want=%d, got=%d", exitcodes.LoadConf, exitCode)
+	}
+}
+
+// "-status-json" prints the mount and unmount events, and is rejected without
+// "-f" as the unmount event would get lost
+func TestStatusJSON(t *testing.T) {
+	dir := test_helpers.InitFS(t)
+	mnt := dir + ".mnt"
+	if err := os.Mkdir(mnt, 0700); err != nil {
+		t.Fatal(err)
+	}
+	cmd := exec.Command(test_helpers.GocryptfsBinary, "-q", "-status-json", "-extpass", "echo test", dir, mnt)
+	err := cmd.Run()
+	if err == nil {
+		test_helpers.UnmountPanic(mnt)
+		t.Fatal("-status-json without -f was accepted")
+	}
+	exitCode := err.(*exec.ExitError).Sys().(syscall.WaitStatus).ExitStatus()
+	if exitCode != exitcodes.Usage {
+		t.Errorf("want=%d, got=%d", exitcodes.Usage, exitCode)
+	}
+	cmd = exec.Command(test_helpers.GocryptfsBinary, "-q", "-f", "-status-json", "-extpass", "echo test", dir, mnt)
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = cmd.Start(); err != nil {
+		t.Fatal(err)
+	}
+	scanner := bufio.NewScanner(stdout)
+	// event reads the next line and checks that it is "want"
+	event := func(want string) {
+		if !scanner.Scan() {
+			t.Fatalf("no %q event: %v", want, scanner.Err())
+		}
+		var e struct {
+			Event      string
+			Mountpoint string
+		}
+		if err := json.Unmarshal(scanner.Bytes(), &e); err != nil {
+			t.Fatalf("%v: %q", err, scanner.Text())
+		}
+		if e.Event != want || e.Mountpoint != mnt {
+			t.Errorf("want %q event for %q, have %q", want, mnt, scanner.Text())
+		}
+	}
+	event("mounted")
+	test_helpers.UnmountPanic(mnt)
+	event("unmounted")
+	if err = cmd.Wait(); err != nil {
+		t.Error(err)
+	}
+}
@@ -0,0 +1,50 @@
+package defaults
+
+import (
+	"os"
+	"syscall"
+	"testing"
+
+	"github.com/rfjakob/gocryptfs/tests/test_helpers"
+)
+
+// Set a directory comment via the virtual xattr and read it back after a
+// remount
+func TestDirComment(t *testing.T) {
+	const attr = "user.gocryptfs.comment"
+	cDir := test_helpers.InitFS(t)
+	pDir := cDir + ".mnt"
+	test_helpers.MountOrFatal(t, cDir, pDir, "-extpass", "echo test")
+	dir := pDir + "/commented"
+	if err := os.Mkdir(dir, 0700); err != nil {
+		t.Fatal(err)
+	}
+	comment := []byte("holiday photos 2017")
+	if err := syscall.Setxattr(dir, attr, comment, 0); err != nil {
+		t.Fatal(err)
+	}
+	test_helpers.UnmountPanic(pDir)
+	test_helpers.MountOrFatal(t, cDir, pDir, "-extpass", "echo test")
+	defer test_helpers.UnmountPanic(pDir)
+	buf := make([]byte, 100)
+	n, err := syscall.Getxattr(dir, attr, buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(buf[:n]) != string(comment) {
+		t.Errorf("wrong comment: %q", buf[:n])
+	}
+	// The comment file is hidden and does not keep Rmdir from working
+	f, err := os.Open(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	names, err := f.Readdirnames(0)
+	f.Close()
+	if len(names) != 0 {
+		t.Errorf("comment file is visible: %v", names)
+	}
+	if err = syscall.Rmdir(dir); err != nil {
+		t.Error(err)
+	}
+}
@@ -9,6 +9,7 @@ import (
 	"os/exec"
 	"runtime"
 	"sync"
+	"syscall"
 	"testing"
 
 	"github.com/rfjakob/gocryptfs/tests/test_helpers"
@@ -191,3 +192,29 @@ func TestWrite0200File(t *testing.T) {
 		t.Fatal("wrong restored permissions")
 	}
 }
+
+// The kernel applies the umask of the calling process to the mode of new
+// files and directories before it reaches gocryptfs, like on a local
+// filesystem. gocryptfs itself runs with umask 0 so it does not mask twice.
+func TestUmask(t *testing.T) {
+	old := syscall.Umask(022)
+	defer syscall.Umask(old)
+	dir := test_helpers.DefaultPlainDir + "/TestUmask"
+	if err := os.Mkdir(dir, 0777); err != nil {
+		t.Fatal(err)
+	}
+	f, err := os.OpenFile(dir+"/file", os.O_CREATE|os.O_WRONLY, 0666)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.Close()
+	for path, want := range map[string]os.FileMode{dir: 0755, dir + "/file": 0644} {
+		fi, err := os.Stat(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if have := fi.Mode().Perm(); have != want {
+			t.Errorf("%s: want mode %o, have %o", path, want, have)
+		}
+	}
+}
@@ -0,0 +1,98 @@
+package defaults
+
+import (
+	"bytes"
+	"io/ioutil"
+	"syscall"
+	"testing"
+
+	"github.com/rfjakob/gocryptfs/tests/test_helpers"
+)
+
+// Extended attributes are passed through to the backing file in encrypted
+// form
+func TestXAttrPassthrough(t *testing.T) {
+	fn := test_helpers.DefaultPlainDir + "/TestXAttrPassthrough"
+	if err := ioutil.WriteFile(fn, nil, 0600); err != nil {
+		t.Fatal(err)
+	}
+	val := []byte("xyz")
+	err := syscall.Setxattr(fn, "user.test", val, 0)
+	if err == syscall.ENOTSUP {
+		t.Skip("backing filesystem does not support xattrs")
+	} else if err != nil {
+		t.Fatal(err)
+	}
+	buf := make([]byte, 100)
+	n, err := syscall.Getxattr(fn, "user.test", buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(buf[:n]) != string(val) {
+		t.Errorf("wrong value: %q", buf[:n])
+	}
+	n, err = syscall.Listxattr(fn, buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(buf[:n]) != "user.test\x00" {
+		t.Errorf("wrong list: %q", buf[:n])
+	}
+	if err = syscall.Removexattr(fn, "user.test"); err != nil {
+		t.Error(err)
+	}
+	if _, err = syscall.Getxattr(fn, "user.test", buf); err != syscall.ENODATA {
+		t.Errorf("want ENODATA, got %v", err)
+	}
+}
+
+// Callers of getxattr(2) first probe the size with an empty buffer, then
+// allocate and fetch. The probe must report the plaintext length.
+func TestXAttrSizeProbe(t *testing.T) {
+	fn := test_helpers.DefaultPlainDir + "/TestXAttrSizeProbe"
+	if err := ioutil.WriteFile(fn, nil, 0600); err != nil {
+		t.Fatal(err)
+	}
+	val := bytes.Repeat([]byte("0123456789"), 300)
+	err := syscall.Setxattr(fn, "user.large", val, 0)
+	if err == syscall.ENOTSUP {
+		t.Skip("backing filesystem does not support xattrs")
+	} else if err != nil {
+		t.Fatal(err)
+	}
+	sz, err := syscall.Getxattr(fn, "user.large", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if sz != len(val) {
+		t.Errorf("size probe: want %d, got %d", len(val), sz)
+	}
+	// One byte too small
+	if _, err = syscall.Getxattr(fn, "user.large", make([]byte, sz-1)); err != syscall.ERANGE {
+		t.Errorf("want ERANGE, got %v", err)
+	}
+	buf := make([]byte, sz)
+	n, err := syscall.Getxattr(fn, "user.large", buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(buf[:n], val) {
+		t.Errorf("wrong value, length %d", n)
+	}
+	// Same loop for the list of names
+	sz, err = syscall.Listxattr(fn, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if sz != len("user.large\x00") {
+		t.Errorf("list size probe: want %d, got %d", len("user.large\x00"), sz)
+	}
+	buf = make([]byte, sz)
+	n, err = syscall.Listxattr(fn, buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(buf[:n]) != "user.large\x00" {
+		t.Errorf("wrong list: %q", buf[:n])
+	}
+}
@@ -386,6 +386,168 @@ func TestFileHoles(t *testing.T) {
 	}
 }
 
+// TestWriteGap writes past the end of file, creating a gap, and checks that
+// the gap reads back as zeros and the written data is intact. The cases cover
+// gaps inside the last block, up to the next block boundary, and spanning
+// several blocks.
+func TestWriteGap(t *testing.T) {
+	sizes := []int{0, 10, 4096, 5000}
+	offsets := []int64{4000, 4096, 3*4096 + 100, 1024*1024 + 7}
+	data := []byte("gapdata")
+	for _, size := range sizes {
+		for _, off := range offsets {
+			if off < int64(size) {
+				continue
+			}
+			fn := fmt.Sprintf("%s/writegap_%d_%d", test_helpers.DefaultPlainDir, size, off)
+			orig := bytes.Repeat([]byte("x"), size)
+			err := ioutil.WriteFile(fn, orig, 0600)
+			if err != nil {
+				t.Fatal(err)
+			}
+			f, err := os.OpenFile(fn, os.O_WRONLY, 0)
+			if err != nil {
+				t.Fatal(err)
+			}
+			_, err = f.WriteAt(data, off)
+			f.Close()
+			if err != nil {
+				t.Fatal(err)
+			}
+			want := make([]byte, int(off)+len(data))
+			copy(want, orig)
+			copy(want[off:], data)
+			have, err := ioutil.ReadFile(fn)
+			if err != nil {
+				t.Errorf("size=%d off=%d: %v", size, off, err)
+			} else if !bytes.Equal(have, want) {
+				t.Errorf("size=%d off=%d: content mismatch", size, off)
+			}
+			syscall.Unlink(fn)
+		}
+	}
+}
+
+// TestTorrentPattern simulates what download clients do: preallocate the file
+// with truncate-up, then fill in the blocks out of order. Unwritten regions
+// must read as zeros, and the final content must be intact.
+func TestTorrentPattern(t *testing.T) {
+	fn := test_helpers.DefaultPlainDir + "/torrent"
+	// 10 pieces of 5000 bytes: not aligned to the 4096-byte crypto blocks
+	const pieceLen = 5000
+	const pieces = 10
+	f, err := os.Create(fn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	err = f.Truncate(pieceLen * pieces)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := make([]byte, pieceLen*pieces)
+	for _, p := range []int{7, 2, 9, 0, 5} {
+		piece := bytes.Repeat([]byte{byte('a' + p)}, pieceLen)
+		_, err = f.WriteAt(piece, int64(p*pieceLen))
+		if err != nil {
+			t.Fatal(err)
+		}
+		copy(want[p*pieceLen:], piece)
+		// Check the whole file after every piece. Pieces not yet written must
+		// be zeros.
+		have, err := ioutil.ReadFile(fn)
+		if err != nil {
+			t.Fatalf("after piece %d: %v", p, err)
+		}
+		if !bytes.Equal(have, want) {
+			t.Fatalf("after piece %d: content mismatch", p)
+		}
+	}
+	for _, p := range []int{8, 1, 3, 6, 4} {
+		piece := bytes.Repeat([]byte{byte('a' + p)}, pieceLen)
+		_, err = f.WriteAt(piece, int64(p*pieceLen))
+		if err != nil {
+			t.Fatal(err)
+		}
+		copy(want[p*pieceLen:], piece)
+	}
+	have, err := ioutil.ReadFile(fn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(have, want) {
+		t.Error("final content mismatch")
+	}
+	test_helpers.VerifySize(t, fn, pieceLen*pieces)
+	syscall.Unlink(fn)
+}
+
+// TestRenameDepth moves a file and a directory up and down the directory tree
+// and checks that they are accessible under the new path, and not under the
+// old one, after every move.
+func TestRenameDepth(t *testing.T) {
+	base := test_helpers.DefaultPlainDir + "/renamedepth"
+	err := os.MkdirAll(base+"/a/b/c/d", 0700)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = os.MkdirAll(base+"/x", 0700)
+	if err != nil {
+		t.Fatal(err)
+	}
+	content := []byte("renamedepth")
+	err = ioutil.WriteFile(base+"/a/b/c/file", content, 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Moves of the file: shallower, deeper, back to the start
+	paths := []string{"/a/b/c/file", "/x/file", "/a/b/c/d/file", "/file", "/a/b/c/file"}
+	for i := 1; i < len(paths); i++ {
+		err = os.Rename(base+paths[i-1], base+paths[i])
+		if err != nil {
+			t.Fatal(err)
+		}
+		have, err := ioutil.ReadFile(base + paths[i])
+		if err != nil {
+			t.Fatalf("%s -> %s: %v", paths[i-1], paths[i], err)
+		}
+		if !bytes.Equal(have, content) {
+			t.Errorf("%s -> %s: wrong content", paths[i-1], paths[i])
+		}
+		if _, err = os.Stat(base + paths[i-1]); err == nil {
+			t.Errorf("%s -> %s: old path still exists", paths[i-1], paths[i])
+		}
+	}
+	// Moves of directory "c" (which contains "file" and "d"): shallower and
+	// back again. Also recreate a directory at the old path to catch stale
+	// DirIV cache entries.
+	err = os.Rename(base+"/a/b/c", base+"/x/c")
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = os.Mkdir(base+"/a/b/c", 0700)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = ioutil.WriteFile(base+"/a/b/c/new", content, 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, p := range []string{"/x/c/file", "/a/b/c/new"} {
+		have, err := ioutil.ReadFile(base + p)
+		if err != nil {
+			t.Fatalf("%s: %v", p, err)
+		}
+		if !bytes.Equal(have, content) {
+			t.Errorf("%s: wrong content", p)
+		}
+	}
+	if !test_helpers.VerifyExistence(base + "/x/c/d") {
+		t.Error("x/c/d missing")
+	}
+	os.RemoveAll(base)
+}
+
 // sContains - does the slice of strings "haystack" contain "needle"?
 func sContains(haystack []string, needle string) bool {
 	for _, element := range haystack {
@@ -683,6 +845,51 @@ func TestLchown(t *testing.T) {
 	}
 }
 
+// TestChownGroupOnly checks that chown with uid -1 (or gid -1) only changes
+// the other field.
+func TestChownGroupOnly(t *testing.T) {
+	path := test_helpers.DefaultPlainDir + "/chowngrouponly"
+	err := ioutil.WriteFile(path, nil, 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer syscall.Unlink(path)
+	check := func(wantUID int, wantGID int) {
+		var st syscall.Stat_t
+		err := syscall.Stat(path, &st)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if int(st.Uid) != wantUID || int(st.Gid) != wantGID {
+			t.Errorf("want uid=%d gid=%d, have uid=%d gid=%d", wantUID, wantGID, st.Uid, st.Gid)
+		}
+	}
+	uid, gid := os.Getuid(), os.Getgid()
+	if uid != 0 {
+		// Without root, we can only "change" the group to our own
+		err = os.Chown(path, -1, gid)
+		if err != nil {
+			t.Fatal(err)
+		}
+		check(uid, gid)
+		return
+	}
+	err = os.Chown(path, 1234, 1234)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = os.Chown(path, -1, 5678)
+	if err != nil {
+		t.Fatal(err)
+	}
+	check(1234, 5678)
+	err = os.Chown(path, 4321, -1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	check(4321, 5678)
+}
+
 // Set nanoseconds by path, symlink
 func TestUtimesNanoSymlink(t *testing.T) {
 	path := test_helpers.DefaultPlainDir + "/utimesnano_symlink"
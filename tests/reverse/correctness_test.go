@@ -191,6 +191,10 @@ func TestTooLongSymlink(t *testing.T) {
 	if err != nil {
 		t.Fatal(err)
 	}
+	// The symlink is still there, only its target cannot be read
+	if _, err = os.Lstat(dirC + "/TooLongSymlink"); err != nil {
+		t.Error(err)
+	}
 	_, err = os.Readlink(dirC + "/TooLongSymlink")
 	if err == nil {
 		return
@@ -201,3 +205,219 @@ func TestTooLongSymlink(t *testing.T) {
 			err2.Err)
 	}
 }
+
+// TestSymlinkRoundtrip checks that absolute and dangling symlinks survive a
+// reverse -> forward round trip unchanged, and that the encrypted target in the
+// reverse view is deterministic so backups of it are stable.
+func TestSymlinkRoundtrip(t *testing.T) {
+	targets := map[string]string{
+		"SymlinkAbsolute": "/usr/share/doc",
+		"SymlinkDangling": "does/not/exist",
+	}
+	for name, target := range targets {
+		err := os.Symlink(target, dirA+"/"+name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		actual, err := os.Readlink(dirC + "/" + name)
+		if err != nil {
+			t.Errorf("%s: Readlink: %v", name, err)
+			continue
+		}
+		if actual != target {
+			t.Errorf("%s: wrong symlink target: want=%q have=%q", name, target, actual)
+		}
+	}
+	if plaintextnames {
+		return
+	}
+	// Compare the encrypted targets in the reverse view across two reads
+	entries, err := ioutil.ReadDir(dirB)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, e := range entries {
+		if e.Mode()&os.ModeSymlink == 0 {
+			continue
+		}
+		c1, err := os.Readlink(dirB + "/" + e.Name())
+		if err2, ok := err.(*os.PathError); ok && err2.Err == syscall.ENAMETOOLONG {
+			// The symlink from TestTooLongSymlink
+			continue
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		c2, err := os.Readlink(dirB + "/" + e.Name())
+		if err != nil {
+			t.Fatal(err)
+		}
+		if c1 != c2 {
+			t.Errorf("%s: encrypted symlink target is not deterministic: %q vs %q", e.Name(), c1, c2)
+		}
+	}
+}
+
+// TestNameStability checks that two independent reverse mounts of the same
+// directory produce exactly the same ciphertext names, including long names
+// and their .name files, and the same file content. Reverse mode keeps no
+// state between mounts; names are derived from the path and the master key
+// only.
+func TestNameStability(t *testing.T) {
+	if plaintextnames {
+		t.Skip("test makes no sense for plaintextnames")
+	}
+	// Use a directory of our own so we can delete it afterwards. Deleting
+	// files in dirA would confuse the dirB mount when their inode numbers
+	// are reused.
+	dir := test_helpers.InitFS(t, "-reverse")
+	defer os.RemoveAll(dir)
+	for _, n := range []string{"stable_short", "stable_" + x240} {
+		if err := ioutil.WriteFile(dir+"/"+n, []byte(n), 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+	list := func() map[string]string {
+		mnt := dir + ".mnt"
+		defer os.Remove(mnt)
+		test_helpers.MountOrFatal(t, dir, mnt, "-reverse", "-extpass", "echo test")
+		defer test_helpers.UnmountPanic(mnt)
+		entries, err := ioutil.ReadDir(mnt)
+		if err != nil {
+			t.Fatal(err)
+		}
+		m := make(map[string]string)
+		for _, e := range entries {
+			if !e.Mode().IsRegular() {
+				continue
+			}
+			m[e.Name()] = test_helpers.Md5fn(mnt + "/" + e.Name())
+		}
+		return m
+	}
+	m1 := list()
+	m2 := list()
+	if len(m1) != len(m2) {
+		t.Errorf("different number of files: %d vs %d", len(m1), len(m2))
+	}
+	for name, h := range m1 {
+		h2, ok := m2[name]
+		if !ok {
+			t.Errorf("%q missing in second mount", name)
+			continue
+		}
+		if h != h2 {
+			t.Errorf("%q: content differs between mounts", name)
+		}
+	}
+}
+
+// TestBlockLocality checks that changing one plaintext block only changes
+// the corresponding ciphertext block in the reverse view. This keeps the
+// delta transfer of rsync and similar tools small.
+func TestBlockLocality(t *testing.T) {
+	const plainBS = 4096
+	// 16 bytes nonce + 16 bytes GCM tag
+	const cipherBS = plainBS + 32
+	const headerLen = 18
+	const blocks = 10
+	const changed = 5
+	fn := "TestBlockLocality"
+	plain := bytes.Repeat([]byte("a"), blocks*plainBS)
+	err := ioutil.WriteFile(dirA+"/"+fn, plain, 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cFn := findCipherFile(t, fn, headerLen+blocks*cipherBS)
+	c1, err := ioutil.ReadFile(cFn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Modify one byte in the middle of block #changed
+	f, err := os.OpenFile(dirA+"/"+fn, os.O_WRONLY, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = f.WriteAt([]byte("b"), changed*plainBS+100)
+	f.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	c2, err := ioutil.ReadFile(cFn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(c1) != len(c2) {
+		t.Fatalf("ciphertext size changed: %d -> %d", len(c1), len(c2))
+	}
+	start := headerLen + changed*cipherBS
+	end := start + cipherBS
+	if !bytes.Equal(c1[:start], c2[:start]) || !bytes.Equal(c1[end:], c2[end:]) {
+		t.Error("ciphertext changed outside of the modified block")
+	}
+	if bytes.Equal(c1[start:end], c2[start:end]) {
+		t.Error("modified block did not change")
+	}
+}
+
+// findCipherFile returns the path of the file "fn" (created in dirA) in the
+// encrypted view dirB. Without -plaintextnames, the file is identified by its
+// ciphertext size "cSize".
+func findCipherFile(t *testing.T, fn string, cSize int) string {
+	if plaintextnames {
+		return dirB + "/" + fn
+	}
+	entries, err := ioutil.ReadDir(dirB)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, e := range entries {
+		if e.Size() == int64(cSize) {
+			return dirB + "/" + e.Name()
+		}
+	}
+	t.Fatal("could not find ciphertext file")
+	return ""
+}
+
+// TestRandomAccessRead checks that any ciphertext block can be read on its
+// own, in any order, and matches what a sequential read returns. rsync and
+// similar tools rely on this.
+func TestRandomAccessRead(t *testing.T) {
+	const plainBS = 4096
+	// 16 bytes nonce + 16 bytes GCM tag
+	const cipherBS = plainBS + 32
+	const headerLen = 18
+	const blocks = 11
+	fn := "TestRandomAccessRead"
+	plain := make([]byte, blocks*plainBS)
+	for i := range plain {
+		plain[i] = byte(i / plainBS)
+	}
+	err := ioutil.WriteFile(dirA+"/"+fn, plain, 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cFn := findCipherFile(t, fn, headerLen+blocks*cipherBS)
+	seq, err := ioutil.ReadFile(cFn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f, err := os.Open(cFn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	buf := make([]byte, cipherBS)
+	// Backwards, so no block is read after its predecessor
+	for b := blocks - 1; b >= 0; b-- {
+		off := headerLen + b*cipherBS
+		n, err := f.ReadAt(buf, int64(off))
+		if err != nil {
+			t.Fatalf("block %d: %v", b, err)
+		}
+		if !bytes.Equal(buf[:n], seq[off:off+cipherBS]) {
+			t.Errorf("block %d differs from the sequential read", b)
+		}
+	}
+}
@@ -0,0 +1,60 @@
+package reverse_test
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/rfjakob/gocryptfs/tests/test_helpers"
+)
+
+// TestExcludeFrom mounts a reverse filesystem with "-reverse-exclude-from"
+// and checks that the excluded paths are absent from the encrypted view.
+// Uses -plaintextnames so the names in the encrypted view can be checked.
+func TestExcludeFrom(t *testing.T) {
+	dir := test_helpers.InitFS(t, "-reverse", "-plaintextnames")
+	mnt := dir + ".mnt"
+	if err := os.Mkdir(mnt, 0700); err != nil {
+		t.Fatal(err)
+	}
+	visible := []string{"file", "dir/file.c", "dir/keep.o", "sub/build"}
+	excluded := []string{"file.o", "dir/file.o", "build/out", "cache/x", "dir/cache/y"}
+	for _, p := range append(visible, excluded...) {
+		path := filepath.Join(dir, p)
+		if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(path, []byte(p), 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+	excludeFile := dir + ".exclude"
+	content := "# object files\n*.o\n!keep.o\n\n/build\ncache/\n"
+	if err := ioutil.WriteFile(excludeFile, []byte(content), 0600); err != nil {
+		t.Fatal(err)
+	}
+	test_helpers.MountOrFatal(t, dir, mnt, "-reverse", "-extpass", "echo test",
+		"-reverse-exclude-from", excludeFile)
+	defer test_helpers.UnmountPanic(mnt)
+	for _, p := range visible {
+		if _, err := os.Stat(filepath.Join(mnt, p)); err != nil {
+			t.Errorf("%q should be visible: %v", p, err)
+		}
+	}
+	for _, p := range excluded {
+		if _, err := os.Stat(filepath.Join(mnt, p)); !os.IsNotExist(err) {
+			t.Errorf("%q should be excluded, but Stat returned %v", p, err)
+		}
+	}
+	// Excluded entries must also not show up in directory listings
+	entries, err := ioutil.ReadDir(mnt + "/dir")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, e := range entries {
+		if e.Name() == "file.o" || e.Name() == "cache" {
+			t.Errorf("excluded %q shows up in the listing", e.Name())
+		}
+	}
+}
@@ -0,0 +1,81 @@
+package reverse_test
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"testing"
+
+	"github.com/rfjakob/gocryptfs/tests/test_helpers"
+)
+
+// Back up the encrypted view and restore the backup by mounting it in
+// forward mode. The only input is the password on stdin: the gocryptfs.conf
+// that reverse mode presents in the encrypted view carries all parameters,
+// including the scrypt settings.
+func TestRestoreBackup(t *testing.T) {
+	src := dirA + "/TestRestoreBackup"
+	if err := os.MkdirAll(src+"/sub", 0700); err != nil {
+		t.Fatal(err)
+	}
+	content := map[string][]byte{
+		"small":       []byte("hello"),
+		"sub/big":     bytes.Repeat([]byte("0123456789"), 1000),
+		"sub/empty":   {},
+		"sub/" + x240: []byte("long name"),
+	}
+	for fn, data := range content {
+		if err := ioutil.WriteFile(filepath.Join(src, fn), data, 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+	backup := test_helpers.TmpDir + "/TestRestoreBackup.backup"
+	if err := os.Mkdir(backup, 0700); err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(backup)
+	entries, err := ioutil.ReadDir(dirB)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, e := range entries {
+		if e.Mode()&os.ModeSymlink != 0 {
+			// Not needed for the restore. The symlink from TestTooLongSymlink
+			// cannot be read in the encrypted view.
+			continue
+		}
+		cmd := exec.Command("cp", "-a", dirB+"/"+e.Name(), backup)
+		if out, err := cmd.CombinedOutput(); err != nil {
+			t.Fatalf("cp: %v: %s", err, out)
+		}
+	}
+	if _, err := os.Stat(backup + "/gocryptfs.conf"); err != nil {
+		t.Fatalf("config file is not part of the backup: %v", err)
+	}
+	restore := backup + ".mnt"
+	if err := os.Mkdir(restore, 0700); err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(restore)
+	// No -extpass, the password comes through stdin
+	cmd := exec.Command(test_helpers.GocryptfsBinary, "-q", "-wpanic", "-nosyslog", backup, restore)
+	cmd.Stdin = bytes.NewReader([]byte("test\n"))
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	if err := cmd.Run(); err != nil {
+		t.Fatalf("restore mount failed: %v", err)
+	}
+	defer test_helpers.UnmountPanic(restore)
+	for fn, want := range content {
+		have, err := ioutil.ReadFile(filepath.Join(restore, "TestRestoreBackup", fn))
+		if err != nil {
+			t.Error(err)
+			continue
+		}
+		if !bytes.Equal(have, want) {
+			t.Errorf("%s: content differs", fn)
+		}
+	}
+}
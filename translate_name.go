@@ -0,0 +1,51 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+
+	"github.com/rfjakob/gocryptfs/internal/contentenc"
+	"github.com/rfjakob/gocryptfs/internal/cryptocore"
+	"github.com/rfjakob/gocryptfs/internal/exitcodes"
+	"github.com/rfjakob/gocryptfs/internal/nametransform"
+	"github.com/rfjakob/gocryptfs/internal/readpassword"
+	"github.com/rfjakob/gocryptfs/internal/tlog"
+)
+
+// translateName prints the ciphertext path of "args.encrypt_name" or the
+// plaintext path of "args.decrypt_name", without mounting. Both are relative
+// to CIPHERDIR. The DirIVs are read from CIPHERDIR, so every directory on the
+// way must exist. The last component does not have to.
+// Does not return.
+func translateName(args *argContainer) {
+	if args.reverse {
+		tlog.Fatal.Printf("-encrypt-name and -decrypt-name do not work in reverse mode")
+		os.Exit(exitcodes.Usage)
+	}
+	masterkey, confFile, err := loadConfig(args)
+	if err != nil {
+		exitcodes.Exit(err)
+	}
+	readpassword.CheckTrailingGarbage()
+	fa := makeFrontendArgs(args, confFile)
+	cc := cryptocore.New(masterkey, fa.CryptoBackend, contentenc.DefaultIVBits, fa.HKDF, false)
+	cryptocore.Wipe(masterkey)
+	nt := nametransform.New(cc.EMECipher, fa.LongNames, fa.Raw64)
+	nt.SetCaseInsensitive(fa.CaseInsensitive)
+	in := filepath.Clean("/" + args.encrypt_name + args.decrypt_name)[1:]
+	out := in
+	if fa.PlaintextNames {
+		// Nothing to translate
+	} else if args.encrypt_name != "" {
+		out, err = nt.EncryptPathDirIV(in, args.cipherdir)
+	} else {
+		out, err = nt.DecryptPathDirIV(in, args.cipherdir)
+	}
+	if err != nil {
+		tlog.Fatal.Printf("Cannot translate %q: %v", "/"+in, err)
+		os.Exit(exitcodes.Other)
+	}
+	fmt.Println(out)
+	os.Exit(0)
+}
@@ -0,0 +1,64 @@
+package main
+
+import (
+	"os"
+	"os/exec"
+	"path/filepath"
+
+	"github.com/rfjakob/gocryptfs/internal/exitcodes"
+	"github.com/rfjakob/gocryptfs/internal/mountinfo"
+	"github.com/rfjakob/gocryptfs/internal/tlog"
+)
+
+// unmount unmounts the gocryptfs filesystem at "mountpoint", falling back to a
+// lazy unmount if it is busy.
+// This is called when you pass the "-unmount" option.
+// Does not return.
+func unmount(mountpoint string) {
+	mnt, err := filepath.Abs(mountpoint)
+	if err != nil {
+		tlog.Fatal.Printf("Invalid mountpoint: %v", err)
+		os.Exit(exitcodes.MountPoint)
+	}
+	// Resolving symlinks fails on a stale mount. Keep the path as it is then.
+	if realMnt, err2 := filepath.EvalSymlinks(mnt); err2 == nil {
+		mnt = realMnt
+	}
+	mounts, err := mountinfo.Read()
+	if err != nil {
+		tlog.Fatal.Printf("Cannot read the mount table: %v", err)
+		os.Exit(exitcodes.MountPoint)
+	}
+	if !isGocryptfsMount(mounts, mnt) {
+		tlog.Fatal.Printf("%q is not a gocryptfs mount", mnt)
+		os.Exit(exitcodes.MountPoint)
+	}
+	clean, err := unmountOrLazy(func() error { return fusermountUnmount(mnt) }, mnt)
+	if err != nil {
+		tlog.Fatal.Printf("Unmounting %q failed: %v", mnt, err)
+		os.Exit(exitcodes.MountPoint)
+	}
+	if !clean {
+		tlog.Info.Printf("%q is busy and will be unmounted once it is no longer used", mnt)
+	}
+	os.Exit(0)
+}
+
+// isGocryptfsMount returns true if a forward or reverse gocryptfs filesystem is
+// mounted on "mnt"
+func isGocryptfsMount(mounts []mountinfo.Entry, mnt string) bool {
+	for _, m := range mounts {
+		if m.MountPoint == mnt && (m.FsType == "fuse."+fuseName || m.FsType == "fuse."+fuseNameReverse) {
+			return true
+		}
+	}
+	return false
+}
+
+// fusermountUnmount runs "fusermount -u" on "mnt", like go-fuse does in
+// Server.Unmount
+func fusermountUnmount(mnt string) error {
+	cmd := exec.Command("fusermount", "-u", mnt)
+	cmd.Stderr = os.Stderr
+	return cmd.Run()
+}